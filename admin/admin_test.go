@@ -0,0 +1,164 @@
+package admin
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/PsychoPunkSage/NexNet/cryptography"
+	"github.com/PsychoPunkSage/NexNet/p2p"
+	"github.com/PsychoPunkSage/NexNet/server"
+	"github.com/PsychoPunkSage/NexNet/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestClient(t *testing.T, configure ...func(opts *server.FileServerOpts)) *Client {
+	opts := server.FileServerOpts{
+		EncKey:            cryptography.NewEncryptionKey(),
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: storage.CASPathTransformFunc,
+		Transport: p2p.NewTCPTransport(p2p.TCPTransportOpts{
+			ListenAddr:    ":0",
+			HandshakeFunc: p2p.NOPHandshakeFunc,
+			Decoder:       p2p.DefaultDecoder{},
+		}),
+	}
+	for _, fn := range configure {
+		fn(&opts)
+	}
+	fs := server.NewFileServer(opts)
+
+	ts := httptest.NewServer(NewServer(ServerOpts{Node: fs, Bandwidth: p2p.NewBandwidth(p2p.BandwidthLimits{})}))
+	t.Cleanup(ts.Close)
+
+	return NewClient(strings.TrimPrefix(ts.URL, "http://"))
+}
+
+func TestAdminAPI(t *testing.T) {
+	c := newTestClient(t)
+
+	obj, err := c.Put("notes/today.txt", strings.NewReader("hello admin"))
+	assert.Nil(t, err)
+	assert.Equal(t, "notes/today.txt", obj.Key)
+	assert.Equal(t, int64(len("hello admin")), obj.Size)
+
+	rc, err := c.Get("notes/today.txt")
+	assert.Nil(t, err)
+	b, err := io.ReadAll(rc)
+	rc.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, "hello admin", string(b))
+
+	objects, err := c.List()
+	assert.Nil(t, err)
+	assert.Len(t, objects, 1)
+	assert.Equal(t, "notes/today.txt", objects[0].Key)
+
+	obj, err = c.Stat("notes/today.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len("hello admin")), obj.Size)
+
+	peers, err := c.Peers()
+	assert.Nil(t, err)
+	assert.Empty(t, peers)
+
+	assert.Nil(t, c.Remove("notes/today.txt"))
+
+	_, err = c.Stat("notes/today.txt")
+	assert.NotNil(t, err)
+
+	err = c.Remove("notes/today.txt")
+	assert.ErrorContains(t, err, "not present")
+}
+
+func TestAdminBandwidth(t *testing.T) {
+	c := newTestClient(t)
+
+	bw, err := c.Bandwidth()
+	assert.Nil(t, err)
+	assert.Equal(t, Bandwidth{}, bw)
+
+	want := Bandwidth{Global: Rate{In: 10 << 20, Out: 5 << 20}, PerPeer: Rate{Out: 1 << 20}}
+	bw, err = c.SetBandwidth(want)
+	assert.Nil(t, err)
+	assert.Equal(t, want, bw)
+
+	bw, err = c.Bandwidth()
+	assert.Nil(t, err)
+	assert.Equal(t, want, bw)
+
+	_, err = c.SetBandwidth(Bandwidth{PerPeer: Rate{In: -1}})
+	assert.ErrorContains(t, err, ">= 0")
+}
+
+func TestAdminToken(t *testing.T) {
+	fs := server.NewFileServer(server.FileServerOpts{
+		EncKey:            cryptography.NewEncryptionKey(),
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: storage.CASPathTransformFunc,
+		Transport: p2p.NewTCPTransport(p2p.TCPTransportOpts{
+			ListenAddr:    ":0",
+			HandshakeFunc: p2p.NOPHandshakeFunc,
+			Decoder:       p2p.DefaultDecoder{},
+		}),
+	})
+	ts := httptest.NewServer(NewServer(ServerOpts{Node: fs, Token: "s3cret"}))
+	t.Cleanup(ts.Close)
+	c := NewClient(strings.TrimPrefix(ts.URL, "http://"))
+
+	_, err := c.Peers()
+	assert.ErrorContains(t, err, "unauthorized")
+	c.Token = "guess"
+	_, err = c.Peers()
+	assert.ErrorContains(t, err, "unauthorized")
+
+	c.Token = "s3cret"
+	peers, err := c.Peers()
+	assert.Nil(t, err)
+	assert.Len(t, peers, 0)
+}
+
+func TestAdminUsage(t *testing.T) {
+	quota := storage.Quota{SoftBytes: 8, HardBytes: 16}
+	c := newTestClient(t, func(opts *server.FileServerOpts) { opts.Quota = quota })
+
+	usages, err := c.Usage()
+	assert.Nil(t, err)
+	assert.Empty(t, usages)
+
+	_, err = c.Put("small", strings.NewReader("0123456789"))
+	assert.Nil(t, err)
+	usages, err = c.Usage()
+	assert.Nil(t, err)
+	if assert.Len(t, usages, 1) {
+		assert.Equal(t, Usage{ID: usages[0].ID, Bytes: 10, Objects: 1, Quota: Quota(quota)}, usages[0])
+
+		usage, err := c.UsageOf(usages[0].ID)
+		assert.Nil(t, err)
+		assert.Equal(t, usages[0], usage)
+	}
+
+	_, err = c.Put("large", strings.NewReader("0123456789"))
+	assert.ErrorContains(t, err, "quota exceeded")
+	_, err = c.Stat("large")
+	assert.NotNil(t, err)
+}
+
+func TestAdminObjectTooLarge(t *testing.T) {
+	c := newTestClient(t, func(opts *server.FileServerOpts) { opts.Limits = server.Limits{MaxObjectSize: 8} })
+
+	_, err := c.Put("small", strings.NewReader("01234567"))
+	assert.Nil(t, err)
+	_, err = c.Put("large", strings.NewReader("012345678"))
+	assert.ErrorContains(t, err, "object too large")
+
+	req, err := http.NewRequest(http.MethodPut, "http://"+c.Addr+objectsPath+"/large", strings.NewReader("012345678"))
+	assert.Nil(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	if assert.Nil(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	}
+}
@@ -0,0 +1,135 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// Client : talks to the admin API of a running node.
+type Client struct {
+	// Address of the node's admin API, e.g. "127.0.0.1:7070".
+	Addr string
+	// Sent as a bearer token, if not empty (see ServerOpts.Token).
+	Token      string
+	HTTPClient *http.Client
+}
+
+func NewClient(addr string) *Client {
+	return &Client{
+		Addr:       addr,
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+func (c *Client) Put(key string, r io.Reader) (Object, error) {
+	var obj Object
+	err := c.do(http.MethodPut, objectsPath+"/"+url.PathEscape(key), r, &obj)
+	return obj, err
+}
+
+// Get : the caller must close the returned reader.
+func (c *Client) Get(key string) (io.ReadCloser, error) {
+	resp, err := c.request(http.MethodGet, objectsPath+"/"+url.PathEscape(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (c *Client) Remove(key string) error {
+	return c.do(http.MethodDelete, objectsPath+"/"+url.PathEscape(key), nil, nil)
+}
+
+func (c *Client) List() ([]Object, error) {
+	var objects []Object
+	err := c.do(http.MethodGet, objectsPath, nil, &objects)
+	return objects, err
+}
+
+func (c *Client) Stat(key string) (Object, error) {
+	var obj Object
+	err := c.do(http.MethodGet, statPath+url.PathEscape(key), nil, &obj)
+	return obj, err
+}
+
+func (c *Client) Peers() ([]string, error) {
+	var peers []string
+	err := c.do(http.MethodGet, peersPath, nil, &peers)
+	return peers, err
+}
+
+// Usage : of every owner ID with files on the node.
+func (c *Client) Usage() ([]Usage, error) {
+	var usages []Usage
+	err := c.do(http.MethodGet, usagePath, nil, &usages)
+	return usages, err
+}
+
+func (c *Client) UsageOf(id string) (Usage, error) {
+	var usage Usage
+	err := c.do(http.MethodGet, usagePath+"/"+url.PathEscape(id), nil, &usage)
+	return usage, err
+}
+
+func (c *Client) Bandwidth() (Bandwidth, error) {
+	var bw Bandwidth
+	err := c.do(http.MethodGet, bandwidthPath, nil, &bw)
+	return bw, err
+}
+
+// SetBandwidth : returns the limits now in force.
+func (c *Client) SetBandwidth(bw Bandwidth) (Bandwidth, error) {
+	body, err := json.Marshal(bw)
+	if err != nil {
+		return Bandwidth{}, err
+	}
+	var out Bandwidth
+	err = c.do(http.MethodPut, bandwidthPath, bytes.NewReader(body), &out)
+	return out, err
+}
+
+// do : sends the request and decodes the JSON response into out (if not nil).
+func (c *Client) do(method, path string, body io.Reader, out any) error {
+	resp, err := c.request(method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// request : sends the request, turning any non-2xx response into an error.
+func (c *Client) request(method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, "http://"+c.Addr+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.Token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+
+		var e errorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || len(e.Error) == 0 {
+			return nil, fmt.Errorf("admin api: %s", resp.Status)
+		}
+		return nil, fmt.Errorf("admin api: %s", e.Error)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,324 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/PsychoPunkSage/NexNet/logging"
+	"github.com/PsychoPunkSage/NexNet/p2p"
+	"github.com/PsychoPunkSage/NexNet/server"
+	"github.com/PsychoPunkSage/NexNet/storage"
+)
+
+const (
+	objectsPath   = "/v1/objects"
+	statPath      = "/v1/stat/"
+	peersPath     = "/v1/peers"
+	bandwidthPath = "/v1/bandwidth"
+	usagePath     = "/v1/usage"
+)
+
+// Node : the operations of server.FileServer exposed over the admin API.
+type Node interface {
+	Store(ctx context.Context, key string, r io.Reader) error
+	Get(ctx context.Context, key string) (io.Reader, error)
+	Remove(ctx context.Context, key string) error
+	List(ctx context.Context) ([]storage.ObjectInfo, error)
+	Stat(ctx context.Context, key string) (storage.ObjectInfo, error)
+	StatUsage(ctx context.Context, id string) (storage.UsageInfo, error)
+	ListUsage(ctx context.Context) ([]storage.UsageInfo, error)
+	Peers() []string
+}
+
+// Object : JSON representation of a stored object.
+type Object struct {
+	Key     string    `json:"key"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// Rate : bytes per second; 0 means unlimited.
+type Rate struct {
+	In  int64 `json:"in"`
+	Out int64 `json:"out"`
+}
+
+// Bandwidth : JSON representation of p2p.BandwidthLimits.
+type Bandwidth struct {
+	Global  Rate `json:"global"`
+	PerPeer Rate `json:"per_peer"`
+}
+
+// Quota : JSON representation of storage.Quota; 0 means unlimited.
+type Quota struct {
+	SoftBytes   int64 `json:"soft_bytes"`
+	HardBytes   int64 `json:"hard_bytes"`
+	SoftObjects int64 `json:"soft_objects"`
+	HardObjects int64 `json:"hard_objects"`
+}
+
+// Usage : JSON representation of storage.UsageInfo.
+type Usage struct {
+	ID      string `json:"id"`
+	Bytes   int64  `json:"bytes"`
+	Objects int64  `json:"objects"`
+	Quota   Quota  `json:"quota"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type ServerOpts struct {
+	// Should stay on a loopback address unless Token is set.
+	ListenAddr string
+	// Bearer token every request must carry ("Authorization: Bearer <token>"); empty leaves the
+	// API unauthenticated.
+	Token string
+	Node  Node
+	// Limits changed through the API; nil disables the bandwidth endpoint.
+	Bandwidth *p2p.Bandwidth
+	// Defaults to slog.Default().
+	Logger *slog.Logger
+}
+
+// Server : local HTTP API used by the command-line client to drive a running node.
+type Server struct {
+	ServerOpts
+
+	log     *slog.Logger
+	handler http.Handler
+}
+
+func NewServer(opts ServerOpts) *Server {
+	s := &Server{
+		ServerOpts: opts,
+		log:        logging.OrDefault(opts.Logger).With("component", "admin"),
+	}
+	s.handler = logging.Middleware(s.log, http.HandlerFunc(s.route))
+	return s
+}
+
+func (s *Server) ListenAndServe() error {
+	s.log.Info("admin API listening", "addr", s.ListenAddr)
+	return http.ListenAndServe(s.ListenAddr, s)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+func (s *Server) route(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+
+	switch {
+	case r.URL.Path == objectsPath:
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		s.handleList(w, r)
+
+	case strings.HasPrefix(r.URL.Path, objectsPath+"/"):
+		key := strings.TrimPrefix(r.URL.Path, objectsPath+"/")
+		switch r.Method {
+		case http.MethodPut:
+			s.handlePut(w, r, key)
+		case http.MethodGet:
+			s.handleGet(w, r, key)
+		case http.MethodDelete:
+			s.handleRemove(w, r, key)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		}
+
+	case strings.HasPrefix(r.URL.Path, statPath) && r.Method == http.MethodGet:
+		s.handleStat(w, r, strings.TrimPrefix(r.URL.Path, statPath))
+
+	case r.URL.Path == peersPath && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, s.Node.Peers())
+
+	case r.URL.Path == usagePath && r.Method == http.MethodGet:
+		s.handleListUsage(w, r)
+
+	case strings.HasPrefix(r.URL.Path, usagePath+"/") && r.Method == http.MethodGet:
+		s.handleStatUsage(w, r, strings.TrimPrefix(r.URL.Path, usagePath+"/"))
+
+	case r.URL.Path == bandwidthPath && s.Bandwidth != nil:
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, toBandwidth(s.Bandwidth.Limits()))
+		case http.MethodPut:
+			s.handleSetBandwidth(w, r)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		}
+
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+// authorized : whether r carries Token, if one is needed.
+func (s *Server) authorized(r *http.Request) bool {
+	if len(s.Token) == 0 {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) == 1
+}
+
+func (s *Server) handlePut(w http.ResponseWriter, r *http.Request, key string) {
+	if err := s.Node.Store(r.Context(), key, r.Body); err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+
+	s.handleStat(w, r, key)
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request, key string) {
+	rd, err := s.Node.Get(r.Context(), key)
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	if rc, ok := rd.(io.Closer); ok {
+		defer rc.Close()
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := io.Copy(w, rd); err != nil {
+		logging.FromContext(r.Context(), s.log).Warn("sending object", logging.Key, key, "err", err)
+	}
+}
+
+func (s *Server) handleRemove(w http.ResponseWriter, r *http.Request, key string) {
+	if err := s.Node.Remove(r.Context(), key); err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	infos, err := s.Node.List(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	objects := make([]Object, 0, len(infos))
+	for _, info := range infos {
+		objects = append(objects, toObject(info))
+	}
+	writeJSON(w, http.StatusOK, objects)
+}
+
+func (s *Server) handleStat(w http.ResponseWriter, r *http.Request, key string) {
+	info, err := s.Node.Stat(r.Context(), key)
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, toObject(info))
+}
+
+func (s *Server) handleListUsage(w http.ResponseWriter, r *http.Request) {
+	infos, err := s.Node.ListUsage(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	usages := make([]Usage, 0, len(infos))
+	for _, info := range infos {
+		usages = append(usages, toUsage(info))
+	}
+	writeJSON(w, http.StatusOK, usages)
+}
+
+func (s *Server) handleStatUsage(w http.ResponseWriter, r *http.Request, id string) {
+	info, err := s.Node.StatUsage(r.Context(), id)
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, toUsage(info))
+}
+
+// handleSetBandwidth : replaces the limits, applied to the transfers in progress too.
+func (s *Server) handleSetBandwidth(w http.ResponseWriter, r *http.Request) {
+	var bw Bandwidth
+	if err := json.NewDecoder(r.Body).Decode(&bw); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if bw.Global.In < 0 || bw.Global.Out < 0 || bw.PerPeer.In < 0 || bw.PerPeer.Out < 0 {
+		writeError(w, http.StatusBadRequest, errors.New("rates must be >= 0"))
+		return
+	}
+
+	s.Bandwidth.SetLimits(p2p.BandwidthLimits{Global: p2p.Rate(bw.Global), PerPeer: p2p.Rate(bw.PerPeer)})
+	s.log.Info("bandwidth limits changed", "global_in", bw.Global.In, "global_out", bw.Global.Out,
+		"per_peer_in", bw.PerPeer.In, "per_peer_out", bw.PerPeer.Out)
+	writeJSON(w, http.StatusOK, toBandwidth(s.Bandwidth.Limits()))
+}
+
+func toBandwidth(l p2p.BandwidthLimits) Bandwidth {
+	return Bandwidth{Global: Rate(l.Global), PerPeer: Rate(l.PerPeer)}
+}
+
+func toObject(info storage.ObjectInfo) Object {
+	return Object{
+		Key:     info.Key,
+		Size:    info.Size,
+		ModTime: info.ModTime,
+	}
+}
+
+func toUsage(info storage.UsageInfo) Usage {
+	return Usage{
+		ID:      info.ID,
+		Bytes:   info.Usage.Bytes,
+		Objects: info.Usage.Objects,
+		Quota:   Quota(info.Quota),
+	}
+}
+
+func statusFor(err error) int {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, storage.ErrQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, server.ErrObjectTooLarge):
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/PsychoPunkSage/NexNet/admin"
+)
+
+const defaultAdminAddr = "127.0.0.1:7070"
+
+// adminFlag : registers the -admin flag shared by all client commands.
+func adminFlag(fset *flag.FlagSet) *string {
+	addr := os.Getenv("NEXNET_ADMIN")
+	if len(addr) == 0 {
+		addr = defaultAdminAddr
+	}
+	return fset.String("admin", addr, "admin API address of the node (env NEXNET_ADMIN)")
+}
+
+// newAdminClient : of the admin API at addr, authenticated with NEXNET_ADMIN_TOKEN if set.
+func newAdminClient(addr string) *admin.Client {
+	c := admin.NewClient(addr)
+	c.Token = os.Getenv("NEXNET_ADMIN_TOKEN")
+	return c
+}
+
+func runPut(args []string) error {
+	fset := newFlagSet("put", "<key> [file]")
+	addr := adminFlag(fset)
+	fset.Parse(args)
+
+	if fset.NArg() < 1 || fset.NArg() > 2 {
+		fset.Usage()
+		return errors.New("expected a key and an optional file")
+	}
+
+	var r io.Reader = os.Stdin
+	if fset.NArg() == 2 {
+		f, err := os.Open(fset.Arg(1))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	obj, err := newAdminClient(*addr).Put(fset.Arg(0), r)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("stored %s (%d bytes)\n", obj.Key, obj.Size)
+	return nil
+}
+
+func runGet(args []string) error {
+	fset := newFlagSet("get", "[-o file] <key>")
+	addr := adminFlag(fset)
+	out := fset.String("o", "", "write the file here instead of stdout")
+	fset.Parse(args)
+
+	if fset.NArg() != 1 {
+		fset.Usage()
+		return errors.New("expected a key")
+	}
+
+	rc, err := newAdminClient(*addr).Get(fset.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	var w io.Writer = os.Stdout
+	if len(*out) > 0 {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	_, err = io.Copy(w, rc)
+	return err
+}
+
+func runRemove(args []string) error {
+	fset := newFlagSet("rm", "<key>")
+	addr := adminFlag(fset)
+	fset.Parse(args)
+
+	if fset.NArg() != 1 {
+		fset.Usage()
+		return errors.New("expected a key")
+	}
+
+	return newAdminClient(*addr).Remove(fset.Arg(0))
+}
+
+func runList(args []string) error {
+	fset := newFlagSet("ls", "")
+	addr := adminFlag(fset)
+	fset.Parse(args)
+
+	objects, err := newAdminClient(*addr).List()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, obj := range objects {
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", obj.Size, obj.ModTime.Format(time.DateTime), obj.Key)
+	}
+	return tw.Flush()
+}
+
+func runStat(args []string) error {
+	fset := newFlagSet("stat", "<key>")
+	addr := adminFlag(fset)
+	fset.Parse(args)
+
+	if fset.NArg() != 1 {
+		fset.Usage()
+		return errors.New("expected a key")
+	}
+
+	obj, err := newAdminClient(*addr).Stat(fset.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("key:      %s\nsize:     %d\nmodified: %s\n", obj.Key, obj.Size, obj.ModTime.Format(time.RFC3339))
+	return nil
+}
+
+func runPeers(args []string) error {
+	fset := newFlagSet("peers", "")
+	addr := adminFlag(fset)
+	fset.Parse(args)
+
+	peers, err := newAdminClient(*addr).Peers()
+	if err != nil {
+		return err
+	}
+
+	for _, p := range peers {
+		fmt.Println(p)
+	}
+	return nil
+}
+
+func runUsage(args []string) error {
+	fset := newFlagSet("usage", "[id]")
+	addr := adminFlag(fset)
+	fset.Parse(args)
+
+	c := newAdminClient(*addr)
+	var usages []admin.Usage
+	if fset.NArg() > 0 {
+		usage, err := c.UsageOf(fset.Arg(0))
+		if err != nil {
+			return err
+		}
+		usages = append(usages, usage)
+	} else {
+		var err error
+		if usages, err = c.Usage(); err != nil {
+			return err
+		}
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "id\tbytes\tsoft quota\thard quota\tobjects\tsoft quota\thard quota\n")
+	for _, u := range usages {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%d\t%s\t%s\n", u.ID,
+			u.Bytes, formatQuota(u.Quota.SoftBytes), formatQuota(u.Quota.HardBytes),
+			u.Objects, formatQuota(u.Quota.SoftObjects), formatQuota(u.Quota.HardObjects))
+	}
+	return tw.Flush()
+}
+
+func formatQuota(n int64) string {
+	if n == 0 {
+		return "-"
+	}
+	return fmt.Sprint(n)
+}
+
+func runBandwidth(args []string) error {
+	fset := newFlagSet("bandwidth", "[-global-in N] [-global-out N] [-peer-in N] [-peer-out N]")
+	addr := adminFlag(fset)
+	// Only the limits given are changed.
+	globalIn := fset.Int64("global-in", 0, "incoming bytes per second over all the peers, 0 for unlimited")
+	globalOut := fset.Int64("global-out", 0, "outgoing bytes per second over all the peers, 0 for unlimited")
+	peerIn := fset.Int64("peer-in", 0, "incoming bytes per second of each peer, 0 for unlimited")
+	peerOut := fset.Int64("peer-out", 0, "outgoing bytes per second of each peer, 0 for unlimited")
+	fset.Parse(args)
+
+	c := newAdminClient(*addr)
+	bw, err := c.Bandwidth()
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	fset.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "global-in":
+			bw.Global.In = *globalIn
+		case "global-out":
+			bw.Global.Out = *globalOut
+		case "peer-in":
+			bw.PerPeer.In = *peerIn
+		case "peer-out":
+			bw.PerPeer.Out = *peerOut
+		default:
+			return
+		}
+		changed = true
+	})
+	if changed {
+		if bw, err = c.SetBandwidth(bw); err != nil {
+			return err
+		}
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "\tin\tout\n")
+	fmt.Fprintf(tw, "global\t%s\t%s\n", formatRate(bw.Global.In), formatRate(bw.Global.Out))
+	fmt.Fprintf(tw, "per peer\t%s\t%s\n", formatRate(bw.PerPeer.In), formatRate(bw.PerPeer.Out))
+	return tw.Flush()
+}
+
+func formatRate(bps int64) string {
+	if bps == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d B/s", bps)
+}
@@ -0,0 +1,44 @@
+// Package clock abstracts time, so that simulations can run nodes under a virtual clock.
+package clock
+
+import (
+	"context"
+	"time"
+)
+
+// Clock : the time functions used by a node.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	// After : same as time.After.
+	After(d time.Duration) <-chan time.Time
+}
+
+// Real : default Clock, the time package.
+type Real struct{}
+
+func (Real) Now() time.Time                         { return time.Now() }
+func (Real) Since(t time.Time) time.Duration        { return time.Since(t) }
+func (Real) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// OrReal : c, or Real if c is nil.
+func OrReal(c Clock) Clock {
+	if c == nil {
+		return Real{}
+	}
+	return c
+}
+
+// Sleep : time.Sleep on c, giving up as soon as ctx is done.
+func Sleep(ctx context.Context, c Clock, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	select {
+	case <-c.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,62 @@
+package clock
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var epoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func fired(ch <-chan time.Time) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestVirtualAdvance(t *testing.T) {
+	v := NewVirtual(epoch)
+
+	late := v.After(2 * time.Second)
+	early := v.After(time.Second)
+	assert.True(t, fired(v.After(0)))
+	assert.Equal(t, 2, v.Pending())
+
+	v.Advance(500 * time.Millisecond)
+	assert.False(t, fired(early))
+	assert.Equal(t, epoch.Add(500*time.Millisecond), v.Now())
+
+	v.Advance(time.Second)
+	assert.Equal(t, epoch.Add(time.Second), <-early)
+	assert.False(t, fired(late))
+	assert.Equal(t, epoch.Add(1500*time.Millisecond), v.Now())
+
+	next, ok := v.Next()
+	assert.True(t, ok)
+	assert.Equal(t, epoch.Add(2*time.Second), next)
+	assert.True(t, v.AdvanceToNext())
+	assert.Equal(t, epoch.Add(2*time.Second), <-late)
+	assert.Equal(t, 2*time.Second, v.Since(epoch))
+	assert.False(t, v.AdvanceToNext())
+}
+
+func TestSleep(t *testing.T) {
+	v := NewVirtual(epoch)
+
+	done := make(chan error)
+	go func() { done <- Sleep(context.Background(), v, time.Minute) }()
+	for v.Pending() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	v.Advance(time.Minute)
+	assert.Nil(t, <-done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, Sleep(ctx, v, time.Minute), context.Canceled)
+}
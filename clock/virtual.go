@@ -0,0 +1,131 @@
+package clock
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Virtual : a Clock that only moves when told to (Advance, AdvanceToNext). Timers fire in
+// deadline order, ties broken by creation order, so a run is the same whatever the goroutine
+// scheduling.
+type Virtual struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers timerHeap
+	// Timers created so far, for ordering & for telling whether anything happened.
+	created uint64
+}
+
+// NewVirtual : a virtual clock set at start.
+func NewVirtual(start time.Time) *Virtual {
+	return &Virtual{now: start}
+}
+
+func (v *Virtual) Now() time.Time {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.now
+}
+
+func (v *Virtual) Since(t time.Time) time.Duration {
+	return v.Now().Sub(t)
+}
+
+func (v *Virtual) After(d time.Duration) <-chan time.Time {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	v.created++
+	if d <= 0 {
+		ch <- v.now
+		return ch
+	}
+	heap.Push(&v.timers, &timer{deadline: v.now.Add(d), seq: v.created, ch: ch})
+	return ch
+}
+
+// Advance : moves the clock d forward, firing the timers due meanwhile.
+func (v *Virtual) Advance(d time.Duration) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.advanceTo(v.now.Add(d))
+}
+
+// AdvanceToNext : moves the clock to the earliest timer and fires it (with any other due then).
+// Returns false if no timer is pending.
+func (v *Virtual) AdvanceToNext() bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if len(v.timers) == 0 {
+		return false
+	}
+	v.advanceTo(v.timers[0].deadline)
+	return true
+}
+
+// Next : deadline of the earliest pending timer; false if there's none.
+func (v *Virtual) Next() (time.Time, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if len(v.timers) == 0 {
+		return time.Time{}, false
+	}
+	return v.timers[0].deadline, true
+}
+
+// Pending : number of timers not fired yet.
+func (v *Virtual) Pending() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return len(v.timers)
+}
+
+// Created : number of timers created so far; a change tells that some goroutine is still busy.
+func (v *Virtual) Created() uint64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.created
+}
+
+func (v *Virtual) advanceTo(t time.Time) {
+	for len(v.timers) > 0 && !v.timers[0].deadline.After(t) {
+		next := heap.Pop(&v.timers).(*timer)
+		v.now = next.deadline
+		next.ch <- next.deadline
+	}
+	if t.After(v.now) {
+		v.now = t
+	}
+}
+
+type timer struct {
+	deadline time.Time
+	seq      uint64
+	ch       chan time.Time
+}
+
+type timerHeap []*timer
+
+func (h timerHeap) Len() int { return len(h) }
+func (h timerHeap) Less(i, j int) bool {
+	if h[i].deadline.Equal(h[j].deadline) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].deadline.Before(h[j].deadline)
+}
+func (h timerHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *timerHeap) Push(x any)   { *h = append(*h, x.(*timer)) }
+func (h *timerHeap) Pop() any {
+	old := *h
+	t := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return t
+}
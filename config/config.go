@@ -0,0 +1,758 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Same as p2p.QUICScheme & p2p.UnixScheme.
+const (
+	quicScheme = "quic://"
+	unixScheme = "unix://"
+)
+
+// Config : everything needed to run a node. Loaded from a TOML, YAML or JSON file
+// (picked by extension), then overridden by NEXNET_* environment variables.
+type Config struct {
+	ListenAddr string `json:"listen_addr" yaml:"listen_addr" toml:"listen_addr" env:"NEXNET_LISTEN_ADDR"`
+	// UDP address to also accept QUIC peers on; empty disables QUIC. Bootstrap nodes reached over
+	// QUIC are written "quic://host:port".
+	QUICListenAddr string `json:"quic_listen_addr" yaml:"quic_listen_addr" toml:"quic_listen_addr" env:"NEXNET_QUIC_LISTEN_ADDR"`
+	// Defaults to "<port>_network".
+	StorageRoot string `json:"storage_root" yaml:"storage_root" toml:"storage_root" env:"NEXNET_STORAGE_ROOT"`
+	// "cas" or "default", see storage.CASPathTransformFunc & storage.DefaultPathTransformFunc.
+	PathTransform  string   `json:"path_transform" yaml:"path_transform" toml:"path_transform" env:"NEXNET_PATH_TRANSFORM"`
+	BootstrapNodes []string `json:"bootstrap_nodes" yaml:"bootstrap_nodes" toml:"bootstrap_nodes" env:"NEXNET_BOOTSTRAP_NODES"`
+	// Made by `fs keygen`. Empty means a throwaway identity.
+	Keystore string `json:"keystore" yaml:"keystore" toml:"keystore" env:"NEXNET_KEYSTORE"`
+	// Empty disables the admin API. A loopback address unless AdminToken is set.
+	AdminAddr string `json:"admin_addr" yaml:"admin_addr" toml:"admin_addr" env:"NEXNET_ADMIN_ADDR"`
+	// Bearer token the admin API requires; empty leaves it unauthenticated.
+	AdminToken string `json:"admin_token" yaml:"admin_token" toml:"admin_token" env:"NEXNET_ADMIN_TOKEN"`
+
+	Replication  Replication  `json:"replication" yaml:"replication" toml:"replication"`
+	Limits       Limits       `json:"limits" yaml:"limits" toml:"limits"`
+	Bandwidth    Bandwidth    `json:"bandwidth" yaml:"bandwidth" toml:"bandwidth"`
+	Quota        Quota        `json:"quota" yaml:"quota" toml:"quota"`
+	Log          Log          `json:"log" yaml:"log" toml:"log"`
+	QUIC         QUIC         `json:"quic" yaml:"quic" toml:"quic"`
+	WebSocket    WebSocket    `json:"websocket" yaml:"websocket" toml:"websocket"`
+	Unix         Unix         `json:"unix" yaml:"unix" toml:"unix"`
+	Discovery    Discovery    `json:"discovery" yaml:"discovery" toml:"discovery"`
+	PeerExchange PeerExchange `json:"peer_exchange" yaml:"peer_exchange" toml:"peer_exchange"`
+	Membership   Membership   `json:"membership" yaml:"membership" toml:"membership"`
+	Heartbeat    Heartbeat    `json:"heartbeat" yaml:"heartbeat" toml:"heartbeat"`
+	Scrub        Scrub        `json:"scrub" yaml:"scrub" toml:"scrub"`
+	S3           S3           `json:"s3" yaml:"s3" toml:"s3"`
+	Metrics      Metrics      `json:"metrics" yaml:"metrics" toml:"metrics"`
+	Tracing      Tracing      `json:"tracing" yaml:"tracing" toml:"tracing"`
+}
+
+type Replication struct {
+	// Number of peers a stored file is pushed to; 0 means every connected peer.
+	Factor int `json:"factor" yaml:"factor" toml:"factor" env:"NEXNET_REPLICATION_FACTOR"`
+}
+
+// Limits : 0 means unlimited. See server.Limits.
+type Limits struct {
+	MaxObjectSize int64 `json:"max_object_size" yaml:"max_object_size" toml:"max_object_size" env:"NEXNET_MAX_OBJECT_SIZE"`
+	MaxPeers      int   `json:"max_peers" yaml:"max_peers" toml:"max_peers" env:"NEXNET_MAX_PEERS"`
+	// Messages per second, from a peer and for an owner ID.
+	PeerMessageRate  float64 `json:"peer_message_rate" yaml:"peer_message_rate" toml:"peer_message_rate" env:"NEXNET_PEER_MESSAGE_RATE"`
+	OwnerMessageRate float64 `json:"owner_message_rate" yaml:"owner_message_rate" toml:"owner_message_rate" env:"NEXNET_OWNER_MESSAGE_RATE"`
+	// File streams received at once, from a peer and for an owner ID.
+	PeerStreams  int `json:"peer_streams" yaml:"peer_streams" toml:"peer_streams" env:"NEXNET_PEER_STREAMS"`
+	OwnerStreams int `json:"owner_streams" yaml:"owner_streams" toml:"owner_streams" env:"NEXNET_OWNER_STREAMS"`
+	// Bytes received, from a peer and for an owner ID.
+	PeerBytes  int64 `json:"peer_bytes" yaml:"peer_bytes" toml:"peer_bytes" env:"NEXNET_PEER_BYTES"`
+	OwnerBytes int64 `json:"owner_bytes" yaml:"owner_bytes" toml:"owner_bytes" env:"NEXNET_OWNER_BYTES"`
+	// Refusals within ban_duration (a Go duration, "10m") that get a peer's host banned for as long.
+	BanThreshold int    `json:"ban_threshold" yaml:"ban_threshold" toml:"ban_threshold" env:"NEXNET_BAN_THRESHOLD"`
+	BanDuration  string `json:"ban_duration" yaml:"ban_duration" toml:"ban_duration" env:"NEXNET_BAN_DURATION"`
+}
+
+// BanDurationValue : BanDuration, parsed; empty is 0.
+func (l Limits) BanDurationValue() (time.Duration, error) {
+	if len(l.BanDuration) == 0 {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(l.BanDuration)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid ban_duration %q, want a duration (e.g. 10m)", l.BanDuration)
+	}
+	return d, nil
+}
+
+// Bandwidth : limits on the file streams over TCP, WebSocket and Unix sockets, in bytes per
+// second; 0 means unlimited. See p2p.Bandwidth.
+type Bandwidth struct {
+	// Over all the peers.
+	GlobalIn  int64 `json:"global_in" yaml:"global_in" toml:"global_in" env:"NEXNET_BANDWIDTH_GLOBAL_IN"`
+	GlobalOut int64 `json:"global_out" yaml:"global_out" toml:"global_out" env:"NEXNET_BANDWIDTH_GLOBAL_OUT"`
+	// Of each peer.
+	PeerIn  int64 `json:"peer_in" yaml:"peer_in" toml:"peer_in" env:"NEXNET_BANDWIDTH_PEER_IN"`
+	PeerOut int64 `json:"peer_out" yaml:"peer_out" toml:"peer_out" env:"NEXNET_BANDWIDTH_PEER_OUT"`
+}
+
+// Quota : storage quota of every owner ID, replicas included; 0 means unlimited. See storage.Quota.
+type Quota struct {
+	SoftBytes   int64 `json:"soft_bytes" yaml:"soft_bytes" toml:"soft_bytes" env:"NEXNET_QUOTA_SOFT_BYTES"`
+	HardBytes   int64 `json:"hard_bytes" yaml:"hard_bytes" toml:"hard_bytes" env:"NEXNET_QUOTA_HARD_BYTES"`
+	SoftObjects int64 `json:"soft_objects" yaml:"soft_objects" toml:"soft_objects" env:"NEXNET_QUOTA_SOFT_OBJECTS"`
+	HardObjects int64 `json:"hard_objects" yaml:"hard_objects" toml:"hard_objects" env:"NEXNET_QUOTA_HARD_OBJECTS"`
+	// Quotas of their own, by owner ID; their fields left out are unlimited.
+	Owners map[string]OwnerQuota `json:"owners" yaml:"owners" toml:"owners"`
+}
+
+// OwnerQuota : quota of a single owner ID, in place of the default one.
+type OwnerQuota struct {
+	SoftBytes   int64 `json:"soft_bytes" yaml:"soft_bytes" toml:"soft_bytes"`
+	HardBytes   int64 `json:"hard_bytes" yaml:"hard_bytes" toml:"hard_bytes"`
+	SoftObjects int64 `json:"soft_objects" yaml:"soft_objects" toml:"soft_objects"`
+	HardObjects int64 `json:"hard_objects" yaml:"hard_objects" toml:"hard_objects"`
+}
+
+// checkQuota : reports the negative limits, and soft ones over hard ones.
+func checkQuota(q OwnerQuota, prefix string, fail func(field, format string, args ...any)) {
+	for _, limit := range []struct {
+		field      string
+		soft, hard int64
+	}{
+		{"bytes", q.SoftBytes, q.HardBytes},
+		{"objects", q.SoftObjects, q.HardObjects},
+	} {
+		switch {
+		case limit.soft < 0:
+			fail(prefix+"soft_"+limit.field, "must be >= 0, got %d", limit.soft)
+		case limit.hard < 0:
+			fail(prefix+"hard_"+limit.field, "must be >= 0, got %d", limit.hard)
+		case limit.hard > 0 && limit.soft > limit.hard:
+			fail(prefix+"soft_"+limit.field, "must be <= hard_%s (%d), got %d", limit.field, limit.hard, limit.soft)
+		}
+	}
+}
+
+type Log struct {
+	// debug, info, warn or error.
+	Level string `json:"level" yaml:"level" toml:"level" env:"NEXNET_LOG_LEVEL"`
+	// text or json.
+	Format string `json:"format" yaml:"format" toml:"format" env:"NEXNET_LOG_FORMAT"`
+}
+
+// QUIC : how QUIC peers (see QUICListenAddr) are authenticated.
+type QUIC struct {
+	// PEM certificate & key of the node, naming the addresses it is dialed at.
+	TLSCert string `json:"tls_cert" yaml:"tls_cert" toml:"tls_cert" env:"NEXNET_QUIC_TLS_CERT"`
+	TLSKey  string `json:"tls_key" yaml:"tls_key" toml:"tls_key" env:"NEXNET_QUIC_TLS_KEY"`
+	// PEM certificates the peers' ones must be signed by, whichever side dials.
+	TLSCA string `json:"tls_ca" yaml:"tls_ca" toml:"tls_ca" env:"NEXNET_QUIC_TLS_CA"`
+	// Instead of the above: a throwaway self-signed certificate, and peers not authenticated.
+	InsecureSkipVerify bool `json:"insecure_skip_verify" yaml:"insecure_skip_verify" toml:"insecure_skip_verify" env:"NEXNET_QUIC_INSECURE_SKIP_VERIFY"`
+}
+
+type WebSocket struct {
+	// Address of the HTTP server accepting WebSocket peers; empty disables them. Bootstrap nodes
+	// reached over WebSockets are written "ws://host:port/path" (or "wss://").
+	ListenAddr string `json:"listen_addr" yaml:"listen_addr" toml:"listen_addr" env:"NEXNET_WS_LISTEN_ADDR"`
+	// Path of the endpoint.
+	Path string `json:"path" yaml:"path" toml:"path" env:"NEXNET_WS_PATH"`
+	// PEM certificate & key, to serve wss:// instead of ws://.
+	TLSCert string `json:"tls_cert" yaml:"tls_cert" toml:"tls_cert" env:"NEXNET_WS_TLS_CERT"`
+	TLSKey  string `json:"tls_key" yaml:"tls_key" toml:"tls_key" env:"NEXNET_WS_TLS_KEY"`
+	// PEM certificates trusted when dialing wss:// peers; defaults to the system's.
+	TLSCA string `json:"tls_ca" yaml:"tls_ca" toml:"tls_ca" env:"NEXNET_WS_TLS_CA"`
+}
+
+type Unix struct {
+	// Path of a Unix socket to also accept peers on (e.g. sidecars on the same host); empty
+	// disables it. Nodes reached over one are written "unix:///path/to.sock".
+	Socket string `json:"socket" yaml:"socket" toml:"socket" env:"NEXNET_UNIX_SOCKET"`
+	// Permissions of the socket file, in octal.
+	Mode string `json:"mode" yaml:"mode" toml:"mode" env:"NEXNET_UNIX_MODE"`
+	// Group (name or GID) given the socket file, for mode to let its members in.
+	Group string `json:"group" yaml:"group" toml:"group" env:"NEXNET_UNIX_GROUP"`
+	// Users (names or UIDs) allowed to connect, checked on the connecting process (Linux only);
+	// anyone mode lets in if empty.
+	AllowUsers []string `json:"allow_users" yaml:"allow_users" toml:"allow_users" env:"NEXNET_UNIX_ALLOW_USERS"`
+}
+
+// FileMode : Mode, parsed.
+func (u Unix) FileMode() (os.FileMode, error) {
+	mode, err := strconv.ParseUint(u.Mode, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("invalid mode %q, want octal permissions (e.g. 0660)", u.Mode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// GID : of Group, -1 if empty.
+func (u Unix) GID() (int, error) {
+	if len(u.Group) == 0 {
+		return -1, nil
+	}
+	if gid, err := strconv.Atoi(u.Group); err == nil {
+		return gid, nil
+	}
+	group, err := user.LookupGroup(u.Group)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(group.Gid)
+}
+
+// UIDs : of AllowUsers.
+func (u Unix) UIDs() ([]int, error) {
+	uids := []int{}
+	for _, name := range u.AllowUsers {
+		if uid, err := strconv.Atoi(name); err == nil {
+			uids = append(uids, uid)
+			continue
+		}
+		usr, err := user.Lookup(name)
+		if err != nil {
+			return nil, err
+		}
+		uid, err := strconv.Atoi(usr.Uid)
+		if err != nil {
+			return nil, err
+		}
+		uids = append(uids, uid)
+	}
+	return uids, nil
+}
+
+// Discovery : finding the other nodes of the cluster on the LAN, see discovery.Service.
+type Discovery struct {
+	Enabled bool `json:"enabled" yaml:"enabled" toml:"enabled" env:"NEXNET_DISCOVERY_ENABLED"`
+	// Nodes only connect to nodes of the same cluster.
+	Cluster string `json:"cluster" yaml:"cluster" toml:"cluster" env:"NEXNET_DISCOVERY_CLUSTER"`
+	// Multicast group (or broadcast address) and port announcements go to.
+	Group string `json:"group" yaml:"group" toml:"group" env:"NEXNET_DISCOVERY_GROUP"`
+	// Network interface multicast goes through; empty lets the system choose.
+	Interface string `json:"interface" yaml:"interface" toml:"interface" env:"NEXNET_DISCOVERY_INTERFACE"`
+	// Time between announcements, as a Go duration ("5s").
+	Interval string `json:"interval" yaml:"interval" toml:"interval" env:"NEXNET_DISCOVERY_INTERVAL"`
+}
+
+// IntervalDuration : Interval, parsed.
+func (d Discovery) IntervalDuration() (time.Duration, error) {
+	interval, err := time.ParseDuration(d.Interval)
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("invalid interval %q, want a positive duration (e.g. 5s)", d.Interval)
+	}
+	return interval, nil
+}
+
+// PeerExchange : gossiping of peer addresses between connected nodes, see server.PeerExchange.
+type PeerExchange struct {
+	Enabled bool `json:"enabled" yaml:"enabled" toml:"enabled" env:"NEXNET_PEX_ENABLED"`
+	// Addresses per message, sent or taken, at most.
+	MaxAddrs int `json:"max_addrs" yaml:"max_addrs" toml:"max_addrs" env:"NEXNET_PEX_MAX_ADDRS"`
+	// File the peers are recorded in, to rejoin the cluster after a restart. Defaults to
+	// "<storage_root>_peers.json".
+	PeerBook string `json:"peer_book" yaml:"peer_book" toml:"peer_book" env:"NEXNET_PEX_PEER_BOOK"`
+}
+
+// Membership : failure detection between the nodes of the cluster, see server.Membership.
+type Membership struct {
+	Enabled bool `json:"enabled" yaml:"enabled" toml:"enabled" env:"NEXNET_MEMBERSHIP_ENABLED"`
+	// Time between two pings of a node, as a Go duration ("1s").
+	ProbeInterval string `json:"probe_interval" yaml:"probe_interval" toml:"probe_interval" env:"NEXNET_MEMBERSHIP_PROBE_INTERVAL"`
+	// How long a suspect node has to refute before it's declared dead, as a Go duration ("5s").
+	SuspicionTimeout string `json:"suspicion_timeout" yaml:"suspicion_timeout" toml:"suspicion_timeout" env:"NEXNET_MEMBERSHIP_SUSPICION_TIMEOUT"`
+}
+
+// Durations : ProbeInterval and SuspicionTimeout, parsed.
+func (m Membership) Durations() (probeInterval, suspicionTimeout time.Duration, err error) {
+	probeInterval, err = time.ParseDuration(m.ProbeInterval)
+	if err != nil || probeInterval <= 0 {
+		return 0, 0, fmt.Errorf("invalid probe_interval %q, want a positive duration (e.g. 1s)", m.ProbeInterval)
+	}
+	suspicionTimeout, err = time.ParseDuration(m.SuspicionTimeout)
+	if err != nil || suspicionTimeout <= 0 {
+		return 0, 0, fmt.Errorf("invalid suspicion_timeout %q, want a positive duration (e.g. 5s)", m.SuspicionTimeout)
+	}
+	return probeInterval, suspicionTimeout, nil
+}
+
+// Heartbeat : pings and timeouts of the peer connections over TCP, WebSocket and Unix sockets
+// (QUIC has its own), see p2p.Heartbeat. Durations are Go ones ("15s").
+type Heartbeat struct {
+	// Time between pings; "0s" disables heartbeats, timeouts included.
+	Interval string `json:"interval" yaml:"interval" toml:"interval" env:"NEXNET_HEARTBEAT_INTERVAL"`
+	// A peer nothing is read from for that long is dropped; empty for 3 intervals.
+	ReadTimeout string `json:"read_timeout" yaml:"read_timeout" toml:"read_timeout" env:"NEXNET_HEARTBEAT_READ_TIMEOUT"`
+	// A write blocked for that long drops the peer; empty for read_timeout.
+	WriteTimeout string `json:"write_timeout" yaml:"write_timeout" toml:"write_timeout" env:"NEXNET_HEARTBEAT_WRITE_TIMEOUT"`
+	// A peer without any message or transfer for that long is dropped; empty or "0s" never.
+	IdleTimeout string `json:"idle_timeout" yaml:"idle_timeout" toml:"idle_timeout" env:"NEXNET_HEARTBEAT_IDLE_TIMEOUT"`
+}
+
+// Scrub : background verification of the files on disk against their checksums, see server.Scrub.
+type Scrub struct {
+	Enabled bool `json:"enabled" yaml:"enabled" toml:"enabled" env:"NEXNET_SCRUB_ENABLED"`
+	// Bytes read per second, at most.
+	Rate int64 `json:"rate" yaml:"rate" toml:"rate" env:"NEXNET_SCRUB_RATE"`
+	// Time between the starts of two passes, as a Go duration ("24h").
+	Interval string `json:"interval" yaml:"interval" toml:"interval" env:"NEXNET_SCRUB_INTERVAL"`
+}
+
+// IntervalDuration : Interval, parsed.
+func (s Scrub) IntervalDuration() (time.Duration, error) {
+	interval, err := time.ParseDuration(s.Interval)
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("invalid interval %q, want a positive duration (e.g. 24h)", s.Interval)
+	}
+	return interval, nil
+}
+
+// Durations : the fields of Heartbeat, parsed; empty ones are 0.
+func (h Heartbeat) Durations() (interval, readTimeout, writeTimeout, idleTimeout time.Duration, err error) {
+	parse := func(name, value string, d *time.Duration) {
+		if len(value) == 0 || err != nil {
+			return
+		}
+		if *d, err = time.ParseDuration(value); err != nil || *d < 0 {
+			err = fmt.Errorf("invalid %s %q, want a duration (e.g. 15s)", name, value)
+		}
+	}
+	parse("interval", h.Interval, &interval)
+	parse("read_timeout", h.ReadTimeout, &readTimeout)
+	parse("write_timeout", h.WriteTimeout, &writeTimeout)
+	parse("idle_timeout", h.IdleTimeout, &idleTimeout)
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	return interval, readTimeout, writeTimeout, idleTimeout, nil
+}
+
+type S3 struct {
+	// Empty disables the S3 gateway.
+	ListenAddr string `json:"listen_addr" yaml:"listen_addr" toml:"listen_addr" env:"NEXNET_S3_LISTEN_ADDR"`
+	// Bucket mapped to the node's own ID.
+	Bucket    string `json:"bucket" yaml:"bucket" toml:"bucket" env:"NEXNET_S3_BUCKET"`
+	AccessKey string `json:"access_key" yaml:"access_key" toml:"access_key" env:"NEXNET_S3_ACCESS_KEY"`
+	SecretKey string `json:"secret_key" yaml:"secret_key" toml:"secret_key" env:"NEXNET_S3_SECRET_KEY"`
+}
+
+type Metrics struct {
+	// Prometheus endpoint (served under /metrics); empty disables it.
+	ListenAddr string `json:"listen_addr" yaml:"listen_addr" toml:"listen_addr" env:"NEXNET_METRICS_LISTEN_ADDR"`
+}
+
+type Tracing struct {
+	// Where finished spans go, as OTLP/JSON lines: "" (nowhere), "stdout" or "file".
+	Exporter string `json:"exporter" yaml:"exporter" toml:"exporter" env:"NEXNET_TRACING_EXPORTER"`
+	// Required by the "file" exporter.
+	File string `json:"file" yaml:"file" toml:"file" env:"NEXNET_TRACING_FILE"`
+}
+
+// Default : configuration used for everything the file and environment leave out.
+func Default() *Config {
+	return &Config{
+		ListenAddr:    ":3000",
+		PathTransform: "cas",
+		AdminAddr:     "127.0.0.1:7070",
+		Log: Log{
+			Level:  "info",
+			Format: "text",
+		},
+		Limits: Limits{
+			BanDuration: "10m",
+		},
+		WebSocket: WebSocket{
+			Path: "/p2p",
+		},
+		Unix: Unix{
+			Mode: "0600",
+		},
+		Discovery: Discovery{
+			Cluster: "default",
+			// Same as discovery.DefaultGroup.
+			Group:    "239.255.78.78:7878",
+			Interval: "5s",
+		},
+		PeerExchange: PeerExchange{
+			Enabled:  true,
+			MaxAddrs: 32,
+		},
+		Membership: Membership{
+			Enabled:          true,
+			ProbeInterval:    "1s",
+			SuspicionTimeout: "5s",
+		},
+		Heartbeat: Heartbeat{
+			Interval: "15s",
+		},
+		Scrub: Scrub{
+			Rate:     4 << 20,
+			Interval: "24h",
+		},
+		S3: S3{
+			Bucket: "nexnet",
+		},
+	}
+}
+
+// Load : defaults, then the file at path (skipped if path is empty), then the environment.
+// The result is not validated, so that callers can still apply their own overrides (e.g. flags).
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	if len(path) > 0 {
+		if err := decodeFile(path, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := applyEnv(cfg, os.LookupEnv); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func decodeFile(path string, cfg *Config) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// Unknown keys are rejected: a typo must not silently fall back to a default.
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(cfg)
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		err = dec.Decode(cfg)
+		if errors.Is(err, io.EOF) {
+			// Empty file.
+			err = nil
+		}
+	case ".toml":
+		var md toml.MetaData
+		md, err = toml.Decode(string(b), cfg)
+		if err == nil {
+			if undecoded := md.Undecoded(); len(undecoded) > 0 {
+				err = fmt.Errorf("unknown field %q", undecoded[0].String())
+			}
+		}
+	default:
+		return fmt.Errorf("config %s: unsupported format %q (want .toml, .yaml, .yml or .json)", path, ext)
+	}
+
+	if err != nil {
+		return fmt.Errorf("config %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate : checks every field, reporting all the problems at once.
+// Also fills StorageRoot and PeerExchange.PeerBook when left empty.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(field, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: "+format, append([]any{field}, args...)...))
+	}
+
+	if err := checkAddr(c.ListenAddr); err != nil {
+		fail("listen_addr", "%v", err)
+	}
+
+	if len(c.QUICListenAddr) > 0 {
+		if err := checkAddr(strings.TrimPrefix(c.QUICListenAddr, quicScheme)); err != nil {
+			fail("quic_listen_addr", "%v", err)
+		}
+		q := c.QUIC
+		if !q.InsecureSkipVerify && (len(q.TLSCert) == 0 || len(q.TLSKey) == 0 || len(q.TLSCA) == 0) {
+			fail("quic", "tls_cert, tls_key and tls_ca are needed to authenticate peers, unless insecure_skip_verify")
+		}
+	}
+	if (len(c.QUIC.TLSCert) == 0) != (len(c.QUIC.TLSKey) == 0) {
+		fail("quic", "tls_cert and tls_key go together")
+	}
+
+	if len(c.StorageRoot) == 0 {
+		c.StorageRoot = defaultStorageRoot(c.ListenAddr)
+	}
+
+	if c.PathTransform != "cas" && c.PathTransform != "default" {
+		fail("path_transform", "must be \"cas\" or \"default\", got %q", c.PathTransform)
+	}
+
+	for i, addr := range c.BootstrapNodes {
+		if err := checkPeerAddr(addr); err != nil {
+			fail(fmt.Sprintf("bootstrap_nodes[%d]", i), "%v", err)
+		}
+	}
+
+	if len(c.Keystore) > 0 {
+		if _, err := os.Stat(c.Keystore); err != nil {
+			fail("keystore", "%v (create one with `fs keygen`)", err)
+		}
+	}
+
+	if len(c.AdminAddr) > 0 {
+		if err := checkAddr(c.AdminAddr); err != nil {
+			fail("admin_addr", "%v", err)
+		} else if !isLoopback(c.AdminAddr) && len(c.AdminToken) == 0 {
+			fail("admin_addr", "%q is not a loopback address: set admin_token, the admin API being unauthenticated otherwise", c.AdminAddr)
+		}
+	}
+
+	if c.Replication.Factor < 0 {
+		fail("replication.factor", "must be >= 0, got %d", c.Replication.Factor)
+	}
+
+	if c.Limits.MaxObjectSize < 0 {
+		fail("limits.max_object_size", "must be >= 0, got %d", c.Limits.MaxObjectSize)
+	}
+	for _, limit := range []struct {
+		field string
+		value float64
+	}{
+		{"limits.max_peers", float64(c.Limits.MaxPeers)},
+		{"limits.peer_message_rate", c.Limits.PeerMessageRate},
+		{"limits.owner_message_rate", c.Limits.OwnerMessageRate},
+		{"limits.peer_streams", float64(c.Limits.PeerStreams)},
+		{"limits.owner_streams", float64(c.Limits.OwnerStreams)},
+		{"limits.peer_bytes", float64(c.Limits.PeerBytes)},
+		{"limits.owner_bytes", float64(c.Limits.OwnerBytes)},
+		{"limits.ban_threshold", float64(c.Limits.BanThreshold)},
+	} {
+		if limit.value < 0 {
+			fail(limit.field, "must be >= 0, got %g", limit.value)
+		}
+	}
+	if banDuration, err := c.Limits.BanDurationValue(); err != nil {
+		fail("limits.ban_duration", "%v", err)
+	} else if c.Limits.BanThreshold > 0 && banDuration == 0 {
+		fail("limits.ban_duration", "required when limits.ban_threshold is set")
+	}
+
+	for _, rate := range []struct {
+		field string
+		value int64
+	}{
+		{"bandwidth.global_in", c.Bandwidth.GlobalIn},
+		{"bandwidth.global_out", c.Bandwidth.GlobalOut},
+		{"bandwidth.peer_in", c.Bandwidth.PeerIn},
+		{"bandwidth.peer_out", c.Bandwidth.PeerOut},
+	} {
+		if rate.value < 0 {
+			fail(rate.field, "must be >= 0, got %d", rate.value)
+		}
+	}
+
+	checkQuota(OwnerQuota{c.Quota.SoftBytes, c.Quota.HardBytes, c.Quota.SoftObjects, c.Quota.HardObjects}, "quota.", fail)
+	owners := make([]string, 0, len(c.Quota.Owners))
+	for id := range c.Quota.Owners {
+		owners = append(owners, id)
+	}
+	sort.Strings(owners)
+	for _, id := range owners {
+		checkQuota(c.Quota.Owners[id], fmt.Sprintf("quota.owners[%s].", id), fail)
+	}
+
+	switch c.Log.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		fail("log.level", "must be one of debug, info, warn, error; got %q", c.Log.Level)
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		fail("log.format", "must be \"text\" or \"json\", got %q", c.Log.Format)
+	}
+
+	if len(c.WebSocket.ListenAddr) > 0 {
+		if err := checkAddr(c.WebSocket.ListenAddr); err != nil {
+			fail("websocket.listen_addr", "%v", err)
+		}
+		if !strings.HasPrefix(c.WebSocket.Path, "/") {
+			fail("websocket.path", "must start with \"/\", got %q", c.WebSocket.Path)
+		}
+	}
+	if (len(c.WebSocket.TLSCert) == 0) != (len(c.WebSocket.TLSKey) == 0) {
+		fail("websocket", "tls_cert and tls_key go together")
+	}
+
+	if len(c.Unix.Socket) > 0 {
+		if _, err := c.Unix.FileMode(); err != nil {
+			fail("unix.mode", "%v", err)
+		}
+		if _, err := c.Unix.GID(); err != nil {
+			fail("unix.group", "%v", err)
+		}
+		if _, err := c.Unix.UIDs(); err != nil {
+			fail("unix.allow_users", "%v", err)
+		}
+	}
+
+	if c.Discovery.Enabled {
+		if len(c.Discovery.Cluster) == 0 {
+			fail("discovery.cluster", "required when discovery is enabled")
+		}
+		if err := checkAddr(c.Discovery.Group); err != nil {
+			fail("discovery.group", "%v", err)
+		}
+		if _, err := c.Discovery.IntervalDuration(); err != nil {
+			fail("discovery.interval", "%v", err)
+		}
+	}
+
+	if c.PeerExchange.MaxAddrs <= 0 {
+		fail("peer_exchange.max_addrs", "must be > 0, got %d", c.PeerExchange.MaxAddrs)
+	}
+	if len(c.PeerExchange.PeerBook) == 0 {
+		c.PeerExchange.PeerBook = c.StorageRoot + "_peers.json"
+	}
+
+	if c.Membership.Enabled {
+		if _, _, err := c.Membership.Durations(); err != nil {
+			fail("membership", "%v", err)
+		}
+	}
+	if _, _, _, _, err := c.Heartbeat.Durations(); err != nil {
+		fail("heartbeat", "%v", err)
+	}
+	if c.Scrub.Enabled {
+		if c.Scrub.Rate <= 0 {
+			fail("scrub.rate", "must be > 0, got %d", c.Scrub.Rate)
+		}
+		if _, err := c.Scrub.IntervalDuration(); err != nil {
+			fail("scrub.interval", "%v", err)
+		}
+	}
+
+	if len(c.S3.ListenAddr) > 0 {
+		if err := checkAddr(c.S3.ListenAddr); err != nil {
+			fail("s3.listen_addr", "%v", err)
+		}
+		if len(c.S3.Bucket) == 0 {
+			fail("s3.bucket", "required when s3.listen_addr is set")
+		}
+		if len(c.S3.AccessKey) == 0 || len(c.S3.SecretKey) == 0 {
+			fail("s3", "access_key and secret_key are required when s3.listen_addr is set")
+		}
+	}
+
+	if len(c.Metrics.ListenAddr) > 0 {
+		if err := checkAddr(c.Metrics.ListenAddr); err != nil {
+			fail("metrics.listen_addr", "%v", err)
+		}
+	}
+
+	switch c.Tracing.Exporter {
+	case "", "stdout":
+	case "file":
+		if len(c.Tracing.File) == 0 {
+			fail("tracing.file", "required by the file exporter")
+		}
+	default:
+		fail("tracing.exporter", "must be empty, \"stdout\" or \"file\", got %q", c.Tracing.Exporter)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// RestartRequired : fields that differ between c and next but cannot be changed on a running node.
+// Everything else (bootstrap nodes, replication, limits, bandwidth, quotas and log level) is
+// reloadable.
+func (c *Config) RestartRequired(next *Config) []string {
+	fields := []string{}
+	check := func(name string, changed bool) {
+		if changed {
+			fields = append(fields, name)
+		}
+	}
+
+	check("listen_addr", c.ListenAddr != next.ListenAddr)
+	check("quic_listen_addr", c.QUICListenAddr != next.QUICListenAddr)
+	check("quic", c.QUIC != next.QUIC)
+	check("storage_root", c.StorageRoot != next.StorageRoot)
+	check("path_transform", c.PathTransform != next.PathTransform)
+	check("keystore", c.Keystore != next.Keystore)
+	check("admin_addr", c.AdminAddr != next.AdminAddr)
+	check("admin_token", c.AdminToken != next.AdminToken)
+	check("log.format", c.Log.Format != next.Log.Format)
+	check("websocket", c.WebSocket != next.WebSocket)
+	check("unix", !reflect.DeepEqual(c.Unix, next.Unix))
+	check("discovery", c.Discovery != next.Discovery)
+	check("peer_exchange", c.PeerExchange != next.PeerExchange)
+	check("membership", c.Membership != next.Membership)
+	check("heartbeat", c.Heartbeat != next.Heartbeat)
+	check("scrub", c.Scrub != next.Scrub)
+	check("s3", c.S3 != next.S3)
+	check("metrics", c.Metrics != next.Metrics)
+	check("tracing", c.Tracing != next.Tracing)
+
+	return fields
+}
+
+// checkPeerAddr : host:port, quic://host:port, a ws:// or wss:// URL, or unix:///path.
+func checkPeerAddr(addr string) error {
+	if strings.HasPrefix(addr, unixScheme) {
+		if !filepath.IsAbs(strings.TrimPrefix(addr, unixScheme)) {
+			return fmt.Errorf("invalid address %q, want unix:///absolute/path", addr)
+		}
+		return nil
+	}
+	if strings.HasPrefix(addr, "ws://") || strings.HasPrefix(addr, "wss://") {
+		if u, err := url.Parse(addr); err != nil || len(u.Host) == 0 {
+			return fmt.Errorf("invalid URL %q, want ws://host:port/path", addr)
+		}
+		return nil
+	}
+	return checkAddr(strings.TrimPrefix(addr, quicScheme))
+}
+
+func checkAddr(addr string) error {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("invalid address %q, want host:port", addr)
+	}
+	return nil
+}
+
+// isLoopback : whether addr (host:port) only listens on the local host; an empty host (":7070")
+// listens on every interface.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// defaultStorageRoot : ":3000" -> "3000_network".
+func defaultStorageRoot(listenAddr string) string {
+	_, port, err := net.SplitHostPort(listenAddr)
+	if err != nil || len(port) == 0 {
+		return "node_network"
+	}
+	return port + "_network"
+}
@@ -0,0 +1,216 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0o644))
+	return path
+}
+
+func TestLoadFormats(t *testing.T) {
+	files := map[string]string{
+		"node.toml": `
+listen_addr = ":4000"
+bootstrap_nodes = [":3000", "10.0.0.2:3000"]
+
+[replication]
+factor = 2
+
+[limits]
+max_object_size = 1048576
+
+[quota]
+hard_bytes = 1073741824
+
+[quota.owners.alice]
+hard_objects = 10
+
+[log]
+level = "debug"
+`,
+		"node.yaml": `
+listen_addr: ":4000"
+bootstrap_nodes: [":3000", "10.0.0.2:3000"]
+replication:
+  factor: 2
+limits:
+  max_object_size: 1048576
+quota:
+  hard_bytes: 1073741824
+  owners:
+    alice:
+      hard_objects: 10
+log:
+  level: debug
+`,
+		"node.json": `{
+  "listen_addr": ":4000",
+  "bootstrap_nodes": [":3000", "10.0.0.2:3000"],
+  "replication": {"factor": 2},
+  "limits": {"max_object_size": 1048576},
+  "quota": {"hard_bytes": 1073741824, "owners": {"alice": {"hard_objects": 10}}},
+  "log": {"level": "debug"}
+}`,
+	}
+
+	for name, content := range files {
+		cfg, err := Load(writeFile(t, name, content))
+		assert.Nil(t, err, name)
+		assert.Nil(t, cfg.Validate(), name)
+
+		assert.Equal(t, ":4000", cfg.ListenAddr, name)
+		assert.Equal(t, "4000_network", cfg.StorageRoot, name)
+		assert.Equal(t, "4000_network_peers.json", cfg.PeerExchange.PeerBook, name)
+		assert.Equal(t, []string{":3000", "10.0.0.2:3000"}, cfg.BootstrapNodes, name)
+		assert.Equal(t, 2, cfg.Replication.Factor, name)
+		assert.Equal(t, int64(1048576), cfg.Limits.MaxObjectSize, name)
+		assert.Equal(t, int64(1073741824), cfg.Quota.HardBytes, name)
+		assert.Equal(t, map[string]OwnerQuota{"alice": {HardObjects: 10}}, cfg.Quota.Owners, name)
+		assert.Equal(t, "debug", cfg.Log.Level, name)
+		// Untouched fields keep their defaults.
+		assert.Equal(t, "text", cfg.Log.Format, name)
+		assert.Equal(t, "cas", cfg.PathTransform, name)
+	}
+}
+
+func TestLoadRejectsUnknownFields(t *testing.T) {
+	for name, content := range map[string]string{
+		"node.toml": "listen_adr = \":4000\"\n",
+		"node.yaml": "listen_adr: \":4000\"\n",
+		"node.json": `{"listen_adr": ":4000"}`,
+	} {
+		_, err := Load(writeFile(t, name, content))
+		assert.ErrorContains(t, err, "listen_adr", name)
+	}
+
+	_, err := Load(writeFile(t, "node.ini", ""))
+	assert.ErrorContains(t, err, "unsupported format")
+}
+
+func TestEnvOverrides(t *testing.T) {
+	t.Setenv("NEXNET_LISTEN_ADDR", ":5000")
+	t.Setenv("NEXNET_BOOTSTRAP_NODES", ":3000, :4000")
+	t.Setenv("NEXNET_MAX_PEERS", "8")
+	t.Setenv("NEXNET_PEER_MESSAGE_RATE", "2.5")
+	t.Setenv("NEXNET_DISCOVERY_ENABLED", "true")
+
+	cfg, err := Load(writeFile(t, "node.json", `{"listen_addr": ":4000", "limits": {"max_peers": 2}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, ":5000", cfg.ListenAddr)
+	assert.Equal(t, []string{":3000", ":4000"}, cfg.BootstrapNodes)
+	assert.Equal(t, 8, cfg.Limits.MaxPeers)
+	assert.Equal(t, 2.5, cfg.Limits.PeerMessageRate)
+	assert.True(t, cfg.Discovery.Enabled)
+
+	t.Setenv("NEXNET_MAX_PEERS", "eight")
+	_, err = Load("")
+	assert.ErrorContains(t, err, "NEXNET_MAX_PEERS")
+
+	t.Setenv("NEXNET_MAX_PEERS", "8")
+	t.Setenv("NEXNET_DISCOVERY_ENABLED", "yes")
+	_, err = Load("")
+	assert.ErrorContains(t, err, "NEXNET_DISCOVERY_ENABLED")
+}
+
+func TestValidateReportsEveryError(t *testing.T) {
+	cfg := Default()
+	cfg.ListenAddr = "3000"
+	cfg.QUICListenAddr = "quic://4000"
+	cfg.BootstrapNodes = []string{"quic://:3000", "nope", "wss://proxy.example.com/p2p"}
+	cfg.WebSocket.TLSCert = "cert.pem"
+	cfg.Unix.Socket = "/run/nexnet.sock"
+	cfg.Unix.Mode = "0999"
+	cfg.Keystore = filepath.Join(t.TempDir(), "missing.key")
+	cfg.Limits.MaxObjectSize = -1
+	cfg.Limits.OwnerMessageRate = -0.5
+	cfg.Limits.BanDuration = "forever"
+	cfg.Bandwidth.PeerOut = -1
+	cfg.Quota.SoftBytes = 2
+	cfg.Quota.HardBytes = 1
+	cfg.Quota.Owners = map[string]OwnerQuota{"alice": {HardObjects: -1}}
+	cfg.Log.Format = "xml"
+	cfg.S3.ListenAddr = ":9000"
+	cfg.Metrics.ListenAddr = "9100"
+	cfg.Tracing.Exporter = "file"
+	cfg.Discovery.Enabled = true
+	cfg.Discovery.Interval = "5"
+	cfg.PeerExchange.MaxAddrs = 0
+	cfg.Membership.ProbeInterval = "1"
+	cfg.Heartbeat.IdleTimeout = "-1s"
+	cfg.Scrub.Enabled = true
+	cfg.Scrub.Interval = "daily"
+
+	err := cfg.Validate()
+	assert.NotNil(t, err)
+	for _, field := range []string{"listen_addr", "quic_listen_addr", "quic:", "bootstrap_nodes[1]", "websocket:", "unix.mode", "keystore", "limits.max_object_size", "limits.owner_message_rate", "limits.ban_duration", "bandwidth.peer_out", "quota.soft_bytes", "quota.owners[alice].hard_objects", "log.format", "s3:", "metrics.listen_addr", "tracing.file", "discovery.interval", "peer_exchange.max_addrs", "membership:", "heartbeat:", "scrub.interval"} {
+		assert.ErrorContains(t, err, field)
+	}
+	assert.NotContains(t, err.Error(), "bootstrap_nodes[0]")
+	assert.NotContains(t, err.Error(), "bootstrap_nodes[2]")
+}
+
+func TestValidateAdminAddr(t *testing.T) {
+	for _, tc := range []struct {
+		addr, token string
+		ok          bool
+	}{
+		{"127.0.0.1:7070", "", true},
+		{"localhost:7070", "", true},
+		{"[::1]:7070", "", true},
+		{":7070", "", false},
+		{"0.0.0.0:7070", "", false},
+		{"10.0.0.7:7070", "", false},
+		{"0.0.0.0:7070", "s3cret", true},
+	} {
+		cfg := Default()
+		cfg.AdminAddr, cfg.AdminToken = tc.addr, tc.token
+		err := cfg.Validate()
+		if tc.ok {
+			assert.Nil(t, err, tc.addr)
+		} else {
+			assert.ErrorContains(t, err, "admin_addr", tc.addr)
+		}
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	cur := Default()
+	next := Default()
+	next.BootstrapNodes = []string{":4000"}
+	next.Limits.MaxPeers = 4
+	next.Bandwidth.GlobalOut = 10 << 20
+	next.Quota.HardBytes = 1 << 30
+	next.Log.Level = "debug"
+	assert.Empty(t, cur.RestartRequired(next))
+
+	next.ListenAddr = ":4000"
+	next.S3.Bucket = "other"
+	assert.Equal(t, []string{"listen_addr", "s3"}, cur.RestartRequired(next))
+}
+
+func TestUnix(t *testing.T) {
+	u := Unix{Mode: "0660", Group: "0", AllowUsers: []string{"root", "1000"}}
+
+	mode, err := u.FileMode()
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0o660), mode)
+
+	gid, err := u.GID()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, gid)
+
+	uids, err := u.UIDs()
+	assert.Nil(t, err)
+	assert.Equal(t, []int{0, 1000}, uids)
+
+	u.AllowUsers = []string{"no-such-user"}
+	_, err = u.UIDs()
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// applyEnv : overrides every field tagged `env:"NAME"` for which lookup finds a value.
+// Lists are comma separated; booleans are as strconv.ParseBool ("true", "1", "false", ...).
+func applyEnv(cfg *Config, lookup func(string) (string, bool)) error {
+	return applyEnvValue(reflect.ValueOf(cfg).Elem(), lookup)
+}
+
+func applyEnvValue(v reflect.Value, lookup func(string) (string, bool)) error {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field, fv := t.Field(i), v.Field(i)
+
+		if field.Type.Kind() == reflect.Struct {
+			if err := applyEnvValue(fv, lookup); err != nil {
+				return err
+			}
+			continue
+		}
+
+		name := field.Tag.Get("env")
+		if len(name) == 0 {
+			continue
+		}
+
+		raw, ok := lookup(name)
+		if !ok {
+			continue
+		}
+
+		switch field.Type.Kind() {
+		case reflect.String:
+			fv.SetString(raw)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(strings.TrimSpace(raw))
+			if err != nil {
+				return fmt.Errorf("env %s: %q is not a boolean", name, raw)
+			}
+			fv.SetBool(b)
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+			if err != nil {
+				return fmt.Errorf("env %s: %q is not an integer", name, raw)
+			}
+			fv.SetInt(n)
+		case reflect.Float64:
+			f, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+			if err != nil {
+				return fmt.Errorf("env %s: %q is not a number", name, raw)
+			}
+			fv.SetFloat(f)
+		case reflect.Slice:
+			items := []string{}
+			for _, item := range strings.Split(raw, ",") {
+				if item = strings.TrimSpace(item); len(item) > 0 {
+					items = append(items, item)
+				}
+			}
+			fv.Set(reflect.ValueOf(items))
+		default:
+			return fmt.Errorf("env %s: unsupported field type %s", name, field.Type)
+		}
+	}
+
+	return nil
+}
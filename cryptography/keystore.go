@@ -0,0 +1,65 @@
+package cryptography
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Keystore : identity of a node that must survive restarts.
+// Files are stored under the node ID and encrypted with EncKey, so losing either loses the data.
+type Keystore struct {
+	ID     string
+	EncKey []byte
+}
+
+type keystoreFile struct {
+	ID     string `json:"id"`
+	EncKey string `json:"enc_key"`
+}
+
+func NewKeystore() *Keystore {
+	return &Keystore{
+		ID:     GenerateId(),
+		EncKey: NewEncryptionKey(),
+	}
+}
+
+func LoadKeystore(path string) (*Keystore, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f keystoreFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("keystore %s: %w", path, err)
+	}
+
+	key, err := hex.DecodeString(f.EncKey)
+	if err != nil {
+		return nil, fmt.Errorf("keystore %s: enc_key: %w", path, err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("keystore %s: enc_key must be 32 bytes, got %d", path, len(key))
+	}
+	if len(f.ID) == 0 {
+		return nil, fmt.Errorf("keystore %s: missing id", path)
+	}
+
+	return &Keystore{ID: f.ID, EncKey: key}, nil
+}
+
+// Save : writes the keystore to path, readable by the owner only.
+func (k *Keystore) Save(path string) error {
+	b, err := json.MarshalIndent(keystoreFile{
+		ID:     k.ID,
+		EncKey: hex.EncodeToString(k.EncKey),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, append(b, '\n'), 0o600)
+}
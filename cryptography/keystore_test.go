@@ -0,0 +1,28 @@
+package cryptography
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeystoreSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.key")
+
+	ks := NewKeystore()
+	assert.Nil(t, ks.Save(path))
+
+	fi, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+
+	loaded, err := LoadKeystore(path)
+	assert.Nil(t, err)
+	assert.Equal(t, ks, loaded)
+
+	assert.Nil(t, os.WriteFile(path, []byte(`{"id":"x","enc_key":"abcd"}`), 0o600))
+	_, err = LoadKeystore(path)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,311 @@
+// Package discovery finds the nodes of a cluster on the local network, without bootstrap list:
+// every node periodically announces its ID, listen address and protocol version over UDP
+// multicast (or broadcast), and dials the nodes it hears of.
+package discovery
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/PsychoPunkSage/NexNet/clock"
+	"github.com/PsychoPunkSage/NexNet/logging"
+	"github.com/PsychoPunkSage/NexNet/p2p"
+)
+
+// DefaultGroup : multicast group (in the organization-local scope) and port announcements go to.
+const DefaultGroup = "239.255.78.78:7878"
+
+// Prefix of every announcement, so that other traffic on the port is ignored cheaply.
+var magic = []byte("NEXNET1")
+
+// Announcements are much smaller; anything bigger isn't one.
+const maxAnnouncementSize = 1024
+
+// PacketConn : the socket announcements are sent and received on (a subset of net.PacketConn).
+type PacketConn interface {
+	ReadFrom(p []byte) (n int, addr net.Addr, err error)
+	WriteTo(p []byte, addr net.Addr) (n int, err error)
+	Close() error
+}
+
+// Announcement : what a node tells the LAN about itself.
+type Announcement struct {
+	Cluster string `json:"cluster"`
+	NodeID  string `json:"node_id"`
+	// Address peers dial. A host left out (":3000") or unspecified ("0.0.0.0:3000") stands for
+	// the address the announcement came from.
+	ListenAddr string `json:"listen_addr"`
+	Version    int    `json:"version"`
+}
+
+// Node : a node heard of.
+type Node struct {
+	ID string
+	// Address it is dialed on.
+	Addr     string
+	Version  int
+	LastSeen time.Time
+}
+
+type ServiceOpts struct {
+	NodeID     string
+	ListenAddr string
+	// Only nodes announcing the same name are dialed, so that separate clusters sharing a LAN
+	// don't merge. Defaults to "default".
+	Cluster string
+	// Multicast group, or broadcast address (e.g. "255.255.255.255:7878"), with the port.
+	// Defaults to DefaultGroup.
+	Group string
+	// Network interface multicast goes through (e.g. "eth0"); defaults to the system's choice.
+	Interface string
+	// Time between announcements. A node not heard of for 3 intervals is forgotten. Defaults to 5s.
+	Interval time.Duration
+	// Called with the address of a node to connect to; must not block (e.g.
+	// server.FileServer.Connect). Of two nodes, only the one with the smaller ID dials the other,
+	// so that they don't connect twice; it dials again each interval the other is heard of, which
+	// must be a no-op while connected.
+	Dial func(addr string)
+	// Defaults to a socket on Group, see Listen. Meant for tests and unusual networks.
+	Conn PacketConn
+	// Defaults to slog.Default().
+	Logger *slog.Logger
+	// Defaults to clock.Real.
+	Clock clock.Clock
+}
+
+// Service : announces the node and dials the nodes of its cluster it hears of.
+type Service struct {
+	ServiceOpts
+
+	group *net.UDPAddr
+	log   *slog.Logger
+
+	mu    sync.Mutex
+	nodes map[string]*node
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+	wg        sync.WaitGroup
+}
+
+type node struct {
+	Node
+	// When it was last dialed; zero if never.
+	dialed time.Time
+}
+
+func NewService(opts ServiceOpts) *Service {
+	if len(opts.Cluster) == 0 {
+		opts.Cluster = "default"
+	}
+	if len(opts.Group) == 0 {
+		opts.Group = DefaultGroup
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = 5 * time.Second
+	}
+	if opts.Dial == nil {
+		opts.Dial = func(string) {}
+	}
+	opts.Clock = clock.OrReal(opts.Clock)
+
+	return &Service{
+		ServiceOpts: opts,
+		log: logging.OrDefault(opts.Logger).With(
+			"component", "discovery",
+			logging.NodeID, opts.NodeID,
+			"cluster", opts.Cluster,
+		),
+		nodes:   make(map[string]*node),
+		closeCh: make(chan struct{}),
+	}
+}
+
+// Start : opens the socket (unless given one) and starts announcing and listening, in the background.
+func (s *Service) Start() error {
+	group, err := net.ResolveUDPAddr("udp4", s.Group)
+	if err != nil {
+		return err
+	}
+	s.group = group
+
+	if s.Conn == nil {
+		if s.Conn, err = Listen(s.Group, s.Interface); err != nil {
+			return err
+		}
+	}
+
+	s.wg.Add(2)
+	go s.announceLoop()
+	go s.receiveLoop()
+
+	s.log.Info("discovery started", "group", s.Group, "interval", s.Interval)
+	return nil
+}
+
+// Close : stops the service and closes its socket.
+func (s *Service) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closeCh)
+		if s.Conn != nil {
+			// Unblocks the receive loop.
+			err = s.Conn.Close()
+		}
+		s.wg.Wait()
+	})
+	return err
+}
+
+// Nodes : the nodes of the cluster heard of lately, by ID.
+func (s *Service) Nodes() []Node {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire()
+	nodes := make([]Node, 0, len(s.nodes))
+	for _, n := range s.nodes {
+		nodes = append(nodes, n.Node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes
+}
+
+func (s *Service) announceLoop() {
+	defer s.wg.Done()
+
+	b, err := json.Marshal(Announcement{
+		Cluster:    s.Cluster,
+		NodeID:     s.NodeID,
+		ListenAddr: s.ListenAddr,
+		Version:    p2p.ProtocolVersion,
+	})
+	if err != nil {
+		s.log.Error("encoding announcement", "err", err)
+		return
+	}
+	packet := append(append([]byte{}, magic...), b...)
+
+	for {
+		if _, err := s.Conn.WriteTo(packet, s.group); err != nil {
+			s.log.Warn("announcement not sent", "err", err)
+		}
+
+		select {
+		case <-s.Clock.After(s.Interval):
+		case <-s.closeCh:
+			return
+		}
+	}
+}
+
+func (s *Service) receiveLoop() {
+	defer s.wg.Done()
+
+	buf := make([]byte, maxAnnouncementSize+1)
+	for {
+		n, from, err := s.Conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.closeCh:
+			default:
+				s.log.Error("discovery stopped", "err", err)
+			}
+			return
+		}
+		if n > maxAnnouncementSize || !bytes.HasPrefix(buf[:n], magic) {
+			continue
+		}
+
+		var a Announcement
+		if err := json.Unmarshal(buf[len(magic):n], &a); err != nil {
+			s.log.Debug("invalid announcement", "from", from.String(), "err", err)
+			continue
+		}
+		s.heard(a, from)
+	}
+}
+
+// heard : records the node behind a, dialing it if it's up to s.
+func (s *Service) heard(a Announcement, from net.Addr) {
+	if a.NodeID == s.NodeID || a.Cluster != s.Cluster || len(a.NodeID) == 0 {
+		return
+	}
+
+	addr, err := dialAddr(a.ListenAddr, from)
+	if err != nil {
+		s.log.Debug("invalid announcement", "from", from.String(), "err", err)
+		return
+	}
+
+	now := s.Clock.Now()
+
+	s.mu.Lock()
+	s.expire()
+	n, known := s.nodes[a.NodeID]
+	if !known {
+		n = &node{Node: Node{ID: a.NodeID}}
+		s.nodes[a.NodeID] = n
+	}
+	n.Addr, n.Version, n.LastSeen = addr, a.Version, now
+
+	log := s.log.With(logging.Peer, addr, "peer_id", a.NodeID)
+	if !known {
+		log.Info("node discovered", "version", a.Version)
+	}
+
+	// The handshake settles on a version both speak.
+	speaks := a.Version >= p2p.MinProtocolVersion && a.Version <= p2p.ProtocolVersion
+	dial := speaks && s.NodeID < a.NodeID &&
+		(n.dialed.IsZero() || now.Sub(n.dialed) >= s.Interval/2)
+	if dial {
+		n.dialed = now
+	}
+	s.mu.Unlock()
+
+	if !speaks {
+		if !known {
+			log.Warn("not dialing node of another protocol version", "version", a.Version,
+				"min_version", p2p.MinProtocolVersion, "own_version", p2p.ProtocolVersion)
+		}
+		return
+	}
+	if dial {
+		log.Debug("dialing discovered node")
+		s.Dial(addr)
+	}
+}
+
+// expire : forgets the nodes not heard of for 3 intervals. Must hold s.mu.
+func (s *Service) expire() {
+	now := s.Clock.Now()
+	for id, n := range s.nodes {
+		if now.Sub(n.LastSeen) >= 3*s.Interval {
+			delete(s.nodes, id)
+			s.log.Info("node lost", logging.Peer, n.Addr, "peer_id", id)
+		}
+	}
+}
+
+// dialAddr : listenAddr, with the host of from if it has none.
+func dialAddr(listenAddr string, from net.Addr) (string, error) {
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(host); len(host) > 0 && (ip == nil || !ip.IsUnspecified()) {
+		return listenAddr, nil
+	}
+
+	udp, ok := from.(*net.UDPAddr)
+	if !ok {
+		return "", errors.New("no host to dial")
+	}
+	return net.JoinHostPort(udp.IP.String(), port), nil
+}
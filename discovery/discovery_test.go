@@ -0,0 +1,231 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PsychoPunkSage/NexNet/clock"
+	"github.com/PsychoPunkSage/NexNet/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lan : delivers every packet written by one of its conns to all of them, as multicast would.
+type lan struct {
+	mu    sync.Mutex
+	conns []*lanConn
+}
+
+type packet struct {
+	b    []byte
+	from net.Addr
+}
+
+type lanConn struct {
+	lan       *lan
+	addr      *net.UDPAddr
+	in        chan packet
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (l *lan) conn() *lanConn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	c := &lanConn{
+		lan:    l,
+		addr:   &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(len(l.conns)+1)), Port: 7878},
+		in:     make(chan packet, 64),
+		closed: make(chan struct{}),
+	}
+	l.conns = append(l.conns, c)
+	return c
+}
+
+func (l *lan) send(b []byte, from net.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, c := range l.conns {
+		select {
+		case c.in <- packet{b: append([]byte{}, b...), from: from}:
+		default:
+		}
+	}
+}
+
+func (c *lanConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-c.in:
+		return copy(p, pkt.b), pkt.from, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *lanConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.lan.send(p, c.addr)
+	return len(p), nil
+}
+
+func (c *lanConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+// dials : records the addresses given to Dial.
+type dials struct {
+	ch chan string
+}
+
+func newDials() *dials {
+	return &dials{ch: make(chan string, 16)}
+}
+
+func (d *dials) dial(addr string) {
+	d.ch <- addr
+}
+
+func (d *dials) next(t *testing.T) string {
+	t.Helper()
+
+	select {
+	case addr := <-d.ch:
+		return addr
+	case <-time.After(2 * time.Second):
+		t.Fatal("nothing dialed")
+		return ""
+	}
+}
+
+func (d *dials) none(t *testing.T) {
+	t.Helper()
+
+	select {
+	case addr := <-d.ch:
+		t.Fatalf("dialed %s", addr)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func startService(t *testing.T, opts ServiceOpts) *Service {
+	s := NewService(opts)
+	require.Nil(t, s.Start())
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func announce(l *lan, from net.Addr, a Announcement) {
+	b, _ := json.Marshal(a)
+	l.send(append(append([]byte{}, magic...), b...), from)
+}
+
+func waitNodes(t *testing.T, s *Service, n int) []Node {
+	t.Helper()
+
+	require.Eventually(t, func() bool { return len(s.Nodes()) == n }, 2*time.Second, 10*time.Millisecond)
+	return s.Nodes()
+}
+
+func TestService(t *testing.T) {
+	l := &lan{}
+	aDials, bDials := newDials(), newDials()
+	// Both on the LAN before either announces, the next announcement being an interval away.
+	aConn, bConn := l.conn(), l.conn()
+	a := startService(t, ServiceOpts{NodeID: "a", ListenAddr: ":3000", Dial: aDials.dial, Conn: aConn})
+	b := startService(t, ServiceOpts{NodeID: "b", ListenAddr: "192.168.1.7:4000", Dial: bDials.dial, Conn: bConn})
+
+	// An unspecified host is that of the sender; only the smaller ID dials.
+	assert.Equal(t, "192.168.1.7:4000", aDials.next(t))
+	bDials.none(t)
+
+	nodes := waitNodes(t, b, 1)
+	assert.Equal(t, "a", nodes[0].ID)
+	assert.Equal(t, "10.0.0.1:3000", nodes[0].Addr)
+	assert.Equal(t, p2p.ProtocolVersion, nodes[0].Version)
+	assert.Equal(t, "b", waitNodes(t, a, 1)[0].ID)
+}
+
+func TestServiceFilters(t *testing.T) {
+	l := &lan{}
+	d := newDials()
+	s := startService(t, ServiceOpts{NodeID: "a", ListenAddr: ":3000", Cluster: "prod", Dial: d.dial, Conn: l.conn()})
+	from := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 9), Port: 7878}
+
+	// Another cluster.
+	announce(l, from, Announcement{Cluster: "staging", NodeID: "b", ListenAddr: ":3000", Version: p2p.ProtocolVersion})
+	// Another protocol version: listed, not dialed.
+	announce(l, from, Announcement{Cluster: "prod", NodeID: "c", ListenAddr: ":3000", Version: p2p.ProtocolVersion + 1})
+	announce(l, from, Announcement{Cluster: "prod", NodeID: "e", ListenAddr: ":3000", Version: p2p.MinProtocolVersion - 1})
+	// Not an announcement.
+	l.send([]byte("hello"), from)
+	d.none(t)
+
+	nodes := waitNodes(t, s, 2)
+	assert.ElementsMatch(t, []string{"c", "e"}, []string{nodes[0].ID, nodes[1].ID})
+
+	announce(l, from, Announcement{Cluster: "prod", NodeID: "d", ListenAddr: ":3000", Version: p2p.ProtocolVersion})
+	assert.Equal(t, "10.0.0.9:3000", d.next(t))
+}
+
+func TestServiceOlderVersion(t *testing.T) {
+	l := &lan{}
+	d := newDials()
+	s := startService(t, ServiceOpts{NodeID: "a", ListenAddr: ":3000", Dial: d.dial, Conn: l.conn()})
+	from := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 9), Port: 7878}
+
+	// Still spoken: dialed, the handshake settling on it.
+	announce(l, from, Announcement{Cluster: "default", NodeID: "b", ListenAddr: ":3000", Version: 3})
+	assert.Equal(t, "10.0.0.9:3000", d.next(t))
+	assert.Equal(t, 3, waitNodes(t, s, 1)[0].Version)
+}
+
+func TestServiceExpiry(t *testing.T) {
+	l := &lan{}
+	d := newDials()
+	clk := clock.NewVirtual(time.Unix(0, 0))
+	s := startService(t, ServiceOpts{NodeID: "a", Interval: time.Second, Dial: d.dial, Conn: l.conn(), Clock: clk})
+	from := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 9), Port: 7878}
+	b := Announcement{Cluster: "default", NodeID: "b", ListenAddr: ":3000", Version: p2p.ProtocolVersion}
+
+	announce(l, from, b)
+	assert.Equal(t, "10.0.0.9:3000", d.next(t))
+
+	// Heard again right away: not redialed.
+	announce(l, from, b)
+	d.none(t)
+
+	// Heard again an interval later: redialed, in case the connection is gone.
+	clk.Advance(time.Second)
+	announce(l, from, b)
+	assert.Equal(t, "10.0.0.9:3000", d.next(t))
+
+	clk.Advance(3 * time.Second)
+	assert.Len(t, s.Nodes(), 0)
+}
+
+// TestServiceMulticast : over real sockets, if the host allows multicast.
+func TestServiceMulticast(t *testing.T) {
+	group := fmt.Sprintf("239.255.78.78:%d", 20000+time.Now().Nanosecond()%10000)
+	conn, err := Listen(group, "")
+	if err != nil {
+		t.Skipf("no multicast: %v", err)
+	}
+	defer conn.Close()
+
+	d := newDials()
+	startService(t, ServiceOpts{NodeID: "a", ListenAddr: "127.0.0.1:3000", Group: group, Interval: 50 * time.Millisecond, Dial: d.dial})
+	startService(t, ServiceOpts{NodeID: "b", ListenAddr: "127.0.0.1:4000", Group: group, Interval: 50 * time.Millisecond})
+
+	select {
+	case addr := <-d.ch:
+		assert.Equal(t, "127.0.0.1:4000", addr)
+	case <-time.After(2 * time.Second):
+		t.Skip("multicast not delivered on this host")
+	}
+}
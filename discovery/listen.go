@@ -0,0 +1,39 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"strconv"
+)
+
+// Listen : a socket receiving what is sent to group, and sending to it. A multicast group is joined
+// on the interface named iface (the system's choice if empty), with loopback on so that nodes of
+// the same host hear each other. Any other address is taken for a broadcast one: the socket then
+// binds its port, shared with the other nodes of the host.
+func Listen(group, iface string) (PacketConn, error) {
+	addr, err := net.ResolveUDPAddr("udp4", group)
+	if err != nil {
+		return nil, err
+	}
+
+	if addr.IP.IsMulticast() {
+		var ifi *net.Interface
+		if len(iface) > 0 {
+			if ifi, err = net.InterfaceByName(iface); err != nil {
+				return nil, err
+			}
+		}
+		conn, err := net.ListenMulticastUDP("udp4", ifi, addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := loopMulticast(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+
+	lc := net.ListenConfig{Control: shareBroadcast}
+	return lc.ListenPacket(context.Background(), "udp4", ":"+strconv.Itoa(addr.Port))
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package discovery
+
+import (
+	"net"
+	"syscall"
+)
+
+// shareBroadcast : sockets keep their defaults; broadcast may need a node per host.
+func shareBroadcast(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+// loopMulticast : left to the system's default.
+func loopMulticast(conn *net.UDPConn) error {
+	return nil
+}
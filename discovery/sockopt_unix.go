@@ -0,0 +1,39 @@
+//go:build unix
+
+package discovery
+
+import (
+	"net"
+	"syscall"
+)
+
+// shareBroadcast : lets the socket send broadcasts, and share its port with the other nodes of the host.
+func shareBroadcast(network, address string, c syscall.RawConn) error {
+	var err error
+	ctrlErr := c.Control(func(fd uintptr) {
+		if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+			return
+		}
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+	})
+	if ctrlErr != nil {
+		return ctrlErr
+	}
+	return err
+}
+
+// loopMulticast : has multicast sent by the socket looped back to the host (net.ListenMulticastUDP
+// turns that off), for its other nodes to hear.
+func loopMulticast(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	ctrlErr := raw.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_LOOP, 1)
+	})
+	if ctrlErr != nil {
+		return ctrlErr
+	}
+	return err
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/PsychoPunkSage/NexNet/cryptography"
+)
+
+func runKeygen(args []string) error {
+	fset := newFlagSet("keygen", "[-o path]")
+	out := fset.String("o", "node.key", "where to write the keystore")
+	force := fset.Bool("f", false, "overwrite an existing keystore")
+	fset.Parse(args)
+
+	// Overwriting a keystore makes every file stored with it unreadable.
+	if _, err := os.Stat(*out); err == nil && !*force {
+		return fmt.Errorf("%s already exists (use -f to overwrite)", *out)
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	ks := cryptography.NewKeystore()
+	if err := ks.Save(*out); err != nil {
+		return err
+	}
+
+	fmt.Printf("wrote keystore for node %s to %s\n", ks.ID, *out)
+	return nil
+}
@@ -0,0 +1,55 @@
+package logging
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// statusWriter : remembers the status code sent through it.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Middleware : gives every request an ID (the client's X-Request-Id when usable), carried by the
+// request context and echoed in the X-Request-Id response header, then logs the outcome.
+func Middleware(logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := SanitizeRequestID(r.Header.Get(RequestIDHeader))
+		if len(id) == 0 {
+			id = NewRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(WithRequestID(r.Context(), id)))
+
+		level := slog.LevelDebug
+		if sw.status >= http.StatusInternalServerError {
+			level = slog.LevelWarn
+		}
+		logger.Log(r.Context(), level, "http request",
+			RequestID, id,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", sw.status,
+			"duration", time.Since(start),
+		)
+	})
+}
@@ -0,0 +1,91 @@
+// Package logging : the structured (log/slog) logging shared by every NexNet component.
+//
+// Components take a *slog.Logger in their Opts and tag their records with the attribute keys
+// below, so that the output of several nodes can be told apart and filtered.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/PsychoPunkSage/NexNet/cryptography"
+)
+
+// Attribute keys.
+const (
+	NodeID     = "node_id"
+	ListenAddr = "listen_addr"
+	Peer       = "peer"
+	Key        = "key"
+	KeyHash    = "key_hash"
+	RequestID  = "request_id"
+)
+
+// RequestIDHeader : HTTP header carrying the request ID, in requests as well as responses.
+const RequestIDHeader = "X-Request-Id"
+
+type requestIDKey struct{}
+
+// New : logger writing to w, in "text" or "json" format.
+func New(w io.Writer, level slog.Leveler, format string) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// ParseLevel : parses "debug", "info", "warn" or "error" (case insensitive).
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return level, fmt.Errorf("unknown log level %q", s)
+	}
+	return level, nil
+}
+
+// OrDefault : logger, or slog.Default() when nil. Meant for NewX constructors.
+func OrDefault(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return slog.Default()
+	}
+	return logger
+}
+
+// NewRequestID : random ID for a request that doesn't carry one.
+func NewRequestID() string {
+	return cryptography.GenerateId()[:16]
+}
+
+// WithRequestID : ctx carrying the given request ID.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFrom : request ID carried by ctx, empty if none.
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// FromContext : logger tagged with the request ID carried by ctx, if any.
+func FromContext(ctx context.Context, logger *slog.Logger) *slog.Logger {
+	if id := RequestIDFrom(ctx); len(id) > 0 {
+		return logger.With(RequestID, id)
+	}
+	return logger
+}
+
+// SanitizeRequestID : keeps a client-provided request ID only if it is short and printable.
+func SanitizeRequestID(id string) string {
+	if len(id) == 0 || len(id) > 128 {
+		return ""
+	}
+	if strings.IndexFunc(id, func(r rune) bool { return r < 0x21 || r > 0x7e }) >= 0 {
+		return ""
+	}
+	return id
+}
@@ -0,0 +1,65 @@
+package logging
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLevel(t *testing.T) {
+	level, err := ParseLevel("WARN")
+	assert.Nil(t, err)
+	assert.Equal(t, slog.LevelWarn, level)
+
+	_, err = ParseLevel("verbose")
+	assert.NotNil(t, err)
+}
+
+func TestRecorderHonorsLevel(t *testing.T) {
+	r := NewRecorder()
+	logger := New(r, slog.LevelInfo, "json").With(NodeID, "n1")
+
+	logger.Debug("hidden")
+	logger.Info("shown", KeyHash, "abc")
+
+	entries := r.Entries()
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "shown", entries[0]["msg"])
+	assert.Equal(t, "n1", entries[0][NodeID])
+	assert.Len(t, r.Find(map[string]any{KeyHash: "abc"}), 1)
+}
+
+func TestMiddlewareRequestID(t *testing.T) {
+	r := NewRecorder()
+
+	var seen string
+	h := Middleware(r.Logger(), http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		seen = RequestIDFrom(req.Context())
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	// The client's ID is kept.
+	req := httptest.NewRequest(http.MethodGet, "/x", nil)
+	req.Header.Set(RequestIDHeader, "client-id")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, "client-id", seen)
+	assert.Equal(t, "client-id", w.Header().Get(RequestIDHeader))
+
+	entries := r.Find(map[string]any{RequestID: "client-id"})
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, float64(http.StatusTeapot), entries[0]["status"])
+	}
+
+	// An unusable one is replaced.
+	req = httptest.NewRequest(http.MethodGet, "/x", nil)
+	req.Header.Set(RequestIDHeader, "bad id\n")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.NotEqual(t, "bad id\n", seen)
+	assert.NotEmpty(t, seen)
+	assert.Equal(t, seen, w.Header().Get(RequestIDHeader))
+}
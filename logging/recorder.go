@@ -0,0 +1,70 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"sync"
+)
+
+// Recorder : in-memory log sink, used by tests to capture (and inspect) the logs of one node.
+type Recorder struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+func (r *Recorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.buf.Write(p)
+}
+
+// Logger : debug-level logger recording into r.
+func (r *Recorder) Logger() *slog.Logger {
+	return New(r, slog.LevelDebug, "json")
+}
+
+// Entries : every record so far, decoded. Attributes are keyed by name, next to "level" & "msg".
+func (r *Recorder) Entries() []map[string]any {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entries := []map[string]any{}
+	for _, line := range bytes.Split(r.buf.Bytes(), []byte("\n")) {
+		var e map[string]any
+		if json.Unmarshal(line, &e) == nil {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// Find : records holding every given attribute with the given value.
+func (r *Recorder) Find(attrs map[string]any) []map[string]any {
+	found := []map[string]any{}
+	for _, e := range r.Entries() {
+		match := true
+		for k, v := range attrs {
+			if e[k] != v {
+				match = false
+				break
+			}
+		}
+		if match {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+func (r *Recorder) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.buf.String()
+}
@@ -1,95 +1,100 @@
 package main
 
 import (
-	"bytes"
+	"flag"
 	"fmt"
-	"io"
-	"log"
-	"time"
-
-	"github.com/PsychoPunkSage/NexNet/cryptography"
-	"github.com/PsychoPunkSage/NexNet/p2p"
-	"github.com/PsychoPunkSage/NexNet/server"
-	"github.com/PsychoPunkSage/NexNet/storage"
+	"os"
+	"strings"
 )
 
-func OnPeer(peer p2p.Peer) error {
-	peer.Close()
-	fmt.Println("Doing some logic with the peer outside of TCPTransport")
-	return nil
+const usage = `NexNet - distributed encrypted file storage
+
+Usage:
+  fs <command> [flags] [args]
+
+Commands:
+  serve            start a node
+  put <key> [file] store a file (read from stdin when no file is given)
+  get <key>        fetch a file (written to stdout unless -o is given)
+  rm <key>         remove a file from the node and its peers
+  ls               list files stored on the node
+  stat <key>       show info about a stored file
+  peers            list the peers the node is connected to
+  usage [id]       show what owner IDs store on the node, and their quotas
+  bandwidth        show or change the bandwidth limits of the node
+  keygen           generate a keystore (node ID + encryption key)
+
+Run 'fs <command> -h' for the flags of a command.
+`
+
+type command struct {
+	name string
+	run  func(args []string) error
+}
+
+var commands = []command{
+	{"serve", runServe},
+	{"put", runPut},
+	{"get", runGet},
+	{"rm", runRemove},
+	{"ls", runList},
+	{"stat", runStat},
+	{"peers", runPeers},
+	{"usage", runUsage},
+	{"bandwidth", runBandwidth},
+	{"keygen", runKeygen},
 }
 
 func main() {
-	s := makeServer(":3000", "")
-	s1 := makeServer(":4000", ":3000")
-	s2 := makeServer(":5000", ":4000", ":3000")
-
-	go func() {
-		log.Fatal(s.Start())
-	}()
-	time.Sleep(1 * time.Second)
-
-	go func() {
-		log.Fatal(s1.Start())
-	}()
-	time.Sleep(1 * time.Second)
-
-	go s2.Start()
-	time.Sleep(1 * time.Second)
-
-	for i := 0; i < 10; i++ {
-		key := fmt.Sprintf("PrivateData%d", i)
-		payload := fmt.Sprintf("A very big data file %d", i)
-
-		// Make file
-		data := bytes.NewReader([]byte(payload))
-		s2.Store(key, data)
-		time.Sleep(5 * time.Millisecond)
-
-		// Remove that file
-		// if err := s2.Remove(key); err != nil {
-		// 	log.Fatal(err)
-		// }
-
-		// Get that file from other networks
-		r, err := s2.Get(key)
-		if err != nil {
-			log.Fatal(err)
-		}
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
 
-		b, err := io.ReadAll(r)
-		if err != nil {
-			log.Fatal(err)
-		}
-		fmt.Printf("Received: %s\n", b)
+	name := os.Args[1]
+	if name == "-h" || name == "--help" || name == "help" {
+		fmt.Print(usage)
+		return
 	}
 
-	if err := s2.Remove("PrivateData2"); err != nil {
-		fmt.Println("Unable to remove")
-		log.Fatal(err)
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+
+		if err := cmd.run(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "fs %s: %v\n", name, err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	select {}
+	fmt.Fprintf(os.Stderr, "fs: unknown command %q\n\n%s", name, usage)
+	os.Exit(2)
 }
 
-func makeServer(listenAddr string, nodes ...string) *server.FileServer {
-	tcpTransportOpts := p2p.TCPTransportOpts{
-		ListenAddr:    listenAddr,
-		HandshakeFunc: p2p.NOPHandshakeFunc,
-		Decoder:       p2p.DefaultDecoder{},
-	}
-	tcpTransport := p2p.NewTCPTransport(tcpTransportOpts)
-
-	fileServerOpts := server.FileServerOpts{
-		EncKey:            cryptography.NewEncryptionKey(),
-		StorageRoot:       listenAddr[1:] + "_network",
-		PathTransformFunc: storage.CASPathTransformFunc,
-		Transport:         tcpTransport,
-		BootstrapNodes:    nodes,
+// newFlagSet : flag set of a subcommand, with `synopsis` printed on -h.
+func newFlagSet(name, synopsis string) *flag.FlagSet {
+	fset := flag.NewFlagSet(name, flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "Usage: fs %s %s\n", name, synopsis)
+		fset.PrintDefaults()
 	}
+	return fset
+}
+
+// listFlag : string list flag, accepting both repeated flags and comma separated values.
+type listFlag []string
 
-	s := server.NewFileServer(fileServerOpts)
-	tcpTransport.OnPeer = s.OnPeer
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
 
-	return s
+func (l *listFlag) Set(v string) error {
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			*l = append(*l, item)
+		}
+	}
+	return nil
 }
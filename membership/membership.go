@@ -0,0 +1,551 @@
+// Package membership tells which nodes of a cluster are alive, suspect or dead, after SWIM
+// ("Scalable Weakly-consistent Infection-style Process Group Membership Protocol", Das et al.).
+//
+// Every probe interval a node pings one member, round robin. Without an ack in time, it asks a
+// few other members to ping it too (indirect pings, in case only the direct path is broken);
+// still nothing by the end of the interval and the member is suspected. A suspect member that
+// doesn't refute the suspicion in time is declared dead. A member refutes by raising its
+// incarnation number, which outranks what the others said about its previous incarnation.
+// Changes are spread by piggybacking them on pings and acks.
+//
+// The package only holds the protocol: messages are carried by the caller (see Opts.Send and
+// Membership.Handle), e.g. over the connections of a server.FileServer.
+package membership
+
+import (
+	"errors"
+	"log/slog"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/PsychoPunkSage/NexNet/clock"
+	"github.com/PsychoPunkSage/NexNet/logging"
+)
+
+// ErrBusy : returned by Opts.Send when the member can't take the message now but is known to be
+// alive, e.g. while a transfer is in progress with it. A probe then counts as acked.
+var ErrBusy = errors.New("member busy")
+
+type State int
+
+const (
+	Alive State = iota
+	Suspect
+	Dead
+)
+
+func (s State) String() string {
+	switch s {
+	case Alive:
+		return "alive"
+	case Suspect:
+		return "suspect"
+	case Dead:
+		return "dead"
+	}
+	return "unknown"
+}
+
+// Member : a node of the cluster, as seen by the local one.
+type Member struct {
+	ID string
+	// Address the node listens on.
+	Addr        string
+	State       State
+	Incarnation uint64
+	// When State was entered.
+	Since time.Time
+}
+
+// Update : what a node says about a member; spread by gossip.
+type Update struct {
+	ID          string
+	Addr        string
+	State       State
+	Incarnation uint64
+}
+
+type Kind int
+
+const (
+	// Ping : asks From for an Ack. Seq 0 is a greeting, not acked.
+	Ping Kind = iota
+	// Ack : answers the Ping Seq; on behalf of Target, for an indirect ping.
+	Ack
+	// PingReq : asks to ping Target, and forward its Ack.
+	PingReq
+)
+
+// Message : a message of the protocol, between two members.
+type Message struct {
+	Kind Kind
+	Seq  uint64
+	// ID of the sender.
+	From   string
+	Target string
+	// Piggybacked gossip.
+	Updates []Update
+}
+
+type Opts struct {
+	ID string
+	// Address the local node listens on, told to the other members.
+	Addr string
+	// A member is pinged every interval. Defaults to 1s.
+	ProbeInterval time.Duration
+	// How long a ping waits for its ack before indirect pings are sent. Defaults to ProbeInterval/3.
+	ProbeTimeout time.Duration
+	// Members asked to ping a member that didn't ack. Defaults to 3.
+	IndirectChecks int
+	// How long a suspect member has to refute before it's declared dead. Defaults to 5
+	// probe intervals.
+	SuspicionTimeout time.Duration
+	// Updates piggybacked on a message at most. Defaults to 8.
+	MaxUpdates int
+	// Sends msg to the member of ID to; an error means it's unreachable, but for ErrBusy. Must not
+	// block for long: it is called while probing and by Handle.
+	Send func(to string, msg Message) error
+	// Called (outside of any lock) when a member changes state, not for the local node.
+	OnChange func(Member)
+	// Defaults to slog.Default().
+	Logger *slog.Logger
+	// Defaults to clock.Real.
+	Clock clock.Clock
+}
+
+// Membership : the local node's view of the cluster.
+type Membership struct {
+	Opts
+
+	log *slog.Logger
+
+	mu          sync.Mutex
+	incarnation uint64
+	members     map[string]*Member
+	// Order members are probed in, reshuffled every round.
+	probeOrder []string
+	probeNext  int
+	seq        uint64
+	// Acks awaited by the probe in progress, by sequence number.
+	acks map[uint64]chan struct{}
+	// Indirect pings sent for other members: our sequence number -> requester & theirs.
+	relays     map[uint64]relay
+	broadcasts []*broadcast
+	// State changes to report with OnChange once mu is released.
+	changes []Member
+	rand    *rand.Rand
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+	wg        sync.WaitGroup
+}
+
+type relay struct {
+	requester string
+	seq       uint64
+	at        time.Time
+}
+
+type broadcast struct {
+	Update
+	transmits int
+}
+
+func New(opts Opts) *Membership {
+	if opts.ProbeInterval <= 0 {
+		opts.ProbeInterval = time.Second
+	}
+	if opts.ProbeTimeout <= 0 {
+		opts.ProbeTimeout = opts.ProbeInterval / 3
+	}
+	if opts.IndirectChecks <= 0 {
+		opts.IndirectChecks = 3
+	}
+	if opts.SuspicionTimeout <= 0 {
+		opts.SuspicionTimeout = 5 * opts.ProbeInterval
+	}
+	if opts.MaxUpdates <= 0 {
+		opts.MaxUpdates = 8
+	}
+	if opts.OnChange == nil {
+		opts.OnChange = func(Member) {}
+	}
+	opts.Clock = clock.OrReal(opts.Clock)
+
+	m := &Membership{
+		Opts: opts,
+		log:  logging.OrDefault(opts.Logger).With("component", "membership", logging.NodeID, opts.ID),
+		// Above what the cluster may remember of a previous run of the node.
+		incarnation: uint64(opts.Clock.Now().UnixNano()),
+		members:     make(map[string]*Member),
+		acks:        make(map[uint64]chan struct{}),
+		relays:      make(map[uint64]relay),
+		rand:        rand.New(rand.NewSource(opts.Clock.Now().UnixNano())),
+		closeCh:     make(chan struct{}),
+	}
+	return m
+}
+
+// Start : starts probing, in the background.
+func (m *Membership) Start() {
+	m.wg.Add(1)
+	go m.probeLoop()
+}
+
+// Close : stops probing.
+func (m *Membership) Close() {
+	m.closeOnce.Do(func() {
+		close(m.closeCh)
+		m.wg.Wait()
+	})
+}
+
+// Members : the other members known, alive, suspect or lately dead, by ID.
+func (m *Membership) Members() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	members := make([]Member, 0, len(m.members))
+	for _, member := range m.members {
+		members = append(members, *member)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	return members
+}
+
+// Member : the member of the given ID; false if unknown.
+func (m *Membership) Member(id string) (Member, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	member, ok := m.members[id]
+	if !ok {
+		return Member{}, false
+	}
+	return *member, true
+}
+
+// Greeting : a message to send to a newly connected node, for it to learn of the local one and of
+// the members known.
+func (m *Membership) Greeting() Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msg := m.message(Ping, 0, "")
+	ids := make([]string, 0, len(m.members))
+	for id := range m.members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		member := m.members[id]
+		if member.State != Dead && len(msg.Updates) <= 2*m.MaxUpdates {
+			msg.Updates = append(msg.Updates, Update{ID: id, Addr: member.Addr, State: member.State, Incarnation: member.Incarnation})
+		}
+	}
+	return msg
+}
+
+// Handle : processes a message received from another member.
+func (m *Membership) Handle(msg Message) {
+	m.mu.Lock()
+	for _, u := range msg.Updates {
+		m.apply(u)
+	}
+
+	var replies []func()
+	switch msg.Kind {
+	case Ping:
+		if msg.Seq == 0 {
+			break
+		}
+		reply := m.message(Ack, msg.Seq, "")
+		replies = append(replies, func() { m.send(msg.From, reply) })
+
+	case Ack:
+		if ack, ok := m.acks[msg.Seq]; ok {
+			delete(m.acks, msg.Seq)
+			close(ack)
+		}
+		if r, ok := m.relays[msg.Seq]; ok {
+			delete(m.relays, msg.Seq)
+			reply := m.message(Ack, r.seq, msg.From)
+			replies = append(replies, func() { m.send(r.requester, reply) })
+		}
+
+	case PingReq:
+		m.seq++
+		m.relays[m.seq] = relay{requester: msg.From, seq: msg.Seq, at: m.Clock.Now()}
+		ping := m.message(Ping, m.seq, "")
+		replies = append(replies, func() { m.send(msg.Target, ping) })
+	}
+	changes := m.takeChanges()
+	m.mu.Unlock()
+
+	m.report(changes)
+	for _, reply := range replies {
+		reply()
+	}
+}
+
+func (m *Membership) probeLoop() {
+	defer m.wg.Done()
+
+	for {
+		start := m.Clock.Now()
+		m.probe()
+		m.expire()
+
+		select {
+		case <-m.Clock.After(m.ProbeInterval - m.Clock.Since(start)):
+		case <-m.closeCh:
+			return
+		}
+	}
+}
+
+// probe : pings the next member, suspecting it if neither it nor the members asked to ping it
+// ack before the end of the interval.
+func (m *Membership) probe() {
+	m.mu.Lock()
+	target, ok := m.nextTarget()
+	if !ok {
+		m.mu.Unlock()
+		return
+	}
+	m.seq++
+	seq := m.seq
+	ack := make(chan struct{})
+	m.acks[seq] = ack
+	ping := m.message(Ping, seq, "")
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		delete(m.acks, seq)
+		m.mu.Unlock()
+	}()
+
+	deadline := m.Clock.After(m.ProbeInterval)
+	timeout := m.Clock.After(m.ProbeTimeout)
+	if err := m.Send(target.ID, ping); errors.Is(err, ErrBusy) {
+		return
+	} else if err != nil {
+		// Straight to the indirect pings.
+		timeout = nil
+		m.indirectPing(target.ID, seq)
+	}
+
+	for {
+		select {
+		case <-ack:
+			return
+		case <-timeout:
+			timeout = nil
+			m.indirectPing(target.ID, seq)
+		case <-deadline:
+			m.suspect(target.ID)
+			return
+		case <-m.closeCh:
+			return
+		}
+	}
+}
+
+// indirectPing : asks a few other members to ping id for the probe seq.
+func (m *Membership) indirectPing(id string, seq uint64) {
+	m.mu.Lock()
+	candidates := []string{}
+	for _, member := range m.members {
+		if member.ID != id && member.State == Alive {
+			candidates = append(candidates, member.ID)
+		}
+	}
+	sort.Strings(candidates)
+	m.rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	if len(candidates) > m.IndirectChecks {
+		candidates = candidates[:m.IndirectChecks]
+	}
+	req := m.message(PingReq, seq, id)
+	m.mu.Unlock()
+
+	for _, via := range candidates {
+		m.send(via, req)
+	}
+}
+
+// nextTarget : next member to probe, round robin over the members not dead. Must hold mu.
+func (m *Membership) nextTarget() (Member, bool) {
+	for tries := 0; tries < 2; tries++ {
+		for m.probeNext < len(m.probeOrder) {
+			id := m.probeOrder[m.probeNext]
+			m.probeNext++
+			if member, ok := m.members[id]; ok && member.State != Dead {
+				return *member, true
+			}
+		}
+
+		// New round.
+		m.probeOrder = m.probeOrder[:0]
+		for id, member := range m.members {
+			if member.State != Dead {
+				m.probeOrder = append(m.probeOrder, id)
+			}
+		}
+		sort.Strings(m.probeOrder)
+		m.rand.Shuffle(len(m.probeOrder), func(i, j int) {
+			m.probeOrder[i], m.probeOrder[j] = m.probeOrder[j], m.probeOrder[i]
+		})
+		m.probeNext = 0
+	}
+	return Member{}, false
+}
+
+func (m *Membership) suspect(id string) {
+	m.mu.Lock()
+	if member, ok := m.members[id]; ok && member.State == Alive {
+		m.log.Info("member suspected", "member", id, logging.Peer, member.Addr)
+		m.apply(Update{ID: id, Addr: member.Addr, State: Suspect, Incarnation: member.Incarnation})
+	}
+	changes := m.takeChanges()
+	m.mu.Unlock()
+
+	m.report(changes)
+}
+
+// expire : declares dead the members suspected for longer than SuspicionTimeout, forgets the dead
+// ones once word of their death has had time to spread, and the indirect pings left unanswered.
+func (m *Membership) expire() {
+	m.mu.Lock()
+	now := m.Clock.Now()
+	for seq, r := range m.relays {
+		if now.Sub(r.at) >= m.ProbeInterval {
+			delete(m.relays, seq)
+		}
+	}
+	for _, member := range m.members {
+		if member.State == Dead && now.Sub(member.Since) >= 10*m.SuspicionTimeout {
+			delete(m.members, member.ID)
+			continue
+		}
+		if member.State == Suspect && now.Sub(member.Since) >= m.SuspicionTimeout {
+			m.log.Warn("member declared dead", "member", member.ID, logging.Peer, member.Addr)
+			m.apply(Update{ID: member.ID, Addr: member.Addr, State: Dead, Incarnation: member.Incarnation})
+		}
+	}
+	changes := m.takeChanges()
+	m.mu.Unlock()
+
+	m.report(changes)
+}
+
+// apply : merges what u tells into the local view, queueing it for gossip if news. Must hold mu.
+func (m *Membership) apply(u Update) {
+	if u.ID == m.ID {
+		// The local node is alive whatever others think: refute, with an incarnation above theirs.
+		if u.State != Alive && u.Incarnation >= m.incarnation {
+			m.incarnation = u.Incarnation + 1
+			// Carried by every message.
+			m.log.Info("refuting suspicion", "said", u.State.String(), "incarnation", m.incarnation)
+		}
+		return
+	}
+
+	member, known := m.members[u.ID]
+	if known && !overrides(u, *member) {
+		return
+	}
+	if !known {
+		member = &Member{ID: u.ID}
+		m.members[u.ID] = member
+	}
+
+	changed := !known || member.State != u.State
+	if len(u.Addr) > 0 {
+		member.Addr = u.Addr
+	}
+	member.Incarnation = u.Incarnation
+	if changed {
+		member.State = u.State
+		member.Since = m.Clock.Now()
+		m.changes = append(m.changes, *member)
+	}
+	m.queue(Update{ID: member.ID, Addr: member.Addr, State: member.State, Incarnation: member.Incarnation})
+}
+
+// overrides : whether u is newer than what is known of member (the SWIM precedence rules).
+func overrides(u Update, member Member) bool {
+	switch u.State {
+	case Alive:
+		return u.Incarnation > member.Incarnation
+	case Suspect:
+		return u.Incarnation > member.Incarnation || (u.Incarnation == member.Incarnation && member.State == Alive)
+	case Dead:
+		return u.Incarnation > member.Incarnation || (u.Incarnation == member.Incarnation && member.State != Dead)
+	}
+	return false
+}
+
+func (m *Membership) self() Update {
+	return Update{ID: m.ID, Addr: m.Addr, State: Alive, Incarnation: m.incarnation}
+}
+
+// queue : has u gossiped, replacing any update about the same member. Must hold mu.
+func (m *Membership) queue(u Update) {
+	for i, b := range m.broadcasts {
+		if b.ID == u.ID {
+			m.broadcasts = append(m.broadcasts[:i], m.broadcasts[i+1:]...)
+			break
+		}
+	}
+	m.broadcasts = append(m.broadcasts, &broadcast{Update: u})
+}
+
+// message : a message carrying the local node's own state, then the updates gossiped least so
+// far. Must hold mu.
+func (m *Membership) message(kind Kind, seq uint64, target string) Message {
+	// Enough for an update to reach every member with high probability.
+	limit := 3 * int(math.Ceil(math.Log2(float64(len(m.members)+2))))
+
+	sort.SliceStable(m.broadcasts, func(i, j int) bool { return m.broadcasts[i].transmits < m.broadcasts[j].transmits })
+	updates := []Update{m.self()}
+	for _, b := range m.broadcasts {
+		if len(updates) > m.MaxUpdates {
+			break
+		}
+		updates = append(updates, b.Update)
+		b.transmits++
+	}
+
+	kept := m.broadcasts[:0]
+	for _, b := range m.broadcasts {
+		if b.transmits < limit {
+			kept = append(kept, b)
+		}
+	}
+	m.broadcasts = kept
+
+	return Message{Kind: kind, Seq: seq, From: m.ID, Target: target, Updates: updates}
+}
+
+func (m *Membership) send(to string, msg Message) {
+	if err := m.Send(to, msg); err != nil {
+		m.log.Debug("membership message not sent", "member", to, "err", err)
+	}
+}
+
+// takeChanges : must hold mu.
+func (m *Membership) takeChanges() []Member {
+	changes := m.changes
+	m.changes = nil
+	return changes
+}
+
+func (m *Membership) report(changes []Member) {
+	for _, member := range changes {
+		m.OnChange(member)
+	}
+}
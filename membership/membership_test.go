@@ -0,0 +1,181 @@
+package membership
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// network : delivers the messages of its members, but over the links cut.
+type network struct {
+	mu      sync.Mutex
+	members map[string]*Membership
+	cut     map[[2]string]bool
+}
+
+func newNetwork() *network {
+	return &network{members: make(map[string]*Membership), cut: make(map[[2]string]bool)}
+}
+
+func (n *network) add(t *testing.T, id string, opts Opts) *Membership {
+	opts.ID = id
+	opts.Addr = id + ":3000"
+	if opts.ProbeInterval == 0 {
+		opts.ProbeInterval = 20 * time.Millisecond
+	}
+	opts.Send = func(to string, msg Message) error {
+		n.mu.Lock()
+		dst, ok := n.members[to]
+		cut := n.cut[[2]string{id, to}] || n.cut[[2]string{to, id}]
+		n.mu.Unlock()
+		if !ok || cut {
+			return errors.New("unreachable")
+		}
+		// Delivered asynchronously, like over a connection.
+		go dst.Handle(msg)
+		return nil
+	}
+
+	m := New(opts)
+	n.mu.Lock()
+	n.members[id] = m
+	n.mu.Unlock()
+	t.Cleanup(m.Close)
+	return m
+}
+
+func (n *network) cutLink(a, b string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.cut[[2]string{a, b}] = true
+}
+
+// isolate : cuts every link of id.
+func (n *network) isolate(id string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for other := range n.members {
+		n.cut[[2]string{id, other}] = true
+	}
+}
+
+// greet : has b learn of a, as when a connects to it.
+func greet(a, b *Membership) {
+	b.Handle(a.Greeting())
+}
+
+func state(m *Membership, id string) State {
+	member, ok := m.Member(id)
+	if !ok {
+		return -1
+	}
+	return member.State
+}
+
+func newCluster(t *testing.T, n int, opts Opts) (*network, []*Membership) {
+	net := newNetwork()
+	members := []*Membership{}
+	for i := 0; i < n; i++ {
+		members = append(members, net.add(t, fmt.Sprintf("node-%d", i), opts))
+	}
+	// Everyone greets the first node only: the rest is gossip.
+	for _, m := range members[1:] {
+		greet(m, members[0])
+		greet(members[0], m)
+	}
+	for _, m := range members {
+		m.Start()
+	}
+	return net, members
+}
+
+func TestMembershipConverges(t *testing.T) {
+	_, members := newCluster(t, 5, Opts{})
+
+	assert.Eventually(t, func() bool {
+		for _, m := range members {
+			if len(m.Members()) != len(members)-1 {
+				return false
+			}
+			for _, member := range m.Members() {
+				if member.State != Alive {
+					return false
+				}
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	member, _ := members[1].Member("node-2")
+	assert.Equal(t, "node-2:3000", member.Addr)
+}
+
+func TestMembershipDetectsFailure(t *testing.T) {
+	var mu sync.Mutex
+	changes := []string{}
+	net, members := newCluster(t, 4, Opts{
+		SuspicionTimeout: 100 * time.Millisecond,
+		OnChange: func(m Member) {
+			mu.Lock()
+			defer mu.Unlock()
+			changes = append(changes, m.ID+" "+m.State.String())
+		},
+	})
+	assert.Eventually(t, func() bool { return len(members[3].Members()) == 3 }, 5*time.Second, 10*time.Millisecond)
+
+	net.isolate("node-3")
+	members[3].Close()
+	for _, m := range members[:3] {
+		m := m
+		assert.Eventually(t, func() bool { return state(m, "node-3") == Dead }, 5*time.Second, 10*time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Contains(t, changes, "node-3 suspect")
+	assert.Contains(t, changes, "node-3 dead")
+}
+
+func TestMembershipIndirectPing(t *testing.T) {
+	net, members := newCluster(t, 3, Opts{SuspicionTimeout: 50 * time.Millisecond})
+	assert.Eventually(t, func() bool { return len(members[1].Members()) == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	// node-0 and node-1 can't talk to each other, but both can to node-2.
+	net.cutLink("node-0", "node-1")
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, Alive, state(members[0], "node-1"))
+	assert.Equal(t, Alive, state(members[1], "node-0"))
+}
+
+func TestMembershipRefutesSuspicion(t *testing.T) {
+	_, members := newCluster(t, 3, Opts{SuspicionTimeout: time.Hour})
+	assert.Eventually(t, func() bool { return len(members[2].Members()) == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	before, _ := members[1].Member("node-0")
+	// node-1 wrongly suspects node-0.
+	members[1].suspect("node-0")
+	assert.Equal(t, Suspect, state(members[1], "node-0"))
+
+	// node-0 hears of it, and outbids it.
+	assert.Eventually(t, func() bool {
+		member, _ := members[1].Member("node-0")
+		return member.State == Alive && member.Incarnation > before.Incarnation
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestOverrides(t *testing.T) {
+	alive := Member{ID: "a", State: Alive, Incarnation: 2}
+	suspect := Member{ID: "a", State: Suspect, Incarnation: 2}
+
+	assert.False(t, overrides(Update{ID: "a", State: Alive, Incarnation: 2}, suspect))
+	assert.True(t, overrides(Update{ID: "a", State: Alive, Incarnation: 3}, suspect))
+	assert.True(t, overrides(Update{ID: "a", State: Suspect, Incarnation: 2}, alive))
+	assert.False(t, overrides(Update{ID: "a", State: Suspect, Incarnation: 1}, alive))
+	assert.False(t, overrides(Update{ID: "a", State: Suspect, Incarnation: 2}, suspect))
+	assert.True(t, overrides(Update{ID: "a", State: Dead, Incarnation: 2}, suspect))
+	assert.False(t, overrides(Update{ID: "a", State: Dead, Incarnation: 1}, alive))
+}
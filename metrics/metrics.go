@@ -0,0 +1,210 @@
+// Package metrics : Prometheus implementation of the instrumentation hooks of p2p, storage and
+// server, exported in the Prometheus text format.
+package metrics
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/PsychoPunkSage/NexNet/p2p"
+	"github.com/PsychoPunkSage/NexNet/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "nexnet"
+
+// Path the metrics are served on.
+const Path = "/metrics"
+
+var (
+	_ p2p.Metrics    = (*Metrics)(nil)
+	_ server.Metrics = (*Metrics)(nil)
+)
+
+// Metrics : the metrics of one node, in a registry of their own.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	bytesIn           *prometheus.CounterVec
+	bytesOut          *prometheus.CounterVec
+	activeStreams     prometheus.Gauge
+	handshakeFailures prometheus.Counter
+	rpcs              *prometheus.CounterVec
+	operations        *prometheus.HistogramVec
+	replicationLag    prometheus.Histogram
+	scrubbed          *prometheus.CounterVec
+	diskUsage         *prometheus.GaugeVec
+	objectCount       *prometheus.GaugeVec
+	quotaExceeded     *prometheus.CounterVec
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+
+		bytesIn: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "p2p",
+			Name:      "received_bytes_total",
+			Help:      "Bytes received from each connected peer.",
+		}, []string{"peer"}),
+		bytesOut: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "p2p",
+			Name:      "sent_bytes_total",
+			Help:      "Bytes sent to each connected peer.",
+		}, []string{"peer"}),
+		activeStreams: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "p2p",
+			Name:      "active_streams",
+			Help:      "Incoming streams currently being consumed.",
+		}),
+		handshakeFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "p2p",
+			Name:      "handshake_failures_total",
+			Help:      "Connections dropped because the handshake failed.",
+		}),
+		rpcs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "server",
+			Name:      "rpcs_total",
+			Help:      "Messages received from peers, by type and outcome.",
+		}, []string{"type", "outcome"}),
+		operations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "server",
+			Name:      "operation_duration_seconds",
+			Help:      "Latency of Store, Get and Remove, by outcome.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+		}, []string{"op", "outcome"}),
+		replicationLag: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "server",
+			Name:      "replication_lag_seconds",
+			Help:      "Time from a file being written locally to it being streamed to all of its replicas.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+		}),
+		scrubbed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "server",
+			Name:      "scrubbed_files_total",
+			Help:      "Files verified by the scrubber, by outcome.",
+		}, []string{"outcome"}),
+		diskUsage: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "storage",
+			Name:      "disk_usage_bytes",
+			Help:      "Bytes taken on disk by the objects of each owner ID.",
+		}, []string{"owner_id"}),
+		objectCount: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "storage",
+			Name:      "objects",
+			Help:      "Objects stored under each owner ID.",
+		}, []string{"owner_id"}),
+		quotaExceeded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "storage",
+			Name:      "quota_exceeded_total",
+			Help:      "Owner IDs going over their soft quota, and writes refused for their hard one.",
+		}, []string{"owner_id", "quota"}),
+	}
+
+	m.registry.MustRegister(
+		m.bytesIn,
+		m.bytesOut,
+		m.activeStreams,
+		m.handshakeFailures,
+		m.rpcs,
+		m.operations,
+		m.replicationLag,
+		m.scrubbed,
+		m.diskUsage,
+		m.objectCount,
+		m.quotaExceeded,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// Handler : serves the metrics in the Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// ListenAndServe : serves the metrics on addr, under Path.
+func (m *Metrics) ListenAndServe(addr string, logger *slog.Logger) error {
+	mux := http.NewServeMux()
+	mux.Handle(Path, m.Handler())
+
+	logger.Info("metrics listening", "addr", addr, "path", Path)
+	return http.ListenAndServe(addr, mux)
+}
+
+func (m *Metrics) AddBytesIn(peer string, n int) {
+	m.bytesIn.WithLabelValues(peer).Add(float64(n))
+}
+
+func (m *Metrics) AddBytesOut(peer string, n int) {
+	m.bytesOut.WithLabelValues(peer).Add(float64(n))
+}
+
+func (m *Metrics) StreamOpened() {
+	m.activeStreams.Inc()
+}
+
+func (m *Metrics) StreamClosed() {
+	m.activeStreams.Dec()
+}
+
+func (m *Metrics) HandshakeFailed() {
+	m.handshakeFailures.Inc()
+}
+
+// ForgetPeer : drops the per-peer series, so that churn doesn't grow them forever.
+func (m *Metrics) ForgetPeer(peer string) {
+	m.bytesIn.DeleteLabelValues(peer)
+	m.bytesOut.DeleteLabelValues(peer)
+}
+
+func (m *Metrics) SetDiskUsage(id string, bytes int64) {
+	m.diskUsage.WithLabelValues(id).Set(float64(bytes))
+}
+
+func (m *Metrics) SetObjectCount(id string, n int64) {
+	m.objectCount.WithLabelValues(id).Set(float64(n))
+}
+
+func (m *Metrics) CountQuotaExceeded(id, quota string) {
+	m.quotaExceeded.WithLabelValues(id, quota).Inc()
+}
+
+func (m *Metrics) ObserveOperation(op string, d time.Duration, err error) {
+	m.operations.WithLabelValues(op, outcome(err)).Observe(d.Seconds())
+}
+
+func (m *Metrics) CountRPC(msgType, outcome string) {
+	m.rpcs.WithLabelValues(msgType, outcome).Inc()
+}
+
+func (m *Metrics) ObserveReplicationLag(d time.Duration) {
+	m.replicationLag.Observe(d.Seconds())
+}
+
+func (m *Metrics) CountScrubbed(outcome string) {
+	m.scrubbed.WithLabelValues(outcome).Inc()
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
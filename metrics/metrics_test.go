@@ -0,0 +1,92 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PsychoPunkSage/NexNet/cryptography"
+	"github.com/PsychoPunkSage/NexNet/p2p"
+	"github.com/PsychoPunkSage/NexNet/server"
+	"github.com/PsychoPunkSage/NexNet/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func scrape(t *testing.T, m *Metrics) string {
+	ts := httptest.NewServer(m.Handler())
+	defer ts.Close()
+
+	resp, err := ts.Client().Get(ts.URL)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	return string(b)
+}
+
+func TestMetricsExposition(t *testing.T) {
+	m := New()
+
+	m.AddBytesIn("10.0.0.1:3000", 100)
+	m.AddBytesOut("10.0.0.1:3000", 42)
+	m.StreamOpened()
+	m.HandshakeFailed()
+	m.CountRPC("get_file", "error")
+	m.ObserveOperation("store", 3*time.Millisecond, nil)
+	m.ObserveOperation("get", time.Millisecond, errors.New("boom"))
+	m.ObserveReplicationLag(time.Millisecond)
+	m.CountScrubbed("repaired")
+	m.SetDiskUsage("owner", 1234)
+	m.SetObjectCount("owner", 3)
+	m.CountQuotaExceeded("owner", "hard")
+
+	out := scrape(t, m)
+	for _, want := range []string{
+		`nexnet_p2p_received_bytes_total{peer="10.0.0.1:3000"} 100`,
+		`nexnet_p2p_sent_bytes_total{peer="10.0.0.1:3000"} 42`,
+		`nexnet_p2p_active_streams 1`,
+		`nexnet_p2p_handshake_failures_total 1`,
+		`nexnet_server_rpcs_total{outcome="error",type="get_file"} 1`,
+		`nexnet_server_operation_duration_seconds_count{op="store",outcome="ok"} 1`,
+		`nexnet_server_operation_duration_seconds_count{op="get",outcome="error"} 1`,
+		`nexnet_server_replication_lag_seconds_count 1`,
+		`nexnet_server_scrubbed_files_total{outcome="repaired"} 1`,
+		`nexnet_storage_disk_usage_bytes{owner_id="owner"} 1234`,
+		`nexnet_storage_objects{owner_id="owner"} 3`,
+		`nexnet_storage_quota_exceeded_total{owner_id="owner",quota="hard"} 1`,
+		`go_goroutines`,
+	} {
+		assert.Contains(t, out, want)
+	}
+
+	// Per-peer series go away with the peer.
+	m.ForgetPeer("10.0.0.1:3000")
+	assert.NotContains(t, scrape(t, m), `peer="10.0.0.1:3000"`)
+}
+
+func TestFileServerInstrumentation(t *testing.T) {
+	m := New()
+	s := server.NewFileServer(server.FileServerOpts{
+		EncKey:            cryptography.NewEncryptionKey(),
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: storage.CASPathTransformFunc,
+		Transport: p2p.NewTCPTransport(p2p.TCPTransportOpts{
+			ListenAddr:    ":0",
+			HandshakeFunc: p2p.NOPHandshakeFunc,
+			Decoder:       p2p.DefaultDecoder{},
+			Metrics:       m,
+		}),
+		Metrics: m,
+	})
+
+	assert.Nil(t, s.Store(context.Background(), "key", strings.NewReader("twelve bytes")))
+
+	out := scrape(t, m)
+	assert.Contains(t, out, `nexnet_server_operation_duration_seconds_count{op="store",outcome="ok"} 1`)
+	assert.Contains(t, out, `nexnet_storage_disk_usage_bytes{owner_id="`+s.ID+`"} 12`)
+}
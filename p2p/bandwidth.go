@@ -0,0 +1,169 @@
+package p2p
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Priority : of a transfer, when bandwidth is limited.
+type Priority int
+
+const (
+	// Foreground : transfers a client waits for (Get, Store).
+	Foreground Priority = iota
+	// Background : transfers nobody waits for (repair, rebalancing); they only get the bandwidth
+	// that foreground ones leave.
+	Background
+)
+
+// Rate : bytes per second, in each direction; 0 means unlimited.
+type Rate struct {
+	In, Out int64
+}
+
+type BandwidthLimits struct {
+	// Over all the peers.
+	Global  Rate
+	PerPeer Rate
+}
+
+// PriorityPeer : a Peer whose streams are scheduled by priority when bandwidth is limited.
+type PriorityPeer interface {
+	// OpenStreamPriority : OpenStream, at priority p.
+	OpenStreamPriority(p Priority) (io.WriteCloser, error)
+	// SetReadPriority : priority of the incoming stream, until CloseStream.
+	SetReadPriority(p Priority)
+}
+
+type direction int
+
+const (
+	inbound direction = iota
+	outbound
+)
+
+// Streams wait for the bandwidth of that many bytes at most at a time, so that transfers interleave.
+const bandwidthChunk = 32 << 10
+
+// How long a wait for bandwidth sleeps at most before checking again, e.g. for new limits.
+const maxBandwidthWait = 100 * time.Millisecond
+
+// Bandwidth : token-bucket limits on the streams of transports, global and per peer, in each
+// direction. Buckets hold up to one second of their rate. A transfer may overdraw a bucket; the
+// next ones wait for it to refill. Background transfers wait while foreground ones do. Safe for
+// concurrent use, and shared by every transport of a node.
+type Bandwidth struct {
+	mu     sync.Mutex
+	limits BandwidthLimits
+	global [2]*bucket
+	// By remote address.
+	peers map[string]*[2]*bucket
+}
+
+type bucket struct {
+	rate   int64
+	tokens float64
+	last   time.Time
+	// Foreground transfers waiting for tokens.
+	foreground int
+}
+
+func NewBandwidth(limits BandwidthLimits) *Bandwidth {
+	b := &Bandwidth{peers: make(map[string]*[2]*bucket)}
+	b.global = [2]*bucket{newBucket(limits.Global.In), newBucket(limits.Global.Out)}
+	b.limits = limits
+	return b
+}
+
+func newBucket(rate int64) *bucket {
+	return &bucket{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+func (b *Bandwidth) Limits() BandwidthLimits {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.limits
+}
+
+// SetLimits : applies to the transfers in progress too.
+func (b *Bandwidth) SetLimits(limits BandwidthLimits) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.limits = limits
+	b.global[inbound].setRate(limits.Global.In)
+	b.global[outbound].setRate(limits.Global.Out)
+	for _, buckets := range b.peers {
+		buckets[inbound].setRate(limits.PerPeer.In)
+		buckets[outbound].setRate(limits.PerPeer.Out)
+	}
+}
+
+// wait : blocks until n bytes can go to/come from peer.
+func (b *Bandwidth) wait(peer string, dir direction, p Priority, n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	buckets, ok := b.peers[peer]
+	if !ok {
+		buckets = &[2]*bucket{newBucket(b.limits.PerPeer.In), newBucket(b.limits.PerPeer.Out)}
+		b.peers[peer] = buckets
+	}
+	b.take(buckets[dir], p, n)
+	b.take(b.global[dir], p, n)
+}
+
+// take : must hold mu, released while sleeping.
+func (b *Bandwidth) take(bk *bucket, p Priority, n int) {
+	if p == Foreground {
+		bk.foreground++
+		defer func() { bk.foreground-- }()
+	}
+
+	for {
+		if bk.rate <= 0 {
+			return
+		}
+		bk.refill(time.Now())
+		if bk.tokens > 0 && (p == Foreground || bk.foreground == 0) {
+			bk.tokens -= float64(n)
+			return
+		}
+
+		wait := maxBandwidthWait
+		if bk.tokens <= 0 {
+			wait = min(wait, time.Duration(-bk.tokens/float64(bk.rate)*float64(time.Second))+time.Millisecond)
+		}
+		b.mu.Unlock()
+		time.Sleep(wait)
+		b.mu.Lock()
+	}
+}
+
+// forget : drops the buckets of a peer gone.
+func (b *Bandwidth) forget(peer string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.peers, peer)
+}
+
+func (bk *bucket) refill(now time.Time) {
+	bk.tokens = min(bk.tokens+float64(bk.rate)*now.Sub(bk.last).Seconds(), float64(bk.rate))
+	bk.last = now
+}
+
+func (bk *bucket) setRate(rate int64) {
+	now := time.Now()
+	if bk.rate > 0 {
+		bk.refill(now)
+	} else {
+		// Was unlimited: starts full.
+		bk.tokens = float64(rate)
+	}
+	bk.rate = rate
+	bk.tokens = min(bk.tokens, float64(rate))
+	bk.last = now
+}
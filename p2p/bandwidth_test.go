@@ -0,0 +1,115 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testRate = 64 << 10
+
+func TestBandwidthRate(t *testing.T) {
+	bw := NewBandwidth(BandwidthLimits{PerPeer: Rate{Out: testRate}})
+
+	start := time.Now()
+	// The bucket starts full, then is overdrawn.
+	bw.wait("node-a", outbound, Foreground, testRate)
+	bw.wait("node-a", outbound, Foreground, testRate/2)
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+
+	// Other peers and directions are unlimited.
+	bw.wait("node-b", outbound, Foreground, 10*testRate)
+	bw.wait("node-a", inbound, Foreground, 10*testRate)
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+
+	// Waits for the overdraft to be paid back.
+	bw.wait("node-a", outbound, Foreground, 1)
+	elapsed := time.Since(start)
+	assert.Greater(t, elapsed, 400*time.Millisecond)
+	assert.Less(t, elapsed, 1500*time.Millisecond)
+}
+
+func TestBandwidthSetLimits(t *testing.T) {
+	bw := NewBandwidth(BandwidthLimits{Global: Rate{In: testRate}})
+	bw.wait("node-a", inbound, Foreground, 10*testRate)
+
+	done := make(chan struct{})
+	go func() {
+		bw.wait("node-b", inbound, Foreground, 1)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("limit not applied")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Lifted, for the transfers waiting too.
+	bw.SetLimits(BandwidthLimits{})
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("still limited")
+	}
+	assert.Equal(t, BandwidthLimits{}, bw.Limits())
+}
+
+func TestBandwidthPriority(t *testing.T) {
+	bw := NewBandwidth(BandwidthLimits{Global: Rate{Out: testRate}})
+	bw.wait("node-a", outbound, Foreground, testRate)
+	bw.wait("node-a", outbound, Foreground, testRate/2)
+
+	order := make(chan Priority, 2)
+	go func() {
+		bw.wait("node-b", outbound, Background, testRate)
+		order <- Background
+	}()
+	// Queued after the background transfer, served first.
+	time.Sleep(50 * time.Millisecond)
+	go func() {
+		bw.wait("node-c", outbound, Foreground, testRate)
+		order <- Foreground
+	}()
+
+	assert.Equal(t, Foreground, <-order)
+	assert.Equal(t, Background, <-order)
+}
+
+func TestBandwidthStreams(t *testing.T) {
+	network := NewMemNetwork(MemNetworkOpts{})
+	bw := NewBandwidth(BandwidthLimits{PerPeer: Rate{Out: testRate}})
+	peers := make(chan Peer, 1)
+
+	a := network.NewTransport(TCPTransportOpts{
+		ListenAddr:    "node-a",
+		HandshakeFunc: NOPHandshakeFunc,
+		Decoder:       DefaultDecoder{},
+	})
+	assert.Nil(t, a.ListenAndAccept())
+	t.Cleanup(func() { a.Close() })
+	b := network.NewTransport(TCPTransportOpts{
+		ListenAddr:    "node-b",
+		HandshakeFunc: NOPHandshakeFunc,
+		Decoder:       DefaultDecoder{},
+		OnPeer:        func(p Peer) error { peers <- p; return nil },
+		Bandwidth:     bw,
+	})
+	t.Cleanup(func() { b.Close() })
+	assert.Nil(t, b.Dial("node-a"))
+	toA := <-peers
+
+	// Messages aren't limited.
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, toA.Send(make([]byte, testRate)))
+	}
+
+	start := time.Now()
+	stream, err := toA.(PriorityPeer).OpenStreamPriority(Background)
+	assert.Nil(t, err)
+	n, err := stream.Write(make([]byte, 2*testRate))
+	assert.Nil(t, err)
+	assert.Equal(t, 2*testRate, n)
+	assert.Nil(t, stream.Close())
+	assert.Greater(t, time.Since(start), 400*time.Millisecond)
+}
@@ -0,0 +1,87 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+)
+
+// Codec : encoding of the messages carried by the transports (the payloads of RPCs).
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// ProtoMessage : a message with a schema-defined encoding, the protobuf wire format, so that
+// nodes written in any language can speak it.
+type ProtoMessage interface {
+	MarshalProto() ([]byte, error)
+	UnmarshalProto(data []byte) error
+}
+
+// ProtoCodec : Codec of ProtoMessages.
+type ProtoCodec struct{}
+
+func (ProtoCodec) Marshal(v any) ([]byte, error) {
+	msg, ok := v.(ProtoMessage)
+	if !ok {
+		return nil, fmt.Errorf("proto codec: %T is not a ProtoMessage", v)
+	}
+	return msg.MarshalProto()
+}
+
+func (ProtoCodec) Unmarshal(data []byte, v any) error {
+	msg, ok := v.(ProtoMessage)
+	if !ok {
+		return fmt.Errorf("proto codec: %T is not a ProtoMessage", v)
+	}
+	return msg.UnmarshalProto(data)
+}
+
+// GobCodec : Codec of protocol version 3, Go only. Interface values must have their types
+// registered with gob.
+type GobCodec struct{}
+
+func (GobCodec) Marshal(v any) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// MaxMessageSize : sized messages above that are refused.
+const MaxMessageSize = 4 << 20
+
+// SizedMessage : the frame of a message of payload, as sent from protocol version 4 on:
+// IncomingSizedMessage, the size of payload (uvarint), then payload.
+func SizedMessage(payload []byte) []byte {
+	frame := make([]byte, 0, 1+binary.MaxVarintLen64+len(payload))
+	frame = append(frame, IncomingSizedMessage)
+	frame = binary.AppendUvarint(frame, uint64(len(payload)))
+	return append(frame, payload...)
+}
+
+// readSized : the payload of a sized message, after its IncomingSizedMessage byte. Doesn't read
+// past the payload: what follows belongs to the read loop (or a stream).
+func readSized(r io.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(byteReader{r})
+	if err != nil {
+		return nil, err
+	}
+	if size > MaxMessageSize {
+		return nil, fmt.Errorf("message of %d bytes: over the limit of %d", size, MaxMessageSize)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
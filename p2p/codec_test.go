@@ -0,0 +1,44 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSizedMessage(t *testing.T) {
+	big := bytes.Repeat([]byte("x"), 5000)
+	wire := bytes.NewReader(append(append(SizedMessage(big), SizedMessage(nil)...), IncomingStream))
+
+	// Read exactly: the frames that follow are intact.
+	var rpc RPC
+	assert.Nil(t, DefaultDecoder{}.Decode(wire, &rpc))
+	assert.Equal(t, big, rpc.Payload)
+
+	rpc = RPC{}
+	assert.Nil(t, DefaultDecoder{}.Decode(wire, &rpc))
+	assert.Empty(t, rpc.Payload)
+
+	rpc = RPC{}
+	assert.Nil(t, DefaultDecoder{}.Decode(wire, &rpc))
+	assert.True(t, rpc.Stream)
+
+	tooBig := binary.AppendUvarint([]byte{IncomingSizedMessage}, MaxMessageSize+1)
+	assert.NotNil(t, DefaultDecoder{}.Decode(bytes.NewReader(tooBig), &RPC{}))
+}
+
+func TestGobCodec(t *testing.T) {
+	type message struct{ Key string }
+
+	b, err := GobCodec{}.Marshal(message{Key: "k"})
+	assert.Nil(t, err)
+	var got message
+	assert.Nil(t, GobCodec{}.Unmarshal(b, &got))
+	assert.Equal(t, message{Key: "k"}, got)
+
+	// Not a ProtoMessage.
+	_, err = ProtoCodec{}.Marshal(message{})
+	assert.NotNil(t, err)
+}
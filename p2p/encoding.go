@@ -23,11 +23,22 @@ func (dec DefaultDecoder) Decode(r io.Reader, msg *RPC) error {
 		return err
 	}
 
-	// Incase of stream we are not decoding what is being sent over the network.
-	stream := peekBuf[0] == IncomingStream
-	if stream {
+	switch peekBuf[0] {
+	case IncomingStream:
+		// Incase of stream we are not decoding what is being sent over the network.
 		msg.Stream = true
 		return nil
+
+	case IncomingSizedMessage:
+		payload, err := readSized(r)
+		msg.Payload = payload
+		return err
+
+	case IncomingPing, IncomingPong:
+		msg.Heartbeat = peekBuf[0]
+		msg.Payload = make([]byte, heartbeatSize)
+		_, err := io.ReadFull(r, msg.Payload)
+		return err
 	}
 
 	buf := make([]byte, 1028)
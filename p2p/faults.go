@@ -0,0 +1,187 @@
+package p2p
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Faults : what can go wrong with the frames (Write calls) sent over a link.
+type Faults struct {
+	// Every frame is delivered that late, plus up to Jitter.
+	Latency time.Duration
+	Jitter  time.Duration
+	// Probability (0 to 1) of a frame being lost.
+	DropRate float64
+	// Probability (0 to 1) of a frame being overtaken by the next one.
+	ReorderRate float64
+}
+
+// link : the direction of traffic between two nodes.
+type link struct {
+	from, to string
+}
+
+// fate : what happens to one frame.
+type fate struct {
+	delay   time.Duration
+	drop    bool
+	reorder bool
+}
+
+// FaultInjector : injects faults in the connections of a MemNetwork. Nodes are named by their
+// listen address. Random decisions come from seeded sources, one per link, so a run can be
+// replayed whatever the order the links are used in.
+type FaultInjector struct {
+	mu   sync.Mutex
+	seed int64
+	rnds map[link]*rand.Rand
+
+	defaults Faults
+	links    map[link]Faults
+	// Node -> partition group; nodes in different groups can't reach each other.
+	groups map[string]int
+
+	conns map[*memConn]struct{}
+}
+
+func NewFaultInjector(seed int64) *FaultInjector {
+	return &FaultInjector{
+		seed:   seed,
+		rnds:   make(map[link]*rand.Rand),
+		links:  make(map[link]Faults),
+		groups: make(map[string]int),
+		conns:  make(map[*memConn]struct{}),
+	}
+}
+
+// Seed : restarts the random sources, e.g. to replay a failing run.
+func (f *FaultInjector) Seed(seed int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.seed = seed
+	f.rnds = make(map[link]*rand.Rand)
+}
+
+func (f *FaultInjector) rand(l link) *rand.Rand {
+	rnd, ok := f.rnds[l]
+	if !ok {
+		h := fnv.New64a()
+		h.Write([]byte(l.from + "\x00" + l.to))
+		rnd = rand.New(rand.NewSource(f.seed ^ int64(h.Sum64())))
+		f.rnds[l] = rnd
+	}
+	return rnd
+}
+
+// SetDefaults : faults of every link without faults of its own.
+func (f *FaultInjector) SetDefaults(faults Faults) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.defaults = faults
+}
+
+// SetLink : faults of the traffic from -> to (one direction only).
+func (f *FaultInjector) SetLink(from, to string, faults Faults) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.links[link{from, to}] = faults
+}
+
+// Partition : splits the network into groups; nodes not listed stay reachable by everyone.
+// Frames crossing groups are lost and dials fail, until Heal.
+func (f *FaultInjector) Partition(groups ...[]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, node := range group {
+			f.groups[node] = i + 1
+		}
+	}
+}
+
+// Heal : removes partitions and link faults.
+func (f *FaultInjector) Heal() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.groups = make(map[string]int)
+	f.links = make(map[link]Faults)
+	f.defaults = Faults{}
+}
+
+func (f *FaultInjector) Partitioned(a, b string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.partitioned(a, b)
+}
+
+func (f *FaultInjector) partitioned(a, b string) bool {
+	ga, gb := f.groups[a], f.groups[b]
+	return ga != 0 && gb != 0 && ga != gb
+}
+
+// Kill : abruptly closes every connection between nodes a and b, dropping queued frames.
+// Returns the number of connections killed.
+func (f *FaultInjector) Kill(a, b string) int {
+	f.mu.Lock()
+	victims := []*memConn{}
+	for c := range f.conns {
+		if (c.local == a && c.remote == b) || (c.local == b && c.remote == a) {
+			victims = append(victims, c)
+		}
+	}
+	f.mu.Unlock()
+
+	for _, c := range victims {
+		c.kill()
+	}
+	// Both ends of a connection are tracked.
+	return len(victims) / 2
+}
+
+func (f *FaultInjector) fate(from, to string) fate {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.partitioned(from, to) {
+		return fate{drop: true}
+	}
+
+	l := link{from, to}
+	faults, ok := f.links[l]
+	if !ok {
+		faults = f.defaults
+	}
+	rnd := f.rand(l)
+
+	var ft fate
+	ft.delay = faults.Latency
+	if faults.Jitter > 0 {
+		ft.delay += time.Duration(rnd.Int63n(int64(faults.Jitter)))
+	}
+	ft.drop = faults.DropRate > 0 && rnd.Float64() < faults.DropRate
+	ft.reorder = faults.ReorderRate > 0 && rnd.Float64() < faults.ReorderRate
+	return ft
+}
+
+func (f *FaultInjector) track(c *memConn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.conns[c] = struct{}{}
+}
+
+func (f *FaultInjector) untrack(c *memConn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.conns, c)
+}
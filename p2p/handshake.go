@@ -1,6 +1,13 @@
 package p2p
 
-import "errors"
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
 
 // ErrInvalidHandShake : returned if handshake between local and remote node couldn't be established.
 var ErrInvalidHandShake = errors.New("invalid handshake")
@@ -9,3 +16,152 @@ var ErrInvalidHandShake = errors.New("invalid handshake")
 type HandshakeFunc func(Peer) error
 
 func NOPHandshakeFunc(Peer) error { return nil }
+
+// MinProtocolVersion : oldest version of the wire protocol this build still speaks, see Hello.
+const MinProtocolVersion = 3
+
+// Capabilities : optional features of the protocol, as flags. Peers only use those both sides
+// have (see Protocol).
+type Capabilities uint32
+
+const (
+	// Messages are compressed.
+	CapCompression Capabilities = 1 << iota
+	// Streams are sealed with an AEAD cipher (not implemented by this build yet).
+	CapAEAD
+	// Streams don't hold up messages, nor each other (e.g. QUIC).
+	CapMultiplexing
+	// Objects may be stored as erasure-coded shards (not implemented by this build yet).
+	CapErasureCoding
+)
+
+var capabilityNames = []string{"compression", "aead", "multiplexing", "erasure_coding"}
+
+// Has : whether every capability of o is in c.
+func (c Capabilities) Has(o Capabilities) bool {
+	return c&o == o
+}
+
+func (c Capabilities) String() string {
+	names := []string{}
+	for i, name := range capabilityNames {
+		if c.Has(1 << i) {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// Protocol : what the two ends of a connection agreed on, see VersionHandshake.
+type Protocol struct {
+	Version      int
+	Capabilities Capabilities
+}
+
+// ProtocolPeer : a peer that went through VersionHandshake.
+type ProtocolPeer interface {
+	// Protocol : as negotiated; the zero Protocol without VersionHandshake.
+	Protocol() Protocol
+}
+
+// Hello : what a node says of itself in the handshake: the range of protocol versions it speaks,
+// and its capabilities.
+type Hello struct {
+	MinVersion   int
+	MaxVersion   int
+	Capabilities Capabilities
+}
+
+// DefaultHello : the versions and capabilities of this build, for transports without
+// multiplexing.
+func DefaultHello() Hello {
+	return Hello{
+		MinVersion:   MinProtocolVersion,
+		MaxVersion:   ProtocolVersion,
+		Capabilities: CapCompression,
+	}
+}
+
+const (
+	// Start of a hello, then versions (2 × 2 bytes) and capabilities (4 bytes), big endian.
+	helloMagic = "NX"
+	helloSize  = len(helloMagic) + 2 + 2 + 4
+	// How long the other side has to say hello.
+	handshakeTimeout = 10 * time.Second
+)
+
+// handshakePeer : a peer able to carry the handshake, before its read loop starts.
+type handshakePeer interface {
+	// Where hellos are written to and read from.
+	handshakeConn() handshakeConn
+	setProtocol(Protocol)
+}
+
+type handshakeConn interface {
+	io.ReadWriter
+	SetReadDeadline(time.Time) error
+}
+
+// VersionHandshake : both sides send their Hello, and settle on the highest version both speak,
+// and the capabilities both have. Fails (with ErrInvalidHandShake) if they have no version in
+// common. The result is given by the peer's Protocol method.
+func VersionHandshake(local Hello) HandshakeFunc {
+	return func(p Peer) error {
+		peer, ok := p.(handshakePeer)
+		if !ok {
+			return fmt.Errorf("%w: %T can't carry a version handshake", ErrInvalidHandShake, p)
+		}
+		conn := peer.handshakeConn()
+
+		if _, err := conn.Write(local.encode()); err != nil {
+			return err
+		}
+
+		buf := make([]byte, helloSize)
+		conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Time{})
+
+		remote, err := decodeHello(buf)
+		if err != nil {
+			return err
+		}
+		protocol, err := negotiate(local, remote)
+		if err != nil {
+			return err
+		}
+		peer.setProtocol(protocol)
+		return nil
+	}
+}
+
+func negotiate(local, remote Hello) (Protocol, error) {
+	version := min(local.MaxVersion, remote.MaxVersion)
+	if version < local.MinVersion || version < remote.MinVersion {
+		return Protocol{}, fmt.Errorf("%w: no common protocol version, ours %d-%d, theirs %d-%d",
+			ErrInvalidHandShake, local.MinVersion, local.MaxVersion, remote.MinVersion, remote.MaxVersion)
+	}
+	return Protocol{Version: version, Capabilities: local.Capabilities & remote.Capabilities}, nil
+}
+
+func (h Hello) encode() []byte {
+	buf := make([]byte, 0, helloSize)
+	buf = append(buf, helloMagic...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(h.MinVersion))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(h.MaxVersion))
+	return binary.BigEndian.AppendUint32(buf, uint32(h.Capabilities))
+}
+
+func decodeHello(buf []byte) (Hello, error) {
+	if string(buf[:len(helloMagic)]) != helloMagic {
+		return Hello{}, fmt.Errorf("%w: not a hello", ErrInvalidHandShake)
+	}
+	buf = buf[len(helloMagic):]
+	return Hello{
+		MinVersion:   int(binary.BigEndian.Uint16(buf)),
+		MaxVersion:   int(binary.BigEndian.Uint16(buf[2:])),
+		Capabilities: Capabilities(binary.BigEndian.Uint32(buf[4:])),
+	}, nil
+}
@@ -0,0 +1,143 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name          string
+		local, remote Hello
+		want          Protocol
+		wantErr       bool
+	}{
+		{
+			name:   "same build",
+			local:  Hello{MinVersion: 3, MaxVersion: 3, Capabilities: CapCompression},
+			remote: Hello{MinVersion: 3, MaxVersion: 3, Capabilities: CapCompression},
+			want:   Protocol{Version: 3, Capabilities: CapCompression},
+		},
+		{
+			name:   "newer remote",
+			local:  Hello{MinVersion: 3, MaxVersion: 3, Capabilities: CapCompression},
+			remote: Hello{MinVersion: 3, MaxVersion: 5, Capabilities: CapCompression | CapAEAD | CapErasureCoding},
+			want:   Protocol{Version: 3, Capabilities: CapCompression},
+		},
+		{
+			name:   "older remote",
+			local:  Hello{MinVersion: 3, MaxVersion: 4, Capabilities: CapCompression | CapMultiplexing},
+			remote: Hello{MinVersion: 2, MaxVersion: 3, Capabilities: CapMultiplexing},
+			want:   Protocol{Version: 3, Capabilities: CapMultiplexing},
+		},
+		{
+			name:    "no common version",
+			local:   Hello{MinVersion: 4, MaxVersion: 5},
+			remote:  Hello{MinVersion: 2, MaxVersion: 3},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := negotiate(tt.local, tt.remote)
+		if tt.wantErr {
+			assert.ErrorIs(t, err, ErrInvalidHandShake, tt.name)
+			continue
+		}
+		assert.Nil(t, err, tt.name)
+		assert.Equal(t, tt.want, got, tt.name)
+
+		// Both sides agree.
+		other, err := negotiate(tt.remote, tt.local)
+		assert.Nil(t, err, tt.name)
+		assert.Equal(t, got, other, tt.name)
+	}
+}
+
+func TestHelloEncoding(t *testing.T) {
+	hello := Hello{MinVersion: 3, MaxVersion: 7, Capabilities: CapCompression | CapErasureCoding}
+	buf := hello.encode()
+	assert.Equal(t, []byte{'N', 'X', 0, 3, 0, 7, 0, 0, 0, 9}, buf)
+
+	got, err := decodeHello(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, hello, got)
+
+	_, err = decodeHello([]byte("GET / HTTP"))
+	assert.ErrorIs(t, err, ErrInvalidHandShake)
+
+	assert.Equal(t, "compression|erasure_coding", hello.Capabilities.String())
+}
+
+func TestVersionHandshake(t *testing.T) {
+	network := NewMemNetwork(MemNetworkOpts{})
+	newTransport := func(addr string, hello Hello, peers chan Peer) *MemTransport {
+		tr := network.NewTransport(TCPTransportOpts{
+			ListenAddr:    addr,
+			HandshakeFunc: VersionHandshake(hello),
+			Decoder:       DefaultDecoder{},
+			OnPeer: func(p Peer) error {
+				peers <- p
+				return nil
+			},
+		})
+		assert.Nil(t, tr.ListenAndAccept())
+		t.Cleanup(func() { tr.Close() })
+		return tr
+	}
+	nextPeer := func(peers chan Peer) Peer {
+		t.Helper()
+		select {
+		case p := <-peers:
+			return p
+		case <-time.After(2 * time.Second):
+			t.Fatal("no peer connected")
+			return nil
+		}
+	}
+
+	newPeers, oldPeers, otherPeers := make(chan Peer, 2), make(chan Peer, 2), make(chan Peer, 2)
+	newNode := newTransport("new", Hello{MinVersion: 3, MaxVersion: 4, Capabilities: CapCompression | CapMultiplexing}, newPeers)
+	newTransport("old", Hello{MinVersion: 3, MaxVersion: 3, Capabilities: CapCompression}, oldPeers)
+	newTransport("other", Hello{MinVersion: 5, MaxVersion: 5}, otherPeers)
+
+	assert.Nil(t, newNode.Dial("old"))
+	want := Protocol{Version: 3, Capabilities: CapCompression}
+	assert.Equal(t, want, nextPeer(newPeers).(ProtocolPeer).Protocol())
+	toNew := nextPeer(oldPeers)
+	assert.Equal(t, want, toNew.(ProtocolPeer).Protocol())
+
+	// Messages flow once agreed.
+	assert.Nil(t, toNew.Send([]byte{IncomingMessage, 'h', 'i'}))
+	assert.Equal(t, []byte("hi"), receive(t, newNode).Payload)
+
+	// No version in common: rejected by both sides.
+	assert.Nil(t, newNode.Dial("other"))
+	select {
+	case <-newPeers:
+		t.Fatal("peer of an incompatible version accepted")
+	case <-otherPeers:
+		t.Fatal("peer of an incompatible version accepted")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestVersionHandshakeQUIC(t *testing.T) {
+	aPeers, bPeers := make(chan Peer, 4), make(chan Peer, 4)
+	a, b := newQUICTransport(t, aPeers), newQUICTransport(t, bPeers)
+	hello := DefaultHello()
+	hello.Capabilities |= CapMultiplexing
+	a.HandshakeFunc, b.HandshakeFunc = VersionHandshake(hello), VersionHandshake(DefaultHello())
+
+	assert.Nil(t, b.Dial(a.ListenAddress()))
+	want := Protocol{Version: ProtocolVersion, Capabilities: CapCompression}
+	assert.Equal(t, want, nextPeer(t, aPeers).Protocol())
+	toA := nextPeer(t, bPeers)
+	assert.Equal(t, want, toA.Protocol())
+
+	assert.Nil(t, toA.Send([]byte{IncomingMessage}))
+	assert.Nil(t, toA.Send([]byte("over the control stream")))
+	assert.Equal(t, []byte("over the control stream"), receive(t, a).Payload)
+}
@@ -0,0 +1,96 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/PsychoPunkSage/NexNet/logging"
+)
+
+// Size of the payload of a heartbeat frame: a timestamp.
+const heartbeatSize = 8
+
+// Pings carry the time they were sent at, since then (on the monotonic clock), for their pongs to
+// tell the RTT.
+var heartbeatEpoch = time.Now()
+
+// Heartbeat : liveness checking of the connections of a TCPTransport. A connection can be
+// half-open (e.g. the other host lost power) without either side noticing: reads block forever
+// and writes go into the void. Pings, answered with pongs, keep bytes flowing both ways, so that
+// a connection nothing is read from for ReadTimeout is known dead and torn down (OnPeerDisconnect
+// is called). Pongs also measure the round-trip time of the peer, see TCPPeer.RTT.
+//
+// The zero value disables pings and timeouts; pings are answered anyway.
+type Heartbeat struct {
+	// Time between pings. 0 disables heartbeats, timeouts included.
+	Interval time.Duration
+	// A connection nothing is read from for that long is dropped. Defaults to 3 intervals.
+	ReadTimeout time.Duration
+	// A write blocked for that long drops the connection. Defaults to ReadTimeout.
+	WriteTimeout time.Duration
+	// A connection without any message or stream, either way, for that long is dropped;
+	// heartbeats don't count. 0 keeps idle connections.
+	IdleTimeout time.Duration
+}
+
+func (h Heartbeat) enabled() bool {
+	return h.Interval > 0
+}
+
+func (h Heartbeat) readTimeout() time.Duration {
+	if h.ReadTimeout > 0 {
+		return h.ReadTimeout
+	}
+	return 3 * h.Interval
+}
+
+func (h Heartbeat) writeTimeout() time.Duration {
+	if h.WriteTimeout > 0 {
+		return h.WriteTimeout
+	}
+	return h.readTimeout()
+}
+
+// RTTPeer : a peer whose round-trip time is measured, e.g. a TCPPeer with heartbeats.
+type RTTPeer interface {
+	// RTT : round-trip time of the last ping answered; 0 if none was yet.
+	RTT() time.Duration
+}
+
+func heartbeatFrame(kind byte, stamp uint64) []byte {
+	frame := make([]byte, 1+heartbeatSize)
+	frame[0] = kind
+	binary.BigEndian.PutUint64(frame[1:], stamp)
+	return frame
+}
+
+// heartbeat : pings peer every interval, and drops it once idle for too long, until done is
+// closed.
+func (t *TCPTransport) heartbeat(peer *TCPPeer, done <-chan struct{}) {
+	defer t.wg.Done()
+
+	log := t.log.With(logging.Peer, peer.RemoteAddr().String())
+	ticker := time.NewTicker(t.Heartbeat.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		case <-t.closeCh:
+			return
+		}
+
+		if idle := t.Heartbeat.IdleTimeout; idle > 0 && time.Since(peer.lastActive()) >= idle {
+			log.Info("closing idle connection", "idle_timeout", idle)
+			peer.Close()
+			return
+		}
+		if err := peer.ping(); err != nil {
+			log.Warn("ping failed, closing connection", "err", err)
+			peer.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newHeartbeatPair : two transports of network with heartbeats, b dialing a. Peers disconnected
+// from a are sent to the returned channel.
+func newHeartbeatPair(t *testing.T, network *MemNetwork, hb Heartbeat) (toA Peer, disconnected chan Peer) {
+	disconnected = make(chan Peer, 1)
+	aPeers, bPeers := make(chan Peer, 1), make(chan Peer, 1)
+
+	a := network.NewTransport(TCPTransportOpts{
+		ListenAddr:       "node-a",
+		HandshakeFunc:    NOPHandshakeFunc,
+		Decoder:          DefaultDecoder{},
+		OnPeer:           func(p Peer) error { aPeers <- p; return nil },
+		OnPeerDisconnect: func(p Peer) { disconnected <- p },
+		Heartbeat:        hb,
+	})
+	assert.Nil(t, a.ListenAndAccept())
+	t.Cleanup(func() { a.Close() })
+	go func() {
+		for range a.Consume() {
+		}
+	}()
+
+	b := network.NewTransport(TCPTransportOpts{
+		ListenAddr:    "node-b",
+		HandshakeFunc: NOPHandshakeFunc,
+		Decoder:       DefaultDecoder{},
+		OnPeer:        func(p Peer) error { bPeers <- p; return nil },
+		Heartbeat:     hb,
+	})
+	t.Cleanup(func() { b.Close() })
+	assert.Nil(t, b.Dial("node-a"))
+
+	<-aPeers
+	return <-bPeers, disconnected
+}
+
+func waitDisconnected(t *testing.T, disconnected chan Peer, within time.Duration) {
+	t.Helper()
+
+	select {
+	case p := <-disconnected:
+		assert.Equal(t, "node-b", p.RemoteAddr().String())
+	case <-time.After(within):
+		t.Fatal("peer not disconnected")
+	}
+}
+
+func TestHeartbeatRTT(t *testing.T) {
+	network := NewMemNetwork(MemNetworkOpts{})
+	network.Faults().SetDefaults(Faults{Latency: 10 * time.Millisecond})
+	toA, _ := newHeartbeatPair(t, network, Heartbeat{Interval: 20 * time.Millisecond})
+
+	// A ping goes both ways.
+	assert.Eventually(t, func() bool { return toA.(RTTPeer).RTT() >= 20*time.Millisecond }, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestHeartbeatHalfOpenConnection(t *testing.T) {
+	network := NewMemNetwork(MemNetworkOpts{})
+	_, disconnected := newHeartbeatPair(t, network, Heartbeat{Interval: 20 * time.Millisecond, ReadTimeout: 100 * time.Millisecond})
+
+	// Still connected, but nothing gets through anymore.
+	network.Faults().Partition([]string{"node-a"}, []string{"node-b"})
+	waitDisconnected(t, disconnected, 2*time.Second)
+}
+
+func TestHeartbeatIdleTimeout(t *testing.T) {
+	network := NewMemNetwork(MemNetworkOpts{})
+	toA, disconnected := newHeartbeatPair(t, network, Heartbeat{Interval: 10 * time.Millisecond, IdleTimeout: 200 * time.Millisecond})
+
+	// Messages keep the connection open, heartbeats don't.
+	for i := 0; i < 5; i++ {
+		time.Sleep(50 * time.Millisecond)
+		assert.Nil(t, toA.Send([]byte{IncomingMessage, 'h', 'i'}))
+	}
+	select {
+	case <-disconnected:
+		t.Fatal("active connection closed")
+	default:
+	}
+
+	waitDisconnected(t, disconnected, 2*time.Second)
+}
+
+func TestHeartbeatPausedDuringStream(t *testing.T) {
+	network := NewMemNetwork(MemNetworkOpts{})
+	toA, disconnected := newHeartbeatPair(t, network, Heartbeat{Interval: 10 * time.Millisecond, ReadTimeout: 50 * time.Millisecond})
+
+	stream, err := toA.OpenStream()
+	assert.Nil(t, err)
+	// The other side doesn't read the stream: no ping may get into it meanwhile.
+	time.Sleep(150 * time.Millisecond)
+	assert.Nil(t, stream.Close())
+
+	select {
+	case <-disconnected:
+		t.Fatal("connection closed during a stream")
+	default:
+	}
+}
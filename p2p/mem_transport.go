@@ -0,0 +1,337 @@
+package p2p
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/PsychoPunkSage/NexNet/clock"
+)
+
+// How long a closed connection keeps trying to deliver the frames still queued.
+const memFlushTimeout = time.Second
+
+// Frames queued (written but not yet delivered) per connection before Write blocks.
+const memQueueSize = 4096
+
+// How long a frame held back for reordering waits for a next one to overtake it.
+const memReorderWindow = 10 * time.Millisecond
+
+type MemNetworkOpts struct {
+	// Seed of the FaultInjector.
+	Seed int64
+	// Defaults to clock.Real. Latencies and reordering windows are waited on it.
+	Clock clock.Clock
+}
+
+// MemNetwork : an in-process network, for tests. Nodes are identified by their listen address,
+// which can be any name ("node-1", ":3000", ...). Connections are net.Pipe based, with a send
+// queue in front (standing for the kernel's socket buffer) where the FaultInjector applies.
+type MemNetwork struct {
+	MemNetworkOpts
+
+	mu        sync.Mutex
+	listeners map[string]*memListener
+
+	faults *FaultInjector
+}
+
+func NewMemNetwork(opts MemNetworkOpts) *MemNetwork {
+	opts.Clock = clock.OrReal(opts.Clock)
+
+	return &MemNetwork{
+		MemNetworkOpts: opts,
+		listeners:      make(map[string]*memListener),
+		faults:         NewFaultInjector(opts.Seed),
+	}
+}
+
+// Faults : the fault injector of every connection of the network.
+func (n *MemNetwork) Faults() *FaultInjector {
+	return n.faults
+}
+
+// MemTransport : Transport over a MemNetwork. It shares the connection handling of TCPTransport
+// (handshake, OnPeer, streams, Close...), so it behaves the same; peers are TCPPeers over
+// in-memory connections.
+type MemTransport struct {
+	*TCPTransport
+}
+
+// NewTransport : a transport of the network, listening on opts.ListenAddr.
+func (n *MemNetwork) NewTransport(opts TCPTransportOpts) *MemTransport {
+	t := NewTCPTransport(opts)
+	t.listen = n.listen
+	t.dial = func(addr string) (net.Conn, error) {
+		return n.dial(opts.ListenAddr, addr)
+	}
+
+	return &MemTransport{TCPTransport: t}
+}
+
+// Listening : whether a transport of the network is listening on addr.
+func (n *MemNetwork) Listening(addr string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	_, ok := n.listeners[addr]
+	return ok
+}
+
+func (n *MemNetwork) listen(addr string) (net.Listener, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.listeners[addr]; ok {
+		return nil, fmt.Errorf("listen mem %s: address already in use", addr)
+	}
+
+	l := &memListener{
+		network: n,
+		addr:    memAddr(addr),
+		conns:   make(chan net.Conn),
+		done:    make(chan struct{}),
+	}
+	n.listeners[addr] = l
+	return l, nil
+}
+
+func (n *MemNetwork) dial(from, to string) (net.Conn, error) {
+	n.mu.Lock()
+	l, ok := n.listeners[to]
+	n.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("dial mem %s: connection refused", to)
+	}
+	if n.faults.Partitioned(from, to) {
+		return nil, fmt.Errorf("dial mem %s: network is unreachable", to)
+	}
+
+	local, remote := net.Pipe()
+	dialer := newMemConn(local, from, to, n)
+	acceptor := newMemConn(remote, to, from, n)
+
+	select {
+	case l.conns <- acceptor:
+		return dialer, nil
+	case <-l.done:
+		dialer.Close()
+		acceptor.Close()
+		return nil, fmt.Errorf("dial mem %s: connection refused", to)
+	}
+}
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+type memListener struct {
+	network *MemNetwork
+	addr    memAddr
+	conns   chan net.Conn
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+
+		l.network.mu.Lock()
+		delete(l.network.listeners, string(l.addr))
+		l.network.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return l.addr
+}
+
+// memConn : one end of a net.Pipe. Writes are queued and delivered in the background, going
+// through the fault injector on the way.
+type memConn struct {
+	net.Conn
+	local, remote string
+	faults        *FaultInjector
+	clock         clock.Clock
+
+	queue chan memFrame
+
+	mu       sync.Mutex
+	writeErr error
+
+	closeOnce sync.Once
+	done      chan struct{}
+	// Closed once the queue has been flushed (or abandoned) and the pipe closed.
+	flushed chan struct{}
+}
+
+func newMemConn(pipe net.Conn, local, remote string, n *MemNetwork) *memConn {
+	c := &memConn{
+		Conn:    pipe,
+		local:   local,
+		remote:  remote,
+		faults:  n.faults,
+		clock:   n.Clock,
+		queue:   make(chan memFrame, memQueueSize),
+		done:    make(chan struct{}),
+		flushed: make(chan struct{}),
+	}
+	c.faults.track(c)
+	go c.deliver()
+	return c
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return memAddr(c.local) }
+func (c *memConn) RemoteAddr() net.Addr { return memAddr(c.remote) }
+
+func (c *memConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	err := c.writeErr
+	c.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	// Decided when written: a frame sent across a partition is lost, even if healed meanwhile.
+	frame := memFrame{
+		data:    append([]byte(nil), b...),
+		written: c.clock.Now(),
+		fate:    c.faults.fate(c.local, c.remote),
+	}
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	select {
+	case c.queue <- frame:
+		return len(b), nil
+	case <-c.done:
+		return 0, net.ErrClosed
+	}
+}
+
+// SetDeadline : sets the read deadline only, see SetWriteDeadline.
+func (c *memConn) SetDeadline(t time.Time) error {
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline : a no-op. Writes only wait for room in the queue, and the pipe's own write
+// deadline is that of Close.
+func (c *memConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// Close : delivers what is still queued (for up to memFlushTimeout), then closes the pipe.
+func (c *memConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.Conn.SetWriteDeadline(time.Now().Add(memFlushTimeout))
+		close(c.done)
+	})
+	return nil
+}
+
+// kill : closes the pipe right away, dropping whatever is queued.
+func (c *memConn) kill() {
+	c.Conn.Close()
+	c.Close()
+}
+
+// memFrame : the bytes of one Write.
+type memFrame struct {
+	data    []byte
+	written time.Time
+	fate    fate
+}
+
+// deliver : writes the queued frames to the pipe, as the fault injector says.
+func (c *memConn) deliver() {
+	defer func() {
+		c.Conn.Close()
+		c.faults.untrack(c)
+		close(c.flushed)
+	}()
+
+	send := func(frame []byte) bool {
+		if _, err := c.Conn.Write(frame); err != nil {
+			c.mu.Lock()
+			c.writeErr = err
+			c.mu.Unlock()
+			return false
+		}
+		return true
+	}
+
+	var held []byte // Frame held back, for the next one to overtake it.
+	for {
+		var reorderTimeout <-chan time.Time
+		if held != nil {
+			reorderTimeout = c.clock.After(memReorderWindow)
+		}
+
+		var frame memFrame
+		select {
+		case frame = <-c.queue:
+		case <-reorderTimeout:
+			if !send(held) {
+				return
+			}
+			held = nil
+			continue
+		case <-c.done:
+			// Flush what's left, unless the other side stopped reading (see Close).
+			if held != nil && !send(held) {
+				return
+			}
+			for {
+				select {
+				case frame := <-c.queue:
+					if !frame.fate.drop && !send(frame.data) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+
+		if wait := frame.written.Add(frame.fate.delay).Sub(c.clock.Now()); wait > 0 {
+			// Closing doesn't wait for the latency: a virtual clock may never get there.
+			select {
+			case <-c.clock.After(wait):
+			case <-c.done:
+			}
+		}
+		if frame.fate.drop {
+			continue
+		}
+		if frame.fate.reorder && held == nil {
+			held = frame.data
+			continue
+		}
+		if !send(frame.data) {
+			return
+		}
+		if held != nil {
+			if !send(held) {
+				return
+			}
+			held = nil
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newMemPair : two transports of network, b dialing a. Returns the peers as seen by each side.
+func newMemPair(t *testing.T, network *MemNetwork) (a, b *MemTransport, aPeers, bPeers chan Peer) {
+	newTransport := func(addr string, peers chan Peer) *MemTransport {
+		tr := network.NewTransport(TCPTransportOpts{
+			ListenAddr:    addr,
+			HandshakeFunc: NOPHandshakeFunc,
+			Decoder:       DefaultDecoder{},
+			OnPeer: func(p Peer) error {
+				peers <- p
+				return nil
+			},
+		})
+		assert.Nil(t, tr.ListenAndAccept())
+		t.Cleanup(func() { tr.Close() })
+		return tr
+	}
+
+	aPeers, bPeers = make(chan Peer, 4), make(chan Peer, 4)
+	a = newTransport("node-a", aPeers)
+	b = newTransport("node-b", bPeers)
+	assert.Nil(t, b.Dial("node-a"))
+	return a, b, aPeers, bPeers
+}
+
+func receive(t *testing.T, tr Transport) RPC {
+	t.Helper()
+
+	select {
+	case rpc := <-tr.Consume():
+		return rpc
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message received")
+		return RPC{}
+	}
+}
+
+func TestMemTransport(t *testing.T) {
+	a, _, aPeers, bPeers := newMemPair(t, NewMemNetwork(MemNetworkOpts{}))
+
+	// Both sides know the other by its listen address.
+	assert.Equal(t, "node-b", (<-aPeers).RemoteAddr().String())
+	toA := <-bPeers
+	assert.Equal(t, "node-a", toA.RemoteAddr().String())
+
+	assert.Nil(t, toA.Send([]byte{IncomingMessage}))
+	assert.Nil(t, toA.Send([]byte("hello")))
+
+	rpc := receive(t, a)
+	assert.Equal(t, []byte("hello"), rpc.Payload)
+	assert.Equal(t, "node-b", rpc.From.String())
+}
+
+func TestMemTransportDialErrors(t *testing.T) {
+	network := NewMemNetwork(MemNetworkOpts{})
+	a := network.NewTransport(TCPTransportOpts{ListenAddr: "node-a", HandshakeFunc: NOPHandshakeFunc, Decoder: DefaultDecoder{}})
+	assert.Nil(t, a.ListenAndAccept())
+	defer a.Close()
+
+	b := network.NewTransport(TCPTransportOpts{ListenAddr: "node-b", HandshakeFunc: NOPHandshakeFunc, Decoder: DefaultDecoder{}})
+	assert.NotNil(t, b.Dial("nowhere"))
+
+	network.Faults().Partition([]string{"node-a"}, []string{"node-b"})
+	assert.NotNil(t, b.Dial("node-a"))
+
+	network.Faults().Heal()
+	assert.Nil(t, b.Dial("node-a"))
+
+	// The address is free again once closed.
+	assert.NotNil(t, network.NewTransport(TCPTransportOpts{ListenAddr: "node-a"}).ListenAndAccept())
+	a.Close()
+	again := network.NewTransport(TCPTransportOpts{ListenAddr: "node-a"})
+	assert.Nil(t, again.ListenAndAccept())
+	again.Close()
+}
+
+func TestMemTransportLatency(t *testing.T) {
+	network := NewMemNetwork(MemNetworkOpts{})
+	network.Faults().SetLink("node-b", "node-a", Faults{Latency: 100 * time.Millisecond})
+	a, _, _, bPeers := newMemPair(t, network)
+	toA := <-bPeers
+
+	start := time.Now()
+	assert.Nil(t, toA.Send([]byte{IncomingMessage}))
+	assert.Nil(t, toA.Send([]byte("late")))
+	assert.Equal(t, []byte("late"), receive(t, a).Payload)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+}
+
+func TestMemTransportPartitionDropsFrames(t *testing.T) {
+	network := NewMemNetwork(MemNetworkOpts{})
+	a, _, _, bPeers := newMemPair(t, network)
+	toA := <-bPeers
+
+	network.Faults().Partition([]string{"node-a"}, []string{"node-b"})
+	assert.Nil(t, toA.Send([]byte{IncomingMessage}))
+	assert.Nil(t, toA.Send([]byte("lost")))
+
+	network.Faults().Heal()
+	assert.Nil(t, toA.Send([]byte{IncomingMessage}))
+	assert.Nil(t, toA.Send([]byte("delivered")))
+
+	assert.Equal(t, []byte("delivered"), receive(t, a).Payload)
+}
+
+func TestMemTransportReorder(t *testing.T) {
+	network := NewMemNetwork(MemNetworkOpts{})
+	a, _, _, bPeers := newMemPair(t, network)
+	toA := <-bPeers
+
+	// Every frame is held back, so each pair gets swapped.
+	network.Faults().SetDefaults(Faults{ReorderRate: 1})
+	assert.Nil(t, toA.Send([]byte("second")))
+	assert.Nil(t, toA.Send([]byte{IncomingMessage}))
+
+	assert.Equal(t, []byte("second"), receive(t, a).Payload)
+}
+
+func TestMemTransportKill(t *testing.T) {
+	network := NewMemNetwork(MemNetworkOpts{})
+	disconnected := make(chan Peer, 1)
+
+	a := network.NewTransport(TCPTransportOpts{
+		ListenAddr:       "node-a",
+		HandshakeFunc:    NOPHandshakeFunc,
+		Decoder:          DefaultDecoder{},
+		OnPeerDisconnect: func(p Peer) { disconnected <- p },
+	})
+	assert.Nil(t, a.ListenAndAccept())
+	defer a.Close()
+
+	b := network.NewTransport(TCPTransportOpts{ListenAddr: "node-b", HandshakeFunc: NOPHandshakeFunc, Decoder: DefaultDecoder{}})
+	defer b.Close()
+	assert.Nil(t, b.Dial("node-a"))
+
+	// The connection is only tracked once accepted.
+	assert.Eventually(t, func() bool { return network.Faults().Kill("node-a", "node-b") == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	select {
+	case p := <-disconnected:
+		assert.Equal(t, "node-b", p.RemoteAddr().String())
+	case <-time.After(2 * time.Second):
+		t.Fatal("killed connection not reported")
+	}
+}
+
+func TestMemTransportCloseDuringStream(t *testing.T) {
+	network := NewMemNetwork(MemNetworkOpts{})
+	peers, disconnected := make(chan Peer, 1), make(chan Peer, 1)
+
+	a := network.NewTransport(TCPTransportOpts{
+		ListenAddr:       "node-a",
+		HandshakeFunc:    NOPHandshakeFunc,
+		Decoder:          DefaultDecoder{},
+		OnPeer:           func(p Peer) error { peers <- p; return nil },
+		OnPeerDisconnect: func(p Peer) { disconnected <- p },
+	})
+	assert.Nil(t, a.ListenAndAccept())
+	defer a.Close()
+
+	bPeers := make(chan Peer, 1)
+	b := network.NewTransport(TCPTransportOpts{
+		ListenAddr:    "node-b",
+		HandshakeFunc: NOPHandshakeFunc,
+		Decoder:       DefaultDecoder{},
+		OnPeer:        func(p Peer) error { bPeers <- p; return nil },
+	})
+	defer b.Close()
+	assert.Nil(t, b.Dial("node-a"))
+
+	// a's read loop waits on the stream, which nobody ever finishes.
+	assert.Nil(t, (<-bPeers).Send([]byte{IncomingStream}))
+	toB := <-peers
+	time.Sleep(50 * time.Millisecond)
+	assert.Nil(t, toB.Close())
+
+	select {
+	case p := <-disconnected:
+		assert.Equal(t, "node-b", p.RemoteAddr().String())
+	case <-time.After(2 * time.Second):
+		t.Fatal("peer closed amid a stream not reported")
+	}
+}
@@ -2,9 +2,19 @@ package p2p
 
 import "net"
 
+// ProtocolVersion : latest version of the wire protocol spoken by this build. Nodes settle on a
+// version both speak in the handshake, see VersionHandshake.
+const ProtocolVersion = 4
+
 const (
 	IncomingMessage = 0x1
 	IncomingStream  = 0x2
+	// Heartbeat frames, followed by a timestamp of the pinging side (8 bytes, big endian) that the
+	// pong echoes. Handled by the transport, see Heartbeat.
+	IncomingPing = 0x3
+	IncomingPong = 0x4
+	// A message with its size, see SizedMessage. IncomingMessage ones are read in one Read.
+	IncomingSizedMessage = 0x5
 )
 
 // RPC : arbitrary data that is being sent over each transport between 2 node (peer) in the network
@@ -12,4 +22,6 @@ type RPC struct {
 	Payload []byte
 	From    net.Addr
 	Stream  bool
+	// IncomingPing or IncomingPong for a heartbeat frame, Payload being its timestamp.
+	Heartbeat byte
 }
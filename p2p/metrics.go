@@ -0,0 +1,48 @@
+package p2p
+
+import "net"
+
+// Metrics : instrumentation hooks of a transport. Peers are identified by remote address.
+type Metrics interface {
+	AddBytesIn(peer string, n int)
+	AddBytesOut(peer string, n int)
+	// An incoming stream started/ended, i.e. the read loop of a peer is handed to the consumer.
+	StreamOpened()
+	StreamClosed()
+	HandshakeFailed()
+	// The peer is gone: its per-peer series can be dropped.
+	ForgetPeer(peer string)
+}
+
+// NopMetrics : default Metrics, recording nothing.
+type NopMetrics struct{}
+
+func (NopMetrics) AddBytesIn(string, int)  {}
+func (NopMetrics) AddBytesOut(string, int) {}
+func (NopMetrics) StreamOpened()           {}
+func (NopMetrics) StreamClosed()           {}
+func (NopMetrics) HandshakeFailed()        {}
+func (NopMetrics) ForgetPeer(string)       {}
+
+// meteredConn : counts the bytes read from/written to a connection.
+type meteredConn struct {
+	net.Conn
+	peer    string
+	metrics Metrics
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.metrics.AddBytesIn(c.peer, n)
+	}
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.metrics.AddBytesOut(c.peer, n)
+	}
+	return n, err
+}
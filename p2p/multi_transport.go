@@ -0,0 +1,116 @@
+package p2p
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+// MultiTransport : several transports as one, so that a node can talk to peers of each (e.g. TCP
+// and QUIC in the same cluster). Addresses are told apart by their scheme ("quic://..."), that of
+// each transport's ListenAddress (or, for transports with a Dials method, those it says it dials);
+// addresses without one go to the first transport.
+type MultiTransport struct {
+	transports []Transport
+	rpcch      chan RPC
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+	wg        sync.WaitGroup
+}
+
+func NewMultiTransport(transports ...Transport) *MultiTransport {
+	return &MultiTransport{
+		transports: transports,
+		rpcch:      make(chan RPC),
+		closeCh:    make(chan struct{}),
+	}
+}
+
+// Transports : in the order given to NewMultiTransport.
+func (t *MultiTransport) Transports() []Transport {
+	return t.transports
+}
+
+func (t *MultiTransport) ListenAndAccept() error {
+	for i, tr := range t.transports {
+		if err := tr.ListenAndAccept(); err != nil {
+			for _, started := range t.transports[:i] {
+				started.Close()
+			}
+			return err
+		}
+	}
+
+	for _, tr := range t.transports {
+		t.wg.Add(1)
+		go t.forward(tr)
+	}
+	return nil
+}
+
+// forward : merges the RPCs of tr into those of t.
+func (t *MultiTransport) forward(tr Transport) {
+	defer t.wg.Done()
+
+	for {
+		select {
+		case rpc := <-tr.Consume():
+			select {
+			case t.rpcch <- rpc:
+			case <-t.closeCh:
+				return
+			}
+		case <-t.closeCh:
+			return
+		}
+	}
+}
+
+func (t *MultiTransport) Dial(addr string) error {
+	return t.transportFor(addr).Dial(addr)
+}
+
+func (t *MultiTransport) transportFor(addr string) Transport {
+	for _, tr := range t.transports {
+		if d, ok := tr.(interface{ Dials(string) bool }); ok {
+			if d.Dials(addr) {
+				return tr
+			}
+			continue
+		}
+		if scheme := schemeOf(tr.ListenAddress()); scheme != "" && scheme == schemeOf(addr) {
+			return tr
+		}
+	}
+	return t.transports[0]
+}
+
+// ListenAddress : that of the first transport.
+func (t *MultiTransport) ListenAddress() string {
+	return t.transports[0].ListenAddress()
+}
+
+func (t *MultiTransport) Consume() <-chan RPC {
+	return t.rpcch
+}
+
+func (t *MultiTransport) Close() error {
+	var errs []error
+	t.closeOnce.Do(func() {
+		close(t.closeCh)
+		for _, tr := range t.transports {
+			errs = append(errs, tr.Close())
+		}
+		t.wg.Wait()
+	})
+	return errors.Join(errs...)
+}
+
+// schemeOf : "quic://" for "quic://127.0.0.1:3000", "" for "127.0.0.1:3000".
+func schemeOf(addr string) string {
+	if i := strings.Index(addr, "://"); i >= 0 {
+		return addr[:i+len("://")]
+	}
+	return ""
+}
@@ -0,0 +1,30 @@
+package p2p
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+var errPeerCredUnsupported = errors.New("SO_PEERCRED not supported")
+
+// peerCred : credentials of the process at the other end of conn, from SO_PEERCRED.
+func peerCred(conn *net.UnixConn) (PeerCred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return PeerCred{}, err
+	}
+
+	var ucred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return PeerCred{}, err
+	}
+	if credErr != nil {
+		return PeerCred{}, credErr
+	}
+	return PeerCred{PID: int(ucred.Pid), UID: int(ucred.Uid), GID: int(ucred.Gid)}, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package p2p
+
+import (
+	"errors"
+	"net"
+)
+
+var errPeerCredUnsupported = errors.New("SO_PEERCRED not supported on this system")
+
+func peerCred(*net.UnixConn) (PeerCred, error) {
+	return PeerCred{}, errPeerCredUnsupported
+}
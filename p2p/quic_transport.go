@@ -0,0 +1,735 @@
+package p2p
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PsychoPunkSage/NexNet/logging"
+	"github.com/quic-go/quic-go"
+)
+
+// QUICScheme : prefix of QUIC addresses ("quic://127.0.0.1:4000"), telling them apart from TCP
+// ones when both transports are used (see MultiTransport).
+const QUICScheme = "quic://"
+
+// ALPN protocol of NexNet over QUIC.
+const quicALPN = "nexnet"
+
+const (
+	// First byte of a control stream, so that the accepting side sees it right away.
+	quicHello = 'N'
+	// How long a dial, or the opening of the control stream, may take.
+	quicHandshakeTimeout = 10 * time.Second
+	// Keeps idle connections from timing out (quic.Config.MaxIdleTimeout defaults to 30s).
+	quicKeepAlive = 15 * time.Second
+	// Incoming streams queued per peer, waiting to be read.
+	quicStreamQueue = 64
+	// Control stream frames above that size are refused.
+	quicMaxFrame = 1 << 20
+)
+
+type QUICTransportOpts struct {
+	// UDP address, with or without QUICScheme.
+	ListenAddr    string
+	HandshakeFunc HandshakeFunc
+	Decoder       Decoder
+	OnPeer        func(Peer) error
+	// Called once a peer accepted by OnPeer is disconnected, whichever side closed it.
+	OnPeerDisconnect func(Peer)
+	// Used on both ends: Certificates (and ClientAuth, ClientCAs) when accepting, RootCAs when
+	// dialing. Required, unless InsecureSkipVerify.
+	TLSConfig *tls.Config
+	// Without TLSConfig, an ephemeral self-signed certificate, and the peers' ones not verified:
+	// the connections are encrypted, yet anyone can connect or pose as the node dialed, as over
+	// TCP (files are encrypted end to end anyway). Off unless asked for.
+	InsecureSkipVerify bool
+	// Defaults to slog.Default().
+	Logger *slog.Logger
+	// Defaults to NopMetrics.
+	Metrics Metrics
+}
+
+// QUICTransport : Transport over QUIC. Messages go over a stream of their own, and every stream
+// (file transfer) opened with Peer.OpenStream gets a QUIC stream too: transfers don't block
+// messages, nor each other, the way they do on a TCP connection. Reconnections to a known node
+// use 0-RTT.
+//
+// Peers are authenticated by TLS, as per TLSConfig: e.g. certificates of a cluster CA, checked
+// both ways (ClientAuth: tls.RequireAndVerifyClientCert), each naming the addresses its node is
+// dialed at. See InsecureSkipVerify for no authentication.
+//
+// Connection migration is left out: quic-go doesn't implement it yet (a node changing address
+// reconnects instead).
+type QUICTransport struct {
+	QUICTransportOpts
+	listener *quic.EarlyListener
+	rpcch    chan RPC
+	log      *slog.Logger
+
+	serverTLS *tls.Config
+	clientTLS *tls.Config
+	config    *quic.Config
+
+	mu      sync.Mutex
+	conns   map[quic.EarlyConnection]struct{}
+	closed  bool
+	closeCh chan struct{}
+	// Accept loop + one handleConn per connection.
+	wg sync.WaitGroup
+}
+
+func NewQUICTransport(opts QUICTransportOpts) (*QUICTransport, error) {
+	opts.ListenAddr = strings.TrimPrefix(opts.ListenAddr, QUICScheme)
+	if opts.Metrics == nil {
+		opts.Metrics = NopMetrics{}
+	}
+
+	serverTLS := opts.TLSConfig
+	if serverTLS == nil && !opts.InsecureSkipVerify {
+		return nil, errors.New("QUIC transport: no TLSConfig, nor InsecureSkipVerify")
+	}
+	if serverTLS == nil {
+		cert, err := selfSignedCert()
+		if err != nil {
+			return nil, fmt.Errorf("generating QUIC certificate: %w", err)
+		}
+		serverTLS = &tls.Config{
+			Certificates:       []tls.Certificate{cert},
+			InsecureSkipVerify: true,
+		}
+	}
+	serverTLS = serverTLS.Clone()
+	serverTLS.NextProtos = []string{quicALPN}
+	serverTLS.InsecureSkipVerify = serverTLS.InsecureSkipVerify || opts.InsecureSkipVerify
+
+	clientTLS := serverTLS.Clone()
+	// Session tickets of the nodes dialed, for 0-RTT reconnections.
+	clientTLS.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+
+	return &QUICTransport{
+		QUICTransportOpts: opts,
+		rpcch:             make(chan RPC),
+		log:               logging.OrDefault(opts.Logger).With(logging.ListenAddr, QUICScheme+opts.ListenAddr),
+		serverTLS:         serverTLS,
+		clientTLS:         clientTLS,
+		config: &quic.Config{
+			Allow0RTT:       true,
+			KeepAlivePeriod: quicKeepAlive,
+		},
+		conns:   make(map[quic.EarlyConnection]struct{}),
+		closeCh: make(chan struct{}),
+	}, nil
+}
+
+func (t *QUICTransport) ListenAndAccept() error {
+	var err error
+
+	t.listener, err = quic.ListenAddrEarly(t.ListenAddr, t.serverTLS, t.config)
+	if err != nil {
+		return err
+	}
+
+	t.wg.Add(1)
+	go t.startAcceptLoop()
+
+	t.log.Info("QUIC transport listening")
+
+	return nil
+}
+
+// ListenAddress : with QUICScheme.
+func (t *QUICTransport) ListenAddress() string {
+	return QUICScheme + t.ListenAddr
+}
+
+func (t *QUICTransport) Consume() <-chan RPC {
+	return t.rpcch
+}
+
+// Close : stops accepting, closes every peer connection and waits for their goroutines to exit.
+func (t *QUICTransport) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	close(t.closeCh)
+
+	var err error
+	if t.listener != nil {
+		err = t.listener.Close()
+	}
+	for conn := range t.conns {
+		conn.CloseWithError(0, "transport closed")
+	}
+	t.mu.Unlock()
+
+	t.wg.Wait()
+	return err
+}
+
+// Dial : addr may have QUICScheme or not.
+func (t *QUICTransport) Dial(addr string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), quicHandshakeTimeout)
+	defer cancel()
+
+	conn, err := quic.DialAddrEarly(ctx, strings.TrimPrefix(addr, QUICScheme), t.clientTLS, t.config)
+	if err != nil {
+		return err
+	}
+
+	if !t.track(conn) {
+		conn.CloseWithError(0, "transport closed")
+		return net.ErrClosed
+	}
+	go t.handleConn(conn, true)
+
+	return nil
+}
+
+func (t *QUICTransport) track(conn quic.EarlyConnection) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return false
+	}
+	t.conns[conn] = struct{}{}
+	t.wg.Add(1)
+	return true
+}
+
+func (t *QUICTransport) untrack(conn quic.EarlyConnection) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.conns, conn)
+}
+
+func (t *QUICTransport) startAcceptLoop() {
+	defer t.wg.Done()
+
+	for {
+		conn, err := t.listener.Accept(context.Background())
+		if errors.Is(err, quic.ErrServerClosed) {
+			return
+		}
+		if err != nil {
+			t.log.Warn("QUIC accept error", "err", err)
+			continue
+		}
+
+		t.log.Debug("new incoming connection", logging.Peer, quicAddr{conn.RemoteAddr()}.String())
+		if !t.track(conn) {
+			conn.CloseWithError(0, "transport closed")
+			return
+		}
+		go t.handleConn(conn, false)
+	}
+}
+
+func (t *QUICTransport) handleConn(conn quic.EarlyConnection, outbound bool) {
+	var err error
+	remote := quicAddr{conn.RemoteAddr()}
+	addr := remote.String()
+	log := t.log.With(logging.Peer, addr)
+
+	defer func() {
+		log.Debug("dropping peer connection", "err", err)
+		conn.CloseWithError(0, "")
+		t.untrack(conn)
+		t.Metrics.ForgetPeer(addr)
+		t.wg.Done()
+	}()
+
+	control, err := openControlStream(conn, outbound)
+	if err != nil {
+		log.Warn("QUIC control stream error", "err", err)
+		t.Metrics.HandshakeFailed()
+		return
+	}
+
+	peer := newQUICPeer(conn, control, outbound, t.Metrics)
+	go peer.acceptStreams()
+
+	if err = t.HandshakeFunc(peer); err != nil {
+		log.Warn("QUIC handshake error", "err", err)
+		t.Metrics.HandshakeFailed()
+		return
+	}
+
+	if t.OnPeer != nil {
+		if err = t.OnPeer(peer); err != nil {
+			log.Info("peer rejected", "err", err)
+			return
+		}
+	}
+
+	if t.OnPeerDisconnect != nil {
+		defer t.OnPeerDisconnect(peer)
+	}
+
+	// Read Loop, of the control stream only: streams are read by the consumer meanwhile.
+	for {
+		rpc := RPC{}
+		err = t.Decoder.Decode(peer.control, &rpc)
+		if err != nil {
+			return
+		}
+		if rpc.Stream {
+			// Streams have QUIC streams of their own, see QUICPeer.OpenStream.
+			log.Warn("unexpected inline stream from peer, ignored")
+			continue
+		}
+
+		rpc.From = remote
+
+		select {
+		case t.rpcch <- rpc:
+		case <-t.closeCh:
+			return
+		}
+	}
+}
+
+// openControlStream : the dialer opens the stream and says hello first, in 0-RTT data when
+// resuming a connection. Should the peer reject it (e.g. it restarted since), the stream is gone:
+// it is opened again over the 1-RTT connection.
+func openControlStream(conn quic.EarlyConnection, outbound bool) (quic.Stream, error) {
+	ctx, cancel := context.WithTimeout(conn.Context(), quicHandshakeTimeout)
+	defer cancel()
+
+	if outbound {
+		stream, err := sayHello(ctx, conn)
+		if errors.Is(err, quic.Err0RTTRejected) {
+			conn.NextConnection()
+			stream, err = sayHello(ctx, conn)
+		}
+		return stream, err
+	}
+
+	stream, err := conn.AcceptStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	hello := make([]byte, 1)
+	stream.SetReadDeadline(time.Now().Add(quicHandshakeTimeout))
+	if _, err := io.ReadFull(stream, hello); err != nil {
+		return nil, err
+	}
+	stream.SetReadDeadline(time.Time{})
+	if hello[0] != quicHello {
+		return nil, ErrInvalidHandShake
+	}
+	return stream, nil
+}
+
+func sayHello(ctx context.Context, conn quic.EarlyConnection) (quic.Stream, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stream.Write([]byte{quicHello}); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-conn.HandshakeComplete():
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	// Streams rejected with the 0-RTT data fail from then on.
+	if _, err := stream.Write(nil); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// QUICPeer : a node over a QUIC connection. Write & Send go over the control stream, each call
+// being one frame, so that the reading side gets them one Read at a time (as the Decoders
+// expect). Read reads the oldest stream opened by the peer, until CloseStream.
+type QUICPeer struct {
+	conn     quic.Connection
+	control  *framedStream
+	outbound bool
+	remote   quicAddr
+	metrics  Metrics
+
+	incoming chan quic.ReceiveStream
+
+	mu sync.Mutex
+	// Stream being read, nil until the next Read.
+	current       quic.ReceiveStream
+	readDeadline  time.Time
+	readWait      *deadline
+	writeDeadline time.Time
+	// Streams opened and not closed yet.
+	outgoing map[*quicSendStream]struct{}
+	protocol Protocol
+}
+
+func newQUICPeer(conn quic.Connection, control quic.Stream, outbound bool, metrics Metrics) *QUICPeer {
+	p := &QUICPeer{
+		conn:     conn,
+		outbound: outbound,
+		remote:   quicAddr{conn.RemoteAddr()},
+		metrics:  metrics,
+		incoming: make(chan quic.ReceiveStream, quicStreamQueue),
+		readWait: newDeadline(),
+		outgoing: make(map[*quicSendStream]struct{}),
+	}
+	p.control = &framedStream{Stream: control, peer: p}
+	return p
+}
+
+func (p *QUICPeer) Outbound() bool {
+	return p.outbound
+}
+
+// acceptStreams : queues the streams opened by the peer, until the connection is gone.
+func (p *QUICPeer) acceptStreams() {
+	defer close(p.incoming)
+
+	for {
+		stream, err := p.conn.AcceptUniStream(p.conn.Context())
+		if err != nil {
+			return
+		}
+		select {
+		case p.incoming <- stream:
+		case <-p.conn.Context().Done():
+			return
+		}
+	}
+}
+
+func (p *QUICPeer) Send(data []byte) error {
+	_, err := p.Write(data)
+	return err
+}
+
+func (p *QUICPeer) Write(b []byte) (int, error) {
+	return p.control.Write(b)
+}
+
+func (p *QUICPeer) Read(b []byte) (int, error) {
+	stream, err := p.nextStream()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := stream.Read(b)
+	if n > 0 {
+		p.metrics.AddBytesIn(p.remote.String(), n)
+	}
+	return n, err
+}
+
+// nextStream : the stream being read, or else the next one opened by the peer.
+func (p *QUICPeer) nextStream() (quic.ReceiveStream, error) {
+	p.mu.Lock()
+	current, wait := p.current, p.readWait.wait()
+	p.mu.Unlock()
+	if current != nil {
+		return current, nil
+	}
+
+	select {
+	case stream, ok := <-p.incoming:
+		if !ok {
+			return nil, net.ErrClosed
+		}
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		stream.SetReadDeadline(p.readDeadline)
+		p.current = stream
+		p.metrics.StreamOpened()
+		return stream, nil
+	case <-wait:
+		return nil, os.ErrDeadlineExceeded
+	}
+}
+
+// OpenStream : a new QUIC stream; the peer reads it once done with the ones opened before.
+func (p *QUICPeer) OpenStream() (io.WriteCloser, error) {
+	ctx, cancel := context.WithTimeout(p.conn.Context(), quicHandshakeTimeout)
+	defer cancel()
+
+	stream, err := p.conn.OpenUniStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &quicSendStream{SendStream: stream, peer: p}
+	p.mu.Lock()
+	stream.SetWriteDeadline(p.writeDeadline)
+	p.outgoing[s] = struct{}{}
+	p.mu.Unlock()
+	return s, nil
+}
+
+// CloseStream : done with the stream being read; the rest of it, if any, is dropped.
+func (p *QUICPeer) CloseStream() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.current == nil {
+		return
+	}
+	p.current.CancelRead(0)
+	p.current = nil
+	p.metrics.StreamClosed()
+}
+
+// Protocol : as negotiated by VersionHandshake.
+func (p *QUICPeer) Protocol() Protocol {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.protocol
+}
+
+func (p *QUICPeer) setProtocol(protocol Protocol) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.protocol = protocol
+}
+
+// handshakeConn : the control stream, read by nothing else yet.
+func (p *QUICPeer) handshakeConn() handshakeConn {
+	return p.control
+}
+
+// ConnectionState : of the QUIC connection (e.g. whether 0-RTT was used).
+func (p *QUICPeer) ConnectionState() quic.ConnectionState {
+	return p.conn.ConnectionState()
+}
+
+func (p *QUICPeer) Close() error {
+	return p.conn.CloseWithError(0, "")
+}
+
+func (p *QUICPeer) LocalAddr() net.Addr  { return quicAddr{p.conn.LocalAddr()} }
+func (p *QUICPeer) RemoteAddr() net.Addr { return p.remote }
+
+func (p *QUICPeer) SetDeadline(t time.Time) error {
+	p.SetReadDeadline(t)
+	return p.SetWriteDeadline(t)
+}
+
+func (p *QUICPeer) SetReadDeadline(t time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.readDeadline = t
+	p.readWait.set(t)
+	if p.current != nil {
+		p.current.SetReadDeadline(t)
+	}
+	return p.control.SetReadDeadline(t)
+}
+
+func (p *QUICPeer) SetWriteDeadline(t time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.writeDeadline = t
+	for s := range p.outgoing {
+		s.SetWriteDeadline(t)
+	}
+	return p.control.SetWriteDeadline(t)
+}
+
+type quicSendStream struct {
+	quic.SendStream
+	peer *QUICPeer
+}
+
+func (s *quicSendStream) Write(b []byte) (int, error) {
+	n, err := s.SendStream.Write(b)
+	if n > 0 {
+		s.peer.metrics.AddBytesOut(s.peer.remote.String(), n)
+	}
+	return n, err
+}
+
+func (s *quicSendStream) Close() error {
+	s.peer.mu.Lock()
+	delete(s.peer.outgoing, s)
+	s.peer.mu.Unlock()
+
+	return s.SendStream.Close()
+}
+
+// framedStream : keeps the boundaries of Writes on a QUIC stream (which, like TCP, has none):
+// every Write is sent as a frame (uvarint length + data), read back by one or more Reads but never
+// merged with the next one.
+type framedStream struct {
+	quic.Stream
+	peer *QUICPeer
+
+	writeMu sync.Mutex
+	// Bytes of the current frame not read yet.
+	left int
+}
+
+func (s *framedStream) Write(b []byte) (int, error) {
+	frame := binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen64+len(b)), uint64(len(b)))
+	frame = append(frame, b...)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if _, err := s.Stream.Write(frame); err != nil {
+		return 0, err
+	}
+	s.peer.metrics.AddBytesOut(s.peer.remote.String(), len(frame))
+	return len(b), nil
+}
+
+// Read : single reader (the read loop).
+func (s *framedStream) Read(b []byte) (int, error) {
+	for s.left == 0 {
+		size, err := binary.ReadUvarint(byteReader{s.Stream})
+		if err != nil {
+			return 0, err
+		}
+		if size > quicMaxFrame {
+			return 0, fmt.Errorf("QUIC frame of %d bytes: over the limit of %d", size, quicMaxFrame)
+		}
+		s.left = int(size)
+	}
+
+	if len(b) > s.left {
+		b = b[:s.left]
+	}
+	n, err := s.Stream.Read(b)
+	s.left -= n
+	if n > 0 {
+		s.peer.metrics.AddBytesIn(s.peer.remote.String(), n)
+	}
+	return n, err
+}
+
+type byteReader struct {
+	io.Reader
+}
+
+func (r byteReader) ReadByte() (byte, error) {
+	b := make([]byte, 1)
+	_, err := io.ReadFull(r.Reader, b)
+	return b[0], err
+}
+
+// quicAddr : a UDP address, written with QUICScheme.
+type quicAddr struct {
+	net.Addr
+}
+
+func (a quicAddr) Network() string { return "quic" }
+func (a quicAddr) String() string  { return QUICScheme + a.Addr.String() }
+
+// deadline : a deadline a wait can select on, as in net.Pipe.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{} // Closed once the deadline has passed.
+}
+
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // Wait for the timer callback to finish and close cancel.
+	}
+	d.timer = nil
+
+	closed := isClosed(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.cancel
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// selfSignedCert : an ephemeral certificate for the QUIC handshake.
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{quicALPN},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,272 @@
+package p2p
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newQUICTransport : listening on a random loopback port, peers not authenticated.
+func newQUICTransport(t *testing.T, peers chan Peer) *QUICTransport {
+	return newQUICTransportTLS(t, peers, nil)
+}
+
+// newQUICTransportTLS : listening on a random loopback port, with tlsConfig if not nil.
+func newQUICTransportTLS(t *testing.T, peers chan Peer, tlsConfig *tls.Config) *QUICTransport {
+	tr, err := NewQUICTransport(QUICTransportOpts{
+		ListenAddr:         "127.0.0.1:0",
+		HandshakeFunc:      NOPHandshakeFunc,
+		Decoder:            DefaultDecoder{},
+		TLSConfig:          tlsConfig,
+		InsecureSkipVerify: tlsConfig == nil,
+		OnPeer: func(p Peer) error {
+			peers <- p
+			return nil
+		},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, tr.ListenAndAccept())
+	// The port picked by the system.
+	tr.ListenAddr = tr.listener.Addr().String()
+	t.Cleanup(func() { tr.Close() })
+	return tr
+}
+
+func nextPeer(t *testing.T, peers chan Peer) *QUICPeer {
+	t.Helper()
+
+	select {
+	case p := <-peers:
+		return p.(*QUICPeer)
+	case <-time.After(2 * time.Second):
+		t.Fatal("no peer connected")
+		return nil
+	}
+}
+
+func TestQUICTransport(t *testing.T) {
+	aPeers, bPeers := make(chan Peer, 4), make(chan Peer, 4)
+	a, b := newQUICTransport(t, aPeers), newQUICTransport(t, bPeers)
+	assert.Equal(t, "quic://"+a.ListenAddr, a.ListenAddress())
+
+	assert.Nil(t, b.Dial(a.ListenAddress()))
+	toA, toB := nextPeer(t, bPeers), nextPeer(t, aPeers)
+	assert.Equal(t, a.ListenAddress(), toA.RemoteAddr().String())
+
+	// Every Send is read on its own.
+	assert.Nil(t, toA.Send([]byte{IncomingMessage}))
+	assert.Nil(t, toA.Send([]byte("hello")))
+	rpc := receive(t, a)
+	assert.Equal(t, []byte("hello"), rpc.Payload)
+	assert.Equal(t, toB.RemoteAddr(), rpc.From)
+
+	// Streams are read one after the other, in the order they were opened, whatever the order
+	// they are written in. What is left of a stream on CloseStream is dropped.
+	first, err := toA.OpenStream()
+	assert.Nil(t, err)
+	second, err := toA.OpenStream()
+	assert.Nil(t, err)
+	_, err = second.Write([]byte("second"))
+	assert.Nil(t, err)
+	assert.Nil(t, second.Close())
+	_, err = first.Write([]byte("first, and more"))
+	assert.Nil(t, err)
+	assert.Nil(t, first.Close())
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(toB, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "first", string(buf))
+	toB.CloseStream()
+
+	got, err := io.ReadAll(toB)
+	assert.Nil(t, err)
+	assert.Equal(t, "second", string(got))
+	toB.CloseStream()
+
+	// Messages keep flowing meanwhile.
+	assert.Nil(t, toB.Send([]byte{IncomingMessage}))
+	assert.Nil(t, toB.Send([]byte("bye")))
+	assert.Equal(t, []byte("bye"), receive(t, b).Payload)
+}
+
+func TestQUICTransportReadDeadline(t *testing.T) {
+	aPeers, bPeers := make(chan Peer, 4), make(chan Peer, 4)
+	a, b := newQUICTransport(t, aPeers), newQUICTransport(t, bPeers)
+
+	assert.Nil(t, b.Dial(a.ListenAddress()))
+	nextPeer(t, bPeers)
+	toB := nextPeer(t, aPeers)
+
+	// No stream opened by b: waiting for one times out.
+	toB.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := toB.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
+
+func TestQUICTransport0RTT(t *testing.T) {
+	aPeers, bPeers := make(chan Peer, 4), make(chan Peer, 4)
+	a, b := newQUICTransport(t, aPeers), newQUICTransport(t, bPeers)
+
+	assert.Nil(t, b.Dial(a.ListenAddress()))
+	toA := nextPeer(t, bPeers)
+	nextPeer(t, aPeers)
+	assert.False(t, toA.ConnectionState().Used0RTT)
+
+	// The session ticket comes after the handshake: give it a round trip to arrive.
+	assert.Nil(t, toA.Send([]byte{IncomingMessage}))
+	assert.Nil(t, toA.Send([]byte("ping")))
+	receive(t, a)
+	time.Sleep(50 * time.Millisecond)
+	toA.Close()
+
+	assert.Nil(t, b.Dial(a.ListenAddress()))
+	toA = nextPeer(t, bPeers)
+	nextPeer(t, aPeers)
+	assert.True(t, toA.ConnectionState().Used0RTT)
+
+	assert.Nil(t, toA.Send([]byte{IncomingMessage}))
+	assert.Nil(t, toA.Send([]byte("resumed")))
+	assert.Equal(t, []byte("resumed"), receive(t, a).Payload)
+}
+
+// testCA : a CA, issuing certificates for 127.0.0.1.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// tlsConfig : of a node of the cluster, peers checked both ways.
+func (ca *testCA) tlsConfig(t *testing.T, serial int64) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	assert.Nil(t, err)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		RootCAs:      ca.pool,
+		ClientCAs:    ca.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+}
+
+func TestQUICTransportTLS(t *testing.T) {
+	_, err := NewQUICTransport(QUICTransportOpts{ListenAddr: "127.0.0.1:0"})
+	assert.NotNil(t, err, "neither TLSConfig nor InsecureSkipVerify")
+
+	ca := newTestCA(t)
+	aPeers, bPeers, cPeers := make(chan Peer, 4), make(chan Peer, 4), make(chan Peer, 4)
+	a := newQUICTransportTLS(t, aPeers, ca.tlsConfig(t, 2))
+	b := newQUICTransportTLS(t, bPeers, ca.tlsConfig(t, 3))
+	// Not of the cluster.
+	c := newQUICTransport(t, cPeers)
+
+	assert.Nil(t, b.Dial(a.ListenAddress()))
+	nextPeer(t, bPeers)
+	nextPeer(t, aPeers)
+
+	// c's certificate isn't the CA's: refused both ways.
+	assert.NotNil(t, b.Dial(c.ListenAddress()))
+	c.Dial(a.ListenAddress())
+	select {
+	case <-aPeers:
+		t.Fatal("peer without a certificate of the CA accepted")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestMultiTransport(t *testing.T) {
+	network := NewMemNetwork(MemNetworkOpts{})
+	newOpts := func(addr string, peers chan Peer) TCPTransportOpts {
+		return TCPTransportOpts{
+			ListenAddr:    addr,
+			HandshakeFunc: NOPHandshakeFunc,
+			Decoder:       DefaultDecoder{},
+			OnPeer: func(p Peer) error {
+				peers <- p
+				return nil
+			},
+		}
+	}
+
+	peers := make(chan Peer, 4)
+	q, err := NewQUICTransport(QUICTransportOpts{
+		ListenAddr:         "127.0.0.1:0",
+		HandshakeFunc:      NOPHandshakeFunc,
+		Decoder:            DefaultDecoder{},
+		InsecureSkipVerify: true,
+		OnPeer: func(p Peer) error {
+			peers <- p
+			return nil
+		},
+	})
+	assert.Nil(t, err)
+	multi := NewMultiTransport(network.NewTransport(newOpts("node-m", peers)), q)
+	assert.Nil(t, multi.ListenAndAccept())
+	defer multi.Close()
+	assert.Equal(t, "node-m", multi.ListenAddress())
+
+	// Addresses go to the transport of their scheme, and the messages of both come out of Consume.
+	memPeers := make(chan Peer, 4)
+	mem := network.NewTransport(newOpts("node-x", memPeers))
+	assert.Nil(t, mem.ListenAndAccept())
+	defer mem.Close()
+	assert.Nil(t, multi.Dial("node-x"))
+	assert.Equal(t, "node-x", (<-peers).RemoteAddr().String())
+	toMulti := <-memPeers
+	assert.Nil(t, toMulti.Send([]byte{IncomingMessage}))
+	assert.Nil(t, toMulti.Send([]byte("over mem")))
+	assert.Equal(t, []byte("over mem"), receive(t, multi).Payload)
+
+	quicPeers := make(chan Peer, 4)
+	remote := newQUICTransport(t, quicPeers)
+	assert.Nil(t, multi.Dial(remote.ListenAddress()))
+	assert.Equal(t, remote.ListenAddress(), nextPeer(t, peers).RemoteAddr().String())
+	toMulti = nextPeer(t, quicPeers)
+	assert.Nil(t, toMulti.Send([]byte{IncomingMessage}))
+	assert.Nil(t, toMulti.Send([]byte("over QUIC")))
+	assert.Equal(t, []byte("over QUIC"), receive(t, multi).Payload)
+}
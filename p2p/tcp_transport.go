@@ -1,11 +1,16 @@
 package p2p
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
 	"sync"
+	"time"
+
+	"github.com/PsychoPunkSage/NexNet/logging"
 )
 
 // TCPPeer: represents a node over TCP connection.
@@ -18,24 +23,234 @@ type TCPPeer struct {
 	*/
 	outbound bool
 
-	wg *sync.WaitGroup
+	// Signals the read loop that the consumer is done with the current stream.
+	streamDone chan struct{}
+	// Closed by Close, for the read loop not to wait on a stream that will never be done.
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// Held for each frame written, and by an open stream until closed: frames don't interleave.
+	writeLock    sync.Mutex
+	writeTimeout time.Duration
+
+	// Nil when unlimited.
+	bandwidth *Bandwidth
+
+	mu       sync.Mutex
+	protocol Protocol
+	rtt      time.Duration
+	// Last message or stream sent or received.
+	active time.Time
+	// Of the incoming stream.
+	readPriority Priority
 }
 
 func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
 	return &TCPPeer{
-		Conn:     conn,
-		outbound: outbound,
-		wg:       &sync.WaitGroup{},
+		Conn:       conn,
+		outbound:   outbound,
+		streamDone: make(chan struct{}, 1),
+		closed:     make(chan struct{}),
+		active:     time.Now(),
 	}
 }
 
+// Close : closes the connection, and ends the read loop even amid a stream.
+func (p *TCPPeer) Close() error {
+	p.closeOnce.Do(func() { close(p.closed) })
+	return p.Conn.Close()
+}
+
+func (p *TCPPeer) Outbound() bool {
+	return p.outbound
+}
+
 func (p *TCPPeer) Send(data []byte) error {
+	p.writeLock.Lock()
+	defer p.writeLock.Unlock()
+
+	p.touch()
+	return p.write(data)
+}
+
+// write : must hold writeLock.
+func (p *TCPPeer) write(data []byte) error {
+	if p.writeTimeout > 0 {
+		p.Conn.SetWriteDeadline(time.Now().Add(p.writeTimeout))
+	}
 	_, err := p.Conn.Write(data)
 	return err
 }
 
+// Read : reads of the incoming stream, throttled by the bandwidth limits.
+func (p *TCPPeer) Read(b []byte) (int, error) {
+	if p.bandwidth == nil {
+		return p.Conn.Read(b)
+	}
+
+	if len(b) > bandwidthChunk {
+		b = b[:bandwidthChunk]
+	}
+	n, err := p.Conn.Read(b)
+	if n > 0 {
+		p.mu.Lock()
+		priority := p.readPriority
+		p.mu.Unlock()
+		// Reading less makes the sender send less.
+		p.bandwidth.wait(p.RemoteAddr().String(), inbound, priority, n)
+	}
+	return n, err
+}
+
+// OpenStream : streams are inline on the connection, after an IncomingStream byte. The read loop
+// of the peer stays paused until its consumer calls CloseStream. Nothing else is written to the
+// connection until the stream is closed.
+func (p *TCPPeer) OpenStream() (io.WriteCloser, error) {
+	return p.OpenStreamPriority(Foreground)
+}
+
+// OpenStreamPriority : implements PriorityPeer.
+func (p *TCPPeer) OpenStreamPriority(priority Priority) (io.WriteCloser, error) {
+	p.writeLock.Lock()
+	p.touch()
+	if err := p.write([]byte{IncomingStream}); err != nil {
+		p.writeLock.Unlock()
+		return nil, err
+	}
+	return &tcpStream{peer: p, priority: priority}, nil
+}
+
+// SetReadPriority : implements PriorityPeer.
+func (p *TCPPeer) SetReadPriority(priority Priority) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.readPriority = priority
+}
+
+type tcpStream struct {
+	peer      *TCPPeer
+	priority  Priority
+	closeOnce sync.Once
+}
+
+func (s *tcpStream) Write(b []byte) (int, error) {
+	if s.peer.bandwidth == nil {
+		return s.write(b)
+	}
+
+	written := 0
+	for len(b) > 0 {
+		chunk := b[:min(len(b), bandwidthChunk)]
+		s.peer.bandwidth.wait(s.peer.RemoteAddr().String(), outbound, s.priority, len(chunk))
+		n, err := s.write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (s *tcpStream) write(b []byte) (int, error) {
+	if s.peer.writeTimeout > 0 {
+		s.peer.Conn.SetWriteDeadline(time.Now().Add(s.peer.writeTimeout))
+	}
+	return s.peer.Conn.Write(b)
+}
+
+func (s *tcpStream) Close() error {
+	s.closeOnce.Do(func() {
+		s.peer.touch()
+		s.peer.writeLock.Unlock()
+	})
+	return nil
+}
+
 func (p *TCPPeer) CloseStream() {
-	p.wg.Done()
+	p.touch()
+	p.SetReadPriority(Foreground)
+	select {
+	case p.streamDone <- struct{}{}:
+	default:
+	}
+}
+
+// Protocol : as negotiated by VersionHandshake.
+func (p *TCPPeer) Protocol() Protocol {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.protocol
+}
+
+func (p *TCPPeer) setProtocol(protocol Protocol) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.protocol = protocol
+}
+
+func (p *TCPPeer) handshakeConn() handshakeConn {
+	return p.Conn
+}
+
+// RTT : round-trip time of the last ping answered by the peer; 0 without heartbeats.
+func (p *TCPPeer) RTT() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.rtt
+}
+
+// ping : sends a ping, unless a stream is being written (which keeps the connection busy anyway).
+func (p *TCPPeer) ping() error {
+	if !p.writeLock.TryLock() {
+		return nil
+	}
+	defer p.writeLock.Unlock()
+
+	return p.write(heartbeatFrame(IncomingPing, uint64(time.Since(heartbeatEpoch))))
+}
+
+// handleHeartbeat : answers a ping, or measures the RTT from a pong.
+func (p *TCPPeer) handleHeartbeat(rpc RPC) error {
+	if len(rpc.Payload) != heartbeatSize {
+		return fmt.Errorf("invalid heartbeat frame of %d bytes", len(rpc.Payload))
+	}
+	stamp := binary.BigEndian.Uint64(rpc.Payload)
+
+	if rpc.Heartbeat == IncomingPong {
+		if rtt := time.Since(heartbeatEpoch) - time.Duration(stamp); rtt >= 0 {
+			p.mu.Lock()
+			p.rtt = rtt
+			p.mu.Unlock()
+		}
+		return nil
+	}
+
+	// Not while a stream is being written: the peer hears from us anyway.
+	if !p.writeLock.TryLock() {
+		return nil
+	}
+	defer p.writeLock.Unlock()
+	return p.write(heartbeatFrame(IncomingPong, stamp))
+}
+
+// touch : records activity on the connection, for the idle timeout.
+func (p *TCPPeer) touch() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.active = time.Now()
+}
+
+func (p *TCPPeer) lastActive() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.active
 }
 
 type TCPTransportOpts struct {
@@ -43,32 +258,70 @@ type TCPTransportOpts struct {
 	HandshakeFunc HandshakeFunc
 	Decoder       Decoder
 	OnPeer        func(Peer) error
+	// Called once a peer accepted by OnPeer is disconnected, whichever side closed it.
+	OnPeerDisconnect func(Peer)
+	// Defaults to slog.Default().
+	Logger *slog.Logger
+	// Defaults to NopMetrics.
+	Metrics Metrics
+	// Pings and timeouts of the connections; disabled by default.
+	Heartbeat Heartbeat
+	// Limits on the streams; nil means unlimited. May be shared with other transports.
+	Bandwidth *Bandwidth
 }
 
 type TCPTransport struct {
 	TCPTransportOpts
 	listener net.Listener
 	rpcch    chan RPC
+	log      *slog.Logger
+
+	// net.Listen & net.Dial over TCP, swapped by MemNetwork for in-memory connections, and by
+	// WSTransport for WebSockets.
+	name   string
+	listen func(addr string) (net.Listener, error)
+	dial   func(addr string) (net.Conn, error)
+
+	mu      sync.Mutex
+	conns   map[net.Conn]struct{}
+	closed  bool
+	closeCh chan struct{}
+	// Accept loop + one handleConn per connection.
+	wg sync.WaitGroup
 }
 
 func NewTCPTransport(opts TCPTransportOpts) *TCPTransport {
+	if opts.Metrics == nil {
+		opts.Metrics = NopMetrics{}
+	}
 	return &TCPTransport{
 		TCPTransportOpts: opts,
 		rpcch:            make(chan RPC),
+		log:              logging.OrDefault(opts.Logger).With(logging.ListenAddr, opts.ListenAddr),
+		conns:            make(map[net.Conn]struct{}),
+		closeCh:          make(chan struct{}),
+		name:             "TCP",
+		listen: func(addr string) (net.Listener, error) {
+			return net.Listen("tcp", addr)
+		},
+		dial: func(addr string) (net.Conn, error) {
+			return net.Dial("tcp", addr)
+		},
 	}
 }
 
 func (t *TCPTransport) ListenAndAccept() error {
 	var err error
 
-	t.listener, err = net.Listen("tcp", t.ListenAddr)
+	t.listener, err = t.listen(t.ListenAddr)
 	if err != nil {
 		return err
 	}
 
+	t.wg.Add(1)
 	go t.startAcceptLoop()
 
-	log.Printf("TCP transport listening on %s\n", t.ListenAddr)
+	t.log.Info(t.name + " transport listening")
 
 	return nil
 }
@@ -84,23 +337,68 @@ func (t *TCPTransport) Consume() <-chan RPC {
 }
 
 // Close: implements transport interface.
+// Stops accepting, closes every peer connection and waits for their goroutines to exit.
 func (t *TCPTransport) Close() error {
-	return t.listener.Close()
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	close(t.closeCh)
+
+	var err error
+	if t.listener != nil {
+		err = t.listener.Close()
+	}
+	for conn := range t.conns {
+		conn.Close()
+	}
+	t.mu.Unlock()
+
+	t.wg.Wait()
+	return err
 }
 
 // Dial: implements transport interface.
 func (t *TCPTransport) Dial(addr string) error {
-	conn, err := net.Dial("tcp", addr)
+	conn, err := t.dial(addr)
 	if err != nil {
 		return err
 	}
 
+	if !t.track(conn) {
+		conn.Close()
+		return net.ErrClosed
+	}
 	go t.handleConn(conn, true)
 
 	return nil
 }
 
+// track : registers a new connection, unless the transport is closed.
+func (t *TCPTransport) track(conn net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return false
+	}
+	t.conns[conn] = struct{}{}
+	t.wg.Add(1)
+	return true
+}
+
+func (t *TCPTransport) untrack(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.conns, conn)
+}
+
 func (t *TCPTransport) startAcceptLoop() {
+	defer t.wg.Done()
+
 	for {
 		conn, err := t.listener.Accept()
 
@@ -110,57 +408,112 @@ func (t *TCPTransport) startAcceptLoop() {
 		}
 
 		if err != nil {
-			fmt.Println("TCP accept error:", err)
+			t.log.Warn("TCP accept error", "err", err)
+			continue
 		}
 
-		fmt.Printf("new incoming connection: %+v\n", conn)
+		t.log.Debug("new incoming connection", logging.Peer, conn.RemoteAddr().String())
+		if !t.track(conn) {
+			conn.Close()
+			return
+		}
 		go t.handleConn(conn, false)
 	}
 }
 
 func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 	var err error
+	addr := conn.RemoteAddr().String()
+	log := t.log.With(logging.Peer, addr)
 
 	defer func() {
-		fmt.Println("Dropping Peer Connection:", err)
+		log.Debug("dropping peer connection", "err", err)
 		conn.Close()
+		t.untrack(conn)
+		t.Metrics.ForgetPeer(addr)
+		t.wg.Done()
 	}()
 
-	peer := NewTCPPeer(conn, outbound)
+	peer := NewTCPPeer(&meteredConn{Conn: conn, peer: addr, metrics: t.Metrics}, outbound)
+	if t.Heartbeat.enabled() {
+		peer.writeTimeout = t.Heartbeat.writeTimeout()
+	}
+	if t.Bandwidth != nil {
+		peer.bandwidth = t.Bandwidth
+		defer t.Bandwidth.forget(addr)
+	}
 
 	if err = t.HandshakeFunc(peer); err != nil {
-		fmt.Println("TCP Handshake Error:", err)
+		log.Warn("TCP handshake error", "err", err)
+		t.Metrics.HandshakeFailed()
 		return
 	}
 
 	if t.OnPeer != nil {
 		if err = t.OnPeer(peer); err != nil {
-			// fmt.Println("TCP OnPeer Error:", err)
+			log.Info("peer rejected", "err", err)
 			return
 		}
 	}
 
+	if t.OnPeerDisconnect != nil {
+		defer t.OnPeerDisconnect(peer)
+	}
+
+	if t.Heartbeat.enabled() {
+		done := make(chan struct{})
+		defer close(done)
+		t.wg.Add(1)
+		go t.heartbeat(peer, done)
+	}
+
 	// Read Loop
 	for {
+		if t.Heartbeat.enabled() {
+			peer.Conn.SetReadDeadline(time.Now().Add(t.Heartbeat.readTimeout()))
+		}
+
 		rpc := RPC{}
-		err = t.Decoder.Decode(conn, &rpc)
-		// fmt.Println(reflect.TypeOf(err))
-		// panic(err)
-		if err == net.ErrClosed {
+		err = t.Decoder.Decode(peer.Conn, &rpc)
+		if err != nil {
+			// Closed by either side, broken, or silent for too long: nothing more will ever be read.
 			return
 		}
 
 		rpc.From = conn.RemoteAddr()
 
+		if rpc.Heartbeat != 0 {
+			if err = peer.handleHeartbeat(rpc); err != nil {
+				return
+			}
+			continue
+		}
+		peer.touch()
+
 		if rpc.Stream {
-			peer.wg.Add(1)
-			fmt.Printf("[%s] Incoming Stream, waiting...\n", rpc.From)
-			peer.wg.Wait()
-			fmt.Printf("[%s] Stream Closed,resuming read loop\n", rpc.From)
-			fmt.Println("=============================================================")
+			log.Debug("incoming stream, waiting")
+			// The consumer reads at its own pace.
+			peer.Conn.SetReadDeadline(time.Time{})
+			t.Metrics.StreamOpened()
+			select {
+			case <-peer.streamDone:
+				t.Metrics.StreamClosed()
+			case <-peer.closed:
+				t.Metrics.StreamClosed()
+				return
+			case <-t.closeCh:
+				t.Metrics.StreamClosed()
+				return
+			}
+			log.Debug("stream closed, resuming read loop")
 			continue
 		}
 
-		t.rpcch <- rpc // pass the received RPC message to another part of the program for further processing.
+		// pass the received RPC message to another part of the program for further processing.
+		select {
+		case t.rpcch <- rpc:
+		case <-t.closeCh:
+			return
+		}
 	}
 }
@@ -13,6 +13,7 @@ func TestTCPTransport(t *testing.T) {
 		Decoder:       DefaultDecoder{},
 	}
 	tr := NewTCPTransport(opts)
+	defer tr.Close()
 	assert.Equal(t, tr.ListenAddr, ":4000")
 
 	// Server
@@ -1,6 +1,7 @@
 package p2p
 
 import (
+	"io"
 	"net"
 )
 
@@ -8,9 +9,18 @@ import (
 type Peer interface {
 	net.Conn
 	Send([]byte) error
+	// OpenStream : starts a stream (e.g. a file) to the peer, which reads it from its Peer until
+	// calling CloseStream. Close it once written.
+	OpenStream() (io.WriteCloser, error)
 	CloseStream()
 }
 
+// DirectedPeer : a peer knowing which end opened the connection.
+type DirectedPeer interface {
+	// Outbound : whether the connection was dialed, rather than accepted.
+	Outbound() bool
+}
+
 // Transport: Anything that handle communication between node in the Network.
 // This can be of form TCP, UDP, websockets, etc.
 type Transport interface {
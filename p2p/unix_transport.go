@@ -0,0 +1,209 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/PsychoPunkSage/NexNet/logging"
+)
+
+// UnixScheme : prefix of Unix socket addresses ("unix:///run/nexnet.sock").
+const UnixScheme = "unix://"
+
+type UnixTransportOpts struct {
+	// ListenAddr is the path of the socket, with or without UnixScheme.
+	TCPTransportOpts
+	// Permissions of the socket file, the first access control: connecting takes write permission.
+	// Defaults to 0600, i.e. processes of the node's user only.
+	Mode os.FileMode
+	// Group the socket file is given to, for Mode to let its members in; -1 (or 0) keeps the default.
+	GID int
+	// UIDs allowed to connect, checked with SO_PEERCRED; any if empty. Linux only: other
+	// systems refuse every connection when set.
+	AllowUIDs []int
+}
+
+// UnixTransport : Transport over Unix domain sockets, for processes on the same host as the node
+// (e.g. sidecars), without TCP overhead nor an exposed port. The connection handling is that of
+// TCPTransport. The credentials of the process at the other end are given by UnixPeerCred.
+type UnixTransport struct {
+	*TCPTransport
+	opts UnixTransportOpts
+	// Numbers accepted connections, so that several of one process get distinct addresses.
+	accepted atomic.Int64
+}
+
+func NewUnixTransport(opts UnixTransportOpts) *UnixTransport {
+	opts.ListenAddr = strings.TrimPrefix(opts.ListenAddr, UnixScheme)
+	if opts.Mode == 0 {
+		opts.Mode = 0o600
+	}
+
+	t := &UnixTransport{
+		TCPTransport: NewTCPTransport(opts.TCPTransportOpts),
+		opts:         opts,
+	}
+	t.name = "Unix socket"
+	t.listen = t.listenUnix
+	t.dial = t.dialUnix
+
+	return t
+}
+
+// ListenAddress : with UnixScheme.
+func (t *UnixTransport) ListenAddress() string {
+	return UnixScheme + t.ListenAddr
+}
+
+// Dials : whether addr is a Unix socket address (see MultiTransport).
+func (t *UnixTransport) Dials(addr string) bool {
+	return strings.HasPrefix(addr, UnixScheme)
+}
+
+// listenUnix : the listen hook of the TCPTransport. A socket file left by a node that is gone is
+// replaced; one still in use is not.
+func (t *UnixTransport) listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode().Type() == os.ModeSocket {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("listen unix %s: address already in use", path)
+		}
+		os.Remove(path)
+	}
+
+	// Bound to a temporary name until its permissions are set: nobody gets in before.
+	tmp := fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+	os.Remove(tmp)
+	ln, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	err = os.Chmod(tmp, t.opts.Mode)
+	if err == nil && t.opts.GID > 0 {
+		err = os.Chown(tmp, -1, t.opts.GID)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		ln.Close()
+		os.Remove(tmp)
+		return nil, err
+	}
+
+	return &unixListener{Listener: ln, transport: t, path: path}, nil
+}
+
+func (t *UnixTransport) dialUnix(addr string) (net.Conn, error) {
+	path := strings.TrimPrefix(addr, UnixScheme)
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// The node's credentials, for the record: a node is trusted by its path.
+	cred, err := peerCred(conn.(*net.UnixConn))
+	return &unixConn{
+		Conn:    conn,
+		local:   unixAddr(UnixScheme),
+		remote:  unixAddr(UnixScheme + path),
+		cred:    cred,
+		hasCred: err == nil,
+	}, nil
+}
+
+// unixListener : checks the credentials of the processes connecting.
+type unixListener struct {
+	net.Listener
+	transport *UnixTransport
+	path      string
+}
+
+func (l *unixListener) Accept() (net.Conn, error) {
+	t := l.transport
+
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		cred, err := peerCred(conn.(*net.UnixConn))
+		if err == nil && len(t.opts.AllowUIDs) > 0 && !slices.Contains(t.opts.AllowUIDs, cred.UID) {
+			err = fmt.Errorf("uid %d not allowed", cred.UID)
+		}
+		if err != nil && (len(t.opts.AllowUIDs) > 0 || !errors.Is(err, errPeerCredUnsupported)) {
+			t.log.Warn("unix socket connection refused", "err", err, "pid", cred.PID, "uid", cred.UID)
+			t.Metrics.HandshakeFailed()
+			conn.Close()
+			continue
+		}
+
+		// Clients have no address of their own.
+		addr := fmt.Sprintf("%s%s?pid=%d&uid=%d#%d", UnixScheme, t.ListenAddr, cred.PID, cred.UID, t.accepted.Add(1))
+		t.log.Debug("unix socket connection", logging.Peer, addr, "pid", cred.PID, "uid", cred.UID, "gid", cred.GID)
+		return &unixConn{
+			Conn:    conn,
+			local:   unixAddr(t.ListenAddress()),
+			remote:  unixAddr(addr),
+			cred:    cred,
+			hasCred: err == nil,
+		}, nil
+	}
+}
+
+// Close : removes the socket file too.
+func (l *unixListener) Close() error {
+	err := l.Listener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return unixAddr(l.transport.ListenAddress())
+}
+
+// PeerCred : credentials of a process at the other end of a Unix socket, when it connected.
+type PeerCred struct {
+	PID, UID, GID int
+}
+
+// UnixPeerCred : credentials of the process behind a peer of a UnixTransport. False for other
+// peers, or if the system doesn't tell them (SO_PEERCRED is Linux only).
+func UnixPeerCred(p Peer) (PeerCred, bool) {
+	tcpPeer, ok := p.(*TCPPeer)
+	if !ok {
+		return PeerCred{}, false
+	}
+	conn := tcpPeer.Conn
+	if metered, ok := conn.(*meteredConn); ok {
+		conn = metered.Conn
+	}
+	unix, ok := conn.(*unixConn)
+	if !ok || !unix.hasCred {
+		return PeerCred{}, false
+	}
+	return unix.cred, true
+}
+
+type unixConn struct {
+	net.Conn
+	local, remote unixAddr
+	cred          PeerCred
+	hasCred       bool
+}
+
+func (c *unixConn) LocalAddr() net.Addr  { return c.local }
+func (c *unixConn) RemoteAddr() net.Addr { return c.remote }
+
+type unixAddr string
+
+func (a unixAddr) Network() string { return "unix" }
+func (a unixAddr) String() string  { return string(a) }
@@ -0,0 +1,99 @@
+package p2p
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newUnixTransport(t *testing.T, opts UnixTransportOpts, peers chan Peer) *UnixTransport {
+	opts.HandshakeFunc = NOPHandshakeFunc
+	opts.Decoder = DefaultDecoder{}
+	opts.OnPeer = func(p Peer) error {
+		peers <- p
+		return nil
+	}
+	tr := NewUnixTransport(opts)
+	t.Cleanup(func() { tr.Close() })
+	return tr
+}
+
+func TestUnixTransport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.sock")
+	nodePeers, clientPeers := make(chan Peer, 4), make(chan Peer, 4)
+	node := newUnixTransport(t, UnixTransportOpts{TCPTransportOpts: TCPTransportOpts{ListenAddr: "unix://" + path}}, nodePeers)
+	assert.Nil(t, node.ListenAndAccept())
+	assert.Equal(t, "unix://"+path, node.ListenAddress())
+
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	client := newUnixTransport(t, UnixTransportOpts{}, clientPeers)
+	assert.Nil(t, client.Dial(node.ListenAddress()))
+	assert.Nil(t, client.Dial(node.ListenAddress()))
+	toNode, toClient := nextWSPeer(t, clientPeers), nextWSPeer(t, nodePeers)
+	other := nextWSPeer(t, nodePeers)
+	assert.Equal(t, node.ListenAddress(), toNode.RemoteAddr().String())
+	// Connections of one process are told apart.
+	assert.NotEqual(t, toClient.RemoteAddr().String(), other.RemoteAddr().String())
+
+	cred, ok := UnixPeerCred(toClient)
+	assert.True(t, ok)
+	assert.Equal(t, PeerCred{PID: os.Getpid(), UID: os.Getuid(), GID: os.Getgid()}, cred)
+
+	assert.Nil(t, toNode.Send([]byte{IncomingMessage}))
+	assert.Nil(t, toNode.Send([]byte("hello")))
+	assert.Equal(t, []byte("hello"), receive(t, node).Payload)
+
+	// The socket file goes with the transport.
+	assert.Nil(t, node.Close())
+	_, err = os.Stat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestUnixTransportAllowUIDs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.sock")
+	nodePeers, clientPeers := make(chan Peer, 4), make(chan Peer, 4)
+	node := newUnixTransport(t, UnixTransportOpts{
+		TCPTransportOpts: TCPTransportOpts{ListenAddr: path},
+		Mode:             0o660,
+		AllowUIDs:        []int{os.Getuid() + 1},
+	}, nodePeers)
+	assert.Nil(t, node.ListenAndAccept())
+
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0o660), info.Mode().Perm())
+
+	client := newUnixTransport(t, UnixTransportOpts{}, clientPeers)
+	assert.Nil(t, client.Dial("unix://"+path))
+	toNode := nextWSPeer(t, clientPeers)
+
+	// Hung up on, without being seen as a peer.
+	toNode.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = toNode.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+	assert.Len(t, nodePeers, 0)
+}
+
+func TestUnixTransportStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.sock")
+
+	// Left behind by a node that is gone.
+	ln, err := net.Listen("unix", path)
+	assert.Nil(t, err)
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+
+	node := newUnixTransport(t, UnixTransportOpts{TCPTransportOpts: TCPTransportOpts{ListenAddr: path}}, make(chan Peer, 1))
+	assert.Nil(t, node.ListenAndAccept())
+
+	// Still in use.
+	again := newUnixTransport(t, UnixTransportOpts{TCPTransportOpts: TCPTransportOpts{ListenAddr: path}}, make(chan Peer, 1))
+	assert.ErrorContains(t, again.ListenAndAccept(), "address already in use")
+}
@@ -0,0 +1,341 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// How long dialing a WebSocket peer (proxy, TLS and WebSocket handshakes included) may take.
+const wsDialTimeout = 10 * time.Second
+
+type WSTransportOpts struct {
+	// ListenAddr is the TCP address of the HTTP server serving Path; empty serves nothing, for
+	// Handler to be mounted on a server of the caller.
+	TCPTransportOpts
+	// Path of the WebSocket endpoint. Defaults to "/p2p".
+	Path string
+	// Serves wss:// when it has certificates. Also used to dial wss:// peers (defaults to the
+	// system's roots then).
+	TLSConfig *tls.Config
+	// HTTP proxy for dialing, as http.Transport.Proxy. Defaults to http.ProxyFromEnvironment.
+	Proxy func(*http.Request) (*url.URL, error)
+}
+
+// WSTransport : Transport over WebSockets, for peers behind HTTP proxies. Every Write is a binary
+// frame carrying the same wire protocol as TCP; the connection handling is that of TCPTransport.
+// Addresses are URLs ("ws://host:port/p2p", "wss://..."); "host:port" is dialed on Path, over TLS
+// if the transport itself serves TLS.
+type WSTransport struct {
+	*TCPTransport
+	opts     WSTransportOpts
+	listener *wsListener
+}
+
+func NewWSTransport(opts WSTransportOpts) *WSTransport {
+	if len(opts.Path) == 0 {
+		opts.Path = "/p2p"
+	}
+	if opts.Proxy == nil {
+		opts.Proxy = http.ProxyFromEnvironment
+	}
+
+	t := &WSTransport{
+		TCPTransport: NewTCPTransport(opts.TCPTransportOpts),
+		opts:         opts,
+	}
+	t.listener = &wsListener{
+		addr:  wsAddr(t.ListenAddress()),
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	t.name = "WebSocket"
+	t.listen = t.serve
+	t.dial = t.dialWS
+
+	return t
+}
+
+// ListenAddress : URL of the endpoint.
+func (t *WSTransport) ListenAddress() string {
+	return t.scheme() + t.ListenAddr + t.opts.Path
+}
+
+// Dials : whether addr is a WebSocket URL (see MultiTransport).
+func (t *WSTransport) Dials(addr string) bool {
+	scheme := schemeOf(addr)
+	return scheme == "ws://" || scheme == "wss://"
+}
+
+func (t *WSTransport) scheme() string {
+	if t.tls() {
+		return "wss://"
+	}
+	return "ws://"
+}
+
+func (t *WSTransport) tls() bool {
+	return t.opts.TLSConfig != nil && (len(t.opts.TLSConfig.Certificates) > 0 || t.opts.TLSConfig.GetCertificate != nil)
+}
+
+// Handler : the WebSocket endpoint, for peers to connect to. Served on Path of ListenAddr by
+// ListenAndAccept, or mounted by the caller; either way ListenAndAccept must be called for its
+// connections to be accepted.
+func (t *WSTransport) Handler() http.Handler {
+	return websocket.Server{
+		// Any Origin: there are no cookies or other ambient credentials to protect.
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			req := ws.Request()
+			scheme := "ws://"
+			if req.TLS != nil {
+				scheme = "wss://"
+			}
+			conn := newWSConn(ws, wsAddr(scheme+req.Host+req.URL.Path), wsAddr(scheme+req.RemoteAddr))
+
+			select {
+			case t.listener.conns <- conn:
+			case <-t.listener.done:
+				conn.Close()
+				return
+			}
+			// The connection is closed when the handler returns.
+			<-conn.closed
+		},
+	}
+}
+
+// serve : the listen hook of the TCPTransport.
+func (t *WSTransport) serve(addr string) (net.Listener, error) {
+	if len(addr) == 0 {
+		return t.listener, nil
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(t.opts.Path, t.Handler())
+	t.listener.srv = &http.Server{
+		Handler:           mux,
+		TLSConfig:         t.opts.TLSConfig,
+		ReadHeaderTimeout: wsDialTimeout,
+	}
+
+	go func() {
+		var err error
+		if t.tls() {
+			err = t.listener.srv.ServeTLS(ln, "", "")
+		} else {
+			err = t.listener.srv.Serve(ln)
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			t.log.Error("WebSocket server stopped", "err", err)
+		}
+	}()
+
+	return t.listener, nil
+}
+
+// dialWS : the dial hook of the TCPTransport. Goes through the proxy, if any, with CONNECT.
+func (t *WSTransport) dialWS(addr string) (net.Conn, error) {
+	u := t.url(addr)
+	ctx, cancel := context.WithTimeout(context.Background(), wsDialTimeout)
+	defer cancel()
+
+	origin := &url.URL{Scheme: "http", Host: u.Host}
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "wss" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	if u.Scheme == "wss" {
+		origin.Scheme = "https"
+	}
+
+	proxy, err := t.opts.Proxy(&http.Request{URL: origin})
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	var conn net.Conn
+	if proxy != nil {
+		conn, err = dialer.DialContext(ctx, "tcp", proxy.Host)
+		if err == nil {
+			err = connectThrough(conn, host, proxy)
+		}
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", host)
+	}
+	if err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, err
+	}
+
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	if u.Scheme == "wss" {
+		config := &tls.Config{}
+		if t.opts.TLSConfig != nil {
+			config = t.opts.TLSConfig.Clone()
+		}
+		if len(config.ServerName) == 0 {
+			config.ServerName = u.Hostname()
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	config, err := websocket.NewConfig(u.String(), origin.String())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return newWSConn(ws, wsAddr(conn.LocalAddr().String()), wsAddr(u.String())), nil
+}
+
+// url : addr as a WebSocket URL.
+func (t *WSTransport) url(addr string) *url.URL {
+	u, err := url.Parse(addr)
+	if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") {
+		u = &url.URL{Scheme: strings.TrimSuffix(t.scheme(), "://"), Host: addr}
+	}
+	if len(u.Path) == 0 {
+		u.Path = t.opts.Path
+	}
+	return u
+}
+
+// connectThrough : asks the HTTP proxy conn is connected to for a tunnel to host.
+func connectThrough(conn net.Conn, host string, proxy *url.URL) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: host},
+		Host:   host,
+		Header: make(http.Header),
+	}
+	if user := proxy.User; user != nil {
+		password, _ := user.Password()
+		req.SetBasicAuth(user.Username(), password)
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		req.Header.Del("Authorization")
+	}
+
+	conn.SetDeadline(time.Now().Add(wsDialTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	// Nothing comes after the response until the tunnel is used: the reader buffers nothing more.
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy %s: CONNECT %s: %s", proxy.Host, host, resp.Status)
+	}
+	return nil
+}
+
+type wsAddr string
+
+func (a wsAddr) Network() string { return "websocket" }
+func (a wsAddr) String() string  { return string(a) }
+
+// wsConn : a WebSocket connection, writing binary frames.
+type wsConn struct {
+	*websocket.Conn
+	local, remote net.Addr
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newWSConn(ws *websocket.Conn, local, remote net.Addr) *wsConn {
+	ws.PayloadType = websocket.BinaryFrame
+	return &wsConn{
+		Conn:   ws,
+		local:  local,
+		remote: remote,
+		closed: make(chan struct{}),
+	}
+}
+
+func (c *wsConn) LocalAddr() net.Addr  { return c.local }
+func (c *wsConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *wsConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.Conn.Close()
+		close(c.closed)
+	})
+	return err
+}
+
+// wsListener : the connections accepted by the Handler.
+type wsListener struct {
+	addr  wsAddr
+	conns chan net.Conn
+	// Serving ListenAddr, if any.
+	srv *http.Server
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *wsListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		if l.srv != nil {
+			err = l.srv.Close()
+		}
+	})
+	return err
+}
+
+func (l *wsListener) Addr() net.Addr {
+	return l.addr
+}
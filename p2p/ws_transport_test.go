@@ -0,0 +1,142 @@
+package p2p
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newWSTransport : not listening by itself, its Handler is to be mounted.
+func newWSTransport(t *testing.T, opts WSTransportOpts, peers chan Peer) *WSTransport {
+	opts.HandshakeFunc = NOPHandshakeFunc
+	opts.Decoder = DefaultDecoder{}
+	opts.OnPeer = func(p Peer) error {
+		peers <- p
+		return nil
+	}
+	tr := NewWSTransport(opts)
+	assert.Nil(t, tr.ListenAndAccept())
+	t.Cleanup(func() { tr.Close() })
+	return tr
+}
+
+func nextWSPeer(t *testing.T, peers chan Peer) Peer {
+	t.Helper()
+
+	select {
+	case p := <-peers:
+		return p
+	case <-time.After(2 * time.Second):
+		t.Fatal("no peer connected")
+		return nil
+	}
+}
+
+// exchange : a message each way, then a stream from dialer to server.
+func exchange(t *testing.T, server, dialer Transport, toServer, toDialer Peer) {
+	assert.Nil(t, toServer.Send([]byte{IncomingMessage}))
+	assert.Nil(t, toServer.Send([]byte("hello")))
+	assert.Equal(t, []byte("hello"), receive(t, server).Payload)
+
+	assert.Nil(t, toDialer.Send([]byte{IncomingMessage}))
+	assert.Nil(t, toDialer.Send([]byte("hi")))
+	assert.Equal(t, []byte("hi"), receive(t, dialer).Payload)
+
+	stream, err := toServer.OpenStream()
+	assert.Nil(t, err)
+	_, err = stream.Write([]byte("streamed"))
+	assert.Nil(t, err)
+	assert.Nil(t, stream.Close())
+
+	buf := make([]byte, len("streamed"))
+	_, err = io.ReadFull(toDialer, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "streamed", string(buf))
+	toDialer.CloseStream()
+}
+
+func TestWSTransport(t *testing.T) {
+	serverPeers, dialerPeers := make(chan Peer, 4), make(chan Peer, 4)
+	server := newWSTransport(t, WSTransportOpts{}, serverPeers)
+	srv := httptest.NewServer(server.Handler())
+	defer srv.Close()
+	dialer := newWSTransport(t, WSTransportOpts{}, dialerPeers)
+
+	addr := "ws://" + srv.Listener.Addr().String() + "/p2p"
+	assert.Nil(t, dialer.Dial(srv.Listener.Addr().String()))
+	toServer, toDialer := nextWSPeer(t, dialerPeers), nextWSPeer(t, serverPeers)
+	assert.Equal(t, addr, toServer.RemoteAddr().String())
+	assert.True(t, strings.HasPrefix(toDialer.RemoteAddr().String(), "ws://127.0.0.1:"))
+
+	exchange(t, server, dialer, toServer, toDialer)
+}
+
+func TestWSTransportTLS(t *testing.T) {
+	serverPeers, dialerPeers := make(chan Peer, 4), make(chan Peer, 4)
+	server := newWSTransport(t, WSTransportOpts{}, serverPeers)
+	srv := httptest.NewTLSServer(server.Handler())
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	dialer := newWSTransport(t, WSTransportOpts{TLSConfig: &tls.Config{RootCAs: roots}}, dialerPeers)
+
+	assert.Nil(t, dialer.Dial("wss://"+srv.Listener.Addr().String()))
+	toServer, toDialer := nextWSPeer(t, dialerPeers), nextWSPeer(t, serverPeers)
+	assert.True(t, strings.HasPrefix(toDialer.RemoteAddr().String(), "wss://"))
+
+	exchange(t, server, dialer, toServer, toDialer)
+
+	// Unknown certificates are refused.
+	untrusting := newWSTransport(t, WSTransportOpts{}, make(chan Peer, 1))
+	assert.NotNil(t, untrusting.Dial("wss://"+srv.Listener.Addr().String()))
+}
+
+func TestWSTransportProxy(t *testing.T) {
+	serverPeers, dialerPeers := make(chan Peer, 4), make(chan Peer, 4)
+	server := newWSTransport(t, WSTransportOpts{}, serverPeers)
+	srv := httptest.NewServer(server.Handler())
+	defer srv.Close()
+
+	// A forward proxy, tunnelling CONNECT requests only.
+	var tunnels atomic.Int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		tunnels.Add(1)
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			io.Copy(upstream, conn)
+			upstream.Close()
+		}()
+		io.Copy(conn, upstream)
+		conn.Close()
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	dialer := newWSTransport(t, WSTransportOpts{Proxy: http.ProxyURL(proxyURL)}, dialerPeers)
+	assert.Nil(t, dialer.Dial("ws://"+srv.Listener.Addr().String()+"/p2p"))
+	toServer, toDialer := nextWSPeer(t, dialerPeers), nextWSPeer(t, serverPeers)
+	assert.Equal(t, int32(1), tunnels.Load())
+
+	exchange(t, server, dialer, toServer, toDialer)
+}
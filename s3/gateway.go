@@ -0,0 +1,489 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PsychoPunkSage/NexNet/logging"
+)
+
+const (
+	defaultStateDirName = "S3Gateway"
+	defaultRegion       = "us-east-1"
+	defaultMaxKeys      = 1000
+	// S3's own limit on a single PUT.
+	defaultMaxObjectSize = 5 << 30
+)
+
+// Backend : the subset of server.FileServer the gateway relies on.
+type Backend interface {
+	StoreAs(ctx context.Context, id, key string, r io.Reader) error
+	GetAs(ctx context.Context, id, key string) (io.Reader, error)
+	RemoveAs(ctx context.Context, id, key string) error
+}
+
+type GatewayOpts struct {
+	ListenAddr string
+	Backend    Backend
+	// Bucket name -> owner ID the objects are stored under.
+	Buckets map[string]string
+	// Access key ID -> secret access key, used to verify SigV4 signatures.
+	Credentials map[string]string
+	Region      string
+	// Folder holding the object index and in-progress multipart uploads.
+	StateDir string
+	// Bytes of a request body (object, or part of one) at most. Defaults to defaultMaxObjectSize.
+	MaxObjectSize int64
+	// Defaults to slog.Default().
+	Logger *slog.Logger
+}
+
+// Gateway : S3-compatible HTTP endpoint (path-style addressing only) in front of a FileServer.
+type Gateway struct {
+	GatewayOpts
+
+	index   *index
+	uploads *uploads
+	created time.Time
+	now     func() time.Time
+	log     *slog.Logger
+	handler http.Handler
+}
+
+func NewGateway(opts GatewayOpts) (*Gateway, error) {
+	if len(opts.StateDir) == 0 {
+		opts.StateDir = defaultStateDirName
+	}
+	if len(opts.Region) == 0 {
+		opts.Region = defaultRegion
+	}
+	if opts.MaxObjectSize <= 0 {
+		opts.MaxObjectSize = defaultMaxObjectSize
+	}
+
+	idx, err := loadIndex(filepath.Join(opts.StateDir, "index.json"))
+	if err != nil {
+		return nil, fmt.Errorf("loading s3 index: %w", err)
+	}
+
+	g := &Gateway{
+		GatewayOpts: opts,
+		index:       idx,
+		uploads:     newUploads(filepath.Join(opts.StateDir, "uploads")),
+		created:     time.Now().UTC(),
+		now:         time.Now,
+		log:         logging.OrDefault(opts.Logger).With("component", "s3"),
+	}
+	g.handler = logging.Middleware(g.log, http.HandlerFunc(g.serve))
+	return g, nil
+}
+
+func (g *Gateway) ListenAndServe() error {
+	g.log.Info("S3 gateway listening", "addr", g.ListenAddr)
+	return http.ListenAndServe(g.ListenAddr, g)
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.handler.ServeHTTP(w, r)
+}
+
+func (g *Gateway) serve(w http.ResponseWriter, r *http.Request) {
+	// What AWS SDKs look for; same value as X-Request-Id.
+	w.Header().Set("X-Amz-Request-Id", logging.RequestIDFrom(r.Context()))
+
+	if err := g.verifyRequest(r); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if len(bucket) == 0 {
+		if r.Method != http.MethodGet {
+			writeError(w, r, errMethodNotAllowed)
+			return
+		}
+		g.listBuckets(w, r)
+		return
+	}
+
+	id, ok := g.Buckets[bucket]
+	if !ok {
+		writeError(w, r, errNoSuchBucket)
+		return
+	}
+
+	var err *apiError
+	if len(key) == 0 {
+		err = g.serveBucket(w, r, bucket)
+	} else {
+		err = g.serveObject(w, r, bucket, id, key)
+	}
+
+	if err != nil {
+		writeError(w, r, err)
+	}
+}
+
+// logger : logger tagged with the ID of request r.
+func (g *Gateway) logger(r *http.Request) *slog.Logger {
+	return logging.FromContext(r.Context(), g.log)
+}
+
+func (g *Gateway) serveBucket(w http.ResponseWriter, r *http.Request, bucket string) *apiError {
+	switch r.Method {
+	case http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+		return nil
+	case http.MethodGet:
+		if r.URL.Query().Get("list-type") != "2" {
+			// ListObjects (v1) is not part of the supported subset.
+			return errNotImplemented
+		}
+		return g.listObjectsV2(w, r, bucket)
+	}
+	return errMethodNotAllowed
+}
+
+func (g *Gateway) serveObject(w http.ResponseWriter, r *http.Request, bucket, id, key string) *apiError {
+	query := r.URL.Query()
+	_, isUploads := query["uploads"]
+	uploadID := query.Get("uploadId")
+
+	switch {
+	case r.Method == http.MethodPost && isUploads:
+		return g.createMultipartUpload(w, r, bucket, key)
+	case r.Method == http.MethodPost && len(uploadID) > 0:
+		return g.completeMultipartUpload(w, r, bucket, id, key, uploadID)
+	case r.Method == http.MethodPut && len(uploadID) > 0:
+		return g.uploadPart(w, r, bucket, key, uploadID)
+	case r.Method == http.MethodDelete && len(uploadID) > 0:
+		return g.abortMultipartUpload(w, r, bucket, key, uploadID)
+	case r.Method == http.MethodPut:
+		return g.putObject(w, r, bucket, id, key)
+	case r.Method == http.MethodGet:
+		return g.getObject(w, r, bucket, id, key)
+	case r.Method == http.MethodHead:
+		return g.headObject(w, bucket, key)
+	case r.Method == http.MethodDelete:
+		return g.deleteObject(w, r, bucket, id, key)
+	}
+	return errMethodNotAllowed
+}
+
+func (g *Gateway) listBuckets(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(g.Buckets))
+	for name := range g.Buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := listAllMyBucketsResult{Xmlns: s3Namespace}
+	for _, name := range names {
+		result.Buckets = append(result.Buckets, bucketEntry{Name: name, CreationDate: g.created})
+	}
+
+	writeXML(w, http.StatusOK, result)
+}
+
+func (g *Gateway) listObjectsV2(w http.ResponseWriter, r *http.Request, bucket string) *apiError {
+	query := r.URL.Query()
+
+	maxKeys := defaultMaxKeys
+	if v := query.Get("max-keys"); len(v) > 0 {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return errInvalidArgument
+		}
+		maxKeys = min(n, defaultMaxKeys)
+	}
+
+	result := listBucketResult{
+		Xmlns:             s3Namespace,
+		Name:              bucket,
+		Prefix:            query.Get("prefix"),
+		Delimiter:         query.Get("delimiter"),
+		StartAfter:        query.Get("start-after"),
+		ContinuationToken: query.Get("continuation-token"),
+		MaxKeys:           maxKeys,
+	}
+
+	// Listing resumes strictly after this key.
+	after := result.StartAfter
+	if len(result.ContinuationToken) > 0 {
+		b, err := base64.RawURLEncoding.DecodeString(result.ContinuationToken)
+		if err != nil {
+			return errInvalidArgument
+		}
+		after = string(b)
+	}
+
+	seenPrefixes := make(map[string]bool)
+	last := ""
+	for _, key := range g.index.keys(bucket, result.Prefix) {
+		if key <= after {
+			continue
+		}
+
+		// Keys containing the delimiter (after the prefix) are rolled up into a common prefix.
+		rollup := ""
+		if len(result.Delimiter) > 0 {
+			rest := strings.TrimPrefix(key, result.Prefix)
+			if i := strings.Index(rest, result.Delimiter); i >= 0 {
+				rollup = result.Prefix + rest[:i+len(result.Delimiter)]
+			}
+		}
+		if len(rollup) > 0 && seenPrefixes[rollup] {
+			continue
+		}
+
+		if result.KeyCount == maxKeys {
+			result.IsTruncated = true
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+			break
+		}
+
+		if len(rollup) > 0 {
+			seenPrefixes[rollup] = true
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: rollup})
+			result.KeyCount++
+			// 0xff never appears in UTF-8, so the next page skips every key under this prefix.
+			last = rollup + "\xff"
+			continue
+		}
+
+		info, ok := g.index.get(bucket, key)
+		if !ok {
+			// Deleted concurrently.
+			continue
+		}
+
+		result.Contents = append(result.Contents, objectEntry{
+			Key:          key,
+			LastModified: info.LastModified,
+			ETag:         info.ETag,
+			Size:         info.Size,
+			StorageClass: "STANDARD",
+		})
+		result.KeyCount++
+		last = key
+	}
+
+	writeXML(w, http.StatusOK, result)
+	return nil
+}
+
+func (g *Gateway) putObject(w http.ResponseWriter, r *http.Request, bucket, id, key string) *apiError {
+	data, md5sum, err := g.readBody(w, r)
+	if err != nil {
+		return err
+	}
+
+	if err := g.Backend.StoreAs(r.Context(), id, key, bytes.NewReader(data)); err != nil {
+		g.logger(r).Error("storing object", "bucket", bucket, logging.Key, key, "err", err)
+		return errInternalError
+	}
+
+	info := objectInfo{
+		Size:         int64(len(data)),
+		ETag:         `"` + hex.EncodeToString(md5sum) + `"`,
+		ContentType:  r.Header.Get("Content-Type"),
+		LastModified: g.now().UTC(),
+	}
+	if err := g.index.put(bucket, key, info); err != nil {
+		g.logger(r).Error("updating index", "bucket", bucket, logging.Key, key, "err", err)
+		return errInternalError
+	}
+
+	w.Header().Set("ETag", info.ETag)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (g *Gateway) headObject(w http.ResponseWriter, bucket, key string) *apiError {
+	info, ok := g.index.get(bucket, key)
+	if !ok {
+		return errNoSuchKey
+	}
+
+	setObjectHeaders(w, info)
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (g *Gateway) getObject(w http.ResponseWriter, r *http.Request, bucket, id, key string) *apiError {
+	info, ok := g.index.get(bucket, key)
+	if !ok {
+		return errNoSuchKey
+	}
+
+	start, length, partial, err := parseRange(r.Header.Get("Range"), info.Size)
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+		return err
+	}
+
+	rd, gerr := g.Backend.GetAs(r.Context(), id, key)
+	if gerr != nil {
+		g.logger(r).Error("reading object", "bucket", bucket, logging.Key, key, "err", gerr)
+		return errNoSuchKey
+	}
+	if rc, ok := rd.(io.Closer); ok {
+		defer rc.Close()
+	}
+
+	if start > 0 {
+		if seeker, ok := rd.(io.Seeker); ok {
+			_, gerr = seeker.Seek(start, io.SeekStart)
+		} else {
+			_, gerr = io.CopyN(io.Discard, rd, start)
+		}
+		if gerr != nil {
+			return errInternalError
+		}
+	}
+
+	setObjectHeaders(w, info)
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	status := http.StatusOK
+	if partial {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, info.Size))
+		status = http.StatusPartialContent
+	}
+	w.WriteHeader(status)
+
+	if _, err := io.CopyN(w, rd, length); err != nil {
+		// Headers are already out, nothing left to report to the client.
+		g.logger(r).Error("sending object", "bucket", bucket, logging.Key, key, "err", err)
+	}
+	return nil
+}
+
+func (g *Gateway) deleteObject(w http.ResponseWriter, r *http.Request, bucket, id, key string) *apiError {
+	if _, ok := g.index.get(bucket, key); ok {
+		// Gone already: only the index entry is left to drop.
+		if err := g.Backend.RemoveAs(r.Context(), id, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			g.logger(r).Error("removing object", "bucket", bucket, logging.Key, key, "err", err)
+			return errInternalError
+		}
+		if err := g.index.delete(bucket, key); err != nil {
+			g.logger(r).Error("updating index", "bucket", bucket, logging.Key, key, "err", err)
+			return errInternalError
+		}
+	}
+
+	// S3 answers 204 whether the key existed or not.
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func setObjectHeaders(w http.ResponseWriter, info objectInfo) {
+	w.Header().Set("ETag", info.ETag)
+	w.Header().Set("Last-Modified", info.LastModified.Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+	if len(info.ContentType) > 0 {
+		w.Header().Set("Content-Type", info.ContentType)
+	} else {
+		w.Header().Set("Content-Type", "binary/octet-stream")
+	}
+}
+
+// readBody : reads the whole request body, up to MaxObjectSize, checking it against
+// x-amz-content-sha256 and Content-MD5. FileServer.StoreAs buffers the file in memory anyway, so
+// nothing is lost by doing it here first.
+func (g *Gateway) readBody(w http.ResponseWriter, r *http.Request) ([]byte, []byte, *apiError) {
+	if r.ContentLength > g.MaxObjectSize {
+		return nil, nil, errEntityTooLarge
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, g.MaxObjectSize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, nil, errEntityTooLarge
+	}
+	if err != nil {
+		return nil, nil, errInternalError
+	}
+
+	if want := payloadHash(r); len(want) > 0 {
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != want {
+			return nil, nil, errContentSHA256Mismatch
+		}
+	}
+
+	md5sum := md5.Sum(data)
+	if v := r.Header.Get("Content-MD5"); len(v) > 0 {
+		want, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(want) != md5.Size {
+			return nil, nil, errInvalidDigest
+		}
+		if !bytes.Equal(want, md5sum[:]) {
+			return nil, nil, errBadDigest
+		}
+	}
+
+	return data, md5sum[:], nil
+}
+
+// parseRange : supports a single `bytes=` range, in any of its 3 forms (a-b, a-, -n).
+func parseRange(header string, size int64) (start, length int64, partial bool, err *apiError) {
+	if len(header) == 0 {
+		return 0, size, false, nil
+	}
+
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, false, errInvalidRange
+	}
+
+	from, to, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, false, errInvalidRange
+	}
+
+	end := size - 1
+	switch {
+	case len(from) == 0:
+		// Suffix range: last n bytes.
+		n, perr := strconv.ParseInt(to, 10, 64)
+		if perr != nil || n <= 0 {
+			return 0, 0, false, errInvalidRange
+		}
+		start = max(size-n, 0)
+	default:
+		var perr error
+		start, perr = strconv.ParseInt(from, 10, 64)
+		if perr != nil || start < 0 {
+			return 0, 0, false, errInvalidRange
+		}
+		if len(to) > 0 {
+			e, perr := strconv.ParseInt(to, 10, 64)
+			if perr != nil || e < start {
+				return 0, 0, false, errInvalidRange
+			}
+			end = min(e, size-1)
+		}
+	}
+
+	if start >= size {
+		return 0, 0, false, errInvalidRange
+	}
+
+	return start, end - start + 1, true, nil
+}
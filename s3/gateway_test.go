@@ -0,0 +1,324 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PsychoPunkSage/NexNet/cryptography"
+	"github.com/PsychoPunkSage/NexNet/p2p"
+	"github.com/PsychoPunkSage/NexNet/server"
+	"github.com/PsychoPunkSage/NexNet/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testAccessKey = "NEXNETTESTKEY"
+	testSecretKey = "nexnet-test-secret"
+	testBucket    = "photos"
+)
+
+func newTestGateway(t *testing.T, options ...func(*GatewayOpts)) *httptest.Server {
+	fs := server.NewFileServer(server.FileServerOpts{
+		EncKey:            cryptography.NewEncryptionKey(),
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: storage.CASPathTransformFunc,
+		Transport: p2p.NewTCPTransport(p2p.TCPTransportOpts{
+			ListenAddr:    ":0",
+			HandshakeFunc: p2p.NOPHandshakeFunc,
+			Decoder:       p2p.DefaultDecoder{},
+		}),
+	})
+
+	opts := GatewayOpts{
+		Backend:     fs,
+		Buckets:     map[string]string{testBucket: fs.ID},
+		Credentials: map[string]string{testAccessKey: testSecretKey},
+		StateDir:    t.TempDir(),
+	}
+	for _, option := range options {
+		option(&opts)
+	}
+	g, err := NewGateway(opts)
+	assert.Nil(t, err)
+
+	ts := httptest.NewServer(g)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// do : sends a request signed by hand with SigV4, the way an AWS SDK would.
+func do(t *testing.T, method, url string, body []byte, headers map[string]string) *http.Response {
+	r, err := http.NewRequest(method, url, bytes.NewReader(body))
+	assert.Nil(t, err)
+
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	return send(t, r, body)
+}
+
+// send : signs r, of the given body, and sends it.
+func send(t *testing.T, r *http.Request, body []byte) *http.Response {
+	sum := sha256.Sum256(body)
+	amzDate := time.Now().UTC().Format(amzDateFormat)
+	r.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sum[:]))
+	r.Header.Set("X-Amz-Date", amzDate)
+
+	auth := authorization{
+		AccessKey:     testAccessKey,
+		Date:          amzDate[:8],
+		Region:        defaultRegion,
+		Service:       "s3",
+		SignedHeaders: []string{"host", "x-amz-content-sha256", "x-amz-date"},
+	}
+	sig := signature(testSecretKey, auth, amzDate, canonicalRequest(r, auth.SignedHeaders, r.Header.Get("X-Amz-Content-Sha256")))
+	r.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, auth.AccessKey, auth.scope(), strings.Join(auth.SignedHeaders, ";"), sig))
+
+	resp, err := http.DefaultClient.Do(r)
+	assert.Nil(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func readAll(t *testing.T, resp *http.Response) string {
+	b, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	return string(b)
+}
+
+func TestGatewayRejectsUnsignedRequests(t *testing.T) {
+	ts := newTestGateway(t)
+
+	resp, err := http.Get(ts.URL + "/" + testBucket + "/key")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Contains(t, readAll(t, resp), "<Code>AccessDenied</Code>")
+}
+
+func TestGatewayObjectLifecycle(t *testing.T) {
+	ts := newTestGateway(t)
+	url := ts.URL + "/" + testBucket + "/docs/readme.txt"
+	payload := []byte("NexNet speaks S3 now")
+
+	resp := do(t, http.MethodPut, url, payload, map[string]string{"Content-Type": "text/plain"})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	sum := md5.Sum(payload)
+	assert.Equal(t, `"`+hex.EncodeToString(sum[:])+`"`, resp.Header.Get("ETag"))
+
+	resp = do(t, http.MethodHead, url, nil, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, fmt.Sprint(len(payload)), resp.Header.Get("Content-Length"))
+	assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+
+	resp = do(t, http.MethodGet, url, nil, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, string(payload), readAll(t, resp))
+
+	resp = do(t, http.MethodGet, url, nil, map[string]string{"Range": "bytes=7-11"})
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, fmt.Sprintf("bytes 7-11/%d", len(payload)), resp.Header.Get("Content-Range"))
+	assert.Equal(t, "speak", readAll(t, resp))
+
+	resp = do(t, http.MethodGet, url, nil, map[string]string{"Range": "bytes=-3"})
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "now", readAll(t, resp))
+
+	resp = do(t, http.MethodGet, url, nil, map[string]string{"Range": "bytes=100-"})
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+
+	resp = do(t, http.MethodDelete, url, nil, nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp = do(t, http.MethodGet, url, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Contains(t, readAll(t, resp), "<Code>NoSuchKey</Code>")
+}
+
+func TestGatewayEntityTooLarge(t *testing.T) {
+	ts := newTestGateway(t, func(opts *GatewayOpts) { opts.MaxObjectSize = 16 })
+	url := ts.URL + "/" + testBucket + "/big"
+	payload := bytes.Repeat([]byte("x"), 17)
+
+	// Refused on its Content-Length.
+	resp := do(t, http.MethodPut, url, payload, nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Contains(t, readAll(t, resp), "<Code>EntityTooLarge</Code>")
+
+	// Without one (chunked): refused once read past the limit.
+	r, err := http.NewRequest(http.MethodPut, url, io.NopCloser(bytes.NewReader(payload)))
+	assert.Nil(t, err)
+	resp = send(t, r, payload)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Contains(t, readAll(t, resp), "<Code>EntityTooLarge</Code>")
+
+	resp = do(t, http.MethodGet, url, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = do(t, http.MethodPut, url, payload[:16], nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+// failingRemove : a Backend whose RemoveAs fails with err.
+type failingRemove struct {
+	Backend
+	err error
+}
+
+func (b failingRemove) RemoveAs(ctx context.Context, id, key string) error {
+	return b.err
+}
+
+func TestGatewayDeleteFailure(t *testing.T) {
+	remove := &failingRemove{err: errors.New("disk on fire")}
+	ts := newTestGateway(t, func(opts *GatewayOpts) {
+		remove.Backend = opts.Backend
+		opts.Backend = remove
+	})
+	url := ts.URL + "/" + testBucket + "/key"
+	payload := []byte("still here")
+
+	resp := do(t, http.MethodPut, url, payload, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Kept in the index, to be deleted again.
+	resp = do(t, http.MethodDelete, url, nil, nil)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	resp = do(t, http.MethodGet, url, nil, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, string(payload), readAll(t, resp))
+
+	// Gone from the node already: dropped from the index.
+	remove.err = fmt.Errorf("file (key) is not present: %w", os.ErrNotExist)
+	resp = do(t, http.MethodDelete, url, nil, nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = do(t, http.MethodHead, url, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestGatewayUnknownBucket(t *testing.T) {
+	ts := newTestGateway(t)
+
+	resp := do(t, http.MethodGet, ts.URL+"/nope/key", nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	body := readAll(t, resp)
+	assert.Contains(t, body, "<Code>NoSuchBucket</Code>")
+	// Same request ID in the header and the error, to match the gateway's logs.
+	assert.NotEmpty(t, resp.Header.Get("X-Amz-Request-Id"))
+	assert.Contains(t, body, "<RequestId>"+resp.Header.Get("X-Amz-Request-Id")+"</RequestId>")
+}
+
+func TestGatewayListObjectsV2(t *testing.T) {
+	ts := newTestGateway(t)
+
+	for _, key := range []string{"a.txt", "b/1.txt", "b/2.txt", "c.txt"} {
+		resp := do(t, http.MethodPut, ts.URL+"/"+testBucket+"/"+key, []byte(key), nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	list := func(query string) listBucketResult {
+		resp := do(t, http.MethodGet, ts.URL+"/"+testBucket+"?"+query, nil, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var result listBucketResult
+		assert.Nil(t, xml.Unmarshal([]byte(readAll(t, resp)), &result))
+		return result
+	}
+
+	result := list("list-type=2&delimiter=%2F")
+	assert.Equal(t, 3, result.KeyCount)
+	assert.Equal(t, "a.txt", result.Contents[0].Key)
+	assert.Equal(t, "c.txt", result.Contents[1].Key)
+	assert.Equal(t, []commonPrefix{{Prefix: "b/"}}, result.CommonPrefixes)
+
+	result = list("list-type=2&prefix=b%2F")
+	assert.Equal(t, 2, result.KeyCount)
+	assert.Equal(t, int64(len("b/1.txt")), result.Contents[0].Size)
+
+	// Paginate one key at a time.
+	keys := []string{}
+	token := ""
+	for {
+		query := "list-type=2&max-keys=1"
+		if len(token) > 0 {
+			query += "&continuation-token=" + token
+		}
+		result = list(query)
+		for _, c := range result.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !result.IsTruncated {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	assert.Equal(t, []string{"a.txt", "b/1.txt", "b/2.txt", "c.txt"}, keys)
+}
+
+func TestGatewayMultipartUpload(t *testing.T) {
+	ts := newTestGateway(t)
+	url := ts.URL + "/" + testBucket + "/big.bin"
+
+	resp := do(t, http.MethodPost, url+"?uploads", nil, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var initiated initiateMultipartUploadResult
+	assert.Nil(t, xml.Unmarshal([]byte(readAll(t, resp)), &initiated))
+	assert.NotEmpty(t, initiated.UploadID)
+
+	parts := [][]byte{bytes.Repeat([]byte("x"), 1024), []byte("tail")}
+	complete := completeMultipartUpload{}
+	for i, part := range parts {
+		resp = do(t, http.MethodPut, fmt.Sprintf("%s?partNumber=%d&uploadId=%s", url, i+1, initiated.UploadID), part, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		complete.Parts = append(complete.Parts, completedPart{PartNumber: i + 1, ETag: resp.Header.Get("ETag")})
+	}
+
+	body, err := xml.Marshal(complete)
+	assert.Nil(t, err)
+	resp = do(t, http.MethodPost, url+"?uploadId="+initiated.UploadID, body, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var completed completeMultipartUploadResult
+	assert.Nil(t, xml.Unmarshal([]byte(readAll(t, resp)), &completed))
+	assert.True(t, strings.HasSuffix(completed.ETag, `-2"`))
+
+	resp = do(t, http.MethodGet, url, nil, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, string(bytes.Join(parts, nil)), readAll(t, resp))
+
+	// The upload is gone once completed.
+	resp = do(t, http.MethodDelete, url+"?uploadId="+initiated.UploadID, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestParseRange(t *testing.T) {
+	start, length, partial, err := parseRange("", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{0, 10}, []int64{start, length})
+	assert.False(t, partial)
+
+	start, length, _, err = parseRange("bytes=2-", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{2, 8}, []int64{start, length})
+
+	start, length, _, err = parseRange("bytes=5-100", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{5, 5}, []int64{start, length})
+
+	_, _, _, err = parseRange("bytes=0-1,3-4", 10)
+	assert.Equal(t, errInvalidRange, err)
+}
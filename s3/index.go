@@ -0,0 +1,114 @@
+package s3
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// objectInfo : S3 level attributes of an object.
+// FileServer only knows about raw bytes, so everything S3 clients expect back is kept here.
+type objectInfo struct {
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag"`
+	ContentType  string    `json:"content_type,omitempty"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// index : bucket -> key -> objectInfo, persisted as a single JSON file.
+// Keys are needed for ListObjectsV2 and cannot be recovered from a CAS path.
+type index struct {
+	path string
+
+	mu      sync.RWMutex
+	buckets map[string]map[string]objectInfo
+}
+
+func loadIndex(path string) (*index, error) {
+	idx := &index{
+		path:    path,
+		buckets: make(map[string]map[string]objectInfo),
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, &idx.buckets); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+func (idx *index) get(bucket, key string) (objectInfo, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	info, ok := idx.buckets[bucket][key]
+	return info, ok
+}
+
+func (idx *index) put(bucket, key string, info objectInfo) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if idx.buckets[bucket] == nil {
+		idx.buckets[bucket] = make(map[string]objectInfo)
+	}
+	idx.buckets[bucket][key] = info
+
+	return idx.save()
+}
+
+func (idx *index) delete(bucket, key string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	delete(idx.buckets[bucket], key)
+
+	return idx.save()
+}
+
+// keys : sorted keys of bucket that start with prefix.
+func (idx *index) keys(bucket, prefix string) []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	keys := []string{}
+	for key := range idx.buckets[bucket] {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// save : must be called with mu held.
+func (idx *index) save() error {
+	b, err := json.Marshal(idx.buckets)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(idx.path), os.ModePerm); err != nil {
+		return err
+	}
+
+	// Write + rename, so that a crash never leaves a half written index behind.
+	tmp := idx.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, idx.path)
+}
@@ -0,0 +1,230 @@
+package s3
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/PsychoPunkSage/NexNet/cryptography"
+	"github.com/PsychoPunkSage/NexNet/logging"
+)
+
+const maxPartNumber = 10000
+
+// upload : an in-progress multipart upload. Parts are staged on local disk until completion.
+type upload struct {
+	bucket      string
+	key         string
+	contentType string
+	// Part number -> quoted MD5 ETag of the part.
+	parts map[int]string
+}
+
+type uploads struct {
+	dir string
+
+	mu     sync.Mutex
+	active map[string]*upload
+}
+
+func newUploads(dir string) *uploads {
+	return &uploads{
+		dir:    dir,
+		active: make(map[string]*upload),
+	}
+}
+
+func (u *uploads) partPath(uploadID string, partNumber int) string {
+	return filepath.Join(u.dir, uploadID, strconv.Itoa(partNumber))
+}
+
+// lookup : returns the upload, making sure it belongs to bucket/key.
+func (u *uploads) lookup(uploadID, bucket, key string) (*upload, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	up, ok := u.active[uploadID]
+	if !ok || up.bucket != bucket || up.key != key {
+		return nil, false
+	}
+	return up, true
+}
+
+func (u *uploads) remove(uploadID string) error {
+	u.mu.Lock()
+	delete(u.active, uploadID)
+	u.mu.Unlock()
+
+	return os.RemoveAll(filepath.Join(u.dir, uploadID))
+}
+
+func (g *Gateway) createMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key string) *apiError {
+	uploadID := cryptography.GenerateId()
+	if err := os.MkdirAll(filepath.Join(g.uploads.dir, uploadID), os.ModePerm); err != nil {
+		g.logger(r).Error("creating upload", "bucket", bucket, logging.Key, key, "err", err)
+		return errInternalError
+	}
+
+	g.uploads.mu.Lock()
+	g.uploads.active[uploadID] = &upload{
+		bucket:      bucket,
+		key:         key,
+		contentType: r.Header.Get("Content-Type"),
+		parts:       make(map[int]string),
+	}
+	g.uploads.mu.Unlock()
+
+	writeXML(w, http.StatusOK, initiateMultipartUploadResult{
+		Xmlns:    s3Namespace,
+		Bucket:   bucket,
+		Key:      key,
+		UploadID: uploadID,
+	})
+	return nil
+}
+
+func (g *Gateway) uploadPart(w http.ResponseWriter, r *http.Request, bucket, key, uploadID string) *apiError {
+	partNumber, perr := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if perr != nil || partNumber < 1 || partNumber > maxPartNumber {
+		return errInvalidArgument
+	}
+
+	up, ok := g.uploads.lookup(uploadID, bucket, key)
+	if !ok {
+		return errNoSuchUpload
+	}
+
+	data, md5sum, err := g.readBody(w, r)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(g.uploads.partPath(uploadID, partNumber), data, 0o644); err != nil {
+		g.logger(r).Error("staging part", "bucket", bucket, logging.Key, key, "part", partNumber, "err", err)
+		return errInternalError
+	}
+
+	etag := `"` + hex.EncodeToString(md5sum) + `"`
+
+	g.uploads.mu.Lock()
+	up.parts[partNumber] = etag
+	g.uploads.mu.Unlock()
+
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (g *Gateway) completeMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, id, key, uploadID string) *apiError {
+	up, ok := g.uploads.lookup(uploadID, bucket, key)
+	if !ok {
+		return errNoSuchUpload
+	}
+
+	body, _, err := g.readBody(w, r)
+	if err != nil {
+		return err
+	}
+
+	var req completeMultipartUpload
+	if err := xml.Unmarshal(body, &req); err != nil || len(req.Parts) == 0 {
+		return errMalformedXML
+	}
+
+	var (
+		readers = []io.Reader{}
+		files   = []*os.File{}
+		etags   = md5.New()
+		size    int64
+	)
+
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	g.uploads.mu.Lock()
+	for i, part := range req.Parts {
+		if i > 0 && part.PartNumber <= req.Parts[i-1].PartNumber {
+			g.uploads.mu.Unlock()
+			return errInvalidPartOrder
+		}
+
+		etag, ok := up.parts[part.PartNumber]
+		if !ok || strings.Trim(part.ETag, `"`) != strings.Trim(etag, `"`) {
+			g.uploads.mu.Unlock()
+			return errInvalidPart
+		}
+
+		sum, _ := hex.DecodeString(strings.Trim(etag, `"`))
+		etags.Write(sum)
+	}
+	g.uploads.mu.Unlock()
+
+	for _, part := range req.Parts {
+		f, err := os.Open(g.uploads.partPath(uploadID, part.PartNumber))
+		if err != nil {
+			return errInvalidPart
+		}
+		files = append(files, f)
+
+		fi, err := f.Stat()
+		if err != nil {
+			return errInternalError
+		}
+		size += fi.Size()
+		readers = append(readers, f)
+	}
+
+	if err := g.Backend.StoreAs(r.Context(), id, key, io.MultiReader(readers...)); err != nil {
+		g.logger(r).Error("storing object", "bucket", bucket, logging.Key, key, "err", err)
+		return errInternalError
+	}
+
+	// Multipart ETag: MD5 of the concatenated part MD5s, suffixed by the part count.
+	info := objectInfo{
+		Size:         size,
+		ETag:         fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(etags.Sum(nil)), len(req.Parts)),
+		ContentType:  up.contentType,
+		LastModified: g.now().UTC(),
+	}
+	if err := g.index.put(bucket, key, info); err != nil {
+		g.logger(r).Error("updating index", "bucket", bucket, logging.Key, key, "err", err)
+		return errInternalError
+	}
+
+	if err := g.uploads.remove(uploadID); err != nil {
+		g.logger(r).Error("cleaning up upload", "upload_id", uploadID, "err", err)
+	}
+
+	writeXML(w, http.StatusOK, completeMultipartUploadResult{
+		Xmlns:  s3Namespace,
+		Bucket: bucket,
+		Key:    key,
+		ETag:   info.ETag,
+	})
+	return nil
+}
+
+func (g *Gateway) abortMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key, uploadID string) *apiError {
+	if _, ok := g.uploads.lookup(uploadID, bucket, key); !ok {
+		return errNoSuchUpload
+	}
+
+	if err := g.uploads.remove(uploadID); err != nil {
+		g.logger(r).Error("aborting upload", "upload_id", uploadID, "err", err)
+		return errInternalError
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
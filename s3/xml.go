@@ -0,0 +1,141 @@
+package s3
+
+import (
+	"encoding/xml"
+	"net/http"
+	"time"
+
+	"github.com/PsychoPunkSage/NexNet/logging"
+)
+
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// apiError : an S3 error response; see https://docs.aws.amazon.com/AmazonS3/latest/API/ErrorResponses.html
+type apiError struct {
+	Code       string
+	Message    string
+	StatusCode int
+}
+
+func (e *apiError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var (
+	errAccessDenied                 = &apiError{"AccessDenied", "Access Denied", http.StatusForbidden}
+	errAuthorizationHeaderMalformed = &apiError{"AuthorizationHeaderMalformed", "The authorization header is malformed", http.StatusBadRequest}
+	errInvalidAccessKeyID           = &apiError{"InvalidAccessKeyId", "The AWS access key ID you provided does not exist in our records", http.StatusForbidden}
+	errSignatureDoesNotMatch        = &apiError{"SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided", http.StatusForbidden}
+	errRequestTimeTooSkewed         = &apiError{"RequestTimeTooSkewed", "The difference between the request time and the server's time is too large", http.StatusForbidden}
+	errMissingContentSHA256         = &apiError{"InvalidRequest", "Missing required header for this request: x-amz-content-sha256", http.StatusBadRequest}
+	errContentSHA256Mismatch        = &apiError{"XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed", http.StatusBadRequest}
+	errBadDigest                    = &apiError{"BadDigest", "The Content-MD5 you specified did not match what we received", http.StatusBadRequest}
+	errInvalidDigest                = &apiError{"InvalidDigest", "The Content-MD5 you specified is not valid", http.StatusBadRequest}
+	errNoSuchBucket                 = &apiError{"NoSuchBucket", "The specified bucket does not exist", http.StatusNotFound}
+	errNoSuchKey                    = &apiError{"NoSuchKey", "The specified key does not exist", http.StatusNotFound}
+	errNoSuchUpload                 = &apiError{"NoSuchUpload", "The specified multipart upload does not exist", http.StatusNotFound}
+	errInvalidPart                  = &apiError{"InvalidPart", "One or more of the specified parts could not be found", http.StatusBadRequest}
+	errInvalidPartOrder             = &apiError{"InvalidPartOrder", "The list of parts was not in ascending order", http.StatusBadRequest}
+	errEntityTooLarge               = &apiError{"EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size", http.StatusBadRequest}
+	errInvalidRange                 = &apiError{"InvalidRange", "The requested range is not satisfiable", http.StatusRequestedRangeNotSatisfiable}
+	errInvalidArgument              = &apiError{"InvalidArgument", "Invalid argument", http.StatusBadRequest}
+	errMalformedXML                 = &apiError{"MalformedXML", "The XML you provided was not well-formed", http.StatusBadRequest}
+	errMethodNotAllowed             = &apiError{"MethodNotAllowed", "The specified method is not allowed against this resource", http.StatusMethodNotAllowed}
+	errNotImplemented               = &apiError{"NotImplemented", "A header you provided implies functionality that is not implemented", http.StatusNotImplemented}
+	errInternalError                = &apiError{"InternalError", "We encountered an internal error. Please try again", http.StatusInternalServerError}
+)
+
+type errorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource,omitempty"`
+	RequestID string   `xml:"RequestId,omitempty"`
+}
+
+type bucketEntry struct {
+	Name         string    `xml:"Name"`
+	CreationDate time.Time `xml:"CreationDate"`
+}
+
+type listAllMyBucketsResult struct {
+	XMLName xml.Name      `xml:"ListAllMyBucketsResult"`
+	Xmlns   string        `xml:"xmlns,attr"`
+	Buckets []bucketEntry `xml:"Buckets>Bucket"`
+}
+
+type objectEntry struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	ETag         string    `xml:"ETag"`
+	Size         int64     `xml:"Size"`
+	StorageClass string    `xml:"StorageClass"`
+}
+
+type commonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name       `xml:"ListBucketResult"`
+	Xmlns                 string         `xml:"xmlns,attr"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	Delimiter             string         `xml:"Delimiter,omitempty"`
+	StartAfter            string         `xml:"StartAfter,omitempty"`
+	ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	KeyCount              int            `xml:"KeyCount"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	Contents              []objectEntry  `xml:"Contents"`
+	CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+}
+
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+type completeMultipartUploadResult struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Bucket  string   `xml:"Bucket"`
+	Key     string   `xml:"Key"`
+	ETag    string   `xml:"ETag"`
+}
+
+func writeXML(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, e *apiError) {
+	if r.Method == http.MethodHead {
+		// HEAD responses carry no body.
+		w.WriteHeader(e.StatusCode)
+		return
+	}
+
+	writeXML(w, e.StatusCode, errorResponse{
+		Code:      e.Code,
+		Message:   e.Message,
+		Resource:  r.URL.Path,
+		RequestID: logging.RequestIDFrom(r.Context()),
+	})
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/PsychoPunkSage/NexNet/admin"
+	"github.com/PsychoPunkSage/NexNet/config"
+	"github.com/PsychoPunkSage/NexNet/cryptography"
+	"github.com/PsychoPunkSage/NexNet/discovery"
+	"github.com/PsychoPunkSage/NexNet/logging"
+	"github.com/PsychoPunkSage/NexNet/metrics"
+	"github.com/PsychoPunkSage/NexNet/p2p"
+	"github.com/PsychoPunkSage/NexNet/s3"
+	"github.com/PsychoPunkSage/NexNet/server"
+	"github.com/PsychoPunkSage/NexNet/storage"
+	"github.com/PsychoPunkSage/NexNet/tracing"
+)
+
+// How long in-flight transfers get to finish once asked to stop.
+const shutdownTimeout = 30 * time.Second
+
+func runServe(args []string) error {
+	defaults := config.Default()
+
+	fset := newFlagSet("serve", "[-config file] [flags]")
+	configPath := fset.String("config", os.Getenv("NEXNET_CONFIG"), "TOML, YAML or JSON config file (env NEXNET_CONFIG)")
+	// Flags below override the config file and environment, but only when given explicitly.
+	fset.String("listen", defaults.ListenAddr, "address the node listens on for peers")
+	fset.String("quic", "", "UDP address the node also listens on for QUIC peers, empty to disable")
+	fset.Bool("quic-insecure", false, "over QUIC, a self-signed certificate and peers not authenticated (instead of [quic] tls_*)")
+	fset.String("ws", "", "address the node also serves WebSocket peers on, empty to disable")
+	fset.String("unix", "", "Unix socket the node also accepts peers on, empty to disable")
+	fset.Bool("discovery", defaults.Discovery.Enabled, "find the other nodes of the cluster on the LAN, over UDP multicast")
+	fset.String("cluster", defaults.Discovery.Cluster, "cluster name: discovery only connects nodes of the same cluster")
+	fset.String("root", "", "storage root folder (default: <port>_network)")
+	fset.String("keystore", "", "keystore made by 'fs keygen' (default: throwaway identity)")
+	fset.String("admin", defaults.AdminAddr, "admin API address, empty to disable")
+	fset.String("s3", "", "S3 gateway address, empty to disable")
+	fset.String("s3-bucket", defaults.S3.Bucket, "bucket name the S3 gateway maps to this node's ID")
+	fset.String("s3-access-key", "", "access key ID accepted by the S3 gateway")
+	fset.String("s3-secret-key", "", "secret key accepted by the S3 gateway")
+	fset.Var(&listFlag{}, "bootstrap", "peer address to connect to on startup (repeatable, comma separated)")
+	fset.Parse(args)
+
+	loadConfig := func() (*config.Config, error) {
+		cfg, err := config.Load(*configPath)
+		if err != nil {
+			return nil, err
+		}
+		applyFlags(fset, cfg)
+		return cfg, cfg.Validate()
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	logger, logLevel := setupLogging(cfg.Log)
+
+	ks, err := loadOrCreateKeystore(logger, cfg.Keystore)
+	if err != nil {
+		return err
+	}
+
+	var m *metrics.Metrics
+	if len(cfg.Metrics.ListenAddr) > 0 {
+		m = metrics.New()
+	}
+
+	tracer, closeTracer, err := makeTracer(cfg.Tracing, ks.ID)
+	if err != nil {
+		return err
+	}
+	defer closeTracer()
+
+	bandwidth := p2p.NewBandwidth(bandwidthLimits(cfg.Bandwidth))
+	s, err := makeServer(cfg, ks, logger, m, bandwidth)
+	if err != nil {
+		return err
+	}
+	s.Tracer = tracer
+	// Admin API, S3 gateway & metrics errors are fatal, same as the node's own.
+	errCh := make(chan error, 4)
+
+	if m != nil {
+		go func() {
+			errCh <- m.ListenAndServe(cfg.Metrics.ListenAddr, logger)
+		}()
+	}
+
+	if len(cfg.AdminAddr) > 0 {
+		api := admin.NewServer(admin.ServerOpts{
+			ListenAddr: cfg.AdminAddr,
+			Token:      cfg.AdminToken,
+			Node:       s,
+			Bandwidth:  bandwidth,
+			Logger:     logger,
+		})
+		go func() {
+			errCh <- api.ListenAndServe()
+		}()
+	}
+
+	if len(cfg.S3.ListenAddr) > 0 {
+		gw, err := s3.NewGateway(s3.GatewayOpts{
+			ListenAddr:  cfg.S3.ListenAddr,
+			Backend:     s,
+			Buckets:     map[string]string{cfg.S3.Bucket: s.ID},
+			Credentials: map[string]string{cfg.S3.AccessKey: cfg.S3.SecretKey},
+			StateDir:    cfg.StorageRoot + "_s3",
+			// Same as FileServer's, but 0 isn't unlimited.
+			MaxObjectSize: cfg.Limits.MaxObjectSize,
+			Logger:        logger,
+		})
+		if err != nil {
+			return err
+		}
+		go func() {
+			errCh <- gw.ListenAndServe()
+		}()
+	}
+
+	go func() {
+		errCh <- s.Start()
+	}()
+
+	if cfg.Discovery.Enabled {
+		// Validated already.
+		interval, _ := cfg.Discovery.IntervalDuration()
+		disco := discovery.NewService(discovery.ServiceOpts{
+			NodeID:     s.ID,
+			ListenAddr: s.Transport.ListenAddress(),
+			Cluster:    cfg.Discovery.Cluster,
+			Group:      cfg.Discovery.Group,
+			Interface:  cfg.Discovery.Interface,
+			Interval:   interval,
+			Dial:       s.Connect,
+			Logger:     logger,
+		})
+		if err := disco.Start(); err != nil {
+			s.Stop()
+			return fmt.Errorf("discovery: %w", err)
+		}
+		defer disco.Close()
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigCh)
+
+	for {
+		select {
+		case err := <-errCh:
+			return err
+
+		case sig := <-sigCh:
+			if sig == syscall.SIGHUP {
+				next, err := loadConfig()
+				if err != nil {
+					logger.Error("config reload failed, keeping the current config", "err", err)
+					continue
+				}
+				reload(logger, s, bandwidth, logLevel, cfg, next)
+				cfg = next
+				continue
+			}
+
+			logger.Info("shutting down", "signal", sig.String(), "timeout", shutdownTimeout)
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			return s.Shutdown(ctx)
+		}
+	}
+}
+
+// reload : applies the hot-reloadable part of next to the running server.
+func reload(logger *slog.Logger, s *server.FileServer, bandwidth *p2p.Bandwidth, logLevel *slog.LevelVar, cur, next *config.Config) {
+	if fields := cur.RestartRequired(next); len(fields) > 0 {
+		logger.Warn("config reload: restart required to apply some changes", "fields", fields)
+	}
+
+	s.SetBootstrapNodes(next.BootstrapNodes)
+	s.SetReplicationFactor(next.Replication.Factor)
+	s.SetLimits(serverLimits(next.Limits))
+	bandwidth.SetLimits(bandwidthLimits(next.Bandwidth))
+	s.SetQuotas(storeQuotas(next.Quota))
+	logLevel.Set(parseLevel(next.Log.Level))
+
+	logger.Info("config reloaded")
+}
+
+// applyFlags : copies the explicitly set flags of `fs serve` into cfg.
+func applyFlags(fset *flag.FlagSet, cfg *config.Config) {
+	fset.Visit(func(f *flag.Flag) {
+		v := f.Value.String()
+		switch f.Name {
+		case "listen":
+			cfg.ListenAddr = v
+		case "quic":
+			cfg.QUICListenAddr = v
+		case "quic-insecure":
+			cfg.QUIC.InsecureSkipVerify = v == "true"
+		case "ws":
+			cfg.WebSocket.ListenAddr = v
+		case "unix":
+			cfg.Unix.Socket = v
+		case "discovery":
+			cfg.Discovery.Enabled = v == "true"
+		case "cluster":
+			cfg.Discovery.Cluster = v
+		case "root":
+			cfg.StorageRoot = v
+		case "keystore":
+			cfg.Keystore = v
+		case "admin":
+			cfg.AdminAddr = v
+		case "s3":
+			cfg.S3.ListenAddr = v
+		case "s3-bucket":
+			cfg.S3.Bucket = v
+		case "s3-access-key":
+			cfg.S3.AccessKey = v
+		case "s3-secret-key":
+			cfg.S3.SecretKey = v
+		case "bootstrap":
+			cfg.BootstrapNodes = *f.Value.(*listFlag)
+		}
+	})
+}
+
+// makeServer : m may be nil, for no metrics. bandwidth applies to the TCP, WebSocket and Unix
+// transports.
+func makeServer(cfg *config.Config, ks *cryptography.Keystore, logger *slog.Logger, m *metrics.Metrics, bandwidth *p2p.Bandwidth) (*server.FileServer, error) {
+	tcpTransportOpts := p2p.TCPTransportOpts{
+		ListenAddr:    cfg.ListenAddr,
+		HandshakeFunc: p2p.VersionHandshake(p2p.DefaultHello()),
+		Decoder:       p2p.DefaultDecoder{},
+		Logger:        logger.With(logging.NodeID, ks.ID),
+		Bandwidth:     bandwidth,
+	}
+	if m != nil {
+		tcpTransportOpts.Metrics = m
+	}
+	// Validated already; also applies to the WebSocket and Unix transports.
+	interval, readTimeout, writeTimeout, idleTimeout, _ := cfg.Heartbeat.Durations()
+	tcpTransportOpts.Heartbeat = p2p.Heartbeat{
+		Interval:     interval,
+		ReadTimeout:  readTimeout,
+		WriteTimeout: writeTimeout,
+		IdleTimeout:  idleTimeout,
+	}
+	tcpTransport := p2p.NewTCPTransport(tcpTransportOpts)
+
+	// TCP first: addresses without a scheme are dialed over TCP.
+	transports := []p2p.Transport{tcpTransport}
+
+	var quicTransport *p2p.QUICTransport
+	if len(cfg.QUICListenAddr) > 0 {
+		hello := p2p.DefaultHello()
+		hello.Capabilities |= p2p.CapMultiplexing
+		tlsConfig, err := quicTLSConfig(cfg.QUIC)
+		if err != nil {
+			return nil, err
+		}
+		quicTransportOpts := p2p.QUICTransportOpts{
+			ListenAddr:         cfg.QUICListenAddr,
+			HandshakeFunc:      p2p.VersionHandshake(hello),
+			Decoder:            p2p.DefaultDecoder{},
+			TLSConfig:          tlsConfig,
+			InsecureSkipVerify: cfg.QUIC.InsecureSkipVerify,
+			Logger:             logger.With(logging.NodeID, ks.ID),
+		}
+		if m != nil {
+			quicTransportOpts.Metrics = m
+		}
+		if quicTransport, err = p2p.NewQUICTransport(quicTransportOpts); err != nil {
+			return nil, err
+		}
+		transports = append(transports, quicTransport)
+	}
+
+	var wsTransport *p2p.WSTransport
+	if len(cfg.WebSocket.ListenAddr) > 0 {
+		wsTransportOpts := p2p.WSTransportOpts{
+			TCPTransportOpts: tcpTransportOpts,
+			Path:             cfg.WebSocket.Path,
+		}
+		wsTransportOpts.ListenAddr = cfg.WebSocket.ListenAddr
+		tlsConfig, err := wsTLSConfig(cfg.WebSocket)
+		if err != nil {
+			return nil, err
+		}
+		wsTransportOpts.TLSConfig = tlsConfig
+		wsTransport = p2p.NewWSTransport(wsTransportOpts)
+		transports = append(transports, wsTransport)
+	}
+
+	var unixTransport *p2p.UnixTransport
+	if len(cfg.Unix.Socket) > 0 {
+		// Validated already.
+		mode, _ := cfg.Unix.FileMode()
+		gid, _ := cfg.Unix.GID()
+		uids, _ := cfg.Unix.UIDs()
+		unixTransportOpts := p2p.UnixTransportOpts{
+			TCPTransportOpts: tcpTransportOpts,
+			Mode:             mode,
+			GID:              gid,
+			AllowUIDs:        uids,
+		}
+		unixTransportOpts.ListenAddr = cfg.Unix.Socket
+		unixTransport = p2p.NewUnixTransport(unixTransportOpts)
+		transports = append(transports, unixTransport)
+	}
+
+	var transport p2p.Transport = tcpTransport
+	if len(transports) > 1 {
+		transport = p2p.NewMultiTransport(transports...)
+	}
+
+	pathTransformFunc := storage.CASPathTransformFunc
+	if cfg.PathTransform == "default" {
+		pathTransformFunc = storage.DefaultPathTransformFunc
+	}
+
+	fileServerOpts := server.FileServerOpts{
+		ID:                ks.ID,
+		EncKey:            ks.EncKey,
+		StorageRoot:       cfg.StorageRoot,
+		PathTransformFunc: pathTransformFunc,
+		Transport:         transport,
+		BootstrapNodes:    cfg.BootstrapNodes,
+		ReplicationFactor: cfg.Replication.Factor,
+		Limits:            serverLimits(cfg.Limits),
+		PeerExchange:      server.PeerExchange(cfg.PeerExchange),
+		Logger:            logger,
+	}
+	fileServerOpts.Quota, fileServerOpts.Quotas = storeQuotas(cfg.Quota)
+	if cfg.Membership.Enabled {
+		probeInterval, suspicionTimeout, _ := cfg.Membership.Durations()
+		fileServerOpts.Membership = server.Membership{
+			Enabled:          true,
+			ProbeInterval:    probeInterval,
+			SuspicionTimeout: suspicionTimeout,
+		}
+	}
+	if cfg.Scrub.Enabled {
+		interval, _ := cfg.Scrub.IntervalDuration()
+		fileServerOpts.Scrub = server.Scrub{Enabled: true, Rate: cfg.Scrub.Rate, Interval: interval}
+	}
+	if m != nil {
+		fileServerOpts.Metrics = m
+	}
+
+	s := server.NewFileServer(fileServerOpts)
+	tcpTransport.OnPeer = s.OnPeer
+	tcpTransport.OnPeerDisconnect = s.OnPeerDisconnect
+	if quicTransport != nil {
+		quicTransport.OnPeer = s.OnPeer
+		quicTransport.OnPeerDisconnect = s.OnPeerDisconnect
+	}
+	if wsTransport != nil {
+		wsTransport.OnPeer = s.OnPeer
+		wsTransport.OnPeerDisconnect = s.OnPeerDisconnect
+	}
+	if unixTransport != nil {
+		unixTransport.OnPeer = s.OnPeer
+		unixTransport.OnPeerDisconnect = s.OnPeerDisconnect
+	}
+
+	return s, nil
+}
+
+// wsTLSConfig : nil when neither serving nor dialing wss:// needs one.
+func wsTLSConfig(cfg config.WebSocket) (*tls.Config, error) {
+	if len(cfg.TLSCert) == 0 && len(cfg.TLSCA) == 0 {
+		return nil, nil
+	}
+	return loadTLSConfig(cfg.TLSCert, cfg.TLSKey, cfg.TLSCA)
+}
+
+// quicTLSConfig : peers checked against the CA whichever side dials; nil when none is set up (see
+// config.QUIC.InsecureSkipVerify).
+func quicTLSConfig(cfg config.QUIC) (*tls.Config, error) {
+	if len(cfg.TLSCert) == 0 && len(cfg.TLSCA) == 0 {
+		return nil, nil
+	}
+
+	tlsConfig, err := loadTLSConfig(cfg.TLSCert, cfg.TLSKey, cfg.TLSCA)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ClientCAs = tlsConfig.RootCAs
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	return tlsConfig, nil
+}
+
+// loadTLSConfig : certFile & keyFile presented, caFile trusted, from PEM files; each optional.
+func loadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if len(certFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if len(caFile) > 0 {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// makeTracer : the returned func flushes & closes the exporter.
+func makeTracer(cfg config.Tracing, nodeID string) (*tracing.Tracer, func() error, error) {
+	opts := tracing.TracerOpts{ServiceName: nodeID}
+	closer := func() error { return nil }
+
+	switch cfg.Exporter {
+	case "stdout":
+		opts.Exporter = tracing.NewOTLPExporter(os.Stdout)
+	case "file":
+		exp, err := tracing.OpenOTLPFile(cfg.File)
+		if err != nil {
+			return nil, nil, err
+		}
+		opts.Exporter = exp
+		closer = exp.Close
+	}
+
+	return tracing.NewTracer(opts), closer, nil
+}
+
+func serverLimits(l config.Limits) server.Limits {
+	banDuration, _ := l.BanDurationValue()
+	return server.Limits{
+		MaxObjectSize:    l.MaxObjectSize,
+		MaxPeers:         l.MaxPeers,
+		PeerMessageRate:  l.PeerMessageRate,
+		OwnerMessageRate: l.OwnerMessageRate,
+		PeerStreams:      l.PeerStreams,
+		OwnerStreams:     l.OwnerStreams,
+		PeerBytes:        l.PeerBytes,
+		OwnerBytes:       l.OwnerBytes,
+		BanThreshold:     l.BanThreshold,
+		BanDuration:      banDuration,
+	}
+}
+
+func storeQuotas(q config.Quota) (storage.Quota, map[string]storage.Quota) {
+	byID := make(map[string]storage.Quota, len(q.Owners))
+	for id, oq := range q.Owners {
+		byID[id] = storage.Quota(oq)
+	}
+	return storage.Quota{
+		SoftBytes:   q.SoftBytes,
+		HardBytes:   q.HardBytes,
+		SoftObjects: q.SoftObjects,
+		HardObjects: q.HardObjects,
+	}, byID
+}
+
+func bandwidthLimits(b config.Bandwidth) p2p.BandwidthLimits {
+	return p2p.BandwidthLimits{
+		Global:  p2p.Rate{In: b.GlobalIn, Out: b.GlobalOut},
+		PerPeer: p2p.Rate{In: b.PeerIn, Out: b.PeerOut},
+	}
+}
+
+// setupLogging : the logger of the node, on stderr. It is also made the default, so that the
+// standard logger goes through it. The returned LevelVar changes the level of the running process.
+func setupLogging(cfg config.Log) (*slog.Logger, *slog.LevelVar) {
+	level := new(slog.LevelVar)
+	level.Set(parseLevel(cfg.Level))
+
+	logger := logging.New(os.Stderr, level, cfg.Format)
+	slog.SetDefault(logger)
+
+	return logger, level
+}
+
+func parseLevel(s string) slog.Level {
+	// Already validated by config.Validate.
+	level, _ := logging.ParseLevel(s)
+	return level
+}
+
+func loadOrCreateKeystore(logger *slog.Logger, path string) (*cryptography.Keystore, error) {
+	if len(path) == 0 {
+		logger.Warn("no keystore given: using a throwaway identity, files will be unreadable after a restart")
+		return cryptography.NewKeystore(), nil
+	}
+	return cryptography.LoadKeystore(path)
+}
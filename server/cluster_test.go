@@ -0,0 +1,595 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PsychoPunkSage/NexNet/cryptography"
+	"github.com/PsychoPunkSage/NexNet/logging"
+	"github.com/PsychoPunkSage/NexNet/p2p"
+	"github.com/PsychoPunkSage/NexNet/server"
+	"github.com/PsychoPunkSage/NexNet/server/servertest"
+	"github.com/PsychoPunkSage/NexNet/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+const eventually = 5 * time.Second
+
+// replicated : whether the node holds the replica of key, stored by owner.
+func replicated(node, owner *server.FileServer, key string) bool {
+	return server.HasLocal(node, owner.ID, cryptography.HashKey(key))
+}
+
+func TestClusterStoreGetRemove(t *testing.T) {
+	c := servertest.NewCluster(t, 3)
+	owner := c.Nodes[0]
+	ctx := context.Background()
+	payload := []byte("replicate me")
+
+	assert.Nil(t, owner.Store(ctx, "photos/cat.png", bytes.NewReader(payload)))
+	for _, node := range c.Nodes[1:] {
+		node := node
+		assert.Eventually(t, func() bool { return replicated(node, owner, "photos/cat.png") }, eventually, 10*time.Millisecond)
+	}
+
+	// Lost locally: fetched back from the replicas.
+	assert.Nil(t, server.DeleteLocal(owner, owner.ID, "photos/cat.png"))
+	r, err := owner.Get(ctx, "photos/cat.png")
+	assert.Nil(t, err)
+	got, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	if rc, ok := r.(io.ReadCloser); ok {
+		rc.Close()
+	}
+	assert.Equal(t, payload, got)
+
+	assert.Nil(t, owner.Remove(ctx, "photos/cat.png"))
+	assert.False(t, server.HasLocal(owner, owner.ID, "photos/cat.png"))
+	for _, node := range c.Nodes[1:] {
+		node := node
+		assert.Eventually(t, func() bool { return !replicated(node, owner, "photos/cat.png") }, eventually, 10*time.Millisecond)
+	}
+
+	assert.ErrorIs(t, owner.Remove(ctx, "photos/cat.png"), os.ErrNotExist)
+}
+
+func TestClusterMemoryBackend(t *testing.T) {
+	roots := []string{}
+	c := servertest.NewCluster(t, 3, func(i int, opts *server.FileServerOpts) {
+		opts.Backend = storage.NewMemory()
+		roots = append(roots, opts.StorageRoot)
+	})
+	owner := c.Nodes[0]
+	ctx := context.Background()
+	payload := []byte("kept in memory")
+
+	assert.Nil(t, owner.Store(ctx, "key", bytes.NewReader(payload)))
+	for _, node := range c.Nodes[1:] {
+		node := node
+		assert.Eventually(t, func() bool { return replicated(node, owner, "key") }, eventually, 10*time.Millisecond)
+	}
+
+	assert.Nil(t, server.DeleteLocal(owner, owner.ID, "key"))
+	r, err := owner.Get(ctx, "key")
+	if assert.Nil(t, err) {
+		got, err := io.ReadAll(r)
+		assert.Nil(t, err)
+		assert.Equal(t, payload, got)
+	}
+
+	usage, err := c.Nodes[1].StatUsage(ctx, owner.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), usage.Usage.Objects)
+
+	// Nothing went to disk.
+	for _, root := range roots {
+		entries, _ := os.ReadDir(root)
+		assert.Empty(t, entries)
+	}
+}
+
+func TestClusterReplicationFactor(t *testing.T) {
+	c := servertest.NewCluster(t, 4, func(i int, opts *server.FileServerOpts) {
+		opts.ReplicationFactor = 1
+	})
+	owner := c.Nodes[3]
+
+	assert.Nil(t, owner.Store(context.Background(), "key", bytes.NewReader([]byte("once"))))
+
+	// Peers are picked in address order.
+	assert.Eventually(t, func() bool { return replicated(c.Nodes[0], owner, "key") }, eventually, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, replicated(c.Nodes[1], owner, "key"))
+	assert.False(t, replicated(c.Nodes[2], owner, "key"))
+}
+
+func TestClusterPartition(t *testing.T) {
+	c := servertest.NewCluster(t, 3)
+	owner := c.Nodes[0]
+
+	c.Faults().Partition([]string{servertest.Addr(0), servertest.Addr(1)}, []string{servertest.Addr(2)})
+	assert.Nil(t, owner.Store(context.Background(), "key", bytes.NewReader([]byte("split brain"))))
+
+	assert.Eventually(t, func() bool { return replicated(c.Nodes[1], owner, "key") }, eventually, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, replicated(c.Nodes[2], owner, "key"))
+
+	// Dials across the partition fail too.
+	assert.NotNil(t, c.Nodes[2].Transport.Dial(servertest.Addr(0)))
+}
+
+func TestClusterKilledConnection(t *testing.T) {
+	c := servertest.NewCluster(t, 3)
+
+	assert.Equal(t, 1, c.Faults().Kill(servertest.Addr(0), servertest.Addr(1)))
+
+	assert.Eventually(t, func() bool {
+		return len(c.Nodes[0].Peers()) == 1 && len(c.Nodes[1].Peers()) == 1
+	}, eventually, 10*time.Millisecond)
+	assert.Equal(t, []string{servertest.Addr(2)}, c.Nodes[0].Peers())
+
+	// The survivors still replicate.
+	owner := c.Nodes[0]
+	assert.Nil(t, owner.Store(context.Background(), "key", bytes.NewReader([]byte("still here"))))
+	assert.Eventually(t, func() bool { return replicated(c.Nodes[2], owner, "key") }, eventually, 10*time.Millisecond)
+	assert.False(t, replicated(c.Nodes[1], owner, "key"))
+}
+
+func TestClusterHeartbeat(t *testing.T) {
+	c := servertest.NewCluster(t, 3, func(i int, opts *server.FileServerOpts) {
+		opts.Transport.(*p2p.MemTransport).Heartbeat = p2p.Heartbeat{Interval: 20 * time.Millisecond, ReadTimeout: 100 * time.Millisecond}
+	})
+
+	assert.Eventually(t, func() bool { return len(c.Nodes[0].PeerRTTs()) == 2 }, eventually, 10*time.Millisecond)
+
+	// Half-open: the connection is there, but nothing gets through.
+	c.Faults().Partition([]string{servertest.Addr(0), servertest.Addr(1)}, []string{servertest.Addr(2)})
+	assert.Eventually(t, func() bool {
+		return len(c.Nodes[0].Peers()) == 1 && len(c.Nodes[1].Peers()) == 1 && len(c.Nodes[2].Peers()) == 0
+	}, eventually, 10*time.Millisecond)
+	assert.Equal(t, []string{servertest.Addr(1)}, c.Nodes[0].Peers())
+}
+
+func TestClusterBandwidth(t *testing.T) {
+	bw := p2p.NewBandwidth(p2p.BandwidthLimits{PerPeer: p2p.Rate{Out: 64 << 10}})
+	c := servertest.NewCluster(t, 2, func(i int, opts *server.FileServerOpts) {
+		if i == 0 {
+			opts.Transport.(*p2p.MemTransport).Bandwidth = bw
+		}
+	})
+	owner := c.Nodes[0]
+	payload := bytes.Repeat([]byte("x"), 128<<10)
+	ctx := server.WithPriority(context.Background(), p2p.Background)
+
+	start := time.Now()
+	assert.Nil(t, owner.Store(ctx, "slow", bytes.NewReader(payload)))
+	assert.Greater(t, time.Since(start), 400*time.Millisecond)
+	assert.Eventually(t, func() bool { return replicated(c.Nodes[1], owner, "slow") }, eventually, 10*time.Millisecond)
+
+	// Lifted while running.
+	bw.SetLimits(p2p.BandwidthLimits{})
+	start = time.Now()
+	assert.Nil(t, owner.Store(ctx, "fast", bytes.NewReader(payload)))
+	assert.Less(t, time.Since(start), 400*time.Millisecond)
+	assert.Eventually(t, func() bool { return replicated(c.Nodes[1], owner, "fast") }, eventually, 10*time.Millisecond)
+}
+
+func TestClusterRateLimit(t *testing.T) {
+	c := servertest.NewCluster(t, 2, func(i int, opts *server.FileServerOpts) {
+		if i == 1 {
+			opts.Limits = server.Limits{OwnerMessageRate: 0.01}
+		}
+	})
+	owner := c.Nodes[0]
+	ctx := context.Background()
+
+	for _, key := range []string{"first", "second"} {
+		assert.Nil(t, owner.Store(ctx, key, bytes.NewReader([]byte(key))))
+	}
+	assert.Eventually(t, func() bool { return replicated(c.Nodes[1], owner, "first") }, eventually, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		refused := c.Logs[0].Find(map[string]any{"msg": "request refused by peer", "peer": servertest.Addr(1)})
+		return len(refused) == 1 && strings.Contains(refused[0]["reason"].(string), "rate limited")
+	}, eventually, 10*time.Millisecond)
+	assert.False(t, replicated(c.Nodes[1], owner, "second"))
+
+	// Not banned: the connection is still usable once the rate allows.
+	c.Nodes[1].SetLimits(server.Limits{})
+	assert.Nil(t, owner.Store(ctx, "third", bytes.NewReader([]byte("third"))))
+	assert.Eventually(t, func() bool { return replicated(c.Nodes[1], owner, "third") }, eventually, 10*time.Millisecond)
+}
+
+func TestClusterOversizeDropped(t *testing.T) {
+	c := servertest.NewCluster(t, 2, func(i int, opts *server.FileServerOpts) {
+		if i == 1 {
+			opts.Limits = server.Limits{MaxObjectSize: 1 << 10}
+		}
+	})
+	owner := c.Nodes[0]
+
+	// Not read just to be dropped: the peer is disconnected instead, failing the transfer.
+	owner.Store(context.Background(), "huge", bytes.NewReader(make([]byte, 64<<10)))
+	assert.Eventually(t, func() bool { return len(c.Nodes[1].Peers()) == 0 }, eventually, 10*time.Millisecond)
+	assert.Len(t, c.Logs[1].Find(map[string]any{"msg": "dropping peer streaming a refused file"}), 1)
+	assert.False(t, replicated(c.Nodes[1], owner, "huge"))
+}
+
+func TestClusterOversizeKeepsObject(t *testing.T) {
+	c := servertest.NewCluster(t, 1, func(i int, opts *server.FileServerOpts) {
+		opts.Limits = server.Limits{MaxObjectSize: 16}
+	})
+	owner := c.Nodes[0]
+	ctx := context.Background()
+	payload := []byte("sixteen bytes ok")
+
+	assert.Nil(t, owner.Store(ctx, "key", bytes.NewReader(payload)))
+	err := owner.Store(ctx, "key", bytes.NewReader(bytes.Repeat([]byte("x"), 17)))
+	assert.ErrorIs(t, err, server.ErrObjectTooLarge)
+
+	// Refused without touching the object already there.
+	r, err := owner.Get(ctx, "key")
+	if assert.Nil(t, err) {
+		got, err := io.ReadAll(r)
+		assert.Nil(t, err)
+		assert.Equal(t, payload, got)
+	}
+	assert.Nil(t, server.VerifyLocal(owner, owner.ID, "key"))
+}
+
+func TestClusterBan(t *testing.T) {
+	c := servertest.NewCluster(t, 2, func(i int, opts *server.FileServerOpts) {
+		if i == 1 {
+			opts.Limits = server.Limits{PeerBytes: 64 << 10, BanThreshold: 2, BanDuration: time.Minute}
+		}
+	})
+	owner := c.Nodes[0]
+	ctx := context.Background()
+	payload := bytes.Repeat([]byte("x"), 48<<10)
+
+	// The second and third files are over the bytes of the peer: refused twice, it's banned.
+	for _, key := range []string{"a", "b", "c"} {
+		assert.Nil(t, owner.Store(ctx, key, bytes.NewReader(payload)))
+	}
+	assert.Eventually(t, func() bool { return len(c.Nodes[1].Peers()) == 0 }, eventually, 10*time.Millisecond)
+	assert.True(t, replicated(c.Nodes[1], owner, "a"))
+	assert.False(t, replicated(c.Nodes[1], owner, "b"))
+	assert.False(t, replicated(c.Nodes[1], owner, "c"))
+	assert.Len(t, c.Logs[1].Find(map[string]any{"msg": "banning peer", "host": servertest.Addr(0)}), 1)
+	refused := c.Logs[0].Find(map[string]any{"msg": "request refused by peer", "peer": servertest.Addr(1)})
+	if assert.NotEmpty(t, refused) {
+		assert.Contains(t, refused[0]["reason"], "too many bytes")
+	}
+
+	assert.Nil(t, c.Nodes[0].Transport.Dial(servertest.Addr(1)))
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, c.Nodes[1].Peers())
+}
+
+func TestClusterQuota(t *testing.T) {
+	c := servertest.NewCluster(t, 2, func(i int, opts *server.FileServerOpts) {
+		if i == 1 {
+			opts.Quota = storage.Quota{HardBytes: 64}
+			opts.Limits = server.Limits{BanThreshold: 1, BanDuration: time.Minute}
+		}
+	})
+	owner := c.Nodes[0]
+	ctx := context.Background()
+
+	assert.Nil(t, owner.Store(ctx, "small", bytes.NewReader([]byte("fits"))))
+	assert.Eventually(t, func() bool { return replicated(c.Nodes[1], owner, "small") }, eventually, 10*time.Millisecond)
+
+	// Over the quota on the replica only: refused there, without counting against the peer.
+	assert.Nil(t, owner.Store(ctx, "large", bytes.NewReader(make([]byte, 64))))
+	assert.Eventually(t, func() bool {
+		refused := c.Logs[0].Find(map[string]any{"msg": "request refused by peer", "peer": servertest.Addr(1)})
+		return len(refused) == 1 && strings.Contains(refused[0]["reason"].(string), "quota exceeded")
+	}, eventually, 10*time.Millisecond)
+	assert.False(t, replicated(c.Nodes[1], owner, "large"))
+	assert.Equal(t, []string{servertest.Addr(0)}, c.Nodes[1].Peers())
+
+	usage, err := c.Nodes[1].StatUsage(ctx, owner.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, storage.Usage{Bytes: int64(len("fits")) + server.PrependSig, Objects: 1}, usage.Usage)
+
+	// Locally, refused before anything is written or sent.
+	c.Nodes[0].SetQuotas(storage.Quota{HardObjects: 2}, nil)
+	err = owner.Store(ctx, "third", bytes.NewReader([]byte("one too many")))
+	assert.ErrorIs(t, err, storage.ErrQuotaExceeded)
+	assert.False(t, server.HasLocal(owner, owner.ID, "third"))
+}
+
+func TestClusterScrub(t *testing.T) {
+	c := servertest.NewCluster(t, 3, func(i int, opts *server.FileServerOpts) {
+		opts.Scrub = server.Scrub{Enabled: true, Rate: 1 << 30, Interval: 50 * time.Millisecond}
+	})
+	owner := c.Nodes[0]
+	ctx := context.Background()
+	payload := []byte("scrub me")
+
+	assert.Nil(t, owner.Store(ctx, "key", bytes.NewReader(payload)))
+	for _, node := range c.Nodes[1:] {
+		node := node
+		assert.Eventually(t, func() bool { return replicated(node, owner, "key") }, eventually, 10*time.Millisecond)
+	}
+
+	// A replica: copied again from the other one.
+	replica := cryptography.HashKey("key")
+	assert.Nil(t, server.CorruptLocal(c.Nodes[1], owner.ID, replica))
+	assert.Eventually(t, func() bool {
+		return len(c.Logs[1].Find(map[string]any{"msg": "corrupt file fetched again from peers", "key": replica})) == 1
+	}, eventually, 10*time.Millisecond)
+	assert.Nil(t, server.VerifyLocal(c.Nodes[1], owner.ID, replica))
+
+	// The owner's own copy: decrypted again from a replica.
+	assert.Nil(t, server.CorruptLocal(owner, owner.ID, "key"))
+	assert.Eventually(t, func() bool {
+		return len(c.Logs[0].Find(map[string]any{"msg": "corrupt file fetched again from peers", "key": "key"})) == 1
+	}, eventually, 10*time.Millisecond)
+	assert.Nil(t, server.VerifyLocal(owner, owner.ID, "key"))
+
+	r, err := owner.Get(ctx, "key")
+	if assert.Nil(t, err) {
+		got, err := io.ReadAll(r)
+		assert.Nil(t, err)
+		assert.Equal(t, payload, got)
+	}
+}
+
+func TestClusterServeCorrupt(t *testing.T) {
+	c := servertest.NewCluster(t, 3)
+	owner := c.Nodes[0]
+	ctx := context.Background()
+	payload := []byte("checked while streamed")
+
+	assert.Nil(t, owner.Store(ctx, "key", bytes.NewReader(payload)))
+	for _, node := range c.Nodes[1:] {
+		node := node
+		assert.Eventually(t, func() bool { return replicated(node, owner, "key") }, eventually, 10*time.Millisecond)
+	}
+
+	replica := cryptography.HashKey("key")
+	assert.Nil(t, server.CorruptLocal(c.Nodes[1], owner.ID, replica))
+	assert.Nil(t, server.DeleteLocal(owner, owner.ID, "key"))
+
+	// Node 1 cuts its stream short; the copy of node 2 is the one kept.
+	r, err := owner.Get(ctx, "key")
+	if assert.Nil(t, err) {
+		got, err := io.ReadAll(r)
+		assert.Nil(t, err)
+		assert.Equal(t, payload, got)
+	}
+	assert.Nil(t, server.VerifyLocal(owner, owner.ID, "key"))
+	assert.Len(t, c.Logs[0].Find(map[string]any{"msg": "file stream cut short by peer", "peer": servertest.Addr(1)}), 1)
+	assert.Eventually(t, func() bool {
+		return len(c.Logs[1].Find(map[string]any{"msg": "corrupt file found", "key": replica})) == 1
+	}, eventually, 10*time.Millisecond)
+
+	// Node 1 is dropped; node 2 still exchanges messages with the owner.
+	assert.Eventually(t, func() bool { return !slices.Contains(owner.Peers(), servertest.Addr(1)) }, eventually, 10*time.Millisecond)
+	assert.Nil(t, owner.Store(ctx, "other", bytes.NewReader(payload)))
+	assert.Eventually(t, func() bool { return replicated(c.Nodes[2], owner, "other") }, eventually, 10*time.Millisecond)
+}
+
+func TestClusterMixedProtocolVersions(t *testing.T) {
+	// Node 2 runs an older build: no compression, and only version 3.
+	c := servertest.NewCluster(t, 3, func(i int, opts *server.FileServerOpts) {
+		hello := p2p.Hello{MinVersion: 3, MaxVersion: 4, Capabilities: p2p.CapCompression}
+		if i == 2 {
+			hello = p2p.Hello{MinVersion: 3, MaxVersion: 3}
+		}
+		opts.Transport.(*p2p.MemTransport).HandshakeFunc = p2p.VersionHandshake(hello)
+		opts.Membership = server.Membership{Enabled: true, ProbeInterval: 20 * time.Millisecond}
+	})
+
+	connected := func(node int, peer int) map[string]any {
+		entries := c.Logs[node].Find(map[string]any{"msg": "connected with remote peer", "peer": servertest.Addr(peer)})
+		if assert.Len(t, entries, 1) {
+			return entries[0]
+		}
+		return nil
+	}
+	assert.Equal(t, float64(4), connected(1, 0)["protocol_version"])
+	assert.Equal(t, "compression", connected(1, 0)["capabilities"])
+	assert.Equal(t, float64(3), connected(1, 2)["protocol_version"])
+	assert.Equal(t, "", connected(1, 2)["capabilities"])
+
+	// Every node understands every other one.
+	owner := c.Nodes[0]
+	assert.Nil(t, owner.Store(context.Background(), "key", bytes.NewReader([]byte("mixed"))))
+	for _, node := range c.Nodes[1:] {
+		node := node
+		assert.Eventually(t, func() bool { return replicated(node, owner, "key") }, eventually, 10*time.Millisecond)
+	}
+	for _, node := range c.Nodes {
+		node := node
+		assert.Eventually(t, func() bool { return len(node.Members()) == 2 }, eventually, 10*time.Millisecond)
+	}
+}
+
+func TestClusterMembership(t *testing.T) {
+	c := servertest.NewCluster(t, 4, func(i int, opts *server.FileServerOpts) {
+		opts.Membership = server.Membership{
+			Enabled:          true,
+			ProbeInterval:    50 * time.Millisecond,
+			SuspicionTimeout: 500 * time.Millisecond,
+		}
+	})
+	states := func(node *server.FileServer) map[string]string {
+		states := map[string]string{}
+		for _, member := range node.Members() {
+			states[member.Addr] = member.State.String()
+		}
+		return states
+	}
+
+	for i, node := range c.Nodes {
+		node := node
+		want := map[string]string{}
+		for j := range c.Nodes {
+			if j != i {
+				want[servertest.Addr(j)] = "alive"
+			}
+		}
+		assert.Eventually(t, func() bool { return assert.ObjectsAreEqual(want, states(node)) }, eventually, 10*time.Millisecond)
+	}
+
+	c.Faults().Partition([]string{servertest.Addr(0), servertest.Addr(1), servertest.Addr(2)}, []string{servertest.Addr(3)})
+	for _, node := range c.Nodes[:3] {
+		node := node
+		assert.Eventually(t, func() bool { return states(node)[servertest.Addr(3)] == "dead" }, eventually, 10*time.Millisecond)
+	}
+
+	// Replicas go to the living only.
+	owner := c.Nodes[0]
+	assert.Nil(t, owner.Store(context.Background(), "key", bytes.NewReader([]byte("alive only"))))
+	for _, node := range c.Nodes[1:3] {
+		node := node
+		assert.Eventually(t, func() bool { return replicated(node, owner, "key") }, eventually, 10*time.Millisecond)
+	}
+}
+
+func TestClusterLatency(t *testing.T) {
+	c := servertest.NewCluster(t, 2)
+	c.Faults().SetDefaults(p2p.Faults{Latency: 20 * time.Millisecond, Jitter: 10 * time.Millisecond})
+	owner := c.Nodes[1]
+	payload := bytes.Repeat([]byte("slow network "), 1000)
+
+	assert.Nil(t, owner.Store(context.Background(), "key", bytes.NewReader(payload)))
+	assert.Eventually(t, func() bool { return replicated(c.Nodes[0], owner, "key") }, eventually, 10*time.Millisecond)
+
+	assert.Nil(t, server.DeleteLocal(owner, owner.ID, "key"))
+	r, err := owner.Get(context.Background(), "key")
+	assert.Nil(t, err)
+	got, _ := io.ReadAll(r)
+	if rc, ok := r.(io.ReadCloser); ok {
+		rc.Close()
+	}
+	assert.Equal(t, payload, got)
+}
+
+func TestClusterTracesSpanNodes(t *testing.T) {
+	c := servertest.NewCluster(t, 2)
+	owner := c.Nodes[0]
+
+	assert.Nil(t, owner.Store(context.Background(), "key", bytes.NewReader([]byte("traced"))))
+	assert.Eventually(t, func() bool { return len(c.Spans.Find("server.handleMessageStoreFile")) == 1 }, eventually, 10*time.Millisecond)
+
+	store := c.Spans.Find("server.Store")[0]
+	handled := c.Spans.Find("server.handleMessageStoreFile")[0]
+	assert.Equal(t, servertest.Addr(0), store.Service)
+	assert.Equal(t, servertest.Addr(1), handled.Service)
+	assert.Equal(t, store.TraceID, handled.TraceID)
+}
+
+// freeUDPAddr : a loopback address nobody listens on, for QUIC transports.
+func freeUDPAddr(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+func TestClusterMixedTransports(t *testing.T) {
+	network := p2p.NewMemNetwork(p2p.MemNetworkOpts{})
+	quicAddr := freeUDPAddr(t)
+	logs := logging.NewRecorder()
+	t.Cleanup(func() {
+		if t.Failed() {
+			t.Logf("logs:\n%s", logs)
+		}
+	})
+
+	newServer := func(tr p2p.Transport) *server.FileServer {
+		s := server.NewFileServer(server.FileServerOpts{
+			EncKey:            cryptography.NewEncryptionKey(),
+			StorageRoot:       t.TempDir(),
+			PathTransformFunc: storage.CASPathTransformFunc,
+			Transport:         tr,
+			Logger:            logs.Logger(),
+		})
+		go s.Start()
+		t.Cleanup(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), servertest.Timeout)
+			defer cancel()
+			s.Shutdown(ctx)
+		})
+		return s
+	}
+	newQUIC := func(addr string) *p2p.QUICTransport {
+		tr, err := p2p.NewQUICTransport(p2p.QUICTransportOpts{
+			ListenAddr:         addr,
+			HandshakeFunc:      p2p.NOPHandshakeFunc,
+			Decoder:            p2p.DefaultDecoder{},
+			InsecureSkipVerify: true,
+			Logger:             logs.Logger(),
+		})
+		assert.Nil(t, err)
+		return tr
+	}
+	newMem := func(addr string) *p2p.MemTransport {
+		return network.NewTransport(p2p.TCPTransportOpts{
+			ListenAddr:    addr,
+			HandshakeFunc: p2p.NOPHandshakeFunc,
+			Decoder:       p2p.DefaultDecoder{},
+			Logger:        logs.Logger(),
+		})
+	}
+
+	newWS := func() *p2p.WSTransport {
+		return p2p.NewWSTransport(p2p.WSTransportOpts{
+			TCPTransportOpts: p2p.TCPTransportOpts{
+				HandshakeFunc: p2p.NOPHandshakeFunc,
+				Decoder:       p2p.DefaultDecoder{},
+				Logger:        logs.Logger(),
+			},
+		})
+	}
+
+	// The owner speaks them all, each replica is reached over one: the in-memory network, QUIC or
+	// WebSockets.
+	ownerMem, ownerQUIC, ownerWS := newMem("node-0"), newQUIC(quicAddr), newWS()
+	owner := newServer(p2p.NewMultiTransport(ownerMem, ownerQUIC, ownerWS))
+	ownerMem.OnPeer, ownerMem.OnPeerDisconnect = owner.OnPeer, owner.OnPeerDisconnect
+	ownerQUIC.OnPeer, ownerQUIC.OnPeerDisconnect = owner.OnPeer, owner.OnPeerDisconnect
+	ownerWS.OnPeer, ownerWS.OnPeerDisconnect = owner.OnPeer, owner.OnPeerDisconnect
+	srv := httptest.NewServer(ownerWS.Handler())
+	t.Cleanup(srv.Close)
+
+	memTr, quicTr, wsTr := newMem("node-1"), newQUIC(freeUDPAddr(t)), newWS()
+	memNode, quicNode, wsNode := newServer(memTr), newServer(quicTr), newServer(wsTr)
+	memTr.OnPeer, memTr.OnPeerDisconnect = memNode.OnPeer, memNode.OnPeerDisconnect
+	quicTr.OnPeer, quicTr.OnPeerDisconnect = quicNode.OnPeer, quicNode.OnPeerDisconnect
+	wsTr.OnPeer, wsTr.OnPeerDisconnect = wsNode.OnPeer, wsNode.OnPeerDisconnect
+
+	assert.Eventually(t, func() bool { return network.Listening("node-0") }, eventually, 10*time.Millisecond)
+	memNode.SetBootstrapNodes([]string{"node-0"})
+	quicNode.SetBootstrapNodes([]string{p2p.QUICScheme + quicAddr})
+	wsNode.SetBootstrapNodes([]string{"ws://" + srv.Listener.Addr().String() + "/p2p"})
+	assert.Eventually(t, func() bool { return len(owner.Peers()) == 3 }, eventually, 10*time.Millisecond)
+
+	ctx := context.Background()
+	payload := bytes.Repeat([]byte("mixed "), 10000)
+	assert.Nil(t, owner.Store(ctx, "key", bytes.NewReader(payload)))
+	for _, node := range []*server.FileServer{memNode, quicNode, wsNode} {
+		node := node
+		assert.Eventually(t, func() bool { return replicated(node, owner, "key") }, eventually, 10*time.Millisecond)
+	}
+
+	// Fetched back from all of them.
+	assert.Nil(t, server.DeleteLocal(owner, owner.ID, "key"))
+	r, err := owner.Get(ctx, "key")
+	assert.Nil(t, err)
+	got, _ := io.ReadAll(r)
+	if rc, ok := r.(io.ReadCloser); ok {
+		rc.Close()
+	}
+	assert.Equal(t, payload, got)
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+
+	store "github.com/PsychoPunkSage/NexNet/storage"
+)
+
+// Access to the local disk of a node, for the tests of package server_test.
+
+func HasLocal(s *FileServer, id, key string) bool {
+	return s.store.Has(id, key)
+}
+
+func DeleteLocal(s *FileServer, id, key string) error {
+	return s.store.Delete(id, key)
+}
+
+// CorruptLocal : flips a bit of the file stored under (id, key), behind the Store's back.
+func CorruptLocal(s *FileServer, id, key string) error {
+	disk := s.store.(*store.Store)
+	pathKey := disk.PathTransformFunc(key)
+	path := filepath.Join(disk.Root, id, pathKey.FullPath())
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	b[len(b)/2] ^= 1
+	return os.WriteFile(path, b, 0o644)
+}
+
+func VerifyLocal(s *FileServer, id, key string) error {
+	return s.verify(id, key)
+}
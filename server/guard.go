@@ -0,0 +1,314 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/PsychoPunkSage/NexNet/logging"
+	"github.com/PsychoPunkSage/NexNet/p2p"
+	store "github.com/PsychoPunkSage/NexNet/storage"
+)
+
+var (
+	// ErrRateLimited : a peer sent more messages than Limits.PeerMessageRate/OwnerMessageRate.
+	ErrRateLimited = errors.New("rate limited")
+	// ErrTooManyStreams : over Limits.PeerStreams/OwnerStreams.
+	ErrTooManyStreams = errors.New("too many streams")
+	// ErrTooManyBytes : over Limits.PeerBytes/OwnerBytes.
+	ErrTooManyBytes = errors.New("too many bytes")
+	// ErrBanned : returned by OnPeer for the hosts of banned peers.
+	ErrBanned = errors.New("banned")
+)
+
+// MessageError : a request of the peer (e.g. a MessageStoreFile) was refused.
+type MessageError struct {
+	RequestID string
+	// Hash of the key of the file the request was about, if any.
+	Key    string
+	Reason string
+}
+
+// guard : what peers, and the owner IDs they act for, have used of the Limits.
+type guard struct {
+	mu sync.Mutex
+	// By remote address, until disconnected.
+	peers map[string]*usage
+	// By owner ID, since the node started.
+	owners map[string]*usage
+	// Times of the recent violations, and end of the ban, by host (see banKey).
+	strikes map[string][]time.Time
+	bans    map[string]time.Time
+}
+
+type usage struct {
+	// Messages that can be sent right away, refilled at the rate limit.
+	tokens float64
+	last   time.Time
+	// Incoming file streams in progress, and bytes received.
+	streams int
+	bytes   int64
+}
+
+func newGuard() *guard {
+	return &guard{
+		peers:   make(map[string]*usage),
+		owners:  make(map[string]*usage),
+		strikes: make(map[string][]time.Time),
+		bans:    make(map[string]time.Time),
+	}
+}
+
+func usageOf(m map[string]*usage, key string) *usage {
+	u, ok := m[key]
+	if !ok {
+		u = &usage{tokens: -1}
+		m[key] = u
+	}
+	return u
+}
+
+// take : one message, if rate (per second, bursts of a second's worth) allows.
+func (u *usage) take(rate float64, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+	burst := max(rate, 1)
+	if u.tokens < 0 {
+		// First message.
+		u.tokens = burst
+	} else {
+		u.tokens = min(u.tokens+rate*now.Sub(u.last).Seconds(), burst)
+	}
+	u.last = now
+	if u.tokens < 1 {
+		return false
+	}
+	u.tokens--
+	return true
+}
+
+// ownerOf : owner ID a message acts for, if any.
+func ownerOf(payload any) (string, bool) {
+	switch m := payload.(type) {
+	case *MessageStoreFile:
+		return m.ID, true
+	case *MessageGetFile:
+		return m.ID, true
+	case *MessageDeleteFile:
+		return m.ID, true
+	}
+	return "", false
+}
+
+// admit : whether the message of the peer at from is within the message rates.
+func (s *FileServer) admit(from string, msg *Message) error {
+	limits := s.limits()
+	now := s.Clock.Now()
+
+	s.guard.mu.Lock()
+	defer s.guard.mu.Unlock()
+
+	if !usageOf(s.guard.peers, from).take(limits.PeerMessageRate, now) {
+		return fmt.Errorf("<%s>: %w (limit is %g messages/s)", from, ErrRateLimited, limits.PeerMessageRate)
+	}
+	if owner, ok := ownerOf(msg.Payload); ok && !usageOf(s.guard.owners, owner).take(limits.OwnerMessageRate, now) {
+		return fmt.Errorf("owner %s: %w (limit is %g messages/s)", owner, ErrRateLimited, limits.OwnerMessageRate)
+	}
+	return nil
+}
+
+// admitStream : reserves a file stream of the peer at from, and its bytes. The returned func
+// releases it once over, its bytes given back unless ok.
+func (s *FileServer) admitStream(from string, msg *MessageStoreFile) (func(ok bool), error) {
+	limits := s.limits()
+	if max := limits.MaxObjectSize; max > 0 && msg.Size-PrependSig > max {
+		return nil, fmt.Errorf("file (%s) from <%s>: %w (limit is %d bytes)", msg.Key, from, ErrObjectTooLarge, max)
+	}
+	if msg.Size < 0 {
+		return nil, fmt.Errorf("file (%s) from <%s>: invalid size %d", msg.Key, from, msg.Size)
+	}
+
+	s.guard.mu.Lock()
+	defer s.guard.mu.Unlock()
+
+	peer, owner := usageOf(s.guard.peers, from), usageOf(s.guard.owners, msg.ID)
+	switch {
+	case limits.PeerStreams > 0 && peer.streams >= limits.PeerStreams:
+		return nil, fmt.Errorf("<%s>: %w (limit is %d)", from, ErrTooManyStreams, limits.PeerStreams)
+	case limits.OwnerStreams > 0 && owner.streams >= limits.OwnerStreams:
+		return nil, fmt.Errorf("owner %s: %w (limit is %d)", msg.ID, ErrTooManyStreams, limits.OwnerStreams)
+	case limits.PeerBytes > 0 && peer.bytes+msg.Size > limits.PeerBytes:
+		return nil, fmt.Errorf("<%s>: %w (limit is %d bytes)", from, ErrTooManyBytes, limits.PeerBytes)
+	case limits.OwnerBytes > 0 && owner.bytes+msg.Size > limits.OwnerBytes:
+		return nil, fmt.Errorf("owner %s: %w (limit is %d bytes)", msg.ID, ErrTooManyBytes, limits.OwnerBytes)
+	}
+
+	for _, u := range []*usage{peer, owner} {
+		u.streams++
+		u.bytes += msg.Size
+	}
+	return func(ok bool) {
+		s.guard.mu.Lock()
+		defer s.guard.mu.Unlock()
+
+		for _, u := range []*usage{peer, owner} {
+			u.streams--
+			if !ok {
+				u.bytes -= msg.Size
+			}
+		}
+	}, nil
+}
+
+// Refused file streams up to maxDrain bytes are read and dropped, within drainTimeout, so that the
+// connection stays usable; the peers streaming bigger ones, or too slowly, are disconnected.
+const (
+	maxDrain     = 1 << 20
+	drainTimeout = 10 * time.Second
+)
+
+// refuse : answers a request of the peer at from refused for err, keeping the connection in sync
+// (a small file stream announced is dropped in the background, see maxDrain; one asked for is sent
+// empty). A peer refused Limits.BanThreshold times within Limits.BanDuration is disconnected, and
+// its host banned.
+func (s *FileServer) refuse(ctx context.Context, from string, msg *Message, err error) {
+	peer, ok := s.peer(from)
+	if !ok {
+		return
+	}
+	log := s.log.With(logging.Peer, from)
+
+	resp := MessageError{Reason: err.Error()}
+	switch m := msg.Payload.(type) {
+	case *MessageStoreFile:
+		resp.RequestID, resp.Key = m.RequestID, m.Key
+	case *MessageGetFile:
+		resp.RequestID, resp.Key = m.RequestID, m.Key
+	case *MessageDeleteFile:
+		resp.RequestID, resp.Key = m.RequestID, m.Key
+	}
+	// Peers of protocol version 3 don't know the message; newer ones skip it if they don't either.
+	if protocolOf(peer).Version >= codecVersion {
+		if err := s.sendTo(ctx, []p2p.Peer{peer}, &Message{Payload: resp}); err != nil {
+			log.Debug("error response not sent", "err", err)
+		}
+	}
+
+	// The owner's quota isn't the peer's doing.
+	ban := !errors.Is(err, store.ErrQuotaExceeded) && s.strike(from)
+	if ban {
+		log.Warn("banning peer", "host", banKey(from), "for", s.limits().BanDuration)
+	}
+
+	switch m := msg.Payload.(type) {
+	case *MessageStoreFile:
+		// The stream can't be skipped, and isn't worth reading past a point.
+		if m.Size < 0 || m.Size > maxDrain || errors.Is(err, ErrObjectTooLarge) {
+			log.Info("dropping peer streaming a refused file", "bytes", m.Size, "err", err)
+			peer.Close()
+			return
+		}
+		// Banned once the stream is read, for the peer not to fail in the middle of it.
+		s.background(func() {
+			if s.drain(peer, m.Size) && ban {
+				peer.Close()
+			}
+		})
+		return
+	case *MessageGetFile:
+		defer s.beginTransfer(peer)()
+		sendNoFile(peer, priorityOf(m.Background))
+	}
+
+	if ban {
+		peer.Close()
+	}
+}
+
+// drain : reads and drops the size bytes of a refused stream from peer, disconnecting it if they
+// don't come within drainTimeout (then returning false). Off the message loop, which the peer
+// would stall otherwise.
+func (s *FileServer) drain(peer p2p.Peer, size int64) bool {
+	defer s.beginTransfer(peer)()
+
+	peer.SetReadDeadline(time.Now().Add(drainTimeout))
+	if _, err := io.CopyN(io.Discard, peer, size); err != nil {
+		s.log.Info("dropping peer streaming a refused file", logging.Peer, peer.RemoteAddr().String(), "err", err)
+		peer.Close()
+		return false
+	}
+	peer.SetReadDeadline(time.Time{})
+	peer.CloseStream()
+	return true
+}
+
+// strike : records a violation of the peer at from, and whether that gets its host banned.
+func (s *FileServer) strike(from string) bool {
+	limits := s.limits()
+	if limits.BanThreshold <= 0 {
+		return false
+	}
+	now, host := s.Clock.Now(), banKey(from)
+
+	s.guard.mu.Lock()
+	defer s.guard.mu.Unlock()
+
+	strikes := []time.Time{now}
+	for _, t := range s.guard.strikes[host] {
+		if now.Sub(t) < limits.BanDuration {
+			strikes = append(strikes, t)
+		}
+	}
+	if len(strikes) < limits.BanThreshold {
+		s.guard.strikes[host] = strikes
+		return false
+	}
+
+	delete(s.guard.strikes, host)
+	s.guard.bans[host] = now.Add(limits.BanDuration)
+	return true
+}
+
+// banned : whether the host of addr is banned.
+func (s *FileServer) banned(addr string) bool {
+	now, host := s.Clock.Now(), banKey(addr)
+
+	s.guard.mu.Lock()
+	defer s.guard.mu.Unlock()
+
+	until, ok := s.guard.bans[host]
+	if ok && !now.Before(until) {
+		delete(s.guard.bans, host)
+		return false
+	}
+	return ok
+}
+
+// forgetPeerUsage : the peer at addr is gone.
+func (s *FileServer) forgetPeerUsage(addr string) {
+	s.guard.mu.Lock()
+	defer s.guard.mu.Unlock()
+
+	delete(s.guard.peers, addr)
+}
+
+// banKey : what a ban applies to: the host of addr, or the whole of it without one (e.g. nodes of a
+// p2p.MemNetwork).
+func banKey(addr string) string {
+	_, hostPort, _ := splitAddr(addr)
+	if host, _, err := net.SplitHostPort(hostPort); err == nil && len(host) > 0 {
+		return host
+	}
+	return addr
+}
+
+func (s *FileServer) handleMessageError(ctx context.Context, from string, msg *MessageError) error {
+	log := s.peerLogger(from, msg.Key, msg.RequestID)
+	log.Warn("request refused by peer", "reason", msg.Reason)
+	return nil
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/PsychoPunkSage/NexNet/membership"
+	"github.com/PsychoPunkSage/NexNet/p2p"
+)
+
+// Membership : SWIM failure detection between the nodes (see package membership), carried over
+// the peer connections. Files are only replicated to peers the node holds alive.
+type Membership struct {
+	Enabled bool
+	// A member is pinged every interval. Defaults to 1s.
+	ProbeInterval time.Duration
+	// How long a suspect member has to refute before it's declared dead. Defaults to 5 probe
+	// intervals.
+	SuspicionTimeout time.Duration
+}
+
+// MessageMembership : a message of the membership protocol.
+type MessageMembership membership.Message
+
+func (s *FileServer) newMembership() *membership.Membership {
+	if !s.Membership.Enabled {
+		return nil
+	}
+	return membership.New(membership.Opts{
+		ID:               s.ID,
+		Addr:             s.Transport.ListenAddress(),
+		ProbeInterval:    s.Membership.ProbeInterval,
+		SuspicionTimeout: s.Membership.SuspicionTimeout,
+		Send:             s.sendMembership,
+		Logger:           s.log,
+		Clock:            s.Clock,
+	})
+}
+
+// Members : the other nodes of the cluster and their state; nil unless Membership is enabled.
+func (s *FileServer) Members() []membership.Member {
+	if s.members == nil {
+		return nil
+	}
+	return s.members.Members()
+}
+
+// greet : has the peer at addr learn of the node and of the members it knows, in the background.
+func (s *FileServer) greet(addr string) {
+	if s.members == nil {
+		return
+	}
+
+	s.background(func() {
+		s.peerLock.Lock()
+		peer, ok := s.peers[addr]
+		s.peerLock.Unlock()
+		if !ok {
+			return
+		}
+
+		greeting := MessageMembership(s.members.Greeting())
+		if err := s.send([]p2p.Peer{peer}, &Message{Payload: greeting}); err != nil {
+			s.log.Debug("membership greeting not sent", "peer", addr, "err", err)
+		}
+	})
+}
+
+// sendMembership : the membership.Opts.Send of the node, over the connection to the member.
+// Members are reachable once they have sent a membership message of their own.
+func (s *FileServer) sendMembership(to string, msg membership.Message) error {
+	s.peerLock.Lock()
+	addr, ok := s.memberAddrs[to]
+	peer := s.peers[addr]
+	busy := s.transfers[addr] > 0
+	s.peerLock.Unlock()
+
+	if !ok || peer == nil {
+		return fmt.Errorf("member %s: not connected", to)
+	}
+	if busy && !protocolOf(peer).Capabilities.Has(p2p.CapMultiplexing) {
+		// A message now would land amid a file stream.
+		return membership.ErrBusy
+	}
+	return s.send([]p2p.Peer{peer}, &Message{Payload: MessageMembership(msg)})
+}
+
+func (s *FileServer) handleMessageMembership(ctx context.Context, from string, msg *MessageMembership) error {
+	if s.members == nil {
+		return nil
+	}
+
+	s.peerLock.Lock()
+	if _, ok := s.peers[from]; !ok {
+		s.peerLock.Unlock()
+		return fmt.Errorf("peer {%s} not found", from)
+	}
+	s.memberAddrs[msg.From] = from
+	s.peerLock.Unlock()
+
+	s.members.Handle(membership.Message(*msg))
+	return nil
+}
+
+// alive : whether the peer at addr isn't held suspect or dead. Must hold peerLock.
+func (s *FileServer) alive(addr string) bool {
+	if s.members == nil {
+		return true
+	}
+	for id, memberAddr := range s.memberAddrs {
+		if memberAddr == addr {
+			member, ok := s.members.Member(id)
+			return !ok || member.State == membership.Alive
+		}
+	}
+	return true
+}
+
+// forgetMember : the peer at addr is gone. Must hold peerLock.
+func (s *FileServer) forgetMember(addr string) {
+	for id, memberAddr := range s.memberAddrs {
+		if memberAddr == addr {
+			delete(s.memberAddrs, id)
+		}
+	}
+}
+
+// beginTransfer : marks a file stream to or from peers as in progress, until the returned func is
+// called. Protocol chatter (e.g. membership pings) holds off meanwhile, the stream sharing their
+// connection.
+func (s *FileServer) beginTransfer(peers ...p2p.Peer) func() {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	addrs := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		addr := peer.RemoteAddr().String()
+		s.transfers[addr]++
+		addrs = append(addrs, addr)
+	}
+
+	return func() {
+		s.peerLock.Lock()
+		defer s.peerLock.Unlock()
+
+		for _, addr := range addrs {
+			if s.transfers[addr]--; s.transfers[addr] <= 0 {
+				delete(s.transfers, addr)
+			}
+		}
+	}
+}
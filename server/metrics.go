@@ -0,0 +1,58 @@
+package server
+
+import (
+	"time"
+
+	store "github.com/PsychoPunkSage/NexNet/storage"
+)
+
+// Metrics : instrumentation hooks of a FileServer, its Store's included.
+type Metrics interface {
+	store.Metrics
+	// op is "store", "get" or "remove".
+	ObserveOperation(op string, d time.Duration, err error)
+	// A message received from a peer was handled; outcome is "ok", "error" or "refused" (over the
+	// Limits).
+	CountRPC(msgType, outcome string)
+	// Time from a file being written locally to it being streamed to all of its replicas.
+	ObserveReplicationLag(d time.Duration)
+	// A file was verified by the scrubber (see Scrub); outcome is "ok", "repaired" (found corrupt,
+	// fetched again), "lost" (found corrupt, not fetched again) or "error".
+	CountScrubbed(outcome string)
+}
+
+// NopMetrics : default Metrics, recording nothing.
+type NopMetrics struct {
+	store.NopMetrics
+}
+
+func (NopMetrics) ObserveOperation(string, time.Duration, error) {}
+func (NopMetrics) CountRPC(string, string)                       {}
+func (NopMetrics) ObserveReplicationLag(time.Duration)           {}
+func (NopMetrics) CountScrubbed(string)                          {}
+
+// observe : records the outcome of an operation started at start, for use with defer.
+func (s *FileServer) observe(op string, start time.Time, err *error) {
+	s.Metrics.ObserveOperation(op, s.Clock.Since(start), *err)
+}
+
+// rpcType : name of a message payload, as used in metrics.
+func rpcType(payload any) string {
+	switch payload.(type) {
+	case *MessageStoreFile:
+		return "store_file"
+	case *MessageGetFile:
+		return "get_file"
+	case *MessageDeleteFile:
+		return "delete_file"
+	case *MessageGoodbye:
+		return "goodbye"
+	case *MessagePeerExchange:
+		return "peer_exchange"
+	case *MessageMembership:
+		return "membership"
+	case *MessageError:
+		return "error"
+	}
+	return "unknown"
+}
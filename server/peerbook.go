@@ -0,0 +1,130 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Entries of a peer book at most; the least recently seen go first.
+	peerBookSize = 256
+	// Nodes not seen for that long are dropped from a peer book.
+	peerBookTTL = 7 * 24 * time.Hour
+)
+
+// bookEntry : a node of the peer book.
+type bookEntry struct {
+	ID       string    `json:"id"`
+	Addr     string    `json:"addr"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// peerBook : the nodes a server has been connected to, persisted as a single JSON file. A nil
+// *peerBook records nothing.
+type peerBook struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]bookEntry // by ID
+}
+
+func loadPeerBook(path string) (*peerBook, error) {
+	book := &peerBook{
+		path:    path,
+		entries: make(map[string]bookEntry),
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return book, nil
+	}
+	if err != nil {
+		return book, err
+	}
+
+	var entries []bookEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return book, err
+	}
+	for _, e := range entries {
+		book.entries[e.ID] = e
+	}
+	return book, nil
+}
+
+// addrs : of the nodes seen within peerBookTTL of now, most recently seen first.
+func (b *peerBook) addrs(now time.Time) []string {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	addrs := []string{}
+	for _, e := range b.sorted() {
+		if now.Sub(e.LastSeen) < peerBookTTL {
+			addrs = append(addrs, e.Addr)
+		}
+	}
+	return addrs
+}
+
+// add : records a node connected to at now, and saves the book.
+func (b *peerBook) add(info PeerInfo, now time.Time) error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.entries[info.ID] = bookEntry{ID: info.ID, Addr: info.Addr, LastSeen: now}
+	entries := b.sorted()
+	for i, e := range entries {
+		if i >= peerBookSize || now.Sub(e.LastSeen) >= peerBookTTL {
+			delete(b.entries, e.ID)
+		}
+	}
+
+	return b.save()
+}
+
+// sorted : most recently seen first. Must be called with mu held.
+func (b *peerBook) sorted() []bookEntry {
+	entries := make([]bookEntry, 0, len(b.entries))
+	for _, e := range b.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].LastSeen.Equal(entries[j].LastSeen) {
+			return entries[i].LastSeen.After(entries[j].LastSeen)
+		}
+		return entries[i].ID < entries[j].ID
+	})
+	return entries
+}
+
+// save : must be called with mu held.
+func (b *peerBook) save() error {
+	data, err := json.MarshalIndent(b.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(b.path), os.ModePerm); err != nil {
+		return err
+	}
+
+	// Write + rename, so that a crash never leaves a half written book behind.
+	tmp := b.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.path)
+}
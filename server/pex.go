@@ -0,0 +1,252 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/PsychoPunkSage/NexNet/logging"
+	"github.com/PsychoPunkSage/NexNet/p2p"
+)
+
+// How long an address dialed after a peer exchange isn't dialed again, connected or not.
+const pexRedialAfter = 30 * time.Second
+
+// PeerExchange : gossiping of peer addresses (PEX), for a node to learn the whole cluster from
+// any one of its members.
+//
+// Peers tell each other their ID, listen address and the nodes they are connected to when they
+// connect, then again whenever they connect to a new node. Of two nodes learning of each other,
+// only the one with the smaller ID dials, so that they don't connect twice; should they still (e.g.
+// dialing each other from their peer books), the duplicate is closed once the peer is identified.
+type PeerExchange struct {
+	Enabled bool
+	// Addresses per message, sent or taken, at most. Defaults to 32.
+	MaxAddrs int
+	// JSON file the connected nodes are recorded in, dialed on Start along with BootstrapNodes, so
+	// that a node rejoins the cluster after a restart without them. Empty records nothing.
+	PeerBook string
+}
+
+// PeerInfo : a node, as told by a peer exchange.
+type PeerInfo struct {
+	ID string
+	// Address the node listens on.
+	Addr string
+}
+
+// MessagePeerExchange : the sender, and the nodes it is connected to.
+type MessagePeerExchange struct {
+	ID         string
+	ListenAddr string
+	Peers      []PeerInfo
+}
+
+func (s *FileServer) maxPEXAddrs() int {
+	if s.PeerExchange.MaxAddrs > 0 {
+		return s.PeerExchange.MaxAddrs
+	}
+	return 32
+}
+
+// exchangePeers : sends the known peers to the peers at addrs (by remote address), in the background.
+func (s *FileServer) exchangePeers(addrs ...string) {
+	if !s.PeerExchange.Enabled {
+		return
+	}
+
+	s.background(func() {
+		s.peerLock.Lock()
+		known := make([]PeerInfo, 0, len(s.peerInfos))
+		for _, info := range s.peerInfos {
+			known = append(known, info)
+		}
+		s.peerLock.Unlock()
+		// Same list for the same peer set.
+		sort.Slice(known, func(i, j int) bool { return known[i].ID < known[j].ID })
+
+		for _, addr := range addrs {
+			s.peerLock.Lock()
+			peer, ok := s.peers[addr]
+			to := s.peerInfos[addr]
+			s.peerLock.Unlock()
+			if !ok {
+				continue
+			}
+
+			infos := []PeerInfo{}
+			for _, info := range known {
+				if info.ID != to.ID && len(infos) < s.maxPEXAddrs() {
+					infos = append(infos, info)
+				}
+			}
+
+			msg := Message{Payload: MessagePeerExchange{
+				ID:         s.ID,
+				ListenAddr: s.Transport.ListenAddress(),
+				Peers:      infos,
+			}}
+			if err := s.sendTo(context.Background(), []p2p.Peer{peer}, &msg); err != nil {
+				s.log.Debug("peer exchange not sent", logging.Peer, addr, "err", err)
+			}
+		}
+	})
+}
+
+func (s *FileServer) handleMessagePeerExchange(ctx context.Context, from string, msg *MessagePeerExchange) (err error) {
+	_, span := s.Tracer.Start(ctx, "server.handleMessagePeerExchange", "peer", from, "peers", len(msg.Peers))
+	defer span.EndWithError(&err)
+
+	if !s.PeerExchange.Enabled {
+		return nil
+	}
+
+	sender := PeerInfo{ID: msg.ID, Addr: resolveAddr(msg.ListenAddr, from)}
+
+	s.peerLock.Lock()
+	peer, ok := s.peers[from]
+	if !ok {
+		s.peerLock.Unlock()
+		return fmt.Errorf("peer {%s} not found", from)
+	}
+	_, known := s.peerInfos[from]
+	var duplicate p2p.Peer
+	if !known {
+		for addr, info := range s.peerInfos {
+			if info.ID != sender.ID {
+				continue
+			}
+			// Connected twice, e.g. each side dialing the other before knowing of the first
+			// connection: one is closed, the same on both sides.
+			if s.keepNewer(peer, s.peers[addr], sender.ID) {
+				duplicate = s.peers[addr]
+				delete(s.peerInfos, addr)
+			} else {
+				duplicate = peer
+			}
+		}
+	}
+	if duplicate == peer {
+		s.peerLock.Unlock()
+		s.log.Info("closing duplicate connection", logging.Peer, from, "peer_id", sender.ID)
+		peer.Close()
+		return nil
+	}
+	s.peerInfos[from] = sender
+	others := make([]string, 0, len(s.peers))
+	for addr := range s.peers {
+		if addr != from {
+			others = append(others, addr)
+		}
+	}
+	s.peerLock.Unlock()
+
+	if duplicate != nil {
+		s.log.Info("closing duplicate connection", logging.Peer, duplicate.RemoteAddr().String(), "peer_id", sender.ID)
+		duplicate.Close()
+	}
+
+	if !known {
+		s.log.Debug("peer identified", logging.Peer, from, "peer_id", sender.ID, "listen_addr", sender.Addr)
+		if err := s.book.add(sender, s.Clock.Now()); err != nil {
+			s.log.Warn("peer book not saved", "err", err)
+		}
+		// News for the other peers.
+		s.exchangePeers(others...)
+	}
+
+	peers := msg.Peers
+	if len(peers) > s.maxPEXAddrs() {
+		peers = peers[:s.maxPEXAddrs()]
+	}
+	for _, info := range peers {
+		if s.shouldDial(info) {
+			s.log.Debug("dialing peer learned from peer exchange", logging.Peer, info.Addr, "peer_id", info.ID, "from", from)
+			s.Connect(info.Addr)
+		}
+	}
+	return nil
+}
+
+// keepNewer : of two connections to the node of ID id, whether to keep newer, just identified,
+// over older. Kept is the one dialed by the node of smaller ID, as PEX has it dial (see
+// PeerExchange), which both nodes agree on; the newer one if dialed the same way, the older
+// being likely stale (e.g. to the node before it restarted).
+func (s *FileServer) keepNewer(newer, older p2p.Peer, id string) bool {
+	dn, ok1 := newer.(p2p.DirectedPeer)
+	do, ok2 := older.(p2p.DirectedPeer)
+	if !ok1 || !ok2 || dn.Outbound() == do.Outbound() {
+		return true
+	}
+	// Dialed by this node, whose ID is the smaller.
+	return dn.Outbound() == (s.ID < id)
+}
+
+// shouldDial : whether a node told of by a peer exchange is to be dialed.
+func (s *FileServer) shouldDial(info PeerInfo) bool {
+	// The other node dials.
+	if len(info.ID) == 0 || len(info.Addr) == 0 || info.ID <= s.ID || info.Addr == s.Transport.ListenAddress() {
+		return false
+	}
+
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	if max := s.limits().MaxPeers; max > 0 && len(s.peers) >= max {
+		return false
+	}
+	if _, ok := s.peers[info.Addr]; ok {
+		return false
+	}
+	for _, known := range s.peerInfos {
+		if known.ID == info.ID || known.Addr == info.Addr {
+			return false
+		}
+	}
+
+	now := s.Clock.Now()
+	for addr, last := range s.pexDialed {
+		if now.Sub(last) >= pexRedialAfter {
+			delete(s.pexDialed, addr)
+		}
+	}
+	if _, ok := s.pexDialed[info.Addr]; ok {
+		return false
+	}
+	s.pexDialed[info.Addr] = now
+	return true
+}
+
+// resolveAddr : listenAddr, as announced by the peer at from; a host left out (":3000") or
+// unspecified ("0.0.0.0:3000") stands for the host of from.
+func resolveAddr(listenAddr, from string) string {
+	scheme, hostPort, path := splitAddr(listenAddr)
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return listenAddr
+	}
+	if ip := net.ParseIP(host); len(host) > 0 && (ip == nil || !ip.IsUnspecified()) {
+		return listenAddr
+	}
+
+	_, fromHostPort, _ := splitAddr(from)
+	fromHost, _, err := net.SplitHostPort(fromHostPort)
+	if err != nil || len(fromHost) == 0 {
+		return listenAddr
+	}
+	return scheme + net.JoinHostPort(fromHost, port) + path
+}
+
+// splitAddr : "ws://", "host:port", "/p2p" for "ws://host:port/p2p".
+func splitAddr(addr string) (scheme, hostPort, path string) {
+	if i := strings.Index(addr, "://"); i >= 0 {
+		scheme, addr = addr[:i+len("://")], addr[i+len("://"):]
+	}
+	if i := strings.Index(addr, "/"); i >= 0 {
+		addr, path = addr[:i], addr[i:]
+	}
+	return scheme, addr, path
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newPEXServer(t *testing.T, book string, nodes ...string) *FileServer {
+	s := newTestServer(t, nodes...)
+	s.PeerExchange = PeerExchange{Enabled: true, PeerBook: book}
+	return s
+}
+
+// listenAddrs : of the peers of s that told who they are.
+func listenAddrs(s *FileServer) []string {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	addrs := []string{}
+	for _, info := range s.peerInfos {
+		addrs = append(addrs, info.Addr)
+	}
+	return addrs
+}
+
+func TestPeerExchange(t *testing.T) {
+	seed := newPEXServer(t, "")
+	startTestServer(t, seed)
+
+	// Each knows the seed only.
+	nodes := []*FileServer{seed}
+	for i := 0; i < 3; i++ {
+		s := newPEXServer(t, "", seed.Transport.ListenAddress())
+		startTestServer(t, s)
+		nodes = append(nodes, s)
+	}
+
+	for _, s := range nodes {
+		s := s
+		waitFor(t, func() bool { return len(listenAddrs(s)) == len(nodes)-1 })
+	}
+	// A single connection per pair.
+	for _, s := range nodes {
+		assert.Len(t, listenAddrs(s), len(nodes)-1)
+		for _, other := range nodes {
+			if other != s {
+				assert.Contains(t, listenAddrs(s), other.Transport.ListenAddress())
+			}
+		}
+	}
+
+	for _, s := range nodes {
+		shutdown(t, s)
+	}
+}
+
+func TestPeerBook(t *testing.T) {
+	book := filepath.Join(t.TempDir(), "peers.json")
+
+	a := newPEXServer(t, "")
+	startTestServer(t, a)
+	b := newPEXServer(t, "")
+	startTestServer(t, b)
+	c := newPEXServer(t, book, a.Transport.ListenAddress())
+	startTestServer(t, c)
+	b.Connect(c.Transport.ListenAddress())
+
+	waitFor(t, func() bool { return len(listenAddrs(c)) == 2 })
+	shutdown(t, c)
+
+	// Same storage & book, no bootstrap node.
+	restarted := newPEXServer(t, book)
+	restarted.ID = c.ID
+	startTestServer(t, restarted)
+	waitFor(t, func() bool { return len(listenAddrs(restarted)) == 2 })
+	assert.ElementsMatch(t, []string{a.Transport.ListenAddress(), b.Transport.ListenAddress()}, listenAddrs(restarted))
+
+	shutdown(t, restarted)
+	shutdown(t, b)
+	shutdown(t, a)
+}
+
+func TestResolveAddr(t *testing.T) {
+	for _, tc := range []struct{ listenAddr, from, want string }{
+		{":3000", "10.0.0.7:51234", "10.0.0.7:3000"},
+		{"0.0.0.0:3000", "10.0.0.7:51234", "10.0.0.7:3000"},
+		{"10.0.0.8:3000", "10.0.0.7:51234", "10.0.0.8:3000"},
+		{"quic://:4000", "quic://10.0.0.7:51234", "quic://10.0.0.7:4000"},
+		{"ws://:8080/p2p", "ws://10.0.0.7:51234", "ws://10.0.0.7:8080/p2p"},
+		{"unix:///run/nexnet.sock", "unix:///run/nexnet.sock?pid=1&uid=0#1", "unix:///run/nexnet.sock"},
+		{"node-1", "node-1", "node-1"},
+	} {
+		assert.Equal(t, tc.want, resolveAddr(tc.listenAddr, tc.from), tc.listenAddr)
+	}
+}
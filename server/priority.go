@@ -0,0 +1,48 @@
+package server
+
+import (
+	"context"
+	"io"
+
+	"github.com/PsychoPunkSage/NexNet/p2p"
+)
+
+// Transfers run at p2p.Foreground unless their context says otherwise: when bandwidth is limited
+// (see p2p.Bandwidth), those of background work (repair, rebalancing) only get what Get and Store
+// leave. The priority goes along with the file messages, so that the peer serves (or reads) the
+// stream at the same priority.
+
+type priorityKey struct{}
+
+// WithPriority : ctx whose Store/Get transfers run at priority p.
+func WithPriority(ctx context.Context, p p2p.Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// PriorityFrom : priority carried by ctx, p2p.Foreground if none.
+func PriorityFrom(ctx context.Context) p2p.Priority {
+	p, _ := ctx.Value(priorityKey{}).(p2p.Priority)
+	return p
+}
+
+func priorityOf(background bool) p2p.Priority {
+	if background {
+		return p2p.Background
+	}
+	return p2p.Foreground
+}
+
+// openStream : peer.OpenStream, at priority p if the peer schedules its streams.
+func openStream(peer p2p.Peer, p p2p.Priority) (io.WriteCloser, error) {
+	if pp, ok := peer.(p2p.PriorityPeer); ok {
+		return pp.OpenStreamPriority(p)
+	}
+	return peer.OpenStream()
+}
+
+// setReadPriority : the incoming stream of peer is read at priority p, until CloseStream.
+func setReadPriority(peer p2p.Peer, p p2p.Priority) {
+	if pp, ok := peer.(p2p.PriorityPeer); ok {
+		pp.SetReadPriority(p)
+	}
+}
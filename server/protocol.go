@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+
+	"github.com/PsychoPunkSage/NexNet/p2p"
+)
+
+// Protocol version messages are encoded with FileServerOpts.Codec (sized), instead of gob.
+const codecVersion = 4
+
+// protocolOf : what the node and peer agreed on in the handshake (see p2p.VersionHandshake). Peers
+// without one are taken as of this build, without capabilities. Of the capabilities, the server
+// acts on:
+//   - p2p.CapCompression: messages are deflated.
+//   - p2p.CapMultiplexing: protocol chatter (e.g. membership pings) doesn't wait for the file
+//     streams with the peer to end.
+func protocolOf(peer p2p.Peer) p2p.Protocol {
+	if p, ok := peer.(p2p.ProtocolPeer); ok {
+		if protocol := p.Protocol(); protocol.Version > 0 {
+			return protocol
+		}
+	}
+	return p2p.Protocol{Version: p2p.ProtocolVersion}
+}
+
+// encodeMessage : msg as sent to peers of each protocol, encoded once per variant.
+type encodeMessage struct {
+	msg    *Message
+	codec  p2p.Codec
+	frames map[encoding][]byte
+}
+
+type encoding struct {
+	codec      bool
+	compressed bool
+}
+
+// frame : the bytes of the message for a peer of the given protocol. Peers of protocol version 3
+// get it gob encoded, in an IncomingMessage frame.
+func (e *encodeMessage) frame(protocol p2p.Protocol) ([]byte, error) {
+	enc := encoding{
+		codec:      protocol.Version >= codecVersion,
+		compressed: protocol.Capabilities.Has(p2p.CapCompression),
+	}
+	if frame, ok := e.frames[enc]; ok {
+		return frame, nil
+	}
+
+	var codec p2p.Codec = p2p.GobCodec{}
+	if enc.codec {
+		codec = e.codec
+	}
+	payload, err := codec.Marshal(e.msg)
+	if err != nil {
+		return nil, err
+	}
+	if enc.compressed {
+		if payload, err = deflate(payload); err != nil {
+			return nil, err
+		}
+	}
+
+	frame := append([]byte{p2p.IncomingMessage}, payload...)
+	if enc.codec {
+		frame = p2p.SizedMessage(payload)
+	}
+	if e.frames == nil {
+		e.frames = make(map[encoding][]byte)
+	}
+	e.frames[enc] = frame
+	return frame, nil
+}
+
+func deflate(payload []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w, _ := flate.NewWriter(buf, flate.BestSpeed)
+	if _, err := w.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeMessage : the message of payload, received from a peer of the given protocol.
+func decodeMessage(codec p2p.Codec, protocol p2p.Protocol, payload []byte) (*Message, error) {
+	if protocol.Capabilities.Has(p2p.CapCompression) {
+		fr := flate.NewReader(bytes.NewReader(payload))
+		defer fr.Close()
+
+		var err error
+		if payload, err = io.ReadAll(io.LimitReader(fr, p2p.MaxMessageSize)); err != nil {
+			return nil, err
+		}
+	}
+	if protocol.Version < codecVersion {
+		codec = p2p.GobCodec{}
+	}
+
+	var msg Message
+	if err := codec.Unmarshal(payload, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+
+	"github.com/PsychoPunkSage/NexNet/clock"
+	"github.com/PsychoPunkSage/NexNet/cryptography"
+	"github.com/PsychoPunkSage/NexNet/logging"
+	"github.com/PsychoPunkSage/NexNet/p2p"
+	store "github.com/PsychoPunkSage/NexNet/storage"
+)
+
+// Scrub : background re-reading of the files on disk, so that corruption (bit rot) is found before
+// the files are needed. Corrupt files are quarantined (see storage.VerifyingBackend) and fetched
+// again from the peers. Needs a backend keeping checksums.
+type Scrub struct {
+	Enabled bool
+	// Bytes read per second, at most. Defaults to 4MB/s.
+	Rate int64
+	// Time between the starts of two passes over the files. Defaults to 24h.
+	Interval time.Duration
+}
+
+// errNotCorrupt : of recoverCorrupt, for a file found fine on a second read (e.g. replaced
+// meanwhile); there's nothing to recover.
+var errNotCorrupt = errors.New("file not corrupt on a second read")
+
+// quitContext : a context done once the server stops.
+func (s *FileServer) quitContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-s.quitCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// scrub : runs the passes of Scrub until the server stops.
+func (s *FileServer) scrub() {
+	ctx, cancel := s.quitContext()
+	defer cancel()
+
+	for {
+		start := s.Clock.Now()
+		s.scrubPass(ctx)
+		if err := clock.Sleep(ctx, s.Clock, s.Scrub.Interval-s.Clock.Since(start)); err != nil {
+			return
+		}
+	}
+}
+
+// scrubPass : verifies every file on disk once, at Scrub.Rate.
+func (s *FileServer) scrubPass(ctx context.Context) {
+	for _, usage := range s.store.Usage() {
+		objects, err := s.store.List(usage.ID)
+		if err != nil {
+			s.log.Warn("listing files to scrub", "owner_id", usage.ID, "err", err)
+			continue
+		}
+
+		for _, obj := range objects {
+			if ctx.Err() != nil {
+				return
+			}
+			s.scrubFile(ctx, usage.ID, obj.Key)
+
+			pause := time.Duration(float64(obj.Size) / float64(s.Scrub.Rate) * float64(time.Second))
+			if err := clock.Sleep(ctx, s.Clock, pause); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *FileServer) scrubFile(ctx context.Context, id, key string) {
+	outcome := "ok"
+	switch err := s.verify(id, key); {
+	case err == nil:
+	case errors.Is(err, fs.ErrNotExist):
+		// Deleted since listed.
+		return
+	case errors.Is(err, store.ErrCorrupt):
+		switch err := s.recoverCorrupt(ctx, id, key, err); {
+		case err == nil:
+			outcome = "repaired"
+		case errors.Is(err, errNotCorrupt):
+		default:
+			outcome = "lost"
+		}
+	default:
+		s.log.Warn("scrubbing file", "owner_id", id, logging.Key, key, "err", err)
+		outcome = "error"
+	}
+	s.Metrics.CountScrubbed(outcome)
+}
+
+// recoverCorrupt : quarantines the file under (id, key), found corrupt, and fetches it again from
+// the peers.
+func (s *FileServer) recoverCorrupt(ctx context.Context, id, key string, cause error) error {
+	log := s.log.With("owner_id", id, logging.Key, key)
+
+	// Confirmed on a second read, in case the file was being replaced.
+	if err := s.verify(id, key); !errors.Is(err, store.ErrCorrupt) {
+		return errNotCorrupt
+	}
+	log.Error("corrupt file found", "err", cause)
+	if err := s.store.(store.VerifyingBackend).Quarantine(id, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	ctx = WithPriority(ctx, p2p.Background)
+	// The file is either the owner's, the peers holding it encrypted under the hash of its key, or
+	// a replica, the other replicas holding it as is.
+	fetched, err := s.fetch(ctx, id, key, cryptography.HashKey(key), true)
+	if err == nil && !fetched {
+		fetched, err = s.fetch(ctx, id, key, key, false)
+	}
+	if err == nil && !fetched {
+		err = fmt.Errorf("no peer has file (%s) of %s", key, id)
+	}
+	if err != nil {
+		log.Error("corrupt file lost", "err", err)
+		return err
+	}
+
+	log.Info("corrupt file fetched again from peers")
+	return nil
+}
@@ -2,39 +2,96 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"os"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/PsychoPunkSage/NexNet/clock"
 	"github.com/PsychoPunkSage/NexNet/cryptography"
+	"github.com/PsychoPunkSage/NexNet/logging"
+	"github.com/PsychoPunkSage/NexNet/membership"
 	"github.com/PsychoPunkSage/NexNet/p2p"
 	store "github.com/PsychoPunkSage/NexNet/storage"
+	"github.com/PsychoPunkSage/NexNet/tracing"
 )
 
 const PrependSig int64 = 16
 
+var (
+	// ErrObjectTooLarge : returned when a file exceeds Limits.MaxObjectSize.
+	ErrObjectTooLarge = errors.New("object too large")
+	// ErrTooManyPeers : returned by OnPeer once Limits.MaxPeers peers are connected.
+	ErrTooManyPeers = errors.New("too many peers")
+	// ErrServerClosed : returned by operations started after Shutdown.
+	ErrServerClosed = errors.New("file server closed")
+)
+
 type Message struct {
 	Payload any
+	// Span the message was sent from, see tracing.SpanContext.
+	TraceID string
+	SpanID  string
 }
 
+// MessageStoreFile : announces a file about to be streamed. In the file messages, RequestID (if
+// any) ties the logs of the receiving peer to the request that caused the message.
 type MessageStoreFile struct {
-	ID   string
-	Key  string
-	Size int64
+	ID        string
+	Key       string
+	Size      int64
+	RequestID string
+	// The stream is background traffic, see WithPriority.
+	Background bool
 }
 
 type MessageGetFile struct {
-	ID  string
-	Key string
+	ID        string
+	Key       string
+	RequestID string
+	// The stream is background traffic, see WithPriority.
+	Background bool
 }
 
 type MessageDeleteFile struct {
-	ID  string
-	Key string
+	ID        string
+	Key       string
+	RequestID string
+}
+
+// MessageGoodbye : sent to every peer right before a node shuts down.
+type MessageGoodbye struct {
+	ID string
+}
+
+// Limits : guard rails of a node. Zero means unlimited. Requests of peers over the limits are
+// refused with a MessageError.
+type Limits struct {
+	// Max size (plaintext) of a file, stored locally or received from a peer.
+	MaxObjectSize int64
+	MaxPeers      int
+	// Messages per second (bursts of a second's worth) from a peer, and from the peers acting for
+	// an owner ID (file messages).
+	PeerMessageRate  float64
+	OwnerMessageRate float64
+	// File streams received at once from a peer, and for an owner ID.
+	PeerStreams  int
+	OwnerStreams int
+	// Bytes of the files received from a peer (over its connection), and for an owner ID (since
+	// the node started).
+	PeerBytes  int64
+	OwnerBytes int64
+	// A peer refused BanThreshold times within BanDuration is disconnected, and its host (see
+	// banKey) banned for BanDuration. 0 never bans.
+	BanThreshold int
+	BanDuration  time.Duration
 }
 
 type FileServerOpts struct {
@@ -44,134 +101,345 @@ type FileServerOpts struct {
 	PathTransformFunc store.PathTransformFunc
 	Transport         p2p.Transport
 	BootstrapNodes    []string
+	// Max number of peers a stored file is pushed to; 0 means every connected peer.
+	ReplicationFactor int
+	Limits            Limits
+	PeerExchange      PeerExchange
+	Membership        Membership
+	Scrub             Scrub
+	// Storage quota of every owner ID but those of Quotas, replicas included. Changed with
+	// SetQuotas.
+	Quota  store.Quota
+	Quotas map[string]store.Quota
+	// Where files are kept. Defaults to a store.Store under StorageRoot, laid out by
+	// PathTransformFunc, with Quota & Quotas; those are ignored otherwise. Quotas and checksums
+	// (scrubbing included) are only enforced by backends having them, see store.QuotaBackend &
+	// store.VerifyingBackend.
+	Backend store.Backend
+	// Encoding of the messages to peers of protocol version 4 on (older ones get gob). Defaults
+	// to p2p.ProtoCodec{}, the encoding wire.proto describes.
+	Codec p2p.Codec
+	// Defaults to slog.Default(). Records get tagged with the node ID and listen address.
+	Logger *slog.Logger
+	// Defaults to NopMetrics. Also used by the underlying Store.
+	Metrics Metrics
+	// Defaults to a tracer dropping every span.
+	Tracer *tracing.Tracer
+	// Defaults to clock.Real. Every wait of the server goes through it.
+	Clock clock.Clock
+	// If set, every disk operation first waits (on Clock) for the returned duration. For
+	// simulating slow disks.
+	DiskLatency func() time.Duration
 }
 
 type FileServer struct {
 	FileServerOpts
 
+	// Guards the options that can be changed while running: BootstrapNodes, ReplicationFactor & Limits.
+	confLock sync.RWMutex
+
 	peerLock sync.Mutex
 	peers    map[string]p2p.Peer
-
-	store  *store.Store
-	quitCh chan struct{}
+	// Who the peers are, by remote address, once they told (see PeerExchange).
+	peerInfos map[string]PeerInfo
+	// Addresses dialed after a peer exchange, and when.
+	pexDialed map[string]time.Time
+	// Nil unless PeerExchange.PeerBook is set.
+	book *peerBook
+	// Nil unless Membership is enabled.
+	members *membership.Membership
+	// Remote addresses of the members, by ID.
+	memberAddrs map[string]string
+	// File streams in progress, by remote address of the peer; see beginTransfer.
+	transfers map[string]int
+	// Serializes the writing of messages, each written in several parts.
+	sendLock sync.Mutex
+	// Usage of the Limits by the peers.
+	guard *guard
+
+	// In-flight Store/Get/Remove calls, drained by Shutdown.
+	opLock       sync.Mutex
+	ops          sync.WaitGroup
+	shuttingDown bool
+
+	// Dials and peer exchanges still in progress, see background.
+	dialWg sync.WaitGroup
+
+	store    store.Backend
+	log      *slog.Logger
+	quitCh   chan struct{}
+	quitOnce sync.Once
+	started  bool // guarded by opLock
+	loopDone chan struct{}
 }
 
 func NewFileServer(opts FileServerOpts) *FileServer {
-	storeOpts := store.StoreOpts{
-		Root:              opts.StorageRoot,
-		PathTransformFunc: opts.PathTransformFunc,
-	}
-
 	if len(opts.ID) == 0 {
 		opts.ID = cryptography.GenerateId()
 	}
+	if opts.Metrics == nil {
+		opts.Metrics = NopMetrics{}
+	}
+	if opts.Tracer == nil {
+		opts.Tracer = tracing.NewTracer(tracing.TracerOpts{ServiceName: opts.ID})
+	}
+	if opts.Codec == nil {
+		opts.Codec = p2p.ProtoCodec{}
+	}
+	if opts.Scrub.Rate <= 0 {
+		opts.Scrub.Rate = 4 << 20
+	}
+	if opts.Scrub.Interval <= 0 {
+		opts.Scrub.Interval = 24 * time.Hour
+	}
+	opts.Clock = clock.OrReal(opts.Clock)
 
-	return &FileServer{
+	log := logging.OrDefault(opts.Logger).With(
+		logging.NodeID, opts.ID,
+		logging.ListenAddr, opts.Transport.ListenAddress(),
+	)
+
+	if opts.Backend == nil {
+		opts.Backend = store.NewStream(store.StoreOpts{
+			Root:              opts.StorageRoot,
+			PathTransformFunc: opts.PathTransformFunc,
+			Logger:            log,
+			Metrics:           opts.Metrics,
+			Quota:             opts.Quota,
+			Quotas:            opts.Quotas,
+		})
+	}
+
+	s := &FileServer{
 		FileServerOpts: opts,
-		store:          store.NewStream(storeOpts),
+		store:          opts.Backend,
+		log:            log,
 		quitCh:         make(chan struct{}),
+		loopDone:       make(chan struct{}),
 		peers:          make(map[string]p2p.Peer),
+		peerInfos:      make(map[string]PeerInfo),
+		pexDialed:      make(map[string]time.Time),
+		memberAddrs:    make(map[string]string),
+		transfers:      make(map[string]int),
+		guard:          newGuard(),
 	}
+	s.members = s.newMembership()
+	return s
+}
+
+func (s *FileServer) Get(ctx context.Context, key string) (io.Reader, error) {
+	return s.GetAs(ctx, s.ID, key)
 }
 
-func (s *FileServer) Get(key string) (io.Reader, error) {
-	if s.store.Has(s.ID, key) {
-		fmt.Printf("[%s] serving file (%s) from local disk\n", s.Transport.ListenAddress(), key)
-		_, r, err := s.store.Read(s.ID, key)
+// GetAs : same as Get, but for a file stored under the given owner ID.
+func (s *FileServer) GetAs(ctx context.Context, id, key string) (_ io.Reader, err error) {
+	if err := s.begin(ctx); err != nil {
+		return nil, err
+	}
+	defer s.ops.Done()
+	defer s.observe("get", s.Clock.Now(), &err)
+
+	ctx, span := s.Tracer.Start(ctx, "server.Get", "owner_id", id, "key", key)
+	defer span.EndWithError(&err)
+
+	log := s.opLogger(ctx, key)
+
+	if s.store.Has(id, key) {
+		log.Debug("serving file from local disk")
+		_, r, err := s.storeRead(ctx, id, key)
 		return r, err
 	}
 
-	fmt.Printf("[%s] Don't have file (%s) locally, fetching from network...\n", s.Transport.ListenAddress(), key)
+	log.Info("file not found locally, fetching from network")
+	if _, err := s.fetch(ctx, id, key, cryptography.HashKey(key), true); err != nil {
+		return nil, err
+	}
+
+	_, r, err := s.storeRead(ctx, id, key)
+	return r, err
+}
+
+// fetch : asks every peer for the file under (id, remoteKey), written under (id, key) as it comes:
+// decrypted if decrypt (the peers hold the owner's encrypted copy), as is otherwise (the peers hold
+// replicas like the node's). Whether a peer had it.
+func (s *FileServer) fetch(ctx context.Context, id, key, remoteKey string, decrypt bool) (bool, error) {
+	log := s.opLogger(ctx, key)
+	defer s.beginTransfer(s.peerList()...)()
 
 	msg := Message{
 		Payload: MessageGetFile{
-			ID:  s.ID,
-			Key: cryptography.HashKey(key),
+			ID:         id,
+			Key:        remoteKey,
+			RequestID:  logging.RequestIDFrom(ctx),
+			Background: PriorityFrom(ctx) == p2p.Background,
 		},
 	}
 
-	if err := s.broadcast(&msg); err != nil {
-		return nil, err
+	if err := s.broadcast(ctx, &msg); err != nil {
+		return false, err
 	}
 
-	time.Sleep(time.Millisecond * 500)
+	if err := clock.Sleep(ctx, s.Clock, time.Millisecond*500); err != nil {
+		return false, err
+	}
 
-	for _, peer := range s.peers {
-		fmt.Println("receiving stream from peer:", peer.RemoteAddr())
+	peers := s.peerList()
+	defer interruptOnCancel(ctx, peers)()
+
+	fetched := false
+	for _, peer := range peers {
+		log := log.With(logging.Peer, peer.RemoteAddr().String())
+		log.Debug("receiving stream from peer")
 		// fileBuf := new(bytes.Buffer)
 		// n, err := io.CopyN(fileBuf, peer, 22)
 		// if err != nil {
 		// 	return nil, err
 		// }
 
+		setReadPriority(peer, PriorityFrom(ctx))
 		var size int64
-		binary.Read(peer, binary.LittleEndian, &size)
+		if err := binary.Read(peer, binary.LittleEndian, &size); err != nil {
+			if ctx.Err() != nil {
+				return false, ctx.Err()
+			}
+			log.Warn("reading file size from peer", "err", err)
+			continue
+		}
+		if size == 0 {
+			// Peer doesn't have the file.
+			peer.CloseStream()
+			continue
+		}
+
 		// To Store Incoming File in the Calling Network.
-		n, err := s.store.WriteDecrypt(s.EncKey, io.LimitReader(peer, size), s.ID, key)
+		write := s.storeWrite
+		if decrypt {
+			write = s.storeWriteDecrypt
+		}
+		n, err := write(ctx, &exactReader{r: peer, left: size}, id, key)
 		if err != nil {
-			return nil, err
+			if ctx.Err() != nil {
+				return false, ctx.Err()
+			}
+			// E.g. the peer found its copy corrupt midway: nothing was stored.
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				log.Warn("file stream cut short by peer", "err", err)
+				// Its stream is never done: dropped, else its read loop stays stuck waiting on it.
+				peer.Close()
+				continue
+			}
+			return false, err
 		}
 
-		fmt.Printf("[%s] Received (%d) bytes ove the network from <%s>\n", s.Transport.ListenAddress(), n, peer.RemoteAddr())
+		log.Info("received file over the network", "bytes", n)
 		peer.CloseStream()
+		fetched = true
 	}
 
-	_, r, err := s.store.Read(s.ID, key)
-	return r, err
+	return fetched, nil
+}
+
+func (s *FileServer) Remove(ctx context.Context, key string) error {
+	return s.RemoveAs(ctx, s.ID, key)
 }
 
-func (s *FileServer) Remove(key string) error {
-	if !s.store.Has(s.ID, key) {
-		fmt.Printf("[%s] The file (%s) is not present in the disk.\n", s.Transport.ListenAddress(), key)
-		return fmt.Errorf("file is not present")
+// RemoveAs : same as Remove, but for a file stored under the given owner ID.
+func (s *FileServer) RemoveAs(ctx context.Context, id, key string) (err error) {
+	if err := s.begin(ctx); err != nil {
+		return err
+	}
+	defer s.ops.Done()
+	defer s.observe("remove", s.Clock.Now(), &err)
+
+	ctx, span := s.Tracer.Start(ctx, "server.Remove", "owner_id", id, "key", key)
+	defer span.EndWithError(&err)
+
+	log := s.opLogger(ctx, key)
+
+	if !s.store.Has(id, key) {
+		log.Debug("file to delete is not present on disk")
+		return fmt.Errorf("file (%s) is not present: %w", key, os.ErrNotExist)
 	}
 
-	fmt.Printf("[%s] File (%s) found locally, deleting it...\n", s.Transport.ListenAddress(), key)
+	log.Debug("file found locally, deleting it")
 
 	// Message to be broadcasted.
 	msg := Message{
 		Payload: MessageDeleteFile{
-			ID:  s.ID,
-			Key: cryptography.HashKey(key),
+			ID:        id,
+			Key:       cryptography.HashKey(key),
+			RequestID: logging.RequestIDFrom(ctx),
 		},
 	}
 
 	// Broadcasting the message
-	if err := s.broadcast(&msg); err != nil {
+	if err := s.broadcast(ctx, &msg); err != nil {
 		return err
 	}
 
-	time.Sleep(time.Millisecond * 500)
+	if err := clock.Sleep(ctx, s.Clock, time.Millisecond*500); err != nil {
+		return err
+	}
 
-	for _, peer := range s.peers {
-		fmt.Printf("[%s] receiving DELETE stream from peer: [%s]", s.Transport.ListenAddress(), peer.RemoteAddr())
+	for _, peer := range s.peerList() {
+		log.Debug("delete sent to peer", logging.Peer, peer.RemoteAddr().String())
 
-		if err := s.store.Delete(s.ID, key); err != nil {
+		if err := s.storeDelete(ctx, id, key); err != nil {
 			return err
 		}
 	}
 
-	fmt.Printf("[%s] File (%s) DELETED.\n", s.Transport.ListenAddress(), key)
-	return s.store.Delete(s.ID, key)
+	if err := s.storeDelete(ctx, id, key); err != nil {
+		return err
+	}
+	log.Info("file deleted")
+	return nil
 }
 
-func (s *FileServer) Store(key string, r io.Reader) error {
+func (s *FileServer) Store(ctx context.Context, key string, r io.Reader) error {
+	return s.StoreAs(ctx, s.ID, key, r)
+}
+
+// StoreAs : same as Store, but the file is owned by (and replicated under) the given ID.
+func (s *FileServer) StoreAs(ctx context.Context, id, key string, r io.Reader) (err error) {
+	if err := s.begin(ctx); err != nil {
+		return err
+	}
+	defer s.ops.Done()
+	defer s.observe("store", s.Clock.Now(), &err)
+
+	ctx, span := s.Tracer.Start(ctx, "server.Store", "owner_id", id, "key", key)
+	defer span.EndWithError(&err)
+
+	log := s.opLogger(ctx, key)
+
+	// Refused before anything is written, if the size is known.
+	if err := s.checkQuota(id, key, sizeOf(r)); err != nil {
+		return err
+	}
+
+	maxSize := s.limits().MaxObjectSize
+	if maxSize > 0 {
+		// Failing the write before the object is in place: the one under key, if any, is kept.
+		r = &maxSizeReader{r: r, left: maxSize, err: fmt.Errorf("file (%s): %w (limit is %d bytes)", key, ErrObjectTooLarge, maxSize)}
+	}
+
 	var (
 		fileBuffer = new(bytes.Buffer)
 		tee        = io.TeeReader(r, fileBuffer)
 	)
 
-	n, err := s.store.Write(tee, s.ID, key)
+	n, err := s.storeWrite(ctx, tee, id, key)
 	if err != nil {
 		return err
 	}
 
+	written := s.Clock.Now()
+
 	// p := &DataMessage{
 	// 	Key:  key,
 	// 	Data: buf.Bytes(),
 	// }
-	// fmt.Println("Buffer:>", buf.Bytes())
-	// fmt.Printf("DataMessage:> %v\n", p)
 	// return s.broadcast(&Message{
 	// 	From:    s.Transport.ListenAddress(),
 	// 	Payload: p,
@@ -179,32 +447,50 @@ func (s *FileServer) Store(key string, r io.Reader) error {
 
 	msg := Message{
 		Payload: MessageStoreFile{
-			ID:   s.ID,
-			Key:  cryptography.HashKey(key),
-			Size: n + PrependSig,
+			ID:         id,
+			Key:        cryptography.HashKey(key),
+			Size:       n + PrependSig,
+			RequestID:  logging.RequestIDFrom(ctx),
+			Background: PriorityFrom(ctx) == p2p.Background,
 		},
 	}
 
-	// Broadcast the FileKey and FileSize to be stored.
-	if err = s.broadcast(&msg); err != nil {
+	replicas := s.replicaPeers()
+	defer s.beginTransfer(replicas...)()
+
+	// Send the FileKey and FileSize to be stored.
+	if err = s.sendTo(ctx, replicas, &msg); err != nil {
 		return err
 	}
 
-	time.Sleep(5 * time.Millisecond)
+	if err := clock.Sleep(ctx, s.Clock, 5*time.Millisecond); err != nil {
+		return err
+	}
+	defer interruptOnCancel(ctx, replicas)()
 
 	// payload := []byte("VERY LARGE FILE CONTENT")
 	////// USE multiwriter here.
-	peers := []io.Writer{}
-	for _, peer := range s.peers {
-		peers = append(peers, peer)
+	streams := []io.Writer{}
+	for _, peer := range replicas {
+		stream, err := openStream(peer, PriorityFrom(ctx))
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+		streams = append(streams, stream)
 	}
-	mw := io.MultiWriter(peers...)
-	mw.Write([]byte{p2p.IncomingStream})
-	nn, err := cryptography.CopyEncrypt(s.EncKey, fileBuffer, mw)
+	mw := io.MultiWriter(streams...)
+	nn, err := s.copyEncrypt(ctx, fileBuffer, mw)
 	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		return err
 	}
-	fmt.Printf("[%s] recv & written (%d) bytes to disk\n", s.Transport.ListenAddress(), nn)
+	if len(replicas) > 0 {
+		s.Metrics.ObserveReplicationLag(s.Clock.Since(written))
+	}
+	log.Info("file stored", "bytes", n, "replicas", len(replicas), "sent_bytes", nn)
 
 	// for _, peer := range s.peers {
 	// 	// if err := peer.Send(payload); err != nil {
@@ -220,67 +506,438 @@ func (s *FileServer) Store(key string, r io.Reader) error {
 	return nil
 }
 
+// List : files stored on local disk under this node's ID.
+func (s *FileServer) List(ctx context.Context) ([]store.ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.store.List(s.ID)
+}
+
+// Stat : info about a file stored on local disk under this node's ID.
+func (s *FileServer) Stat(ctx context.Context, key string) (store.ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return store.ObjectInfo{}, err
+	}
+	return s.store.Stat(s.ID, key)
+}
+
+// StatUsage : what is stored locally under an owner ID, replicas included, and its quota.
+func (s *FileServer) StatUsage(ctx context.Context, id string) (store.UsageInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return store.UsageInfo{}, err
+	}
+	for _, info := range s.store.Usage() {
+		if info.ID == id {
+			return info, nil
+		}
+	}
+	info := store.UsageInfo{ID: id}
+	if qb, ok := s.store.(store.QuotaBackend); ok {
+		info.Quota = qb.QuotaOf(id)
+	}
+	return info, nil
+}
+
+// ListUsage : StatUsage of every owner ID with files stored locally.
+func (s *FileServer) ListUsage(ctx context.Context) ([]store.UsageInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.store.Usage(), nil
+}
+
+// SetQuotas : storage quota of every owner ID but those of byID, for the files to come. Ignored
+// by backends without quotas.
+func (s *FileServer) SetQuotas(quota store.Quota, byID map[string]store.Quota) {
+	if qb, ok := s.store.(store.QuotaBackend); ok {
+		qb.SetQuotas(quota, byID)
+	}
+}
+
+// checkQuota : whether writing size bytes under (id, key) stays within the hard quota of id, for
+// backends with quotas.
+func (s *FileServer) checkQuota(id, key string, size int64) error {
+	if qb, ok := s.store.(store.QuotaBackend); ok {
+		return qb.CheckQuota(id, key, size)
+	}
+	return nil
+}
+
+// verify : whether the file under (id, key) matches its checksum, for backends keeping them.
+func (s *FileServer) verify(id, key string) error {
+	if vb, ok := s.store.(store.VerifyingBackend); ok {
+		return vb.Verify(id, key)
+	}
+	return nil
+}
+
+// sendNoFile : answers a MessageGetFile of peer with an empty stream: the requester waits on every
+// peer it asked.
+func sendNoFile(peer p2p.Peer, p p2p.Priority) {
+	if stream, err := openStream(peer, p); err == nil {
+		binary.Write(stream, binary.LittleEndian, int64(0))
+		stream.Close()
+	}
+}
+
+// copyVerified : copies the size bytes of r, as read from the store, to w. The last byte is only
+// written once r reached EOF, i.e. once the checksum of the file checked out (see
+// store.VerifyingBackend): a corrupt file is cut short instead.
+func copyVerified(w io.Writer, r io.Reader, size int64) (int64, error) {
+	n, err := io.CopyN(w, r, size-1)
+	if err != nil {
+		return n, err
+	}
+	tail, err := io.ReadAll(r)
+	if err != nil {
+		return n, err
+	}
+	m, err := w.Write(tail)
+	return n + int64(m), err
+}
+
+// maxSizeReader : r, failing with err once more than left bytes are read from it.
+type maxSizeReader struct {
+	r    io.Reader
+	left int64
+	err  error
+}
+
+func (r *maxSizeReader) Read(p []byte) (int, error) {
+	// One extra byte to tell "exactly at the limit" from "over the limit".
+	if int64(len(p)) > r.left+1 {
+		p = p[:r.left+1]
+	}
+	n, err := r.r.Read(p)
+	if int64(n) > r.left {
+		return int(r.left), r.err
+	}
+	r.left -= int64(n)
+	return n, err
+}
+
+// exactReader : the size bytes of a stream, failing with io.ErrUnexpectedEOF if cut short.
+type exactReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (r *exactReader) Read(p []byte) (int, error) {
+	if r.left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.left {
+		p = p[:r.left]
+	}
+	n, err := r.r.Read(p)
+	r.left -= int64(n)
+	if err == io.EOF && r.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// sizeOf : bytes left in r if it tells (e.g. a *bytes.Reader), 0 otherwise.
+func sizeOf(r io.Reader) int64 {
+	if l, ok := r.(interface{ Len() int }); ok {
+		return int64(l.Len())
+	}
+	return 0
+}
+
+// Peers : remote addresses of all the connected peers.
+func (s *FileServer) Peers() []string {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	addrs := make([]string, 0, len(s.peers))
+	for addr := range s.peers {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// PeerRTTs : round-trip time of the connected peers that measure it (see p2p.Heartbeat), by
+// remote address; for routing decisions.
+func (s *FileServer) PeerRTTs() map[string]time.Duration {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	rtts := make(map[string]time.Duration)
+	for addr, peer := range s.peers {
+		if p, ok := peer.(p2p.RTTPeer); ok {
+			if rtt := p.RTT(); rtt > 0 {
+				rtts[addr] = rtt
+			}
+		}
+	}
+	return rtts
+}
+
+// SetBootstrapNodes : replaces the bootstrap list of a running server, dialing the nodes that are new to it.
+func (s *FileServer) SetBootstrapNodes(nodes []string) {
+	s.confLock.Lock()
+	known := make(map[string]bool)
+	for _, addr := range s.BootstrapNodes {
+		known[addr] = true
+	}
+	s.BootstrapNodes = nodes
+	s.confLock.Unlock()
+
+	for _, addr := range nodes {
+		if !known[addr] {
+			s.dial(addr)
+		}
+	}
+}
+
+// Connect : dials addr in the background, unless a peer of that address (or listening on it, see
+// PeerExchange) is connected already. For nodes found other than by the bootstrap list (e.g.
+// discovery.Service).
+func (s *FileServer) Connect(addr string) {
+	s.peerLock.Lock()
+	_, connected := s.peers[addr]
+	for _, info := range s.peerInfos {
+		connected = connected || info.Addr == addr
+	}
+	s.peerLock.Unlock()
+	if connected {
+		return
+	}
+
+	// Held while dialing starts, so that Shutdown doesn't miss it.
+	s.opLock.Lock()
+	defer s.opLock.Unlock()
+	if s.shuttingDown {
+		return
+	}
+	s.dial(addr)
+}
+
+// background : runs fn in a goroutine waited for by Shutdown, unless Shutdown has begun.
+func (s *FileServer) background(fn func()) {
+	// Held while the goroutine is registered, so that Shutdown doesn't miss it.
+	s.opLock.Lock()
+	defer s.opLock.Unlock()
+	if s.shuttingDown {
+		return
+	}
+
+	s.dialWg.Add(1)
+	go func() {
+		defer s.dialWg.Done()
+		fn()
+	}()
+}
+
+func (s *FileServer) SetReplicationFactor(n int) {
+	s.confLock.Lock()
+	defer s.confLock.Unlock()
+
+	s.ReplicationFactor = n
+}
+
+func (s *FileServer) SetLimits(l Limits) {
+	s.confLock.Lock()
+	defer s.confLock.Unlock()
+
+	s.Limits = l
+}
+
+func (s *FileServer) limits() Limits {
+	s.confLock.RLock()
+	defer s.confLock.RUnlock()
+
+	return s.Limits
+}
+
+// Stop : stops the server right away, cutting any in-flight transfer. See Shutdown.
 func (s *FileServer) Stop() {
-	close(s.quitCh)
+	s.quitOnce.Do(func() {
+		close(s.quitCh)
+	})
+}
+
+// Shutdown : gracefully stops the server. New operations and peers are refused, in-flight
+// operations are drained, peers are told goodbye, then every connection is closed and every
+// goroutine waited for. If ctx expires before the drain is over, the remaining transfers are cut
+// and ctx.Err() is returned.
+func (s *FileServer) Shutdown(ctx context.Context) error {
+	s.opLock.Lock()
+	s.shuttingDown = true
+	s.opLock.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		s.ops.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+		if err := s.broadcast(ctx, &Message{Payload: MessageGoodbye{ID: s.ID}}); err != nil {
+			s.log.Warn("goodbye broadcast error", "err", err)
+		}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	s.Stop()
+
+	s.opLock.Lock()
+	started := s.started
+	s.opLock.Unlock()
+
+	if started {
+		// loop closes the transport on its way out.
+		<-s.loopDone
+	} else {
+		s.Transport.Close()
+	}
+	s.dialWg.Wait()
+
+	return err
 }
 
 func (s *FileServer) Start() error {
+	s.opLock.Lock()
+	if s.shuttingDown {
+		s.opLock.Unlock()
+		return ErrServerClosed
+	}
+	s.started = true
+	s.opLock.Unlock()
+
+	defer close(s.loopDone)
+
 	if err := s.Transport.ListenAndAccept(); err != nil {
 		return err
 	}
 
+	if s.PeerExchange.Enabled && len(s.PeerExchange.PeerBook) > 0 {
+		book, err := loadPeerBook(s.PeerExchange.PeerBook)
+		if err != nil {
+			// Rebuilt from the peers to come.
+			s.log.Warn("peer book not loaded", "path", s.PeerExchange.PeerBook, "err", err)
+		}
+		s.book = book
+	}
+
 	s.bootstrapNetwork()
+	if s.members != nil {
+		s.members.Start()
+	}
+	if _, ok := s.store.(store.VerifyingBackend); ok && s.Scrub.Enabled {
+		s.background(s.scrub)
+	} else if s.Scrub.Enabled {
+		s.log.Warn("scrubbing disabled: the storage backend keeps no checksums")
+	}
 
 	s.loop()
 
 	return nil
 }
 
+// begin : registers an in-flight operation, refusing it once Shutdown has started.
+// Must be paired with s.ops.Done().
+func (s *FileServer) begin(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.opLock.Lock()
+	defer s.opLock.Unlock()
+
+	if s.shuttingDown {
+		return ErrServerClosed
+	}
+	s.ops.Add(1)
+	return nil
+}
+
 func (s *FileServer) OnPeer(p p2p.Peer) error {
 	s.peerLock.Lock()
 	defer s.peerLock.Unlock()
 
+	s.opLock.Lock()
+	shuttingDown := s.shuttingDown
+	s.opLock.Unlock()
+	if shuttingDown {
+		return ErrServerClosed
+	}
+
+	if max := s.limits().MaxPeers; max > 0 && len(s.peers) >= max {
+		return fmt.Errorf("rejecting <%s>: %w (limit is %d)", p.RemoteAddr(), ErrTooManyPeers, max)
+	}
+	if s.banned(p.RemoteAddr().String()) {
+		return fmt.Errorf("rejecting <%s>: %w", p.RemoteAddr(), ErrBanned)
+	}
+
 	s.peers[p.RemoteAddr().String()] = p
 
-	log.Println("Connected with remote Peer:", p.RemoteAddr().String())
+	protocol := protocolOf(p)
+	s.log.Info("connected with remote peer", logging.Peer, p.RemoteAddr().String(),
+		"protocol_version", protocol.Version, "capabilities", protocol.Capabilities.String())
+	s.exchangePeers(p.RemoteAddr().String())
+	s.greet(p.RemoteAddr().String())
 	return nil
 }
 
+// OnPeerDisconnect : forgets a peer whose connection is gone.
+func (s *FileServer) OnPeerDisconnect(p p2p.Peer) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	addr := p.RemoteAddr().String()
+	// A goodbye may already have removed it, or a new connection from the same address replaced it.
+	if s.peers[addr] == p {
+		delete(s.peers, addr)
+		delete(s.peerInfos, addr)
+		s.forgetMember(addr)
+		s.forgetPeerUsage(addr)
+		s.log.Info("disconnected from remote peer", logging.Peer, addr)
+	}
+}
+
 func (s *FileServer) loop() {
 	defer func() {
-		fmt.Println("File Server stopped due to user Quit action.")
+		s.log.Info("file server stopped")
+		if s.members != nil {
+			s.members.Close()
+		}
 		s.Transport.Close()
 	}()
 
 	for {
 		select {
 		case rpc := <-s.Transport.Consume():
-			var msg Message
-			if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg); err != nil {
-				log.Println("decodeing err:", err)
+			protocol := p2p.Protocol{Version: p2p.ProtocolVersion}
+			if peer, ok := s.peer(rpc.From.String()); ok {
+				protocol = protocolOf(peer)
 			}
-
-			if err := s.handleMessage(rpc.From.String(), &msg); err != nil {
-				log.Println("handleMessage err:", err)
-				// return
+			msg, err := decodeMessage(s.Codec, protocol, rpc.Payload)
+			if err != nil {
+				s.log.Warn("decoding message", logging.Peer, rpc.From.String(), "err", err)
+				s.Metrics.CountRPC("undecodable", "error")
+				continue
 			}
 
-			// fmt.Printf("recv: %s\n", string(msg.Payload.([]byte)))
-			// fmt.Printf("Payload: %v\n", msg.Payload)
-			// peer, ok := s.peers[rpc.From.String()]
-			// if !ok {
-			// 	panic("peer not found in peers map")
-			// }
-			// fmt.Println("Peer: ", peer.RemoteAddr())
-			// b := make([]byte, 1000)
-			// if _, err := peer.Read(b); err != nil {
-			// 	panic(err)
-			// }
-			// fmt.Printf("Data: %s\n", string(b))
-			// peer.(*p2p.TCPPeer).Wg.Done()
-			// if err := s.handleMessage(&m); err != nil {
-			// 	log.Fatal(err)
-			// }
+			outcome := "ok"
+			ctx := tracing.ContextWithRemote(context.Background(), tracing.SpanContext{TraceID: msg.TraceID, SpanID: msg.SpanID})
+			if err := s.admit(rpc.From.String(), msg); err != nil {
+				s.log.Warn("refusing message", logging.Peer, rpc.From.String(), "err", err)
+				s.refuse(ctx, rpc.From.String(), msg, err)
+				s.Metrics.CountRPC(rpcType(msg.Payload), "refused")
+				continue
+			}
+			if err := s.handleMessage(ctx, rpc.From.String(), msg); err != nil {
+				s.log.Warn("handling message", logging.Peer, rpc.From.String(), "err", err)
+				outcome = "error"
+			}
+			s.Metrics.CountRPC(rpcType(msg.Payload), outcome)
 		case <-s.quitCh:
 			return
 		}
@@ -288,23 +945,37 @@ func (s *FileServer) loop() {
 }
 
 func (s *FileServer) bootstrapNetwork() error {
-	for _, addr := range s.BootstrapNodes {
-		if len(addr) == 0 {
-			// In case of empty string... SKIP
-			continue
+	s.confLock.RLock()
+	nodes := s.BootstrapNodes
+	s.confLock.RUnlock()
+
+	dialed := make(map[string]bool)
+	for _, addr := range append(nodes, s.book.addrs(s.Clock.Now())...) {
+		if !dialed[addr] && addr != s.Transport.ListenAddress() {
+			dialed[addr] = true
+			s.dial(addr)
 		}
-
-		go func(addr string) {
-			fmt.Printf("[%s] attempting to connect with <%s>\n", s.Transport.ListenAddress(), addr)
-			if err := s.Transport.Dial(addr); err != nil {
-				log.Println("Dial error: ", err)
-			}
-		}(addr)
 	}
 
 	return nil
 }
 
+func (s *FileServer) dial(addr string) {
+	if len(addr) == 0 {
+		// In case of empty string... SKIP
+		return
+	}
+
+	s.dialWg.Add(1)
+	go func(addr string) {
+		defer s.dialWg.Done()
+		s.log.Debug("attempting to connect", logging.Peer, addr)
+		if err := s.Transport.Dial(addr); err != nil {
+			s.log.Warn("dial error", logging.Peer, addr, "err", err)
+		}
+	}(addr)
+}
+
 // func (s *FileServer) stream(msg *Message) error {
 // 	peers := []io.Writer{}
 // 	for _, peer := range s.peers {
@@ -315,117 +986,292 @@ func (s *FileServer) bootstrapNetwork() error {
 // 	return gob.NewEncoder(multiWriter).Encode(msg)
 // }
 
-func (s *FileServer) broadcast(msg *Message) error {
-	buf := new(bytes.Buffer)
+// replicaPeers : the peers a new file is pushed to, as per ReplicationFactor.
+func (s *FileServer) replicaPeers() []p2p.Peer {
+	s.confLock.RLock()
+	n := s.ReplicationFactor
+	s.confLock.RUnlock()
 
-	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
-		return err
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	addrs := make([]string, 0, len(s.peers))
+	for addr := range s.peers {
+		if s.alive(addr) {
+			addrs = append(addrs, addr)
+		}
 	}
+	// Sorted, so that the same peers are picked as long as the peer set doesn't change.
+	sort.Strings(addrs)
 
+	if n > 0 && n < len(addrs) {
+		addrs = addrs[:n]
+	}
+
+	peers := make([]p2p.Peer, 0, len(addrs))
+	for _, addr := range addrs {
+		peers = append(peers, s.peers[addr])
+	}
+	return peers
+}
+
+// peer : the connected peer of remote address addr.
+func (s *FileServer) peer(addr string) (p2p.Peer, bool) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peer, ok := s.peers[addr]
+	return peer, ok
+}
+
+// peerList : snapshot of the connected peers.
+func (s *FileServer) peerList() []p2p.Peer {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peers := make([]p2p.Peer, 0, len(s.peers))
 	for _, peer := range s.peers {
-		peer.Send([]byte{p2p.IncomingMessage}) // Cause we are sending message to all the peers.
-		if err := peer.Send(buf.Bytes()); err != nil {
-			return err
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+func (s *FileServer) broadcast(ctx context.Context, msg *Message) error {
+	return s.sendTo(ctx, s.peerList(), msg)
+}
+
+func (s *FileServer) sendTo(ctx context.Context, peers []p2p.Peer, msg *Message) (err error) {
+	ctx, span := s.Tracer.Start(ctx, "server.send", "type", rpcType(msg.Payload), "peers", len(peers))
+	defer span.EndWithError(&err)
+	withTrace(ctx, msg)
+
+	return s.send(peers, msg)
+}
+
+// send : sendTo, untraced; for the chatter of the protocol (e.g. membership pings).
+func (s *FileServer) send(peers []p2p.Peer, msg *Message) error {
+	enc := &encodeMessage{msg: msg, codec: s.Codec}
+
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+
+	// A peer failing doesn't keep the message from the others.
+	var errs []error
+	for _, peer := range peers {
+		frame, err := enc.frame(protocolOf(peer))
+		if err == nil {
+			// One write, so that the frame isn't split by the transport's own (e.g. heartbeats).
+			err = peer.Send(frame)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("peer (%s): %w", peer.RemoteAddr(), err))
 		}
 	}
-	return nil
+	return errors.Join(errs...)
 }
 
-func (s *FileServer) handleMessage(from string, msg *Message) error {
+func (s *FileServer) handleMessage(ctx context.Context, from string, msg *Message) error {
+	s.log.Debug("received message", logging.Peer, from, "type", fmt.Sprintf("%T", msg.Payload))
+
 	switch t := msg.Payload.(type) {
 	case *MessageStoreFile:
-		fmt.Println("Received MessageStoreFile")
-		return s.handleMessageStoreFile(from, t)
+		return s.handleMessageStoreFile(ctx, from, t)
 
 	case *MessageGetFile:
-		fmt.Println("Received MessageGetFile")
-		return s.handleMessageGetFile(from, t)
+		return s.handleMessageGetFile(ctx, from, t)
 
 	case *MessageDeleteFile:
-		fmt.Println("Received MessageDeleteFile")
-		return s.handleMessageDeleteFile(from, t)
+		return s.handleMessageDeleteFile(ctx, from, t)
+
+	case *MessageGoodbye:
+		return s.handleMessageGoodbye(ctx, from, t)
+
+	case *MessagePeerExchange:
+		return s.handleMessagePeerExchange(ctx, from, t)
+
+	case *MessageMembership:
+		return s.handleMessageMembership(ctx, from, t)
+
+	case *MessageError:
+		return s.handleMessageError(ctx, from, t)
 	}
 	return nil
 }
 
-func (s *FileServer) handleMessageStoreFile(from string, msg *MessageStoreFile) error {
-	fmt.Printf("Received Message: %v\n", msg)
-	peer, ok := s.peers[from]
+func (s *FileServer) handleMessageStoreFile(ctx context.Context, from string, msg *MessageStoreFile) (err error) {
+	ctx, span := s.Tracer.Start(ctx, "server.handleMessageStoreFile", "peer", from, "owner_id", msg.ID, "key_hash", msg.Key)
+	defer span.EndWithError(&err)
+
+	peer, ok := s.peer(from)
 	if !ok {
 		return fmt.Errorf("peer {%s} not found", from)
 	}
+	defer s.beginTransfer(peer)()
+	setReadPriority(peer, priorityOf(msg.Background))
+
+	release, err := s.admitStream(from, msg)
+	if err == nil {
+		if err = s.checkQuota(msg.ID, msg.Key, msg.Size); err != nil {
+			release(false)
+		}
+	}
+	if err != nil {
+		// The peer streams the file regardless.
+		s.refuse(ctx, from, &Message{Payload: msg}, err)
+		return err
+	}
 
-	n, err := s.store.Write(io.LimitReader(peer, msg.Size), msg.ID, msg.Key)
+	n, err := s.storeWrite(ctx, io.LimitReader(peer, msg.Size), msg.ID, msg.Key)
+	release(err == nil)
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("[%s] Written (%d) bytes to disk\n", s.Transport.ListenAddress(), n)
+	s.peerLogger(from, msg.Key, msg.RequestID).Info("replica written to disk", "bytes", n)
 
 	peer.CloseStream() // Streaming is OVER!!
 
 	return nil
 }
 
-func (s *FileServer) handleMessageGetFile(from string, msg *MessageGetFile) error {
-	fmt.Printf("Received Message: %v\n", msg)
+func (s *FileServer) handleMessageGetFile(ctx context.Context, from string, msg *MessageGetFile) (err error) {
+	ctx, span := s.Tracer.Start(ctx, "server.handleMessageGetFile", "peer", from, "owner_id", msg.ID, "key_hash", msg.Key)
+	defer span.EndWithError(&err)
+
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer {%s} not found", from)
+	}
+	defer s.beginTransfer(peer)()
 
 	if !s.store.Has(msg.ID, msg.Key) {
+		sendNoFile(peer, priorityOf(msg.Background))
 		return fmt.Errorf("[%s] file (%s) not found", s.Transport.ListenAddress(), msg.Key)
 	}
 
-	fmt.Printf("[%s] serving file (%s) over the network\n", s.Transport.ListenAddress(), msg.Key)
+	log := s.peerLogger(from, msg.Key, msg.RequestID)
+	log.Debug("serving file over the network")
 
-	size, r, err := s.store.Read(msg.ID, msg.Key)
+	size, r, err := s.storeRead(ctx, msg.ID, msg.Key)
 	if err != nil {
 		return err
 	}
 
 	if rc, ok := r.(io.ReadCloser); ok {
-		fmt.Printf("[%s] Closing ReadCloser\n", s.Transport.ListenAddress())
 		defer rc.Close()
 	}
 
-	peer, ok := s.peers[from]
-	if !ok {
-		return fmt.Errorf("peer {%s} not found", from)
+	stream, err := openStream(peer, priorityOf(msg.Background))
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	binary.Write(stream, binary.LittleEndian, size)
+
+	n, err := copyVerified(stream, r, size)
+	if errors.Is(err, store.ErrCorrupt) {
+		// The stream can't be taken back: cut short, the connection closed for the requester not
+		// to wait for the rest (see fetch).
+		peer.Close()
+		s.background(func() {
+			ctx, cancel := s.quitContext()
+			defer cancel()
+			s.recoverCorrupt(ctx, msg.ID, msg.Key, err)
+		})
+		return err
 	}
-
-	// for `peepBuf` to know that a Stream is comming
-	peer.Send([]byte{p2p.IncomingStream})
-	binary.Write(peer, binary.LittleEndian, size)
-
-	n, err := io.Copy(peer, r)
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("[%s] written (%d) bytes over the network to <%s>\n", s.Transport.ListenAddress(), n, from)
+	log.Info("file sent over the network", "bytes", n)
 	return nil
 }
 
-func (s *FileServer) handleMessageDeleteFile(from string, msg *MessageDeleteFile) error {
-	fmt.Printf("Received Message: %v\n", msg)
+func (s *FileServer) handleMessageDeleteFile(ctx context.Context, from string, msg *MessageDeleteFile) (err error) {
+	ctx, span := s.Tracer.Start(ctx, "server.handleMessageDeleteFile", "peer", from, "owner_id", msg.ID, "key_hash", msg.Key)
+	defer span.EndWithError(&err)
 
 	if !s.store.Has(msg.ID, msg.Key) {
 		return fmt.Errorf("[%s] file (%s) not found", s.Transport.ListenAddress(), msg.Key)
 	}
 
-	_, ok := s.peers[from]
-	if !ok {
+	if _, ok := s.peer(from); !ok {
 		return fmt.Errorf("peer {%s} not found", from)
 	}
 
-	if err := s.store.Delete(msg.ID, msg.Key); err != nil {
+	if err := s.storeDelete(ctx, msg.ID, msg.Key); err != nil {
 		return err
 	}
 
-	fmt.Printf("[%s] Deleted file (%s) from disk\n", s.Transport.ListenAddress(), msg.Key)
+	s.peerLogger(from, msg.Key, msg.RequestID).Info("replica deleted from disk")
 	return nil
 }
 
+func (s *FileServer) handleMessageGoodbye(ctx context.Context, from string, msg *MessageGoodbye) (err error) {
+	_, span := s.Tracer.Start(ctx, "server.handleMessageGoodbye", "peer", from)
+	defer span.EndWithError(&err)
+
+	s.peerLock.Lock()
+	peer, ok := s.peers[from]
+	delete(s.peers, from)
+	delete(s.peerInfos, from)
+	s.forgetMember(from)
+	s.forgetPeerUsage(from)
+	s.peerLock.Unlock()
+
+	if !ok {
+		return fmt.Errorf("peer {%s} not found", from)
+	}
+
+	s.log.Info("peer is shutting down, disconnecting", logging.Peer, from, "peer_id", msg.ID)
+	return peer.Close()
+}
+
+// opLogger : logger for a local operation on key.
+func (s *FileServer) opLogger(ctx context.Context, key string) *slog.Logger {
+	return logging.FromContext(ctx, s.log).With(
+		logging.Key, key,
+		logging.KeyHash, cryptography.HashKey(key),
+	)
+}
+
+// peerLogger : logger for a message from a peer about the file hashed as keyHash.
+func (s *FileServer) peerLogger(from, keyHash, requestID string) *slog.Logger {
+	log := s.log.With(logging.Peer, from, logging.KeyHash, keyHash)
+	if len(requestID) > 0 {
+		log = log.With(logging.RequestID, requestID)
+	}
+	return log
+}
+
+// interruptOnCancel : once ctx is done, expires the deadlines of peers so that blocked transfers
+// return. The returned func must be called when the transfer is over: a transfer cut short leaves
+// the connection out of sync with the peer, so it gets closed.
+func interruptOnCancel(ctx context.Context, peers []p2p.Peer) func() {
+	stop := context.AfterFunc(ctx, func() {
+		for _, peer := range peers {
+			peer.SetDeadline(time.Now())
+		}
+	})
+
+	return func() {
+		if !stop() {
+			for _, peer := range peers {
+				peer.Close()
+			}
+		}
+	}
+}
+
+// Payloads, for gob (protocol version 3).
 func init() {
 	gob.Register(&MessageStoreFile{})
 	gob.Register(&MessageGetFile{})
 	gob.Register(&MessageDeleteFile{})
+	gob.Register(&MessageGoodbye{})
+	gob.Register(&MessagePeerExchange{})
+	gob.Register(&MessageMembership{})
+	gob.Register(&MessageError{})
 }
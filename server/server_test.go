@@ -1 +1,331 @@
 package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PsychoPunkSage/NexNet/cryptography"
+	"github.com/PsychoPunkSage/NexNet/logging"
+	"github.com/PsychoPunkSage/NexNet/p2p"
+	store "github.com/PsychoPunkSage/NexNet/storage"
+	"github.com/PsychoPunkSage/NexNet/tracing"
+	"github.com/stretchr/testify/assert"
+)
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func newTestServer(t *testing.T, nodes ...string) *FileServer {
+	s, _ := newTestServerWithLogs(t, nodes...)
+	return s
+}
+
+// newTestServerWithLogs : same as newTestServer, also returning the logs of the node.
+// They get printed if the test fails.
+func newTestServerWithLogs(t *testing.T, nodes ...string) (*FileServer, *logging.Recorder) {
+	logs := logging.NewRecorder()
+
+	tr := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    freeAddr(t),
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+		Logger:        logs.Logger(),
+	})
+
+	s := NewFileServer(FileServerOpts{
+		EncKey:            cryptography.NewEncryptionKey(),
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: store.CASPathTransformFunc,
+		Transport:         tr,
+		BootstrapNodes:    nodes,
+		Logger:            logs.Logger(),
+	})
+	tr.OnPeer = s.OnPeer
+	tr.OnPeerDisconnect = s.OnPeerDisconnect
+
+	t.Cleanup(func() {
+		if t.Failed() {
+			t.Logf("logs of node %s:\n%s", tr.ListenAddress(), logs)
+		}
+	})
+
+	return s, logs
+}
+
+// startTestServer : starts s and waits until it accepts connections.
+func startTestServer(t *testing.T, s *FileServer) {
+	go s.Start()
+
+	waitFor(t, func() bool {
+		conn, err := net.Dial("tcp", s.Transport.ListenAddress())
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	})
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func shutdown(t *testing.T, s *FileServer) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, s.Shutdown(ctx))
+}
+
+func TestShutdownLeavesNoGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	a := newTestServer(t)
+	startTestServer(t, a)
+	b := newTestServer(t, a.Transport.ListenAddress())
+	startTestServer(t, b)
+
+	waitFor(t, func() bool { return len(a.Peers()) == 1 && len(b.Peers()) == 1 })
+
+	// Replicate a file, so that streams have been used on both sides.
+	payload := []byte("shutdown me gently")
+	assert.Nil(t, b.Store(context.Background(), "key", bytes.NewReader(payload)))
+	waitFor(t, func() bool { return a.store.Has(b.ID, cryptography.HashKey("key")) })
+
+	shutdown(t, b)
+	// The goodbye (or the closed connection) makes a forget about b.
+	waitFor(t, func() bool { return len(a.Peers()) == 0 })
+	shutdown(t, a)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			buf = buf[:runtime.Stack(buf, true)]
+			t.Fatalf("leaked %d goroutines:\n%s", runtime.NumGoroutine()-before, buf)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShutdownDrainsInFlightStore(t *testing.T) {
+	s := newTestServer(t)
+	startTestServer(t, s)
+
+	pr, pw := io.Pipe()
+	storeErr := make(chan error, 1)
+	go func() {
+		storeErr <- s.Store(context.Background(), "slow", pr)
+	}()
+	// Only returns once Store is reading, i.e. in flight.
+	pw.Write([]byte("first half, "))
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- s.Shutdown(context.Background())
+	}()
+
+	select {
+	case <-shutdownErr:
+		t.Fatal("Shutdown returned before the in-flight Store was over")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	pw.Write([]byte("second half"))
+	pw.Close()
+
+	assert.Nil(t, <-storeErr)
+	assert.Nil(t, <-shutdownErr)
+
+	_, r, err := s.store.Read(s.ID, "slow")
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	r.(io.Closer).Close()
+	assert.Equal(t, "first half, second half", string(b))
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	s := newTestServer(t)
+	startTestServer(t, s)
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go s.Store(context.Background(), "stuck", pr)
+	pw.Write([]byte("never finished"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+}
+
+func TestOperationsHonorContextAndShutdown(t *testing.T) {
+	s := newTestServer(t)
+	startTestServer(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, s.Store(ctx, "key", strings.NewReader("data")), context.Canceled)
+	_, err := s.Get(ctx, "key")
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// Not stored locally: Get has to wait on the network, and gives up with ctx.
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = s.Get(ctx, "missing")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	shutdown(t, s)
+	assert.ErrorIs(t, s.Store(context.Background(), "key", strings.NewReader("data")), ErrServerClosed)
+	assert.ErrorIs(t, s.Remove(context.Background(), "key"), ErrServerClosed)
+}
+
+func TestConnect(t *testing.T) {
+	a := newTestServer(t)
+	startTestServer(t, a)
+	b := newTestServer(t)
+	startTestServer(t, b)
+
+	addr := a.Transport.ListenAddress()
+	b.Connect(addr)
+	waitFor(t, func() bool { return len(b.Peers()) == 1 })
+
+	// Connected already: not dialed again.
+	b.Connect(addr)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, []string{addr}, b.Peers())
+
+	shutdown(t, b)
+	b.Connect(addr)
+	assert.Len(t, b.Peers(), 0)
+	shutdown(t, a)
+}
+
+func TestRecoverCorruptNotCorrupt(t *testing.T) {
+	s := newTestServer(t)
+	_, err := s.store.Write(bytes.NewReader([]byte("fine after all")), s.ID, "key")
+	assert.Nil(t, err)
+
+	// E.g. replaced between the two reads: neither quarantined nor counted as repaired.
+	cause := &store.CorruptionError{ID: s.ID, Key: "key"}
+	err = s.recoverCorrupt(context.Background(), s.ID, "key", cause)
+	assert.ErrorIs(t, err, errNotCorrupt)
+	assert.True(t, s.store.Has(s.ID, "key"))
+}
+
+func TestSendReachesPeersPastAFailingOne(t *testing.T) {
+	s := newTestServer(t)
+
+	gone, _ := net.Pipe()
+	gone.Close()
+	conn, other := net.Pipe()
+	defer conn.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		b := make([]byte, 1)
+		n, _ := other.Read(b)
+		received <- b[:n]
+		io.Copy(io.Discard, other)
+	}()
+
+	peers := []p2p.Peer{p2p.NewTCPPeer(gone, true), p2p.NewTCPPeer(conn, true)}
+	err := s.send(peers, &Message{Payload: MessageDeleteFile{ID: s.ID, Key: "key"}})
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+	assert.Equal(t, []byte{p2p.IncomingSizedMessage}, <-received)
+}
+
+func TestLogsCarryNodeAndRequestFields(t *testing.T) {
+	a, aLogs := newTestServerWithLogs(t)
+	startTestServer(t, a)
+	b, bLogs := newTestServerWithLogs(t, a.Transport.ListenAddress())
+	startTestServer(t, b)
+	defer shutdown(t, a)
+	defer shutdown(t, b)
+
+	waitFor(t, func() bool { return len(a.Peers()) == 1 && len(b.Peers()) == 1 })
+
+	ctx := logging.WithRequestID(context.Background(), "req-42")
+	assert.Nil(t, b.Store(ctx, "logged", strings.NewReader("data")))
+
+	stored := bLogs.Find(map[string]any{"msg": "file stored"})
+	if assert.Len(t, stored, 1) {
+		assert.Equal(t, b.ID, stored[0][logging.NodeID])
+		assert.Equal(t, b.Transport.ListenAddress(), stored[0][logging.ListenAddr])
+		assert.Equal(t, "req-42", stored[0][logging.RequestID])
+		assert.Equal(t, "logged", stored[0][logging.Key])
+		assert.Equal(t, cryptography.HashKey("logged"), stored[0][logging.KeyHash])
+	}
+
+	// The request ID travels with the message, so the replica's logs can be matched to it.
+	waitFor(t, func() bool {
+		return len(aLogs.Find(map[string]any{
+			"msg":             "replica written to disk",
+			logging.NodeID:    a.ID,
+			logging.RequestID: "req-42",
+			logging.KeyHash:   cryptography.HashKey("logged"),
+		})) == 1
+	})
+
+	// Each node only logs its own records.
+	assert.Empty(t, aLogs.Find(map[string]any{logging.NodeID: b.ID}))
+}
+
+func TestTracePropagatesAcrossPeers(t *testing.T) {
+	a := newTestServer(t)
+	aSpans := tracing.NewInMemoryExporter()
+	a.Tracer = tracing.NewTracer(tracing.TracerOpts{ServiceName: "a", Exporter: aSpans})
+	startTestServer(t, a)
+
+	b := newTestServer(t, a.Transport.ListenAddress())
+	bSpans := tracing.NewInMemoryExporter()
+	b.Tracer = tracing.NewTracer(tracing.TracerOpts{ServiceName: "b", Exporter: bSpans})
+	startTestServer(t, b)
+	defer shutdown(t, a)
+	defer shutdown(t, b)
+
+	waitFor(t, func() bool { return len(a.Peers()) == 1 && len(b.Peers()) == 1 })
+
+	assert.Nil(t, a.Store(context.Background(), "traced", strings.NewReader("data")))
+	waitFor(t, func() bool { return len(bSpans.Find("storage.write")) == 1 })
+
+	root := aSpans.Find("server.Store")[0]
+	send := aSpans.Find("server.send")[0]
+	assert.Equal(t, root.SpanID, send.ParentSpanID)
+	assert.Equal(t, root.SpanID, aSpans.Find("cryptography.encrypt")[0].ParentSpanID)
+
+	// b's side of the replication is part of a's trace.
+	handle := bSpans.Find("server.handleMessageStoreFile")[0]
+	assert.Equal(t, root.TraceID, handle.TraceID)
+	assert.Equal(t, send.SpanID, handle.ParentSpanID)
+	assert.Equal(t, handle.SpanID, bSpans.Find("storage.write")[0].ParentSpanID)
+
+	// Get fans out to the peers, which answer within the same trace.
+	assert.Nil(t, a.store.Delete(a.ID, "traced"))
+	r, err := a.Get(context.Background(), "traced")
+	assert.Nil(t, err)
+	r.(io.Closer).Close()
+
+	get := aSpans.Find("server.Get")[0]
+	assert.NotEqual(t, root.TraceID, get.TraceID)
+	waitFor(t, func() bool { return len(bSpans.Find("server.handleMessageGetFile")) == 1 })
+	served := bSpans.Find("server.handleMessageGetFile")[0]
+	assert.Equal(t, get.TraceID, served.TraceID)
+	assert.Empty(t, served.Error)
+	assert.Equal(t, get.SpanID, aSpans.Find("storage.write_decrypt")[0].ParentSpanID)
+}
@@ -0,0 +1,153 @@
+// Package servertest builds clusters of FileServers running in one process, over a
+// p2p.MemNetwork, for tests.
+package servertest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PsychoPunkSage/NexNet/cryptography"
+	"github.com/PsychoPunkSage/NexNet/logging"
+	"github.com/PsychoPunkSage/NexNet/p2p"
+	"github.com/PsychoPunkSage/NexNet/server"
+	store "github.com/PsychoPunkSage/NexNet/storage"
+	"github.com/PsychoPunkSage/NexNet/tracing"
+)
+
+// How long NewCluster waits for the nodes to connect, and Cleanup for them to shut down.
+const Timeout = 5 * time.Second
+
+// Cluster : N nodes, each connected to every other one.
+type Cluster struct {
+	Network *p2p.MemNetwork
+	Nodes   []*server.FileServer
+	// Logs[i] : logs of Nodes[i], printed if the test fails.
+	Logs []*logging.Recorder
+	// Spans of every node; SpanData.Service is the node's address.
+	Spans *tracing.InMemoryExporter
+}
+
+// NewCluster : starts n nodes named "node-0" to "node-<n-1>" (their listen addresses), and waits
+// for the full mesh. configure, if given, can change the options of each node before it's
+// created. The nodes are shut down when the test ends.
+func NewCluster(t testing.TB, n int, configure ...func(i int, opts *server.FileServerOpts)) *Cluster {
+	t.Helper()
+
+	c := &Cluster{
+		Network: p2p.NewMemNetwork(p2p.MemNetworkOpts{}),
+		Spans:   tracing.NewInMemoryExporter(),
+	}
+
+	for i := 0; i < n; i++ {
+		addr := Addr(i)
+		logs := logging.NewRecorder()
+
+		tr := c.Network.NewTransport(p2p.TCPTransportOpts{
+			ListenAddr:    addr,
+			HandshakeFunc: p2p.VersionHandshake(p2p.DefaultHello()),
+			Decoder:       p2p.DefaultDecoder{},
+			Logger:        logs.Logger(),
+		})
+
+		opts := server.FileServerOpts{
+			EncKey:            cryptography.NewEncryptionKey(),
+			StorageRoot:       t.TempDir(),
+			PathTransformFunc: store.CASPathTransformFunc,
+			Transport:         tr,
+			Logger:            logs.Logger(),
+			Tracer:            tracing.NewTracer(tracing.TracerOpts{ServiceName: addr, Exporter: c.Spans}),
+		}
+		for _, fn := range configure {
+			fn(i, &opts)
+		}
+
+		s := server.NewFileServer(opts)
+		tr.OnPeer = s.OnPeer
+		tr.OnPeerDisconnect = s.OnPeerDisconnect
+
+		c.Nodes = append(c.Nodes, s)
+		c.Logs = append(c.Logs, logs)
+	}
+
+	t.Cleanup(func() {
+		c.shutdown(t)
+		if t.Failed() {
+			for i, logs := range c.Logs {
+				t.Logf("logs of %s:\n%s", Addr(i), logs)
+			}
+		}
+	})
+
+	for _, s := range c.Nodes {
+		go s.Start()
+	}
+	c.waitFor(t, "nodes listening", func() bool {
+		for i := range c.Nodes {
+			if !c.Network.Listening(Addr(i)) {
+				return false
+			}
+		}
+		return true
+	})
+
+	// Node i dials the nodes before it: one connection per pair.
+	for i, s := range c.Nodes {
+		nodes := []string{}
+		for j := 0; j < i; j++ {
+			nodes = append(nodes, Addr(j))
+		}
+		s.SetBootstrapNodes(nodes)
+	}
+	c.waitFor(t, "full mesh", func() bool {
+		for _, s := range c.Nodes {
+			if len(s.Peers()) != n-1 {
+				return false
+			}
+		}
+		return true
+	})
+
+	return c
+}
+
+// Addr : listen address of the i-th node.
+func Addr(i int) string {
+	return fmt.Sprintf("node-%d", i)
+}
+
+// Faults : the fault injector of the cluster's network.
+func (c *Cluster) Faults() *p2p.FaultInjector {
+	return c.Network.Faults()
+}
+
+func (c *Cluster) waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(Timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("cluster: %s not reached in %s", what, Timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (c *Cluster) shutdown(t testing.TB) {
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i, s := range c.Nodes {
+		wg.Add(1)
+		go func(i int, s *server.FileServer) {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				t.Errorf("shutting down %s: %v", Addr(i), err)
+			}
+		}(i, s)
+	}
+	wg.Wait()
+}
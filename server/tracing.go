@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"io"
+
+	"github.com/PsychoPunkSage/NexNet/clock"
+	"github.com/PsychoPunkSage/NexNet/cryptography"
+	"github.com/PsychoPunkSage/NexNet/tracing"
+)
+
+// Store calls wrapped in spans. Keys are logged as given: plaintext for local files, hashed for
+// the copies held on behalf of peers.
+
+func (s *FileServer) storeRead(ctx context.Context, id, key string) (_ int64, _ io.Reader, err error) {
+	_, span := s.Tracer.Start(ctx, "storage.read", "owner_id", id, "key", key)
+	defer span.EndWithError(&err)
+
+	if err := s.waitDisk(ctx); err != nil {
+		return 0, nil, err
+	}
+	n, r, err := s.store.Read(id, key)
+	span.SetAttributes("bytes", n)
+	return n, r, err
+}
+
+func (s *FileServer) storeWrite(ctx context.Context, r io.Reader, id, key string) (_ int64, err error) {
+	_, span := s.Tracer.Start(ctx, "storage.write", "owner_id", id, "key", key)
+	defer span.EndWithError(&err)
+
+	if err := s.waitDisk(ctx); err != nil {
+		return 0, err
+	}
+	n, err := s.store.Write(r, id, key)
+	span.SetAttributes("bytes", n)
+	return n, err
+}
+
+// storeWriteDecrypt : decryption happens while writing, so it gets a single span.
+func (s *FileServer) storeWriteDecrypt(ctx context.Context, r io.Reader, id, key string) (_ int64, err error) {
+	_, span := s.Tracer.Start(ctx, "storage.write_decrypt", "owner_id", id, "key", key)
+	defer span.EndWithError(&err)
+
+	if err := s.waitDisk(ctx); err != nil {
+		return 0, err
+	}
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := cryptography.CopyDecrypt(s.EncKey, r, pw)
+		pw.CloseWithError(err)
+	}()
+
+	n, err := s.store.Write(pr, id, key)
+	// Unblocks the decryption if the write stopped early; r is the caller's again once it's done.
+	pr.Close()
+	<-done
+	span.SetAttributes("bytes", n)
+	return n, err
+}
+
+func (s *FileServer) storeDelete(ctx context.Context, id, key string) (err error) {
+	_, span := s.Tracer.Start(ctx, "storage.delete", "owner_id", id, "key", key)
+	defer span.EndWithError(&err)
+
+	if err := s.waitDisk(ctx); err != nil {
+		return err
+	}
+	return s.store.Delete(id, key)
+}
+
+// waitDisk : the delay of a (simulated) slow disk, see FileServerOpts.DiskLatency.
+func (s *FileServer) waitDisk(ctx context.Context) error {
+	if s.DiskLatency == nil {
+		return nil
+	}
+	return clock.Sleep(ctx, s.Clock, s.DiskLatency())
+}
+
+func (s *FileServer) copyEncrypt(ctx context.Context, src io.Reader, dst io.Writer) (_ int, err error) {
+	_, span := s.Tracer.Start(ctx, "cryptography.encrypt")
+	defer span.EndWithError(&err)
+
+	n, err := cryptography.CopyEncrypt(s.EncKey, src, dst)
+	span.SetAttributes("bytes", n)
+	return n, err
+}
+
+// withTrace : sets the trace & span IDs of the span carried by ctx on msg, for the peers' spans
+// to join the trace.
+func withTrace(ctx context.Context, msg *Message) {
+	sc := tracing.SpanContextFrom(ctx)
+	msg.TraceID = sc.TraceID
+	msg.SpanID = sc.SpanID
+}
@@ -0,0 +1,380 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/PsychoPunkSage/NexNet/membership"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Protobuf encoding of the messages, as wire.proto describes them. Empty fields are left out,
+// unknown ones skipped, so that fields can be added without breaking older nodes.
+
+// Field numbers of Message's payloads.
+const (
+	fieldStoreFile    protowire.Number = 10
+	fieldGetFile      protowire.Number = 11
+	fieldDeleteFile   protowire.Number = 12
+	fieldGoodbye      protowire.Number = 13
+	fieldPeerExchange protowire.Number = 14
+	fieldMembership   protowire.Number = 15
+	fieldError        protowire.Number = 16
+)
+
+// MarshalProto : implements p2p.ProtoMessage.
+func (m *Message) MarshalProto() ([]byte, error) {
+	var b []byte
+	b = appendString(b, 1, m.TraceID)
+	b = appendString(b, 2, m.SpanID)
+
+	switch p := m.Payload.(type) {
+	case MessageStoreFile:
+		b = appendMessage(b, fieldStoreFile, p.marshalProto())
+	case *MessageStoreFile:
+		b = appendMessage(b, fieldStoreFile, p.marshalProto())
+	case MessageGetFile:
+		b = appendMessage(b, fieldGetFile, p.marshalProto())
+	case *MessageGetFile:
+		b = appendMessage(b, fieldGetFile, p.marshalProto())
+	case MessageDeleteFile:
+		b = appendMessage(b, fieldDeleteFile, p.marshalProto())
+	case *MessageDeleteFile:
+		b = appendMessage(b, fieldDeleteFile, p.marshalProto())
+	case MessageGoodbye:
+		b = appendMessage(b, fieldGoodbye, p.marshalProto())
+	case *MessageGoodbye:
+		b = appendMessage(b, fieldGoodbye, p.marshalProto())
+	case MessagePeerExchange:
+		b = appendMessage(b, fieldPeerExchange, p.marshalProto())
+	case *MessagePeerExchange:
+		b = appendMessage(b, fieldPeerExchange, p.marshalProto())
+	case MessageMembership:
+		b = appendMessage(b, fieldMembership, p.marshalProto())
+	case *MessageMembership:
+		b = appendMessage(b, fieldMembership, p.marshalProto())
+	case MessageError:
+		b = appendMessage(b, fieldError, p.marshalProto())
+	case *MessageError:
+		b = appendMessage(b, fieldError, p.marshalProto())
+	default:
+		return nil, fmt.Errorf("no wire encoding for payload %T", m.Payload)
+	}
+	return b, nil
+}
+
+// UnmarshalProto : implements p2p.ProtoMessage. Payloads are decoded as pointers. A message
+// without a payload known to this build is an error.
+func (m *Message) UnmarshalProto(data []byte) error {
+	*m = Message{}
+	err := walkFields(data, func(f field) error {
+		var err error
+		switch f.num {
+		case 1:
+			m.TraceID = f.string()
+		case 2:
+			m.SpanID = f.string()
+		case fieldStoreFile:
+			p := new(MessageStoreFile)
+			m.Payload, err = p, p.unmarshalProto(f.bytes)
+		case fieldGetFile:
+			p := new(MessageGetFile)
+			m.Payload, err = p, p.unmarshalProto(f.bytes)
+		case fieldDeleteFile:
+			p := new(MessageDeleteFile)
+			m.Payload, err = p, p.unmarshalProto(f.bytes)
+		case fieldGoodbye:
+			p := new(MessageGoodbye)
+			m.Payload, err = p, p.unmarshalProto(f.bytes)
+		case fieldPeerExchange:
+			p := new(MessagePeerExchange)
+			m.Payload, err = p, p.unmarshalProto(f.bytes)
+		case fieldMembership:
+			p := new(MessageMembership)
+			m.Payload, err = p, p.unmarshalProto(f.bytes)
+		case fieldError:
+			p := new(MessageError)
+			m.Payload, err = p, p.unmarshalProto(f.bytes)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if m.Payload == nil {
+		return fmt.Errorf("message without a known payload")
+	}
+	return nil
+}
+
+func (m MessageStoreFile) marshalProto() []byte {
+	var b []byte
+	b = appendString(b, 1, m.ID)
+	b = appendString(b, 2, m.Key)
+	b = appendVarint(b, 3, uint64(m.Size))
+	b = appendString(b, 4, m.RequestID)
+	return appendBool(b, 5, m.Background)
+}
+
+func (m *MessageStoreFile) unmarshalProto(data []byte) error {
+	return walkFields(data, func(f field) error {
+		switch f.num {
+		case 1:
+			m.ID = f.string()
+		case 2:
+			m.Key = f.string()
+		case 3:
+			m.Size = int64(f.varint)
+		case 4:
+			m.RequestID = f.string()
+		case 5:
+			m.Background = f.varint != 0
+		}
+		return nil
+	})
+}
+
+func (m MessageGetFile) marshalProto() []byte {
+	return appendBool(marshalFileRef(m.ID, m.Key, m.RequestID), 4, m.Background)
+}
+
+func (m *MessageGetFile) unmarshalProto(data []byte) error {
+	if err := unmarshalFileRef(data, &m.ID, &m.Key, &m.RequestID); err != nil {
+		return err
+	}
+	return walkFields(data, func(f field) error {
+		if f.num == 4 {
+			m.Background = f.varint != 0
+		}
+		return nil
+	})
+}
+
+func (m MessageDeleteFile) marshalProto() []byte {
+	return marshalFileRef(m.ID, m.Key, m.RequestID)
+}
+
+func (m *MessageDeleteFile) unmarshalProto(data []byte) error {
+	return unmarshalFileRef(data, &m.ID, &m.Key, &m.RequestID)
+}
+
+// marshalFileRef : the fields GetFile and DeleteFile have in common.
+func marshalFileRef(id, key, requestID string) []byte {
+	var b []byte
+	b = appendString(b, 1, id)
+	b = appendString(b, 2, key)
+	return appendString(b, 3, requestID)
+}
+
+func unmarshalFileRef(data []byte, id, key, requestID *string) error {
+	return walkFields(data, func(f field) error {
+		switch f.num {
+		case 1:
+			*id = f.string()
+		case 2:
+			*key = f.string()
+		case 3:
+			*requestID = f.string()
+		}
+		return nil
+	})
+}
+
+func (m MessageGoodbye) marshalProto() []byte {
+	return appendString(nil, 1, m.ID)
+}
+
+func (m *MessageGoodbye) unmarshalProto(data []byte) error {
+	return walkFields(data, func(f field) error {
+		if f.num == 1 {
+			m.ID = f.string()
+		}
+		return nil
+	})
+}
+
+func (m MessagePeerExchange) marshalProto() []byte {
+	var b []byte
+	b = appendString(b, 1, m.ID)
+	b = appendString(b, 2, m.ListenAddr)
+	for _, peer := range m.Peers {
+		var p []byte
+		p = appendString(p, 1, peer.ID)
+		p = appendString(p, 2, peer.Addr)
+		b = appendMessage(b, 3, p)
+	}
+	return b
+}
+
+func (m *MessagePeerExchange) unmarshalProto(data []byte) error {
+	return walkFields(data, func(f field) error {
+		switch f.num {
+		case 1:
+			m.ID = f.string()
+		case 2:
+			m.ListenAddr = f.string()
+		case 3:
+			var peer PeerInfo
+			err := walkFields(f.bytes, func(f field) error {
+				switch f.num {
+				case 1:
+					peer.ID = f.string()
+				case 2:
+					peer.Addr = f.string()
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			m.Peers = append(m.Peers, peer)
+		}
+		return nil
+	})
+}
+
+func (m MessageMembership) marshalProto() []byte {
+	var b []byte
+	b = appendVarint(b, 1, uint64(m.Kind))
+	b = appendVarint(b, 2, m.Seq)
+	b = appendString(b, 3, m.From)
+	b = appendString(b, 4, m.Target)
+	for _, u := range m.Updates {
+		var p []byte
+		p = appendString(p, 1, u.ID)
+		p = appendString(p, 2, u.Addr)
+		p = appendVarint(p, 3, uint64(u.State))
+		p = appendVarint(p, 4, u.Incarnation)
+		b = appendMessage(b, 5, p)
+	}
+	return b
+}
+
+func (m *MessageMembership) unmarshalProto(data []byte) error {
+	return walkFields(data, func(f field) error {
+		switch f.num {
+		case 1:
+			m.Kind = membership.Kind(f.varint)
+		case 2:
+			m.Seq = f.varint
+		case 3:
+			m.From = f.string()
+		case 4:
+			m.Target = f.string()
+		case 5:
+			var u membership.Update
+			err := walkFields(f.bytes, func(f field) error {
+				switch f.num {
+				case 1:
+					u.ID = f.string()
+				case 2:
+					u.Addr = f.string()
+				case 3:
+					u.State = membership.State(f.varint)
+				case 4:
+					u.Incarnation = f.varint
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			m.Updates = append(m.Updates, u)
+		}
+		return nil
+	})
+}
+
+func (m MessageError) marshalProto() []byte {
+	var b []byte
+	b = appendString(b, 1, m.RequestID)
+	b = appendString(b, 2, m.Key)
+	return appendString(b, 3, m.Reason)
+}
+
+func (m *MessageError) unmarshalProto(data []byte) error {
+	return walkFields(data, func(f field) error {
+		switch f.num {
+		case 1:
+			m.RequestID = f.string()
+		case 2:
+			m.Key = f.string()
+		case 3:
+			m.Reason = f.string()
+		}
+		return nil
+	})
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if len(s) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	return appendVarint(b, num, 1)
+}
+
+// appendMessage : an embedded message, written even if empty (e.g. for a oneof).
+func appendMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+// field : a field of an encoded message. Only varint and length-delimited fields are used.
+type field struct {
+	num    protowire.Number
+	varint uint64
+	bytes  []byte
+}
+
+func (f field) string() string {
+	return string(f.bytes)
+}
+
+// walkFields : calls fn with every varint and length-delimited field of data, in order; fields of
+// other types are skipped.
+func walkFields(data []byte, fn func(field) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		f := field{num: num}
+		switch typ {
+		case protowire.VarintType:
+			f.varint, n = protowire.ConsumeVarint(data)
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		if typ != protowire.VarintType && typ != protowire.BytesType {
+			continue
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package server_test
+
+import (
+	"encoding/hex"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/PsychoPunkSage/NexNet/membership"
+	"github.com/PsychoPunkSage/NexNet/p2p"
+	"github.com/PsychoPunkSage/NexNet/server"
+	"github.com/stretchr/testify/assert"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of testdata/wire")
+
+// wireMessages : one of each payload, as decoded (pointers), by golden file name.
+var wireMessages = map[string]*server.Message{
+	"store_file": {
+		Payload: &server.MessageStoreFile{ID: "node-a", Key: "5f2b", Size: 1 << 20, RequestID: "req-1"},
+		TraceID: "4bf92f3577b34da6a3ce929d0e0e4736",
+		SpanID:  "00f067aa0ba902b7",
+	},
+	"get_file":    {Payload: &server.MessageGetFile{ID: "node-a", Key: "5f2b", RequestID: "req-2", Background: true}},
+	"delete_file": {Payload: &server.MessageDeleteFile{ID: "node-a", Key: "5f2b"}},
+	"goodbye":     {Payload: &server.MessageGoodbye{ID: "node-a"}},
+	"peer_exchange": {Payload: &server.MessagePeerExchange{
+		ID:         "node-a",
+		ListenAddr: ":3000",
+		Peers:      []server.PeerInfo{{ID: "node-b", Addr: "10.0.0.2:3000"}, {ID: "node-c", Addr: "quic://10.0.0.3:4000"}},
+	}},
+	"error": {Payload: &server.MessageError{RequestID: "req-1", Key: "5f2b", Reason: "rate limited"}},
+	"membership": {Payload: &server.MessageMembership{
+		Kind:   membership.PingReq,
+		Seq:    42,
+		From:   "node-a",
+		Target: "node-c",
+		Updates: []membership.Update{
+			{ID: "node-a", Addr: ":3000", State: membership.Alive, Incarnation: 7},
+			{ID: "node-c", Addr: ":3002", State: membership.Suspect, Incarnation: 3},
+		},
+	}},
+}
+
+// TestWireGolden : the encoding of the messages is that of wire.proto, and must not change
+// (run with -update once a change is intended, e.g. a new field).
+func TestWireGolden(t *testing.T) {
+	for name, msg := range wireMessages {
+		path := filepath.Join("testdata", "wire", name+".hex")
+
+		b, err := msg.MarshalProto()
+		assert.Nil(t, err, name)
+		if *update {
+			assert.Nil(t, os.WriteFile(path, []byte(hex.EncodeToString(b)+"\n"), 0o644))
+		}
+
+		golden, err := os.ReadFile(path)
+		if !assert.Nil(t, err, name) {
+			continue
+		}
+		want, err := hex.DecodeString(strings.TrimSpace(string(golden)))
+		assert.Nil(t, err, name)
+		assert.Equal(t, want, b, name)
+
+		var decoded server.Message
+		assert.Nil(t, decoded.UnmarshalProto(want), name)
+		assert.Equal(t, msg, &decoded, name)
+	}
+}
+
+func TestWireValuePayloads(t *testing.T) {
+	// Payloads are sent as values, and received as pointers.
+	b, err := p2p.ProtoCodec{}.Marshal(&server.Message{Payload: server.MessageGoodbye{ID: "node-a"}})
+	assert.Nil(t, err)
+
+	var msg server.Message
+	assert.Nil(t, p2p.ProtoCodec{}.Unmarshal(b, &msg))
+	assert.Equal(t, &server.MessageGoodbye{ID: "node-a"}, msg.Payload)
+}
+
+func TestWireUnknownFields(t *testing.T) {
+	// From a newer node: fields this build doesn't know, in the message (3, varint) and in the
+	// Goodbye payload (2, bytes, and 3, fixed64).
+	newer := []byte{
+		0x18, 0x01,
+		0x6a, 0x14,
+		0x0a, 0x06, 'n', 'o', 'd', 'e', '-', 'a',
+		0x12, 0x01, 'x',
+		0x19, 1, 2, 3, 4, 5, 6, 7, 8,
+	}
+	var msg server.Message
+	assert.Nil(t, msg.UnmarshalProto(newer))
+	assert.Equal(t, &server.MessageGoodbye{ID: "node-a"}, msg.Payload)
+
+	// A payload unknown to this build.
+	assert.NotNil(t, msg.UnmarshalProto([]byte{0x0a, 0x01, 'x', 0xa2, 0x06, 0x00}))
+	// Garbage.
+	assert.NotNil(t, msg.UnmarshalProto([]byte{0x0a, 0x7f}))
+}
@@ -0,0 +1,578 @@
+// Package sim runs FileServer clusters as a discrete-event simulation: the nodes share a virtual
+// clock (clock.Virtual) which only moves once they are all waiting on it, and every random
+// choice (operations, crashes, partitions, slow disks, network faults) comes from a seed. A run
+// that breaks an invariant can be replayed from its seed.
+package sim
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/PsychoPunkSage/NexNet/clock"
+	"github.com/PsychoPunkSage/NexNet/p2p"
+	"github.com/PsychoPunkSage/NexNet/server"
+	store "github.com/PsychoPunkSage/NexNet/storage"
+)
+
+// Virtual time the simulations start at.
+var Epoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+const (
+	// Real time without any new timer after which the nodes are deemed all blocked, waiting on
+	// the virtual clock.
+	settleTime   = time.Millisecond
+	settleRounds = 3
+	// Real time an operation may take before the run fails as stuck.
+	stuckTimeout = 10 * time.Second
+	// Virtual time given to the work left running by an operation.
+	quiesceHorizon = time.Second
+	// Keys stored per node are picked among that many, so that keys get overwritten.
+	keySpace     = 8
+	maxValueSize = 4 << 10
+)
+
+type Opts struct {
+	Seed int64
+	// Defaults to 3.
+	Nodes int
+	// Number of random events; defaults to 100.
+	Steps int
+	// Where the nodes store their files; defaults to a temporary directory, removed by Close.
+	Dir string
+	// Logger of the nodes; defaults to discarding everything.
+	Logger *slog.Logger
+}
+
+// Simulation : one seeded run over a cluster.
+type Simulation struct {
+	Opts
+
+	Clock   *clock.Virtual
+	Network *p2p.MemNetwork
+
+	rnd     *rand.Rand
+	nodes   []*node
+	tempDir bool
+	// Owner node & key -> values a Get may return: the last one whose Store was acknowledged,
+	// and those of the failed Stores since (they may or may not have been applied).
+	acked   map[ackedKey][][]byte
+	history []string
+}
+
+type ackedKey struct {
+	node int
+	key  string
+}
+
+type node struct {
+	addr   string
+	id     string
+	encKey []byte
+	root   string
+	// Nil while crashed.
+	server *server.FileServer
+	// Nanoseconds of (virtual) latency of every disk operation.
+	diskLatency atomic.Int64
+}
+
+// Failure : an invariant broken (or an operation stuck) during a run.
+type Failure struct {
+	Seed int64
+	Step int
+	Err  error
+	// Every event of the run up to the failure.
+	History []string
+}
+
+func (f *Failure) Error() string {
+	return fmt.Sprintf("simulation seed %d failed at step %d: %v\nhistory:\n  %s",
+		f.Seed, f.Step, f.Err, strings.Join(f.History, "\n  "))
+}
+
+func (f *Failure) Unwrap() error {
+	return f.Err
+}
+
+// ErrStuck : an operation didn't return while every node was idle and no timer was left.
+var ErrStuck = errors.New("operation stuck")
+
+// Run : runs a simulation and cleans it up; a broken invariant is returned as a *Failure.
+func Run(opts Opts) error {
+	s, err := New(opts)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	return s.Run()
+}
+
+// New : creates the nodes and starts them, fully connected.
+func New(opts Opts) (*Simulation, error) {
+	if opts.Nodes == 0 {
+		opts.Nodes = 3
+	}
+	if opts.Steps == 0 {
+		opts.Steps = 100
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+
+	s := &Simulation{
+		Opts:  opts,
+		Clock: clock.NewVirtual(Epoch),
+		rnd:   rand.New(rand.NewSource(opts.Seed)),
+		acked: make(map[ackedKey][][]byte),
+	}
+	s.Network = p2p.NewMemNetwork(p2p.MemNetworkOpts{Seed: opts.Seed, Clock: s.Clock})
+
+	if len(s.Dir) == 0 {
+		dir, err := os.MkdirTemp("", "nexnet-sim-")
+		if err != nil {
+			return nil, err
+		}
+		s.Dir = dir
+		s.tempDir = true
+	}
+
+	for i := 0; i < s.Nodes; i++ {
+		n := &node{
+			addr:   fmt.Sprintf("node-%d", i),
+			id:     s.randomHex(32),
+			encKey: s.randomBytes(32),
+		}
+		n.root = filepath.Join(s.Dir, n.addr)
+		s.nodes = append(s.nodes, n)
+	}
+
+	for i := range s.nodes {
+		if err := s.start(i); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Run : plays Steps random events, checking the invariants after each one.
+func (s *Simulation) Run() error {
+	for step := 0; step < s.Steps; step++ {
+		if err := s.step(); err != nil {
+			return &Failure{Seed: s.Seed, Step: step, Err: err, History: s.History()}
+		}
+	}
+	return nil
+}
+
+// History : the events played so far, with their virtual time and outcome.
+func (s *Simulation) History() []string {
+	return append([]string(nil), s.history...)
+}
+
+// Close : shuts every node down, and removes the temporary directory if any.
+func (s *Simulation) Close() error {
+	for i, n := range s.nodes {
+		if n.server != nil {
+			s.crash(i)
+		}
+	}
+	if s.tempDir {
+		return os.RemoveAll(s.Dir)
+	}
+	return nil
+}
+
+func (s *Simulation) record(format string, args ...any) {
+	at := s.Clock.Since(Epoch)
+	s.history = append(s.history, fmt.Sprintf("[%s] ", at)+fmt.Sprintf(format, args...))
+}
+
+// step : one random event.
+func (s *Simulation) step() error {
+	switch p := s.rnd.Float64(); {
+	case p < 0.35:
+		return s.store()
+	case p < 0.60:
+		return s.get()
+	case p < 0.65:
+		return s.remove()
+	case p < 0.70:
+		return s.crashRandom()
+	case p < 0.80:
+		return s.restartRandom()
+	case p < 0.84:
+		s.partition()
+	case p < 0.88:
+		s.heal()
+	case p < 0.91:
+		s.slowLink()
+	case p < 0.95:
+		s.slowDisk()
+	default:
+		d := time.Duration(s.rnd.Int63n(int64(2 * time.Second)))
+		s.record("wait %s", d)
+		s.advance(d)
+	}
+	return nil
+}
+
+func (s *Simulation) store() error {
+	i, ok := s.aliveNode()
+	if !ok {
+		return nil
+	}
+	key := fmt.Sprintf("key-%d", s.rnd.Intn(keySpace))
+	value := s.randomBytes(1 + s.rnd.Intn(maxValueSize))
+
+	var err error
+	if opErr := s.do(func() {
+		err = s.nodes[i].server.Store(context.Background(), key, bytes.NewReader(value))
+	}); opErr != nil {
+		return fmt.Errorf("store %s on %s: %w", key, s.nodes[i].addr, opErr)
+	}
+	s.record("store %s on %s (%d bytes): %v", key, s.nodes[i].addr, len(value), outcome(err))
+
+	k := ackedKey{i, key}
+	if err == nil {
+		s.acked[k] = [][]byte{value}
+	} else if _, ok := s.acked[k]; ok {
+		s.acked[k] = append(s.acked[k], value)
+	}
+	return nil
+}
+
+// get : invariant, every acknowledged Store is readable (with its last value) from its owner.
+func (s *Simulation) get() error {
+	k, ok := s.ackedKey()
+	if !ok {
+		return nil
+	}
+	n := s.nodes[k.node]
+
+	var (
+		got []byte
+		err error
+	)
+	if opErr := s.do(func() {
+		var r io.Reader
+		if r, err = n.server.Get(context.Background(), k.key); err != nil {
+			return
+		}
+		got, err = io.ReadAll(r)
+		if rc, ok := r.(io.ReadCloser); ok {
+			rc.Close()
+		}
+	}); opErr != nil {
+		return fmt.Errorf("get %s on %s: %w", k.key, n.addr, opErr)
+	}
+	s.record("get %s on %s: %v", k.key, n.addr, outcome(err))
+
+	if err != nil {
+		return fmt.Errorf("acknowledged %s of %s not readable: %w", k.key, n.addr, err)
+	}
+	for _, value := range s.acked[k] {
+		if bytes.Equal(got, value) {
+			// Whatever failed Store got applied, that's the value from now on.
+			s.acked[k] = [][]byte{value}
+			return nil
+		}
+	}
+	return fmt.Errorf("acknowledged %s of %s reads %d bytes that match none of the %d values stored", k.key, n.addr, len(got), len(s.acked[k]))
+}
+
+func (s *Simulation) remove() error {
+	k, ok := s.ackedKey()
+	if !ok {
+		return nil
+	}
+	n := s.nodes[k.node]
+
+	var err error
+	if opErr := s.do(func() {
+		err = n.server.Remove(context.Background(), k.key)
+	}); opErr != nil {
+		return fmt.Errorf("remove %s on %s: %w", k.key, n.addr, opErr)
+	}
+	s.record("remove %s on %s: %v", k.key, n.addr, outcome(err))
+
+	// Once removed, or maybe removed, there's nothing left to check.
+	delete(s.acked, k)
+	return nil
+}
+
+// crashRandom : stops a node abruptly, keeping at least one alive.
+func (s *Simulation) crashRandom() error {
+	alive := s.alive()
+	if len(alive) < 2 {
+		return nil
+	}
+	i := alive[s.rnd.Intn(len(alive))]
+	s.crash(i)
+	s.record("crash %s", s.nodes[i].addr)
+	return nil
+}
+
+func (s *Simulation) restartRandom() error {
+	crashed := []int{}
+	for i, n := range s.nodes {
+		if n.server == nil {
+			crashed = append(crashed, i)
+		}
+	}
+	if len(crashed) == 0 {
+		return nil
+	}
+	i := crashed[s.rnd.Intn(len(crashed))]
+	s.record("restart %s", s.nodes[i].addr)
+	return s.start(i)
+}
+
+// partition : splits the nodes in two random groups.
+func (s *Simulation) partition() {
+	groups := [2][]string{}
+	for _, i := range s.rnd.Perm(len(s.nodes)) {
+		g := s.rnd.Intn(2)
+		groups[g] = append(groups[g], s.nodes[i].addr)
+	}
+	s.Network.Faults().Partition(groups[0], groups[1])
+	s.record("partition %v | %v", groups[0], groups[1])
+}
+
+// heal : ends the partition, and reconnects the nodes that lost each other meanwhile.
+func (s *Simulation) heal() {
+	s.Network.Faults().Heal()
+	s.record("heal")
+	s.connect()
+}
+
+// slowLink : adds latency to the traffic from a node to another, until the next heal.
+func (s *Simulation) slowLink() {
+	from, to := s.nodes[s.rnd.Intn(len(s.nodes))], s.nodes[s.rnd.Intn(len(s.nodes))]
+	latency := time.Duration(s.rnd.Int63n(int64(100 * time.Millisecond)))
+	jitter := time.Duration(s.rnd.Int63n(int64(20 * time.Millisecond)))
+	s.Network.Faults().SetLink(from.addr, to.addr, p2p.Faults{Latency: latency, Jitter: jitter})
+	s.record("link %s -> %s takes %s (+%s)", from.addr, to.addr, latency, jitter)
+}
+
+func (s *Simulation) slowDisk() {
+	n := s.nodes[s.rnd.Intn(len(s.nodes))]
+	d := time.Duration(s.rnd.Int63n(int64(200 * time.Millisecond)))
+	n.diskLatency.Store(int64(d))
+	s.record("disk of %s takes %s", n.addr, d)
+}
+
+// start : (re)starts the i-th node on its storage.
+func (s *Simulation) start(i int) error {
+	n := s.nodes[i]
+
+	tr := s.Network.NewTransport(p2p.TCPTransportOpts{
+		ListenAddr:    n.addr,
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+		Logger:        s.Logger,
+	})
+	fs := server.NewFileServer(server.FileServerOpts{
+		ID:                n.id,
+		EncKey:            n.encKey,
+		StorageRoot:       n.root,
+		PathTransformFunc: store.CASPathTransformFunc,
+		Transport:         tr,
+		Logger:            s.Logger,
+		Clock:             s.Clock,
+		DiskLatency: func() time.Duration {
+			return time.Duration(n.diskLatency.Load())
+		},
+	})
+	tr.OnPeer = fs.OnPeer
+	tr.OnPeerDisconnect = fs.OnPeerDisconnect
+
+	go fs.Start()
+	deadline := time.Now().Add(stuckTimeout)
+	for !s.Network.Listening(n.addr) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s not listening", n.addr)
+		}
+		time.Sleep(settleTime)
+	}
+	n.server = fs
+
+	s.connect()
+	return nil
+}
+
+// crash : cuts every connection of the i-th node, then stops it (it can't say goodbye).
+func (s *Simulation) crash(i int) {
+	n := s.nodes[i]
+	for _, other := range s.nodes {
+		s.Network.Faults().Kill(n.addr, other.addr)
+	}
+
+	// Handlers may be waiting on the clock (e.g. a slow disk): keep it going until stopped.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.do(func() { n.server.Shutdown(ctx) })
+	n.server = nil
+
+	// Let the peers notice.
+	s.settle()
+}
+
+// connect : makes every pair of alive nodes, not partitioned, connected.
+func (s *Simulation) connect() {
+	alive := s.alive()
+	for a, i := range alive {
+		for _, j := range alive[a+1:] {
+			from, to := s.nodes[j], s.nodes[i]
+			if s.Network.Faults().Partitioned(from.addr, to.addr) || connected(from.server, to.addr) {
+				continue
+			}
+			if err := from.server.Transport.Dial(to.addr); err != nil {
+				s.record("dial %s -> %s: %v", from.addr, to.addr, err)
+			}
+		}
+	}
+
+	// Let the connections be registered on both sides.
+	s.settle()
+}
+
+func connected(s *server.FileServer, addr string) bool {
+	for _, peer := range s.Peers() {
+		if peer == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// do : runs op, advancing the virtual clock whenever the nodes are all blocked on it.
+func (s *Simulation) do(op func()) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		op()
+	}()
+
+	deadline := time.Now().Add(stuckTimeout)
+	for {
+		s.settle()
+		select {
+		case <-done:
+			s.quiesce()
+			return nil
+		default:
+		}
+		if !s.Clock.AdvanceToNext() && time.Now().After(deadline) {
+			return ErrStuck
+		}
+	}
+}
+
+// advance : lets d of virtual time pass.
+func (s *Simulation) advance(d time.Duration) {
+	target := s.Clock.Now().Add(d)
+	s.runUntil(target)
+	s.Clock.Advance(target.Sub(s.Clock.Now()))
+}
+
+// quiesce : lets what an operation left running (e.g. peers writing their replica) finish, so
+// that it doesn't overlap with the next event.
+func (s *Simulation) quiesce() {
+	s.runUntil(s.Clock.Now().Add(quiesceHorizon))
+}
+
+// runUntil : fires in order the timers due by target, letting the nodes settle after each.
+func (s *Simulation) runUntil(target time.Time) {
+	for {
+		s.settle()
+		next, ok := s.Clock.Next()
+		if !ok || next.After(target) {
+			return
+		}
+		s.Clock.AdvanceToNext()
+	}
+}
+
+// settle : waits until no new timer shows up for settleRounds*settleTime, i.e. the nodes are
+// idle. The only heuristic of the simulator: a goroutine not scheduled for that long would make
+// the clock move too early, and the run diverge.
+func (s *Simulation) settle() {
+	created := s.Clock.Created()
+	for quiet := 0; quiet < settleRounds; {
+		time.Sleep(settleTime)
+		runtime.Gosched()
+		if now := s.Clock.Created(); now != created {
+			created, quiet = now, 0
+			continue
+		}
+		quiet++
+	}
+}
+
+func (s *Simulation) alive() []int {
+	alive := []int{}
+	for i, n := range s.nodes {
+		if n.server != nil {
+			alive = append(alive, i)
+		}
+	}
+	return alive
+}
+
+func (s *Simulation) aliveNode() (int, bool) {
+	alive := s.alive()
+	if len(alive) == 0 {
+		return 0, false
+	}
+	return alive[s.rnd.Intn(len(alive))], true
+}
+
+// ackedKey : a random acknowledged key whose owner is alive, picked in a stable order.
+func (s *Simulation) ackedKey() (ackedKey, bool) {
+	keys := []ackedKey{}
+	for i, n := range s.nodes {
+		if n.server == nil {
+			continue
+		}
+		for k := 0; k < keySpace; k++ {
+			key := ackedKey{i, fmt.Sprintf("key-%d", k)}
+			if _, ok := s.acked[key]; ok {
+				keys = append(keys, key)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return ackedKey{}, false
+	}
+	return keys[s.rnd.Intn(len(keys))], true
+}
+
+func (s *Simulation) randomBytes(n int) []byte {
+	b := make([]byte, n)
+	s.rnd.Read(b)
+	return b
+}
+
+func (s *Simulation) randomHex(n int) string {
+	return hex.EncodeToString(s.randomBytes(n))
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return "ok"
+}
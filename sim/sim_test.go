@@ -0,0 +1,39 @@
+package sim
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	seed  = flag.Int64("sim.seed", 1, "seed of the first simulation")
+	runs  = flag.Int("sim.runs", 5, "number of simulations, with consecutive seeds")
+	steps = flag.Int("sim.steps", 100, "events per simulation")
+)
+
+// Thousands of scenarios: go test ./sim -sim.runs=5000
+// Replaying a failure: go test ./sim -run TestSimulations -sim.seed=<seed> -sim.runs=1 -v
+func TestSimulations(t *testing.T) {
+	for i := 0; i < *runs; i++ {
+		if err := Run(Opts{Seed: *seed + int64(i), Steps: *steps}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSimulationReplays(t *testing.T) {
+	history := func() []string {
+		s, err := New(Opts{Seed: 42, Steps: 50})
+		assert.Nil(t, err)
+		defer s.Close()
+
+		assert.Nil(t, s.Run())
+		return s.History()
+	}
+
+	first := history()
+	assert.NotEmpty(t, first)
+	assert.Equal(t, first, history())
+}
@@ -0,0 +1,47 @@
+package storage
+
+import "io"
+
+// Backend : where a node keeps objects, by owner ID and key. Store keeps them on the local
+// filesystem; Memory in memory, for tests.
+type Backend interface {
+	Has(id, key string) bool
+	Stat(id, key string) (ObjectInfo, error)
+	// Read : size of the object under (id, key) and a reader of it, to close if an io.Closer.
+	Read(id, key string) (int64, io.Reader, error)
+	// ReadAt : as io.ReaderAt, in the object under (id, key).
+	ReadAt(id, key string, p []byte, off int64) (int, error)
+	// Write : replaces the object under (id, key) with the bytes of r. A failed write leaves the
+	// object as it was.
+	Write(r io.Reader, id, key string) (int64, error)
+	// Delete : removes the object under (id, key); deleting a missing object is not an error.
+	Delete(id, key string) error
+	List(id string) ([]ObjectInfo, error)
+	// Usage : of every owner ID with objects stored, by ID.
+	Usage() []UsageInfo
+}
+
+// QuotaBackend : a Backend enforcing quotas on the owner IDs, see Quota.
+type QuotaBackend interface {
+	Backend
+	SetQuotas(quota Quota, byID map[string]Quota)
+	QuotaOf(id string) Quota
+	// CheckQuota : whether writing size bytes under (id, key) stays within the hard quota of id.
+	CheckQuota(id, key string, size int64) error
+}
+
+// VerifyingBackend : a Backend keeping checksums of its objects, see ErrCorrupt.
+type VerifyingBackend interface {
+	Backend
+	// Verify : reads the object under (id, key) whole, failing with a *CorruptionError if it
+	// doesn't match its checksum.
+	Verify(id, key string) error
+	// Quarantine : sets the object under (id, key) aside, out of the objects stored.
+	Quarantine(id, key string) error
+}
+
+var (
+	_ QuotaBackend     = (*Store)(nil)
+	_ VerifyingBackend = (*Store)(nil)
+	_ Backend          = (*Memory)(nil)
+)
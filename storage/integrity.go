@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Objects found corrupt are moved under Root/quarantineDir/<id>, out of the way of the Store.
+const quarantineDir = ".quarantine"
+
+// ErrCorrupt : matched (errors.Is) by the *CorruptionError of objects whose bytes on disk aren't
+// the ones written.
+var ErrCorrupt = errors.New("object corrupt")
+
+// CorruptionError : the object under (ID, Key) doesn't match the checksum recorded when written.
+type CorruptionError struct {
+	ID  string
+	Key string
+	// SHA-256 checksums, hex encoded: recorded, and of the bytes read.
+	Want string
+	Got  string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("object (%s) of %s: %v (sha256 is %s, want %s)", e.Key, e.ID, ErrCorrupt, e.Got, e.Want)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return ErrCorrupt
+}
+
+// verifyingReader : checks the object read against its checksum once at EOF, failing with a
+// *CorruptionError instead of io.EOF if they differ.
+type verifyingReader struct {
+	f    *os.File
+	hash hash.Hash
+	err  *CorruptionError
+	// Set once EOF is reached.
+	done error
+}
+
+func newVerifyingReader(f *os.File, id, key, sum string) *verifyingReader {
+	return &verifyingReader{
+		f:    f,
+		hash: sha256.New(),
+		err:  &CorruptionError{ID: id, Key: key, Want: sum},
+	}
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	if r.done != nil {
+		return 0, r.done
+	}
+
+	n, err := r.f.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF {
+		r.done = io.EOF
+		if got := hex.EncodeToString(r.hash.Sum(nil)); got != r.err.Want {
+			r.err.Got = got
+			r.done = r.err
+		}
+		err = r.done
+	}
+	return n, err
+}
+
+func (r *verifyingReader) Close() error {
+	return r.f.Close()
+}
+
+// Verify : reads the object under (id, key) through, failing with a *CorruptionError if it doesn't
+// match its checksum. Objects written before checksums were recorded always pass.
+func (s *Store) Verify(id, key string) error {
+	_, r, err := s.readStream(id, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	_, err = io.Copy(io.Discard, r)
+	return err
+}
+
+// Quarantine : moves the object under (id, key) and its sidecar out of the Store, to be looked at
+// (e.g. once found corrupt); it's then as if deleted.
+func (s *Store) Quarantine(id, key string) error {
+	if err := checkID(id); err != nil {
+		return err
+	}
+	size, exists := s.objectSize(id, key)
+	if !exists {
+		return fs.ErrNotExist
+	}
+
+	path, pathKey := s.fullPath(id, key), s.PathTransformFunc(key)
+	to := filepath.Join(s.Root, quarantineDir, id, pathKey.FullPath())
+	if err := os.MkdirAll(filepath.Dir(to), os.ModePerm); err != nil {
+		return err
+	}
+	if err := rename(path, to); err != nil {
+		return err
+	}
+	// The object is out already: accounted for as such whatever becomes of its sidecar.
+	s.addUsage(id, Usage{Bytes: -size, Objects: -1})
+	s.pruneDirs(filepath.Dir(path))
+	s.Logger.Warn("object quarantined", "owner_id", id, "key", key, "path", to)
+
+	// Objects written before sidecars were kept have none.
+	meta := s.metaPath(path)
+	if err := rename(meta, to+metaFileExt); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	s.pruneDirs(filepath.Dir(meta))
+	return nil
+}
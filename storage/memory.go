@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Memory : a Backend keeping objects in memory, lost with the process. Meant for tests; it has
+// neither quotas nor checksums.
+type Memory struct {
+	lock    sync.RWMutex
+	objects map[string]map[string]memObject // by owner ID, then key
+}
+
+type memObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{objects: make(map[string]map[string]memObject)}
+}
+
+func (m *Memory) get(id, key string) (memObject, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	obj, ok := m.objects[id][key]
+	if !ok {
+		return memObject{}, fmt.Errorf("object (%s) of %s: %w", key, id, fs.ErrNotExist)
+	}
+	return obj, nil
+}
+
+func (m *Memory) Has(id, key string) bool {
+	_, err := m.get(id, key)
+	return err == nil
+}
+
+func (m *Memory) Stat(id, key string) (ObjectInfo, error) {
+	obj, err := m.get(id, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Key: key, Size: int64(len(obj.data)), ModTime: obj.modTime}, nil
+}
+
+func (m *Memory) Read(id, key string) (int64, io.Reader, error) {
+	obj, err := m.get(id, key)
+	if err != nil {
+		return 0, nil, err
+	}
+	// Never written to: a Write replaces the slice.
+	return int64(len(obj.data)), bytes.NewReader(obj.data), nil
+}
+
+func (m *Memory) ReadAt(id, key string, p []byte, off int64) (int, error) {
+	obj, err := m.get(id, key)
+	if err != nil {
+		return 0, err
+	}
+	return bytes.NewReader(obj.data).ReadAt(p, off)
+}
+
+func (m *Memory) Write(r io.Reader, id, key string) (int64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.objects[id] == nil {
+		m.objects[id] = make(map[string]memObject)
+	}
+	m.objects[id][key] = memObject{data: data, modTime: time.Now()}
+	return int64(len(data)), nil
+}
+
+func (m *Memory) Delete(id, key string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.objects[id], key)
+	if len(m.objects[id]) == 0 {
+		delete(m.objects, id)
+	}
+	return nil
+}
+
+func (m *Memory) List(id string) ([]ObjectInfo, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	objects := []ObjectInfo{}
+	for key, obj := range m.objects[id] {
+		objects = append(objects, ObjectInfo{Key: key, Size: int64(len(obj.data)), ModTime: obj.modTime})
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (m *Memory) Usage() []UsageInfo {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	infos := []UsageInfo{}
+	for id, objects := range m.objects {
+		info := UsageInfo{ID: id}
+		for _, obj := range objects {
+			info.Usage.Bytes += int64(len(obj.data))
+			info.Usage.Objects++
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
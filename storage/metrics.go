@@ -0,0 +1,18 @@
+package storage
+
+// Metrics : instrumentation hooks of a Store.
+type Metrics interface {
+	// Bytes taken on disk by the objects of an owner ID, set whenever it changes.
+	SetDiskUsage(id string, bytes int64)
+	// Objects stored under an owner ID, set whenever it changes.
+	SetObjectCount(id string, n int64)
+	// An owner ID went over its "soft" quota, or a write was refused for its "hard" one.
+	CountQuotaExceeded(id, quota string)
+}
+
+// NopMetrics : default Metrics, recording nothing.
+type NopMetrics struct{}
+
+func (NopMetrics) SetDiskUsage(string, int64)        {}
+func (NopMetrics) SetObjectCount(string, int64)      {}
+func (NopMetrics) CountQuotaExceeded(string, string) {}
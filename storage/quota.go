@@ -0,0 +1,203 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// ErrQuotaExceeded : matched (errors.Is) by the *QuotaError of writes over a hard quota.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Quota : limits on what an owner ID stores; 0 means unlimited. Going over a soft limit is only
+// logged and counted (see Metrics), writes that would go over a hard one fail with a *QuotaError.
+type Quota struct {
+	SoftBytes   int64
+	HardBytes   int64
+	SoftObjects int64
+	HardObjects int64
+}
+
+// QuotaError : a write under ID was refused for going over its hard quota.
+type QuotaError struct {
+	ID    string
+	Usage Usage
+	Quota Quota
+	// Bytes the write would have taken.
+	Size int64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("owner %s: %v (writing %d bytes; %d bytes in %d objects stored, hard quota is %s bytes, %s objects)",
+		e.ID, ErrQuotaExceeded, e.Size, e.Usage.Bytes, e.Usage.Objects, formatLimit(e.Quota.HardBytes), formatLimit(e.Quota.HardObjects))
+}
+
+func (e *QuotaError) Unwrap() error {
+	return ErrQuotaExceeded
+}
+
+func formatLimit(n int64) string {
+	if n == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprint(n)
+}
+
+// UsageInfo : usage and quota of an owner ID.
+type UsageInfo struct {
+	ID    string
+	Usage Usage
+	Quota Quota
+}
+
+// SetQuotas : quota of every owner ID, but those of byID. Applies to the writes to come.
+func (s *Store) SetQuotas(quota Quota, byID map[string]Quota) {
+	s.usageLock.Lock()
+	defer s.usageLock.Unlock()
+
+	s.Quota, s.Quotas = quota, byID
+}
+
+// QuotaOf : quota of id.
+func (s *Store) QuotaOf(id string) Quota {
+	s.usageLock.Lock()
+	defer s.usageLock.Unlock()
+
+	return s.quotaOf(id)
+}
+
+func (s *Store) quotaOf(id string) Quota {
+	if q, ok := s.Quotas[id]; ok {
+		return q
+	}
+	return s.Quota
+}
+
+// StatUsage : usage and quota of id.
+func (s *Store) StatUsage(id string) UsageInfo {
+	s.usageLock.Lock()
+	defer s.usageLock.Unlock()
+
+	return UsageInfo{ID: id, Usage: s.usage[id], Quota: s.quotaOf(id)}
+}
+
+// Usage : usage and quota of every owner ID with objects stored, by ID.
+func (s *Store) Usage() []UsageInfo {
+	s.usageLock.Lock()
+	defer s.usageLock.Unlock()
+
+	infos := []UsageInfo{}
+	for id, u := range s.usage {
+		if u.Objects > 0 {
+			infos = append(infos, UsageInfo{ID: id, Usage: u, Quota: s.quotaOf(id)})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// CheckQuota : whether writing size bytes under (id, key) stays within the hard quota of id, the
+// object replacing any stored there, given the writes in progress. Lets callers refuse a write
+// before the data is streamed; Write checks again as the bytes come.
+func (s *Store) CheckQuota(id, key string, size int64) error {
+	oldSize, exists := s.objectSize(id, key)
+
+	s.usageLock.Lock()
+	defer s.usageLock.Unlock()
+
+	return s.room(id, Usage{Bytes: size, Objects: 1 - objectCount(exists)}, oldSize)
+}
+
+// room : whether id can take delta more within its hard quota, on top of its usage and the
+// reservations of the writes in progress, oldSize bytes being replaced. Called with usageLock
+// held.
+func (s *Store) room(id string, delta Usage, oldSize int64) error {
+	q := s.quotaOf(id)
+	u, res := s.usage[id], s.reserved[id]
+	inUse := Usage{Bytes: u.Bytes + res.Bytes, Objects: u.Objects + res.Objects}
+
+	overObjects := q.HardObjects > 0 && delta.Objects > 0 && inUse.Objects+delta.Objects > q.HardObjects
+	overBytes := q.HardBytes > 0 && delta.Bytes > 0 && inUse.Bytes+delta.Bytes-oldSize > q.HardBytes
+	if overObjects || overBytes {
+		s.Metrics.CountQuotaExceeded(id, "hard")
+		return &QuotaError{ID: id, Usage: inUse, Quota: q, Size: delta.Bytes}
+	}
+	return nil
+}
+
+// reservation : what a write in progress holds of the hard quota of its owner ID, for concurrent
+// writes not to go over it together. Released once the object is in place (its usage then
+// counted) or the write failed.
+type reservation struct {
+	s  *Store
+	id string
+	// Of the object replaced, taken back once it is.
+	oldSize int64
+	held    Usage
+}
+
+// reserve : a reservation for a write under id, holding an object unless it replaces one of
+// oldSize.
+func (s *Store) reserve(id string, oldSize int64, exists bool) (*reservation, error) {
+	s.usageLock.Lock()
+	defer s.usageLock.Unlock()
+
+	res := &reservation{s: s, id: id, oldSize: oldSize}
+	if !exists {
+		if err := res.takeLocked(Usage{Objects: 1}); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// takeLocked : holds delta more, if within the hard quota. Called with usageLock held.
+func (r *reservation) takeLocked(delta Usage) error {
+	// On top of the reservations, this one included.
+	if err := r.s.room(r.id, delta, r.oldSize); err != nil {
+		var qerr *QuotaError
+		if errors.As(err, &qerr) {
+			qerr.Size = r.held.Bytes + delta.Bytes
+		}
+		return err
+	}
+	r.s.reserved[r.id] = Usage{Bytes: r.s.reserved[r.id].Bytes + delta.Bytes, Objects: r.s.reserved[r.id].Objects + delta.Objects}
+	r.held = Usage{Bytes: r.held.Bytes + delta.Bytes, Objects: r.held.Objects + delta.Objects}
+	return nil
+}
+
+func (r *reservation) release() {
+	r.s.usageLock.Lock()
+	defer r.s.usageLock.Unlock()
+
+	r.releaseLocked()
+}
+
+func (r *reservation) releaseLocked() {
+	res := r.s.reserved[r.id]
+	res = Usage{Bytes: res.Bytes - r.held.Bytes, Objects: res.Objects - r.held.Objects}
+	if res == (Usage{}) {
+		delete(r.s.reserved, r.id)
+	} else {
+		r.s.reserved[r.id] = res
+	}
+	r.held = Usage{}
+}
+
+// quotaWriter : reserves the bytes written as they come, failing with a *QuotaError past the
+// hard quota.
+type quotaWriter struct {
+	w   io.Writer
+	res *reservation
+}
+
+func (q *quotaWriter) Write(p []byte) (int, error) {
+	q.res.s.usageLock.Lock()
+	err := q.res.takeLocked(Usage{Bytes: int64(len(p))})
+	q.res.s.usageLock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return q.w.Write(p)
+}
@@ -2,19 +2,47 @@ package storage
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/fs"
+	"log/slog"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/PsychoPunkSage/NexNet/cryptography"
 )
 
 const defaultRootFolderName = "PPSNetwork"
 
+// Every object has a sidecar file remembering the key it was stored under, at the same path under
+// Root/metaDir. Objects and sidecars are written to temp files in Root/tempDir, then renamed in
+// place; any found when a Store opens are leftovers of a crash. Both are out of the paths of the
+// owner IDs, which keys can't reach, and dot names aren't valid owner IDs.
+const (
+	metaDir = ".meta"
+	tempDir = ".tmp"
+)
+
+// ErrInvalidID : of owner IDs that can't be stored under, such as dot names (see metaDir).
+var ErrInvalidID = errors.New("invalid owner ID")
+
+func checkID(id string) error {
+	if len(id) == 0 || strings.HasPrefix(id, ".") || strings.ContainsAny(id, `/\`) {
+		return fmt.Errorf("%w %q", ErrInvalidID, id)
+	}
+	return nil
+}
+
+// Extension of the sidecars kept next to their object: in quarantineDir, and before metaDir.
+const metaFileExt = ".meta"
+
 type PathKey struct {
 	PathName string
 	Filename string
@@ -63,14 +91,41 @@ func CASPathTransformFunc(key string) PathKey {
 	}
 }
 
+// ObjectInfo : what the Store knows about a single stored object.
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// objectMeta : content of the `.meta` sidecar file.
+type objectMeta struct {
+	Key string `json:"key"`
+	// Of the object as written, hex encoded; empty for objects written before checksums were.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
 type StoreOpts struct {
 	// Folder name of Root; Contains all the folders/files of the system.
 	Root              string
 	PathTransformFunc PathTransformFunc
+	// Defaults to slog.Default().
+	Logger *slog.Logger
+	// Defaults to NopMetrics.
+	Metrics Metrics
+	// Of every owner ID but those of Quotas. Changed with SetQuotas.
+	Quota  Quota
+	Quotas map[string]Quota
 }
 
 type Store struct {
 	StoreOpts
+
+	// Also guards Quota & Quotas.
+	usageLock sync.Mutex
+	usage     map[string]Usage
+	// Held of the hard quotas by the writes in progress, see reserve.
+	reserved map[string]Usage
 }
 
 func NewStream(opts StoreOpts) *Store {
@@ -80,42 +135,186 @@ func NewStream(opts StoreOpts) *Store {
 	if len(opts.Root) == 0 {
 		opts.Root = defaultRootFolderName
 	}
-	return &Store{
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	if opts.Metrics == nil {
+		opts.Metrics = NopMetrics{}
+	}
+
+	s := &Store{
 		StoreOpts: opts,
+		usage:     make(map[string]Usage),
+		reserved:  make(map[string]Usage),
+	}
+	if err := s.removeTempFiles(); err != nil {
+		s.Logger.Warn("removing partial writes", "root", s.Root, "err", err)
+	}
+	if err := s.migrateSidecars(); err != nil {
+		s.Logger.Warn("moving sidecars", "root", s.Root, "err", err)
+	}
+	if err := s.scanUsage(); err != nil {
+		s.Logger.Warn("computing disk usage", "root", s.Root, "err", err)
 	}
+	return s
+}
+
+func (s *Store) fullPath(id, key string) string {
+	pathKey := s.PathTransformFunc(key)
+	return fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
 }
 
 func (s *Store) Has(id, key string) bool {
+	if checkID(id) != nil {
+		return false
+	}
 	pathKey := s.PathTransformFunc(key)
 	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
 	_, err := os.Stat(fullPathWithRoot)
 	return !errors.Is(err, os.ErrNotExist)
 }
 
+// Stat : returns info about the object stored under (id, key).
+func (s *Store) Stat(id, key string) (ObjectInfo, error) {
+	if err := checkID(id); err != nil {
+		return ObjectInfo{}, err
+	}
+	pathKey := s.PathTransformFunc(key)
+	fi, err := os.Stat(fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath()))
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	return ObjectInfo{
+		Key:     key,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}, nil
+}
+
+// List : returns every object stored under id.
+// Keys are recovered from the `.meta` sidecars, since a PathTransformFunc (e.g. CAS) is not reversible.
+func (s *Store) List(id string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+	if err := checkID(id); err != nil {
+		return objects, err
+	}
+
+	err := filepath.WalkDir(fmt.Sprintf("%s/%s", s.Root, id), func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			// Nothing was ever stored under id.
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		key := d.Name()
+		if meta, err := s.readMeta(path); err == nil {
+			key = meta.Key
+		}
+
+		objects = append(objects, ObjectInfo{
+			Key:     key,
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+		})
+		return nil
+	})
+
+	return objects, err
+}
+
 func (s *Store) Clear() error {
-	return os.RemoveAll(s.Root)
+	if err := os.RemoveAll(s.Root); err != nil {
+		return err
+	}
+
+	s.usageLock.Lock()
+	defer s.usageLock.Unlock()
+	for id := range s.usage {
+		s.usage[id] = Usage{}
+		s.Metrics.SetDiskUsage(id, 0)
+		s.Metrics.SetObjectCount(id, 0)
+	}
+	return nil
 }
 
+// Delete : removes the object under (id, key) and its sidecar, then the directories left empty
+// above them. Objects sharing a path prefix with it are untouched. Deleting a missing object is
+// not an error.
 func (s *Store) Delete(id, key string) error {
-	pathKey := s.PathTransformFunc(key)
-	defer func() {
-		log.Println("Deleted: <", pathKey.FullPath(), "> from disk")
-	}()
+	if err := checkID(id); err != nil {
+		return err
+	}
+	path := s.fullPath(id, key)
 
-	firstPathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FirstPathName())
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) || (err == nil && fi.IsDir()) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 
-	err := os.RemoveAll(firstPathNameWithRoot)
-	if err != nil && !os.IsNotExist(err) {
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
 		return err
 	}
+	meta := s.metaPath(path)
+	if err := os.Remove(meta); err != nil && !os.IsNotExist(err) {
+		s.Logger.Warn("deleting sidecar", "path", meta, "err", err)
+	}
+	s.addUsage(id, Usage{Bytes: -fi.Size(), Objects: -1})
+	s.pruneDirs(filepath.Dir(path))
+	s.pruneDirs(filepath.Dir(meta))
 
+	s.Logger.Debug("deleted from disk", "path", path)
 	return nil
 }
 
+// pruneDirs : removes dir and its parents, up to Root (excluded), as long as they're empty.
+func (s *Store) pruneDirs(dir string) {
+	for {
+		if rel, err := filepath.Rel(s.Root, dir); err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			return
+		}
+		// Fails on the first directory holding anything else.
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
 func (s *Store) Read(id, key string) (int64, io.Reader, error) {
 	return s.readStream(id, key)
 }
 
+// ReadAt : reads len(p) bytes of the object under (id, key) from off, unchecked against its checksum.
+func (s *Store) ReadAt(id, key string, p []byte, off int64) (int, error) {
+	if err := checkID(id); err != nil {
+		return 0, err
+	}
+	file, err := os.Open(s.fullPath(id, key))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	return file.ReadAt(p, off)
+}
+
 func (s *Store) Write(r io.Reader, id, key string) (int64, error) {
 	return s.writeStream(r, id, key)
 }
@@ -124,7 +323,11 @@ func (s *Store) WriteDecrypt(encKey []byte, r io.Reader, id, key string) (int64,
 	return s.writeDecryptStream(encKey, r, id, key)
 }
 
+// readStream : the object under (id, key), checked against its checksum as it's read.
 func (s *Store) readStream(id, key string) (int64, io.ReadCloser, error) {
+	if err := checkID(id); err != nil {
+		return 0, nil, err
+	}
 	pathKey := s.PathTransformFunc(key)
 	fullPathKeyWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
 
@@ -135,44 +338,267 @@ func (s *Store) readStream(id, key string) (int64, io.ReadCloser, error) {
 
 	fi, err := file.Stat()
 	if err != nil {
+		file.Close()
 		return 0, nil, err
 	}
 
-	return fi.Size(), file, nil
+	meta, err := s.readMeta(fullPathKeyWithRoot)
+	if err != nil || len(meta.SHA256) == 0 {
+		return fi.Size(), file, nil
+	}
+	return fi.Size(), newVerifyingReader(file, id, key, meta.SHA256), nil
 }
 
 func (s *Store) writeDecryptStream(encKey []byte, r io.Reader, id, key string) (int64, error) {
-	f, err := s.openFileForWriting(id, key)
+	n, err := s.write(id, key, func(w io.Writer) (int64, error) {
+		n, err := cryptography.CopyDecrypt(encKey, r, w)
+		return int64(n), err
+	})
 	if err != nil {
 		return 0, err
 	}
+	return n, nil
+}
+
+func (s *Store) writeStream(r io.Reader, id, key string) (int64, error) {
+	// When we read from a connection, the conn will not always return a file.
+	// Basically, storage keeps on waiting for new stuffs
+	return s.write(id, key, func(w io.Writer) (int64, error) { return io.Copy(w, r) })
+}
 
-	n, err := cryptography.CopyDecrypt(encKey, r, f)
+// write : the object under (id, key), as written by copy, within the hard quota of id. The bytes
+// go to a temp file, renamed in place once synced: the object is either all there or not changed.
+func (s *Store) write(id, key string, copy func(w io.Writer) (int64, error)) (int64, error) {
+	if err := checkID(id); err != nil {
+		return 0, err
+	}
+	oldSize, exists := s.objectSize(id, key)
+	res, err := s.reserve(id, oldSize, exists)
 	if err != nil {
 		return 0, err
 	}
+	defer res.release()
 
-	return int64(n), nil
+	tmp, err := s.createTemp()
+	if err != nil {
+		return 0, err
+	}
+	// Neither is left behind if the write fails; after the rename, both fail harmlessly.
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	sum := sha256.New()
+	n, err := copy(io.MultiWriter(&quotaWriter{w: tmp, res: res}, sum))
+	var qerr *QuotaError
+	if errors.As(err, &qerr) {
+		return n, qerr
+	}
+	if err != nil {
+		return n, err
+	}
+	if err := syncClose(tmp); err != nil {
+		return n, err
+	}
+
+	// The key first, for an object never to be listed without it; the checksum once the object is
+	// in place, for a failure (or a crash) in between to leave the old object unchecked rather than
+	// next to the checksum of the new one.
+	if err := s.writeMeta(id, key, ""); err != nil {
+		return n, err
+	}
+	path := s.fullPath(id, key)
+	if err := s.place(id, key, tmp.Name(), n, res); err != nil {
+		return n, err
+	}
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return n, err
+	}
+	if err := s.writeMeta(id, key, hex.EncodeToString(sum.Sum(nil))); err != nil {
+		s.Logger.Warn("object written without checksum", "owner_id", id, "key", key, "err", err)
+	}
+	return n, nil
 }
 
-func (s *Store) writeStream(r io.Reader, id, key string) (int64, error) {
-	f, err := s.openFileForWriting(id, key)
+// place : renames the temp file at tmp, of size bytes, to the object under (id, key), settling
+// the usage of id in the same step: the object it replaces is the one there when renamed, which a
+// concurrent write may have changed.
+func (s *Store) place(id, key, tmp string, size int64, res *reservation) error {
+	path := s.fullPath(id, key)
+
+	s.usageLock.Lock()
+	defer s.usageLock.Unlock()
+
+	oldSize, exists := s.objectSize(id, key)
+	if err := move(tmp, path); err != nil {
+		return err
+	}
+	res.releaseLocked()
+	s.addUsageLocked(id, Usage{Bytes: size - oldSize, Objects: 1 - objectCount(exists)})
+	return nil
+}
+
+func objectCount(exists bool) int64 {
+	if exists {
+		return 1
+	}
+	return 0
+}
+
+func (s *Store) writeMeta(id, key, sum string) error {
+	b, err := json.Marshal(objectMeta{Key: key, SHA256: sum})
 	if err != nil {
-		return 0, err
+		return err
 	}
-	// When we read from a connection, the conn will not always return a file.
-	// Basically, storage keeps on waiting for new stuffs
-	return io.Copy(f, r)
+
+	tmp, err := s.createTemp()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := tmp.Write(b); err != nil {
+		return err
+	}
+	return commit(tmp, s.metaPath(s.fullPath(id, key)))
 }
 
-func (s *Store) openFileForWriting(id, key string) (*os.File, error) {
-	pathkey := s.PathTransformFunc(key)
-	pathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathkey.PathName)
-	if err := os.MkdirAll(pathNameWithRoot, os.ModePerm); err != nil {
+// metaPath : of the sidecar of the object at path.
+func (s *Store) metaPath(path string) string {
+	rel, err := filepath.Rel(s.Root, path)
+	if err != nil {
+		return path + metaFileExt
+	}
+	return filepath.Join(s.Root, metaDir, rel)
+}
+
+// readMeta : sidecar of the object at path.
+func (s *Store) readMeta(path string) (objectMeta, error) {
+	var meta objectMeta
+	b, err := os.ReadFile(s.metaPath(path))
+	if err != nil {
+		return meta, err
+	}
+	return meta, json.Unmarshal(b, &meta)
+}
+
+// createTemp : a temp file in Root/tempDir, for commit to put in place.
+func (s *Store) createTemp() (*os.File, error) {
+	dir := filepath.Join(s.Root, tempDir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
 		return nil, err
 	}
+	return os.CreateTemp(dir, "")
+}
+
+// removeTempFiles : left by writes interrupted by a crash.
+func (s *Store) removeTempFiles() error {
+	dir := filepath.Join(s.Root, tempDir)
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathkey.FullPath())
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		s.Logger.Info("removing partial write", "path", path)
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateSidecars : moves the sidecars kept next to their object, by Stores before metaDir, to
+// metaDir. Files ending in metaFileExt are only taken for sidecars if next to an object and
+// holding a key.
+func (s *Store) migrateSidecars() error {
+	entries, err := os.ReadDir(s.Root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		err := filepath.WalkDir(filepath.Join(s.Root, e.Name()), func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || !strings.HasSuffix(path, metaFileExt) {
+				return err
+			}
+			object := strings.TrimSuffix(path, metaFileExt)
+			if fi, err := os.Stat(object); err != nil || !fi.Mode().IsRegular() {
+				return nil
+			}
+			var meta objectMeta
+			if b, err := os.ReadFile(path); err != nil || json.Unmarshal(b, &meta) != nil || len(meta.Key) == 0 {
+				return nil
+			}
+
+			to := s.metaPath(object)
+			if err := os.MkdirAll(filepath.Dir(to), os.ModePerm); err != nil {
+				return err
+			}
+			return os.Rename(path, to)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commit : syncs and closes tmp, then moves it to path and syncs the directory, so that path
+// survives a crash.
+func commit(tmp *os.File, path string) error {
+	if err := syncClose(tmp); err != nil {
+		return err
+	}
+	if err := move(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func syncClose(f *os.File) error {
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// move : renames from to path, making the directory of path.
+func move(from, path string) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	err := rename(from, path)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Pruned by a Delete in between: once more.
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return err
+		}
+		err = rename(from, path)
+	}
+	return err
+}
+
+// rename : os.Rename, but for tests.
+var rename = os.Rename
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
 
-	return os.Create(fullPathWithRoot)
+	return d.Sync()
 }
@@ -2,10 +2,17 @@ package storage
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestStore(t *testing.T) {
@@ -109,6 +116,209 @@ func TestDeleteStream(t *testing.T) {
 	}
 }
 
+// samePrefix : n keys other than key whose CASPathTransformFunc paths share their first
+// directory with its.
+func samePrefix(key string, n int) []string {
+	want := CASPathTransformFunc(key).FirstPathName()
+	keys := []string{}
+	for i := 0; len(keys) < n; i++ {
+		candidate := fmt.Sprintf("%s_%d", key, i)
+		hash := sha1.Sum([]byte(candidate))
+		if hex.EncodeToString(hash[:3])[:len(want)] == want {
+			keys = append(keys, candidate)
+		}
+	}
+	return keys
+}
+
+func TestDeleteOnlyTarget(t *testing.T) {
+	for name, opts := range map[string]StoreOpts{
+		"cas":     {PathTransformFunc: CASPathTransformFunc},
+		"default": {PathTransformFunc: DefaultPathTransformFunc},
+	} {
+		opts.Root = t.TempDir()
+		store := NewStream(opts)
+		id := "PPS"
+
+		target := "photos/cat"
+		keys := append([]string{target, "photos/dog", "photos/cat/kitten"}, samePrefix(target, 2)...)
+		for i := 0; i < 20; i++ {
+			keys = append(keys, fmt.Sprintf("photos/%d", i))
+		}
+		for _, key := range keys {
+			if _, err := store.Write(bytes.NewReader([]byte(key)), id, key); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+
+		if err := store.Delete(id, target); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if store.Has(id, target) {
+			t.Errorf("%s: %s still stored", name, target)
+		}
+		for _, key := range keys[1:] {
+			_, r, err := store.Read(id, key)
+			if err != nil {
+				t.Errorf("%s: %s lost: %v", name, key, err)
+				continue
+			}
+			if b, _ := io.ReadAll(r); string(b) != key {
+				t.Errorf("%s: want %s got %s", name, key, b)
+			}
+			r.(io.Closer).Close()
+		}
+
+		want := Usage{Objects: int64(len(keys) - 1)}
+		for _, key := range keys[1:] {
+			want.Bytes += int64(len(key))
+		}
+		if got := store.StatUsage(id).Usage; got != want {
+			t.Errorf("%s: want usage %+v got %+v", name, want, got)
+		}
+		if got := len(files(t, opts.Root)); got != 2*len(keys[1:]) {
+			t.Errorf("%s: want %d files (objects & sidecars) got %d", name, 2*len(keys[1:]), got)
+		}
+
+		// Deleting the rest leaves no directory behind, but the one of temp files.
+		for _, key := range keys[1:] {
+			if err := store.Delete(id, key); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+		if entries, _ := os.ReadDir(opts.Root); len(entries) != 1 || entries[0].Name() != tempDir {
+			t.Errorf("%s: want an empty root, got %v", name, entries)
+		}
+		if err := store.Delete(id, target); err != nil {
+			t.Errorf("%s: deleting a missing object: %v", name, err)
+		}
+	}
+}
+
+func TestBackends(t *testing.T) {
+	for name, backend := range map[string]Backend{
+		"store":  NewStream(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc}),
+		"memory": NewMemory(),
+	} {
+		id, key, data := "PPS", "photos/cat", []byte("some bytes")
+
+		if backend.Has(id, key) {
+			t.Errorf("%s: has %s before it's written", name, key)
+		}
+		if _, err := backend.Stat(id, key); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: want fs.ErrNotExist got %v", name, err)
+		}
+		if _, _, err := backend.Read(id, key); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: want fs.ErrNotExist got %v", name, err)
+		}
+
+		if n, err := backend.Write(bytes.NewReader(data), id, key); err != nil || n != int64(len(data)) {
+			t.Fatalf("%s: wrote %d bytes: %v", name, n, err)
+		}
+		if !backend.Has(id, key) {
+			t.Errorf("%s: %s not stored", name, key)
+		}
+		if info, err := backend.Stat(id, key); err != nil || info.Key != key || info.Size != int64(len(data)) {
+			t.Errorf("%s: want %s of %d bytes got %+v (%v)", name, key, len(data), info, err)
+		}
+
+		size, r, err := backend.Read(id, key)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if b, _ := io.ReadAll(r); size != int64(len(data)) || string(b) != string(data) {
+			t.Errorf("%s: want %s got %s (%d bytes)", name, data, b, size)
+		}
+		if rc, ok := r.(io.Closer); ok {
+			rc.Close()
+		}
+
+		p := make([]byte, 5)
+		if n, err := backend.ReadAt(id, key, p, 5); err != nil || string(p[:n]) != "bytes" {
+			t.Errorf("%s: want bytes got %s (%v)", name, p[:n], err)
+		}
+		if _, err := backend.ReadAt(id, key, p, 8); err != io.EOF {
+			t.Errorf("%s: want io.EOF past the end got %v", name, err)
+		}
+
+		// A failed write leaves the object as it was.
+		if _, err := backend.Write(&failingReader{data: []byte("other")}, id, key); err == nil {
+			t.Errorf("%s: failed write succeeded", name)
+		}
+		if objects, err := backend.List(id); err != nil || len(objects) != 1 || objects[0].Key != key || objects[0].Size != int64(len(data)) {
+			t.Errorf("%s: want %s of %d bytes got %+v (%v)", name, key, len(data), objects, err)
+		}
+		if got := backend.Usage(); len(got) != 1 || got[0].ID != id || got[0].Usage != (Usage{Bytes: int64(len(data)), Objects: 1}) {
+			t.Errorf("%s: want usage of %s got %+v", name, id, got)
+		}
+
+		if err := backend.Delete(id, key); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if err := backend.Delete(id, key); err != nil {
+			t.Errorf("%s: deleting a missing object: %v", name, err)
+		}
+		if backend.Has(id, key) || len(backend.Usage()) != 0 {
+			t.Errorf("%s: %s still stored", name, key)
+		}
+		if objects, err := backend.List(id); err != nil || len(objects) != 0 {
+			t.Errorf("%s: want no objects got %+v (%v)", name, objects, err)
+		}
+	}
+}
+
+func TestListAndStat(t *testing.T) {
+	store := NewStream(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	})
+	id := "PPS"
+
+	objects, err := store.List(id)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(objects) != 0 {
+		t.Errorf("want no objects got %d", len(objects))
+	}
+
+	want := map[string]int64{}
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("photo_%d.png", i)
+		data := bytes.Repeat([]byte("x"), i+1)
+		want[key] = int64(len(data))
+
+		if _, err := store.Write(bytes.NewReader(data), id, key); err != nil {
+			t.Error(err)
+		}
+	}
+
+	objects, err = store.List(id)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(objects) != len(want) {
+		t.Errorf("want %d objects got %d", len(want), len(objects))
+	}
+	for _, o := range objects {
+		if want[o.Key] != o.Size {
+			t.Errorf("%s: want size %d got %d", o.Key, want[o.Key], o.Size)
+		}
+	}
+
+	info, err := store.Stat(id, "photo_2.png")
+	if err != nil {
+		t.Error(err)
+	}
+	if info.Size != 3 {
+		t.Errorf("want size 3 got %d", info.Size)
+	}
+
+	if _, err := store.Stat(id, "missing"); !os.IsNotExist(err) {
+		t.Errorf("want not-exist error got %v", err)
+	}
+}
+
 func TestPathTransformFunc(t *testing.T) {
 	key := "mybestpic"
 	pathkey := CASPathTransformFunc(key)
@@ -136,3 +346,487 @@ func teardown(t *testing.T, s *Store) {
 		t.Error(err)
 	}
 }
+
+func TestDiskUsage(t *testing.T) {
+	store := NewStream(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	})
+
+	store.Write(bytes.NewReader([]byte("12345")), "alice", "a")
+	store.Write(bytes.NewReader([]byte("123")), "alice", "b")
+	store.Write(bytes.NewReader([]byte("1")), "bob", "a")
+	if got := store.DiskUsage("alice"); got != 8 {
+		t.Errorf("alice: want 8 got %d", got)
+	}
+
+	// Overwriting only accounts for the difference.
+	store.Write(bytes.NewReader([]byte("1")), "alice", "a")
+	if got := store.DiskUsage("alice"); got != 4 {
+		t.Errorf("alice after overwrite: want 4 got %d", got)
+	}
+
+	store.Delete("alice", "b")
+	if got := store.DiskUsage("alice"); got != 1 {
+		t.Errorf("alice after delete: want 1 got %d", got)
+	}
+
+	// A new Store over the same Root finds the same usage.
+	reopened := NewStream(store.StoreOpts)
+	if got := reopened.DiskUsage("alice"); got != 1 {
+		t.Errorf("alice after reopen: want 1 got %d", got)
+	}
+	if got := reopened.DiskUsage("bob"); got != 1 {
+		t.Errorf("bob after reopen: want 1 got %d", got)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	store := NewStream(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+		Quota:             Quota{SoftBytes: 4, HardBytes: 8, HardObjects: 2},
+		Quotas:            map[string]Quota{"bob": {}},
+	})
+
+	if _, err := store.Write(bytes.NewReader([]byte("12345")), "alice", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := store.StatUsage("alice").Usage; got != (Usage{Bytes: 5, Objects: 1}) {
+		t.Errorf("alice: want 5 bytes in 1 object got %+v", got)
+	}
+
+	// Refused before any byte is written.
+	err := store.CheckQuota("alice", "b", 4)
+	var qerr *QuotaError
+	if !errors.As(err, &qerr) || !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("want a *QuotaError got %v", err)
+	}
+	if qerr.ID != "alice" || qerr.Size != 4 || qerr.Usage.Bytes != 5 {
+		t.Errorf("wrong quota error: %+v", qerr)
+	}
+	// Replacing an object only counts the difference.
+	if err := store.CheckQuota("alice", "a", 8); err != nil {
+		t.Errorf("overwrite: %v", err)
+	}
+
+	// Writes of unknown size fail once over, and leave nothing behind.
+	if _, err := store.Write(bytes.NewReader([]byte("1234")), "alice", "b"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("want ErrQuotaExceeded got %v", err)
+	}
+	if store.Has("alice", "b") {
+		t.Errorf("partial object left behind")
+	}
+	if got := store.StatUsage("alice").Usage; got != (Usage{Bytes: 5, Objects: 1}) {
+		t.Errorf("alice after refusal: want 5 bytes in 1 object got %+v", got)
+	}
+
+	// Objects.
+	store.Write(bytes.NewReader([]byte("1")), "alice", "b")
+	if _, err := store.Write(bytes.NewReader([]byte("1")), "alice", "c"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("want ErrQuotaExceeded got %v", err)
+	}
+
+	// Other IDs have quotas of their own.
+	if _, err := store.Write(bytes.NewReader(make([]byte, 64)), "bob", "a"); err != nil {
+		t.Errorf("bob: %v", err)
+	}
+	store.SetQuotas(Quota{}, nil)
+	if _, err := store.Write(bytes.NewReader([]byte("1")), "alice", "c"); err != nil {
+		t.Errorf("quota lifted: %v", err)
+	}
+
+	infos := store.Usage()
+	if len(infos) != 2 || infos[0].ID != "alice" || infos[0].Usage.Objects != 3 || infos[1].ID != "bob" {
+		t.Errorf("wrong usage listed: %+v", infos)
+	}
+}
+
+// failingReader : yields data, then fails, like a connection dropped mid-transfer.
+type failingReader struct {
+	data []byte
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, errors.New("connection reset")
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// chunkReader : yields data a few bytes at a time, pausing in between.
+type chunkReader struct {
+	data []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(time.Millisecond)
+	n := copy(p[:min(len(p), 4)], r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestQuotaConcurrentWrites(t *testing.T) {
+	store := NewStream(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+		Quota:             Quota{HardBytes: 100, HardObjects: 5},
+	})
+
+	// Each fits alone; together, only 3 do.
+	var wg sync.WaitGroup
+	errs := make([]error, 20)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = store.Write(&chunkReader{data: make([]byte, 30)}, "alice", fmt.Sprint(i))
+		}(i)
+	}
+	wg.Wait()
+
+	written := int64(0)
+	for _, err := range errs {
+		if err == nil {
+			written++
+		} else if !errors.Is(err, ErrQuotaExceeded) {
+			t.Errorf("want ErrQuotaExceeded got %v", err)
+		}
+	}
+	usage := store.StatUsage("alice").Usage
+	if usage.Bytes > 100 || usage.Objects > 5 {
+		t.Errorf("over the hard quota: %+v", usage)
+	}
+	if usage != (Usage{Bytes: 30 * written, Objects: written}) || written == 0 {
+		t.Errorf("want %d objects of 30 bytes got %+v", written, usage)
+	}
+	if objects, _ := store.List("alice"); int64(len(objects)) != written {
+		t.Errorf("want %d objects stored got %d", written, len(objects))
+	}
+	// Nothing left reserved.
+	if err := store.CheckQuota("alice", "more", 100-30*written); err != nil {
+		t.Errorf("room left: %v", err)
+	}
+}
+
+// stuckReader : yields data, then blocks until release is closed, like a node killed mid-write.
+type stuckReader struct {
+	failingReader
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (r *stuckReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		close(r.reading)
+		<-r.release
+	}
+	return r.failingReader.Read(p)
+}
+
+// files : the regular files under root.
+func files(t *testing.T, root string) []string {
+	found := []string{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			found = append(found, path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+func TestFailedWrite(t *testing.T) {
+	store := NewStream(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	})
+
+	// A new object isn't there at all.
+	if _, err := store.Write(&failingReader{data: []byte("partial")}, "alice", "new"); err == nil {
+		t.Fatal("want an error")
+	}
+	if store.Has("alice", "new") {
+		t.Errorf("partial object reported as present")
+	}
+	if got := files(t, store.Root); len(got) != 0 {
+		t.Errorf("want no files left got %v", got)
+	}
+
+	// An object replaced stays as it was.
+	if _, err := store.Write(bytes.NewReader([]byte("version 1")), "alice", "old"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Write(&failingReader{data: []byte("version")}, "alice", "old"); err == nil {
+		t.Fatal("want an error")
+	}
+	_, r, err := store.Read("alice", "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	r.(io.Closer).Close()
+	if string(b) != "version 1" {
+		t.Errorf("want %q got %q", "version 1", b)
+	}
+	if got := store.StatUsage("alice").Usage; got != (Usage{Bytes: 9, Objects: 1}) {
+		t.Errorf("want 9 bytes in 1 object got %+v", got)
+	}
+	if got := files(t, store.Root); len(got) != 2 {
+		t.Errorf("want the object and its sidecar got %v", got)
+	}
+}
+
+func TestCrashMidWrite(t *testing.T) {
+	opts := StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	}
+	store := NewStream(opts)
+	if _, err := store.Write(bytes.NewReader([]byte("version 1")), "alice", "old"); err != nil {
+		t.Fatal(err)
+	}
+
+	writes := make(chan error, 2)
+	release := make(chan struct{})
+	for _, key := range []string{"old", "new"} {
+		r := &stuckReader{failingReader: failingReader{data: []byte("half of version 2")}, reading: make(chan struct{}), release: release}
+		go func(key string) {
+			_, err := store.Write(r, "alice", key)
+			writes <- err
+		}(key)
+		<-r.reading
+	}
+
+	// The node dies there; what's on disk is what the restarted one finds.
+	restarted := NewStream(opts)
+	if restarted.Has("alice", "new") {
+		t.Errorf("partial object reported as present")
+	}
+	objects, err := restarted.List("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Key != "old" || objects[0].Size != 9 {
+		t.Errorf("want only the old object got %+v", objects)
+	}
+	if got := restarted.StatUsage("alice").Usage; got != (Usage{Bytes: 9, Objects: 1}) {
+		t.Errorf("want 9 bytes in 1 object got %+v", got)
+	}
+	// The partial writes are cleaned up.
+	if got := files(t, opts.Root); len(got) != 2 {
+		t.Errorf("want the object and its sidecar got %v", got)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-writes; err == nil {
+			t.Errorf("interrupted write succeeded")
+		}
+	}
+}
+
+func TestCorruption(t *testing.T) {
+	store := NewStream(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	})
+	if _, err := store.Write(bytes.NewReader([]byte("the bytes written")), "alice", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Verify("alice", "a"); err != nil {
+		t.Errorf("intact object: %v", err)
+	}
+
+	// Bit rot.
+	path := store.fullPath("alice", "a")
+	if err := os.WriteFile(path, []byte("the bytes wrItten"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, r, err := store.Read("alice", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(r)
+	r.(io.Closer).Close()
+	var cerr *CorruptionError
+	if !errors.As(err, &cerr) || cerr.ID != "alice" || cerr.Key != "a" || cerr.Want == cerr.Got {
+		t.Errorf("want a *CorruptionError got %v", err)
+	}
+	if err := store.Verify("alice", "a"); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("want ErrCorrupt got %v", err)
+	}
+
+	if err := store.Quarantine("alice", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if store.Has("alice", "a") {
+		t.Errorf("quarantined object still present")
+	}
+	if got := store.StatUsage("alice").Usage; got != (Usage{}) {
+		t.Errorf("want no usage got %+v", got)
+	}
+	// Kept aside, and not taken for an owner ID.
+	if got := files(t, filepath.Join(store.Root, quarantineDir)); len(got) != 2 {
+		t.Errorf("want the object and its sidecar quarantined got %v", got)
+	}
+	if got := NewStream(store.StoreOpts).Usage(); len(got) != 0 {
+		t.Errorf("want no usage after reopen got %+v", got)
+	}
+}
+
+func TestQuarantineSidecar(t *testing.T) {
+	store := NewStream(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	})
+	if err := store.Quarantine(".meta", "a"); !errors.Is(err, ErrInvalidID) {
+		t.Errorf("want ErrInvalidID got %v", err)
+	}
+
+	// Written before sidecars were kept.
+	if _, err := store.Write(bytes.NewReader([]byte("legacy")), "alice", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(store.metaPath(store.fullPath("alice", "a"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Quarantine("alice", "a"); err != nil {
+		t.Errorf("quarantine without sidecar: %v", err)
+	}
+
+	if _, err := store.Write(bytes.NewReader([]byte("bytes")), "alice", "b"); err != nil {
+		t.Fatal(err)
+	}
+	meta := store.metaPath(store.fullPath("alice", "b"))
+	rename = func(from, to string) error {
+		if from == meta {
+			return errors.New("disk full")
+		}
+		return os.Rename(from, to)
+	}
+	defer func() { rename = os.Rename }()
+
+	if err := store.Quarantine("alice", "b"); err == nil {
+		t.Error("quarantine succeeded despite the failed sidecar rename")
+	}
+	if store.Has("alice", "b") {
+		t.Errorf("quarantined object still present")
+	}
+	if got := store.StatUsage("alice").Usage; got != (Usage{}) {
+		t.Errorf("want no usage got %+v", got)
+	}
+}
+
+func TestFailedRenameKeepsChecksum(t *testing.T) {
+	store := NewStream(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	})
+	if _, err := store.Write(bytes.NewReader([]byte("old bytes")), "alice", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The object can't be put in place, its sidecar can.
+	path := store.fullPath("alice", "a")
+	rename = func(from, to string) error {
+		if to == path {
+			return errors.New("disk full")
+		}
+		return os.Rename(from, to)
+	}
+	defer func() { rename = os.Rename }()
+
+	if _, err := store.Write(bytes.NewReader([]byte("new bytes")), "alice", "a"); err == nil {
+		t.Fatal("write succeeded despite the failed rename")
+	}
+	if err := store.Verify("alice", "a"); err != nil {
+		t.Errorf("old object: %v", err)
+	}
+	_, r, err := store.Read("alice", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.(io.Closer).Close()
+	if b, _ := io.ReadAll(r); string(b) != "old bytes" {
+		t.Errorf("want old bytes got %s", b)
+	}
+}
+
+func TestReservedNames(t *testing.T) {
+	store := NewStream(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: DefaultPathTransformFunc,
+	})
+
+	// Keys looking like temp files or sidecars are objects like any other.
+	keys := []string{".tmp-x", "photo.meta", ".meta", ".tmp"}
+	for _, key := range keys {
+		if _, err := store.Write(bytes.NewReader([]byte(key)), "alice", key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reopened := NewStream(store.StoreOpts)
+	objects, err := reopened.List("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != len(keys) {
+		t.Errorf("want %d objects got %+v", len(keys), objects)
+	}
+	if got := reopened.StatUsage("alice").Usage; got.Objects != int64(len(keys)) {
+		t.Errorf("want %d objects in usage got %+v", len(keys), got)
+	}
+	for _, key := range keys {
+		if !reopened.Has("alice", key) {
+			t.Errorf("%s lost on reopen", key)
+		}
+	}
+
+	// Nor can owner IDs reach the reserved directories.
+	for _, id := range []string{".meta", ".tmp", "", "a/b"} {
+		if _, err := store.Write(bytes.NewReader([]byte("x")), id, "key"); !errors.Is(err, ErrInvalidID) {
+			t.Errorf("%q: want ErrInvalidID got %v", id, err)
+		}
+	}
+	if _, err := store.List(".meta"); !errors.Is(err, ErrInvalidID) {
+		t.Errorf("want ErrInvalidID got %v", err)
+	}
+}
+
+func TestMigrateSidecars(t *testing.T) {
+	root := t.TempDir()
+	store := NewStream(StoreOpts{Root: root, PathTransformFunc: CASPathTransformFunc})
+
+	// As laid out before metaDir: the sidecar next to its object.
+	path := store.fullPath("alice", "photos/cat")
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("meow"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path+metaFileExt, []byte(`{"key":"photos/cat"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := NewStream(store.StoreOpts)
+	objects, err := reopened.List("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Key != "photos/cat" {
+		t.Errorf("want photos/cat got %+v", objects)
+	}
+	if got := reopened.StatUsage("alice").Usage; got != (Usage{Bytes: 4, Objects: 1}) {
+		t.Errorf("want the object alone in usage got %+v", got)
+	}
+}
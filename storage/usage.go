@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Usage : what is stored under an owner ID, maintained as objects are written and deleted.
+type Usage struct {
+	// Taken on disk by the objects, sidecars not included.
+	Bytes   int64
+	Objects int64
+}
+
+// DiskUsage : bytes taken on disk by the objects stored under id (sidecars not included).
+func (s *Store) DiskUsage(id string) int64 {
+	s.usageLock.Lock()
+	defer s.usageLock.Unlock()
+
+	return s.usage[id].Bytes
+}
+
+// scanUsage : computes the disk usage of every owner ID found under Root.
+func (s *Store) scanUsage() error {
+	entries, err := os.ReadDir(s.Root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		// Not an owner ID, e.g. quarantineDir.
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		u, err := dirUsage(filepath.Join(s.Root, e.Name()))
+		if err != nil {
+			return err
+		}
+		s.addUsage(e.Name(), u)
+	}
+	return nil
+}
+
+// addUsage : adds delta (possibly negative) to the usage of id, noting when it goes over the soft
+// quota.
+func (s *Store) addUsage(id string, delta Usage) {
+	s.usageLock.Lock()
+	defer s.usageLock.Unlock()
+
+	s.addUsageLocked(id, delta)
+}
+
+func (s *Store) addUsageLocked(id string, delta Usage) {
+	before := s.usage[id]
+	after := Usage{Bytes: before.Bytes + delta.Bytes, Objects: before.Objects + delta.Objects}
+	s.usage[id] = after
+	s.Metrics.SetDiskUsage(id, after.Bytes)
+	s.Metrics.SetObjectCount(id, after.Objects)
+
+	q := s.quotaOf(id)
+	crossed := func(soft, before, after int64) bool { return soft > 0 && before <= soft && after > soft }
+	if crossed(q.SoftBytes, before.Bytes, after.Bytes) || crossed(q.SoftObjects, before.Objects, after.Objects) {
+		s.Logger.Warn("soft quota exceeded", "owner_id", id, "bytes", after.Bytes, "objects", after.Objects,
+			"soft_bytes", q.SoftBytes, "soft_objects", q.SoftObjects)
+		s.Metrics.CountQuotaExceeded(id, "soft")
+	}
+}
+
+// objectSize : size of the object stored under (id, key), and whether there is one.
+func (s *Store) objectSize(id, key string) (int64, bool) {
+	fi, err := os.Stat(s.fullPath(id, key))
+	if err != nil {
+		return 0, false
+	}
+	return fi.Size(), true
+}
+
+// dirUsage : objects under dir and their total size.
+func dirUsage(dir string) (Usage, error) {
+	var u Usage
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		u.Bytes += fi.Size()
+		u.Objects++
+		return nil
+	})
+	return u, err
+}
@@ -0,0 +1,56 @@
+package tracing
+
+import "sync"
+
+// Exporter : receives every finished span. Must be safe for concurrent use.
+type Exporter interface {
+	Export(SpanData)
+}
+
+// NopExporter : default Exporter, dropping every span.
+type NopExporter struct{}
+
+func (NopExporter) Export(SpanData) {}
+
+// InMemoryExporter : keeps the finished spans, for tests.
+type InMemoryExporter struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+func NewInMemoryExporter() *InMemoryExporter {
+	return &InMemoryExporter{}
+}
+
+func (e *InMemoryExporter) Export(span SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.spans = append(e.spans, span)
+}
+
+// Spans : every span exported so far, in the order they ended.
+func (e *InMemoryExporter) Spans() []SpanData {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return append([]SpanData(nil), e.spans...)
+}
+
+// Find : exported spans with the given name.
+func (e *InMemoryExporter) Find(name string) []SpanData {
+	found := []SpanData{}
+	for _, span := range e.Spans() {
+		if span.Name == name {
+			found = append(found, span)
+		}
+	}
+	return found
+}
+
+func (e *InMemoryExporter) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.spans = nil
+}
@@ -0,0 +1,168 @@
+package tracing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// OTLPExporter : writes every span as one line of OTLP/JSON (an ExportTraceServiceRequest), the
+// format read by the OpenTelemetry Collector's file receiver (otlpjsonfile).
+type OTLPExporter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+// NewOTLPExporter : writes to w, e.g. os.Stdout.
+func NewOTLPExporter(w io.Writer) *OTLPExporter {
+	return &OTLPExporter{w: w}
+}
+
+// OpenOTLPFile : appends to the file at path, created if needed. Close it when done.
+func OpenOTLPFile(path string) (*OTLPExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening trace file: %w", err)
+	}
+	return &OTLPExporter{w: f, closer: f}, nil
+}
+
+func (e *OTLPExporter) Export(span SpanData) {
+	b, err := json.Marshal(toOTLP(span))
+	if err != nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.w.Write(append(b, '\n'))
+}
+
+func (e *OTLPExporter) Close() error {
+	if e.closer == nil {
+		return nil
+	}
+	return e.closer.Close()
+}
+
+// OTLP/JSON encoding, see opentelemetry-proto (trace/v1/trace.proto). Only what SpanData holds.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+const (
+	// SPAN_KIND_INTERNAL
+	otlpKindInternal = 1
+	// STATUS_CODE_ERROR
+	otlpStatusError = 2
+)
+
+func toOTLP(span SpanData) otlpRequest {
+	s := otlpSpan{
+		TraceID:           span.TraceID,
+		SpanID:            span.SpanID,
+		ParentSpanID:      span.ParentSpanID,
+		Name:              span.Name,
+		Kind:              otlpKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+	}
+
+	keys := make([]string, 0, len(span.Attributes))
+	for k := range span.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s.Attributes = append(s.Attributes, otlpKeyValue{Key: k, Value: otlpValue(span.Attributes[k])})
+	}
+
+	if len(span.Error) > 0 {
+		s.Status = otlpStatus{Code: otlpStatusError, Message: span.Error}
+	}
+
+	return otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpKeyValue{{Key: "service.name", Value: otlpValue(span.Service)}},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "github.com/PsychoPunkSage/NexNet"},
+				Spans: []otlpSpan{s},
+			}},
+		}},
+	}
+}
+
+func otlpValue(v any) otlpAnyValue {
+	switch v := v.(type) {
+	case string:
+		return otlpAnyValue{StringValue: &v}
+	case bool:
+		return otlpAnyValue{BoolValue: &v}
+	case int:
+		s := strconv.FormatInt(int64(v), 10)
+		return otlpAnyValue{IntValue: &s}
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		return otlpAnyValue{IntValue: &s}
+	case float64:
+		return otlpAnyValue{DoubleValue: &v}
+	}
+	s := fmt.Sprint(v)
+	return otlpAnyValue{StringValue: &s}
+}
@@ -0,0 +1,168 @@
+// Package tracing : minimal OpenTelemetry-style distributed tracing.
+//
+// A Tracer starts spans carried by a context.Context. The SpanContext (trace & span IDs) of a span
+// is sent to peers inside messages, so that the spans of a remote node join the same trace.
+// Finished spans are handed to an Exporter.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// SpanContext : what is propagated across nodes. IDs are lowercase hex, as in W3C trace context.
+type SpanContext struct {
+	TraceID string
+	SpanID  string
+}
+
+func (sc SpanContext) IsValid() bool {
+	return len(sc.TraceID) == 32 && len(sc.SpanID) == 16
+}
+
+// SpanData : a finished span, as handed to an Exporter.
+type SpanData struct {
+	Name         string
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	// Service (node) the span was recorded by.
+	Service    string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]any
+	// Empty unless the span recorded an error.
+	Error string
+}
+
+type TracerOpts struct {
+	// Reported with every span, e.g. the node ID.
+	ServiceName string
+	// Defaults to NopExporter.
+	Exporter Exporter
+}
+
+type Tracer struct {
+	TracerOpts
+}
+
+func NewTracer(opts TracerOpts) *Tracer {
+	if opts.Exporter == nil {
+		opts.Exporter = NopExporter{}
+	}
+	return &Tracer{
+		TracerOpts: opts,
+	}
+}
+
+// Span : a span in progress. Safe for concurrent use; End must be called exactly once.
+type Span struct {
+	tracer *Tracer
+
+	mu   sync.Mutex
+	data SpanData
+}
+
+type spanKey struct{}
+
+// Start : starts a span, child of the span (local or remote) carried by ctx if any.
+// The returned context carries the new span.
+func (t *Tracer) Start(ctx context.Context, name string, attrs ...any) (context.Context, *Span) {
+	parent := SpanContextFrom(ctx)
+
+	traceID := parent.TraceID
+	if !parent.IsValid() {
+		traceID = newID(16)
+		parent = SpanContext{}
+	}
+
+	span := &Span{
+		tracer: t,
+		data: SpanData{
+			Name:         name,
+			TraceID:      traceID,
+			SpanID:       newID(8),
+			ParentSpanID: parent.SpanID,
+			Service:      t.ServiceName,
+			Start:        time.Now(),
+			Attributes:   make(map[string]any),
+		},
+	}
+	span.SetAttributes(attrs...)
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// SpanContext : IDs of the span, to propagate to peers.
+func (s *Span) SpanContext() SpanContext {
+	return SpanContext{TraceID: s.data.TraceID, SpanID: s.data.SpanID}
+}
+
+// SetAttributes : key/value pairs, e.g. SetAttributes("peer", addr, "bytes", n).
+func (s *Span) SetAttributes(kv ...any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := 0; i+1 < len(kv); i += 2 {
+		if k, ok := kv[i].(string); ok {
+			s.data.Attributes[k] = kv[i+1]
+		}
+	}
+}
+
+// RecordError : marks the span as failed, if err isn't nil.
+func (s *Span) RecordError(err error) {
+	if err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data.Error = err.Error()
+}
+
+// End : finishes the span and exports it.
+func (s *Span) End() {
+	s.mu.Lock()
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+
+	s.tracer.Exporter.Export(data)
+}
+
+// EndWithError : RecordError(*err) then End, for use with defer on a named error result.
+func (s *Span) EndWithError(err *error) {
+	s.RecordError(*err)
+	s.End()
+}
+
+// SpanContextFrom : IDs of the span carried by ctx (local or remote), zero if none.
+func SpanContextFrom(ctx context.Context) SpanContext {
+	switch v := ctx.Value(spanKey{}).(type) {
+	case *Span:
+		return v.SpanContext()
+	case SpanContext:
+		return v
+	}
+	return SpanContext{}
+}
+
+// ContextWithRemote : ctx carrying a span context received from a peer, so that spans started
+// from it continue the peer's trace.
+func ContextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	if !sc.IsValid() {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, sc)
+}
+
+func newID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,81 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpanParenting(t *testing.T) {
+	exp := NewInMemoryExporter()
+	tracer := NewTracer(TracerOpts{ServiceName: "node-a", Exporter: exp})
+
+	ctx, root := tracer.Start(context.Background(), "root")
+	_, child := tracer.Start(ctx, "child", "bytes", 42)
+	child.RecordError(errors.New("boom"))
+	child.End()
+	root.End()
+
+	spans := exp.Spans()
+	assert.Len(t, spans, 2)
+	c, r := spans[0], spans[1]
+
+	assert.Equal(t, "child", c.Name)
+	assert.Equal(t, r.TraceID, c.TraceID)
+	assert.Equal(t, r.SpanID, c.ParentSpanID)
+	assert.Empty(t, r.ParentSpanID)
+	assert.Equal(t, 42, c.Attributes["bytes"])
+	assert.Equal(t, "boom", c.Error)
+	assert.Equal(t, "node-a", c.Service)
+	assert.True(t, root.SpanContext().IsValid())
+}
+
+func TestRemoteParent(t *testing.T) {
+	exp := NewInMemoryExporter()
+	tracer := NewTracer(TracerOpts{Exporter: exp})
+
+	remote := SpanContext{TraceID: "0af7651916cd43dd8448eb211c80319c", SpanID: "b7ad6b7169203331"}
+	_, span := tracer.Start(ContextWithRemote(context.Background(), remote), "handle")
+	span.End()
+
+	got := exp.Find("handle")[0]
+	assert.Equal(t, remote.TraceID, got.TraceID)
+	assert.Equal(t, remote.SpanID, got.ParentSpanID)
+
+	// Garbage from the wire starts a new trace instead.
+	_, span = tracer.Start(ContextWithRemote(context.Background(), SpanContext{TraceID: "x"}), "fresh")
+	span.End()
+	assert.Empty(t, exp.Find("fresh")[0].ParentSpanID)
+}
+
+func TestOTLPExporter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	tracer := NewTracer(TracerOpts{ServiceName: "node-a", Exporter: NewOTLPExporter(buf)})
+
+	_, span := tracer.Start(context.Background(), "server.Get", "key", "cat.png", "bytes", int64(7))
+	span.RecordError(errors.New("not found"))
+	span.End()
+
+	var req map[string]any
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &req))
+
+	rs := req["resourceSpans"].([]any)[0].(map[string]any)
+	service := rs["resource"].(map[string]any)["attributes"].([]any)[0].(map[string]any)
+	assert.Equal(t, "service.name", service["key"])
+	assert.Equal(t, map[string]any{"stringValue": "node-a"}, service["value"])
+
+	s := rs["scopeSpans"].([]any)[0].(map[string]any)["spans"].([]any)[0].(map[string]any)
+	assert.Equal(t, "server.Get", s["name"])
+	assert.Equal(t, span.SpanContext().TraceID, s["traceId"])
+	assert.Equal(t, span.SpanContext().SpanID, s["spanId"])
+	assert.NotContains(t, s, "parentSpanId")
+	assert.Equal(t, []any{
+		map[string]any{"key": "bytes", "value": map[string]any{"intValue": "7"}},
+		map[string]any{"key": "key", "value": map[string]any{"stringValue": "cat.png"}},
+	}, s["attributes"])
+	assert.Equal(t, map[string]any{"code": float64(2), "message": "not found"}, s["status"])
+}